@@ -14,7 +14,10 @@ import (
 	_ "k8s.io/component-base/logs/json/register"
 	"k8s.io/component-base/version"
 
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/backfill"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/drift"
 	"github.com/authzed/spicedb-kubeapi-proxy/pkg/proxy"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/workflowadmin"
 )
 
 func main() {
@@ -33,7 +36,11 @@ func NewProxyCommand(ctx context.Context) *cobra.Command {
 		Short: "Authorizes Kube api requests with SpiceDB.",
 		Long: `spicedb-kubeapi-proxy is a reverse proxy that authorizes Kube api 
 requests with SpiceDB and keeps relationship data up to date. The proxy handles
-TLS termination and authentication with a backend kube apiserver.`,
+TLS termination and authentication with a backend kube apiserver. With
+--mode=authz-webhook, it answers the SubjectAccessReviews of a kube
+authorization webhook with the same rules instead. With --mode=admission-webhook,
+it answers AdmissionReviews and writes the relationships of admitted writes once
+kube persists them.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			completed, err := options.Complete(ctx)
 			if err != nil {
@@ -53,6 +60,9 @@ TLS termination and authentication with a backend kube apiserver.`,
 	}
 
 	options.AddFlags(cmd.Flags())
+	cmd.AddCommand(NewBackfillCommand(ctx))
+	cmd.AddCommand(NewDriftCommand(ctx))
+	cmd.AddCommand(NewWorkflowsCommand(ctx))
 
 	if v := version.Get().String(); len(v) == 0 {
 		cmd.Version = "<unknown>"
@@ -62,3 +72,124 @@ TLS termination and authentication with a backend kube apiserver.`,
 
 	return cmd
 }
+
+func NewBackfillCommand(ctx context.Context) *cobra.Command {
+	options := backfill.NewCommandOptions()
+	cmd := &cobra.Command{
+		Use:   "backfill",
+		Short: "Seeds SpiceDB with the relationships of existing objects.",
+		Long: `backfill lists every resource that has create rules, resolves the creates
+and touches of those rules for each object as if its owner had created it
+through the proxy, and writes the relationships to SpiceDB with a bulk import.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if errs := options.Validate(); errs != nil {
+				return errors.NewAggregate(errs)
+			}
+			return options.Run(ctx, cmd.OutOrStdout())
+		},
+	}
+
+	options.AddFlags(cmd.Flags())
+
+	return cmd
+}
+
+func NewDriftCommand(ctx context.Context) *cobra.Command {
+	options := drift.NewCommandOptions()
+	cmd := &cobra.Command{
+		Use:   "drift",
+		Short: "Reports differences between kube objects and SpiceDB relationships.",
+		Long: `drift compares the objects of every resource that has create rules with the
+relationships in SpiceDB. It reports relationships of objects that no longer
+exist, objects that have no relationships, and locks left behind by workflows
+that are no longer running.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if errs := options.Validate(); errs != nil {
+				return errors.NewAggregate(errs)
+			}
+			return options.Run(ctx, cmd.OutOrStdout())
+		},
+	}
+
+	options.AddFlags(cmd.Flags())
+
+	return cmd
+}
+
+func NewWorkflowsCommand(ctx context.Context) *cobra.Command {
+	options := workflowadmin.NewCommandOptions()
+	cmd := &cobra.Command{
+		Use:   "workflows",
+		Short: "Inspects, retries and rolls back the dual write workflows of a proxy.",
+		Long: `workflows talks to the workflow admin API of a running proxy, which must be
+started with --workflow-admin-groups. The kubeconfig must connect to the proxy
+as a user in one of those groups, except for approve and reject, which any
+user who passes the approval checks of a write can run.`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if errs := options.Validate(); errs != nil {
+				return errors.NewAggregate(errs)
+			}
+			return nil
+		},
+	}
+	options.AddFlags(cmd.PersistentFlags())
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "Lists the workflows that are running or failed.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return options.List(ctx, cmd.OutOrStdout())
+		},
+	}
+	options.AddListFlags(list.Flags())
+
+	get := &cobra.Command{
+		Use:   "get INSTANCE",
+		Short: "Prints a workflow with its input and history.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return options.Get(ctx, args[0], cmd.OutOrStdout())
+		},
+	}
+
+	retry := &cobra.Command{
+		Use:   "retry INSTANCE",
+		Short: "Starts a new workflow with the input of a finished workflow.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return options.Retry(ctx, args[0], cmd.OutOrStdout())
+		},
+	}
+
+	rollback := &cobra.Command{
+		Use:   "rollback INSTANCE",
+		Short: "Cancels a workflow and reverts the relationships it wrote.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return options.Rollback(ctx, args[0], cmd.OutOrStdout())
+		},
+	}
+
+	approve := &cobra.Command{
+		Use:   "approve INSTANCE",
+		Short: "Approves a write that is pending approval.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return options.Approve(ctx, args[0], cmd.OutOrStdout())
+		},
+	}
+
+	reject := &cobra.Command{
+		Use:   "reject INSTANCE",
+		Short: "Rejects a write that is pending approval.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return options.Reject(ctx, args[0], cmd.OutOrStdout())
+		},
+	}
+
+	cmd.AddCommand(list, get, retry, rollback, approve, reject)
+
+	return cmd
+}
@@ -647,6 +647,26 @@ var _ = Describe("Proxy", func() {
 				Expect(chaniList).To(ContainElement(chaniNamespace))
 			})
 
+			It("honors dry runs without writing relationships", func(ctx context.Context) {
+				dryRun := metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}}
+
+				// the dry run succeeds, but nothing is written
+				_, err := paulClient.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{Name: paulNamespace},
+				}, dryRun)
+				Expect(err).To(Succeed())
+				Expect(k8serrors.IsNotFound(GetNamespace(ctx, adminClient, paulNamespace))).To(BeTrue())
+				Expect(k8serrors.IsUnauthorized(GetNamespace(ctx, paulClient, paulNamespace))).To(BeTrue())
+
+				// the dry run of a write whose relationships exist conflicts
+				Expect(CreateNamespace(ctx, paulClient, paulNamespace)).To(Succeed())
+				_, err = paulClient.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{Name: paulNamespace},
+				}, dryRun)
+				Expect(k8serrors.IsConflict(err)).To(BeTrue())
+				Expect(GetNamespace(ctx, paulClient, paulNamespace)).To(Succeed())
+			})
+
 			It("recovers when there are kube write failures", func(ctx context.Context) {
 				// paul creates his namespace
 				Expect(CreateNamespace(ctx, paulClient, paulNamespace)).To(Succeed())
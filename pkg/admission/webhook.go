@@ -0,0 +1,446 @@
+// Package admission serves the update sections of the rules as an admission
+// webhook, so that SpiceDB is kept in sync with kube no matter which client
+// writes an object.
+//
+// On admission, the preconditions of the write are checked against SpiceDB,
+// and a workflow is started that writes the relationships once kube has
+// persisted the write. It is dropped if kube doesn't within the confirm
+// timeout. The workflows are stored in the workflow backend, so admitted
+// writes outlive restarts of the proxy.
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cschleiden/go-workflows/backend"
+	"github.com/cschleiden/go-workflows/client"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/storage/names"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+// DefaultConfirmTimeout is how long an admitted create or update waits to
+// be persisted in kube before its relationship writes are dropped.
+const DefaultConfirmTimeout = time.Minute
+
+// Options configure a Webhook.
+type Options struct {
+	// ConfirmTimeout is how long an admitted create or update waits to be
+	// persisted in kube before its relationship writes are dropped.
+	ConfirmTimeout time.Duration
+
+	// RemovalTimeout is how long an admitted delete waits for kube to
+	// remove the object, i.e. until its finalizers are done, before its
+	// relationship writes are dropped.
+	RemovalTimeout time.Duration
+
+	// MaxUpdatesPerWrite is the size of the chunks the relationship
+	// updates are written in, see distributedtx.WriteObjInput.
+	MaxUpdatesPerWrite int
+
+	// LockGranularity is what the lock of pessimistic rules covers, one of
+	// the distributedtx.LockGranularity constants.
+	LockGranularity string
+
+	// Locks is where pessimistic writes store their locks, which are checked
+	// before writes are admitted. If nil, the locks are read from SpiceDB.
+	Locks distributedtx.LockBackend
+}
+
+// Webhook answers the AdmissionReviews of writes that match rules with an
+// update, and starts workflows that write the relationships of the admitted
+// writes once kube persisted them.
+//
+// The webhook can be registered as either a mutating or a validating
+// webhook. A validating webhook is preferable: it sees generated names and
+// the uid of created objects, which lets the relationships be resolved
+// against the object that kube persists. As a mutating webhook, it only
+// patches the names of created objects with a generateName, which it
+// generates itself.
+type Webhook struct {
+	opts              Options
+	workflowClient    *client.Client
+	permissionsClient v1.PermissionsServiceClient
+
+	// rules holds the rules with an update by the verb of the admission
+	// (create, update or delete) and the resource.
+	rules map[string]map[schema.GroupVersionResource][]*rules.RunnableRule
+}
+
+// NewWebhook creates a Webhook for the rules of the configs that update
+// relationships. The workflows that confirm admitted writes are started
+// with the workflow client, and run by the workers of its backend.
+func NewWebhook(configs []proxyrule.Config, workflowClient *client.Client, permissionsClient v1.PermissionsServiceClient, opts Options) (*Webhook, error) {
+	if opts.ConfirmTimeout <= 0 {
+		opts.ConfirmTimeout = DefaultConfirmTimeout
+	}
+	if opts.RemovalTimeout <= 0 {
+		opts.RemovalTimeout = distributedtx.DefaultRemovalTimeout
+	}
+
+	h := &Webhook{
+		opts:              opts,
+		workflowClient:    workflowClient,
+		permissionsClient: permissionsClient,
+		rules:             make(map[string]map[schema.GroupVersionResource][]*rules.RunnableRule),
+	}
+	for _, config := range configs {
+		rule, err := rules.Compile(config)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't compile rule %s: %w", config.Name, err)
+		}
+		if rule.Update == nil {
+			continue
+		}
+		for _, m := range config.Matches {
+			gv, err := schema.ParseGroupVersion(m.GroupVersion)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse gv %q: %w", m.GroupVersion, err)
+			}
+			gvr := gv.WithResource(m.Resource)
+
+			for _, verb := range m.Verbs {
+				// kube admits both updates and patches as UPDATE
+				if verb == "patch" {
+					verb = "update"
+				}
+				if verb != "create" && verb != "update" && verb != "delete" {
+					continue
+				}
+				if h.rules[verb] == nil {
+					h.rules[verb] = make(map[schema.GroupVersionResource][]*rules.RunnableRule)
+				}
+				if !slices.Contains(h.rules[verb][gvr], rule) {
+					h.rules[verb][gvr] = append(h.rules[verb][gvr], rule)
+				}
+			}
+		}
+	}
+	return h, nil
+}
+
+// Resources returns the resources that the webhook admits.
+func (h *Webhook) Resources() []schema.GroupVersionResource {
+	var resources []schema.GroupVersionResource
+	for _, byResource := range h.rules {
+		for gvr := range byResource {
+			if !slices.Contains(resources, gvr) {
+				resources = append(resources, gvr)
+			}
+		}
+	}
+	slices.SortFunc(resources, func(a, b schema.GroupVersionResource) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return resources
+}
+
+// MaxAdmissionReviewBytes is the largest AdmissionReview that the webhook
+// reads. A review holds the object and the old object of a write, which kube
+// limits to 3MiB each.
+const MaxAdmissionReviewBytes = 7 << 20
+
+// ServeHTTP answers an admission.k8s.io/v1 AdmissionReview.
+func (h *Webhook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "admission reviews must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, MaxAdmissionReviewBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("AdmissionReview is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to read request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode AdmissionReview: %s", err), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "expected an admission.k8s.io/v1 AdmissionReview with a request", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = h.Admit(req.Context(), review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	review.SetGroupVersionKind(admissionv1.SchemeGroupVersion.WithKind("AdmissionReview"))
+
+	resp, err := json.Marshal(&review)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to encode AdmissionReview: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		klog.FromContext(req.Context()).Error(err, "unable to write admission response")
+	}
+}
+
+// Admit checks the preconditions of the rule that matches an admission
+// request, and starts the workflow that writes its relationships once kube
+// persisted the write. Requests without a matching rule are allowed.
+func (h *Webhook) Admit(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	allowed := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+
+	var verb string
+	switch req.Operation {
+	case admissionv1.Create:
+		verb = "create"
+	case admissionv1.Update:
+		verb = "update"
+	case admissionv1.Delete:
+		verb = "delete"
+	default:
+		return allowed
+	}
+	if req.SubResource != "" {
+		return allowed
+	}
+	gvr := schema.GroupVersionResource{Group: req.Resource.Group, Version: req.Resource.Version, Resource: req.Resource.Resource}
+	candidates := h.rules[verb][gvr]
+	if len(candidates) == 0 {
+		return allowed
+	}
+
+	// a mutating webhook sees creates with a generateName before kube
+	// generated the name, so the webhook generates it like kube would and
+	// patches it into the object. Otherwise the relationships would be
+	// resolved without a name, and the object couldn't be found to confirm
+	// them.
+	var patch []byte
+	if verb == "create" && req.Name == "" {
+		var err error
+		req, patch, err = withGeneratedName(req)
+		if err != nil {
+			return denied(http.StatusBadRequest, metav1.StatusReasonBadRequest, err)
+		}
+		if patch != nil {
+			allowed.Patch = patch
+			allowed.PatchType = ptr.To(admissionv1.PatchTypeJSONPatch)
+		}
+	}
+
+	input, err := resolveInput(verb, gvr, req)
+	if err != nil {
+		return denied(http.StatusBadRequest, metav1.StatusReasonBadRequest, err)
+	}
+	matching, err := rules.FilterRulesWithCELConditions(candidates, input)
+	if err != nil {
+		return denied(http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Errorf("unable to evaluate rule conditions: %w", err))
+	}
+	switch len(matching) {
+	case 0:
+		return allowed
+	case 1:
+	default:
+		return denied(http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Errorf("multiple write rules matched: %v", matching))
+	}
+	rule := matching[0]
+
+	resolved, err := rule.Update.Resolve(input)
+	if err != nil {
+		return denied(http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Errorf("unable to resolve relationships of rule %s: %w", rule.Name, err))
+	}
+	writeInput := &distributedtx.WriteObjInput{
+		RequestInfo:     input.Request,
+		ObjectMeta:      &input.Object.ObjectMeta,
+		LockGranularity: h.opts.LockGranularity,
+	}
+	if rule.LockGranularity != "" {
+		writeInput.LockGranularity = string(rule.LockGranularity)
+	}
+	if err := authz.EvaluateRelationshipWrites(ctx, h.permissionsClient, h.opts.Locks, rule.LockMode, writeInput, resolved); err != nil {
+		klog.FromContext(ctx).V(3).Info("denied admission, relationship writes would fail", "rule", rule.Name, "resource", gvr, "namespace", input.Namespace, "name", input.Name, "verb", verb, "reason", err.Error())
+		return denied(http.StatusConflict, metav1.StatusReasonConflict, err)
+	}
+
+	if req.DryRun != nil && *req.DryRun {
+		return allowed
+	}
+
+	// a write whose relationships can't be recorded is denied, since they
+	// would never be written
+	if err := h.startConfirmation(ctx, req, input, resolved); err != nil {
+		return denied(http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Errorf("unable to record relationship writes: %w", err))
+	}
+	klog.FromContext(ctx).V(3).Info("admitted write, waiting for it to be persisted", "rule", rule.Name, "resource", gvr, "namespace", input.Object.Namespace, "name", input.Object.Name, "verb", verb, "user", input.User.Name)
+	return allowed
+}
+
+// startConfirmation starts the workflow that writes the relationships of an
+// admitted write once kube persisted it. Deletes wait for kube to remove
+// the object with AwaitRemoval, like deletes through the proxy, so that
+// objects with finalizers keep their relationships until they are gone.
+func (h *Webhook) startConfirmation(ctx context.Context, req *admissionv1.AdmissionRequest, input *rules.ResolveInput, resolved *rules.ResolvedUpdate) error {
+	path := rules.NewRequestInfo(input.Request.Verb, schema.GroupVersionResource{
+		Group:    input.Request.APIGroup,
+		Version:  input.Request.APIVersion,
+		Resource: input.Request.Resource,
+	}, input.Object.Namespace, input.Object.Name).Path
+	updates := resolved.IdempotentUpdates()
+
+	var workflowName string
+	var workflowInput any
+	switch input.Request.Verb {
+	case "delete":
+		workflowName = distributedtx.CurrentWorkflow("AwaitRemoval")
+		workflowInput = &distributedtx.AwaitRemovalInput{
+			Path:               path,
+			UID:                string(input.Object.UID),
+			Preconditions:      resolved.Preconditions,
+			Updates:            updates,
+			DeleteByFilter:     resolved.DeleteByFilter,
+			Timeout:            h.opts.RemovalTimeout,
+			MaxUpdatesPerWrite: h.opts.MaxUpdatesPerWrite,
+		}
+	default:
+		object := &distributedtx.AdmittedObject{Path: path, UID: string(input.Object.UID)}
+		if input.OldObject != nil {
+			object.ResourceVersion = input.OldObject.ResourceVersion
+			object.Generation = input.Object.Generation
+			object.Labels = setValues(input.OldObject.Labels, input.Object.Labels)
+			object.Annotations = setValues(input.OldObject.Annotations, input.Object.Annotations)
+		}
+		workflowName = distributedtx.CurrentWorkflow("ConfirmAdmission")
+		workflowInput = &distributedtx.ConfirmAdmissionInput{
+			Object:             object,
+			Preconditions:      resolved.Preconditions,
+			Updates:            updates,
+			DeleteByFilter:     resolved.DeleteByFilter,
+			Timeout:            h.opts.ConfirmTimeout,
+			MaxUpdatesPerWrite: h.opts.MaxUpdatesPerWrite,
+		}
+	}
+
+	_, err := h.workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+		InstanceID: distributedtx.AdmissionInstanceID(string(req.UID)),
+	}, workflowName, workflowInput)
+	if errors.Is(err, backend.ErrInstanceAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+// setValues returns the labels or annotations that an update adds or
+// changes, or nil if it doesn't.
+func setValues(old, updated map[string]string) map[string]string {
+	var set map[string]string
+	for k, v := range updated {
+		if got, ok := old[k]; ok && got == v {
+			continue
+		}
+		if set == nil {
+			set = make(map[string]string)
+		}
+		set[k] = v
+	}
+	return set
+}
+
+// withGeneratedName returns a copy of a create request whose object has a
+// generateName but no name, with a name generated like kube does, and the
+// JSON patch that sets the name. Requests with a name, or without a
+// generateName, are returned unchanged without a patch.
+func withGeneratedName(req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionRequest, []byte, error) {
+	var object map[string]any
+	if err := json.Unmarshal(req.Object.Raw, &object); err != nil {
+		return nil, nil, fmt.Errorf("unable to decode object: %w", err)
+	}
+	metadata, _ := object["metadata"].(map[string]any)
+	generateName, _ := metadata["generateName"].(string)
+	if name, _ := metadata["name"].(string); name != "" || generateName == "" {
+		return req, nil, nil
+	}
+
+	name := names.SimpleNameGenerator.GenerateName(generateName)
+	metadata["name"] = name
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to encode object: %w", err)
+	}
+	patch, err := json.Marshal([]map[string]any{{"op": "add", "path": "/metadata/name", "value": name}})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to encode patch: %w", err)
+	}
+
+	named := req.DeepCopy()
+	named.Name = name
+	named.Object.Raw = raw
+	named.Object.Object = nil
+	return named, patch, nil
+}
+
+// resolveInput returns the input that the rules are resolved against for an
+// admission request. Deletes are resolved against the deleted object.
+func resolveInput(verb string, gvr schema.GroupVersionResource, req *admissionv1.AdmissionRequest) (*rules.ResolveInput, error) {
+	raw := req.Object.Raw
+	if verb == "delete" {
+		raw = req.OldObject.Raw
+	}
+	var object map[string]any
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, fmt.Errorf("unable to decode object: %w", err)
+	}
+
+	userInfo := &user.DefaultInfo{
+		Name:   req.UserInfo.Username,
+		UID:    req.UserInfo.UID,
+		Groups: req.UserInfo.Groups,
+	}
+	if len(req.UserInfo.Extra) > 0 {
+		userInfo.Extra = make(map[string][]string, len(req.UserInfo.Extra))
+		for k, v := range req.UserInfo.Extra {
+			userInfo.Extra[k] = v
+		}
+	}
+
+	input := rules.NewResolveInputFromObject(rules.NewRequestInfo(verb, gvr, req.Namespace, req.Name), userInfo, object)
+	input.Body = raw
+	if verb == "update" && len(req.OldObject.Raw) > 0 {
+		var old metav1.PartialObjectMetadata
+		if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+			return nil, fmt.Errorf("unable to decode old object: %w", err)
+		}
+		input.OldObject = &old
+		input.OldObjectBody = req.OldObject.Raw
+	}
+	return input, nil
+}
+
+// denied returns a response that denies the admission with a status.
+func denied(code int32, reason metav1.StatusReason, err error) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Reason:  reason,
+			Code:    code,
+		},
+	}
+}
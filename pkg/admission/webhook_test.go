@@ -0,0 +1,483 @@
+package admission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cschleiden/go-workflows/diag"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest/fake"
+	"k8s.io/utils/ptr"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+var (
+	podsGVR       = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	namespacesGVR = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+)
+
+const testRules = `
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: create-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["create"]
+update:
+  preconditionExists:
+  - tpl: "namespace:{{namespace}}#creator@user:{{user.name}}"
+  creates:
+  - tpl: "pod:{{namespacedName}}#creator@user:{{user.name}}"
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: delete-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["delete"]
+update:
+  deleteByFilter:
+  - tpl: "pod:{{namespacedName}}#$resourceRelation@$subjectType:$subjectID"
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: get-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["get"]
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: patch-namespaces
+match:
+- apiVersion: v1
+  resource: namespaces
+  verbs: ["patch"]
+update:
+  touches:
+  - tpl: "namespace:{{name}}#viewer@user:{{user.name}}"
+`
+
+func TestNewWebhook(t *testing.T) {
+	h, err := NewWebhook(parseRules(t, testRules), nil, nil, Options{})
+	require.NoError(t, err)
+
+	require.Equal(t, []schema.GroupVersionResource{namespacesGVR, podsGVR}, h.Resources())
+	require.Equal(t, DefaultConfirmTimeout, h.opts.ConfirmTimeout)
+
+	require.Len(t, h.rules["create"][podsGVR], 1)
+	require.Len(t, h.rules["delete"][podsGVR], 1)
+	// patches are admitted as updates
+	require.Len(t, h.rules["update"][namespacesGVR], 1)
+	require.Empty(t, h.rules["update"][podsGVR])
+}
+
+func TestAdmit(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+	_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: []*v1.RelationshipUpdate{
+		{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: rel("namespace", "default", "creator", "alice")},
+	}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		req         *admissionv1.AdmissionRequest
+		wantAllowed bool
+		wantCode    int32
+		wantPatch   bool
+		wantPending int
+	}{
+		{
+			name:        "create that satisfies the preconditions",
+			req:         admissionRequest(admissionv1.Create, podsGVR, newPod("default", "web"), "alice"),
+			wantAllowed: true,
+			wantPending: 1,
+		},
+		{
+			name:        "create with a generated name",
+			req:         admissionRequest(admissionv1.Create, podsGVR, newGeneratedPod("default", "web-"), "alice"),
+			wantAllowed: true,
+			wantPatch:   true,
+			wantPending: 1,
+		},
+		{
+			name:     "create that fails the preconditions",
+			req:      admissionRequest(admissionv1.Create, podsGVR, newPod("default", "web"), "bob"),
+			wantCode: http.StatusConflict,
+		},
+		{
+			name: "dry run",
+			req: func() *admissionv1.AdmissionRequest {
+				req := admissionRequest(admissionv1.Create, podsGVR, newPod("default", "web"), "alice")
+				req.DryRun = ptr.To(true)
+				return req
+			}(),
+			wantAllowed: true,
+		},
+		{
+			name:        "delete",
+			req:         admissionRequest(admissionv1.Delete, podsGVR, newPod("default", "web"), "bob"),
+			wantAllowed: true,
+			wantPending: 1,
+		},
+		{
+			name:        "patch admitted as update",
+			req:         admissionRequest(admissionv1.Update, namespacesGVR, newNamespace("default"), "bob"),
+			wantAllowed: true,
+			wantPending: 1,
+		},
+		{
+			name:        "no rule with an update",
+			req:         admissionRequest(admissionv1.Update, podsGVR, newPod("default", "web"), "bob"),
+			wantAllowed: true,
+		},
+		{
+			name: "subresource",
+			req: func() *admissionv1.AdmissionRequest {
+				req := admissionRequest(admissionv1.Create, podsGVR, newPod("default", "web"), "bob")
+				req.SubResource = "binding"
+				return req
+			}(),
+			wantAllowed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the worker isn't started, so the started workflows stay
+			// active
+			workflowClient, worker, err := distributedtx.SetupWithSQLiteBackend(ctx, psc, newKubeClient(nil), filepath.Join(t.TempDir(), "workflows.db"))
+			require.NoError(t, err)
+			h, err := NewWebhook(parseRules(t, testRules), workflowClient, psc, Options{})
+			require.NoError(t, err)
+
+			resp := h.Admit(ctx, tt.req)
+			require.Equal(t, tt.wantAllowed, resp.Allowed)
+			if tt.wantCode != 0 {
+				require.NotNil(t, resp.Result)
+				require.Equal(t, tt.wantCode, resp.Result.Code)
+			}
+			if tt.wantPatch {
+				require.Equal(t, admissionv1.PatchTypeJSONPatch, *resp.PatchType)
+				require.Regexp(t, `^\[\{"op":"add","path":"/metadata/name","value":"web-[a-z0-9]{5}"\}\]$`, string(resp.Patch))
+			} else {
+				require.Nil(t, resp.Patch)
+			}
+
+			// kube calls the webhook again with the same review uid,
+			// which doesn't start a second workflow
+			require.Equal(t, tt.wantAllowed, h.Admit(ctx, tt.req).Allowed)
+			active, err := distributedtx.ActiveInstanceIDs(ctx, worker.Backend().(diag.Backend))
+			require.NoError(t, err)
+			require.Len(t, active, tt.wantPending)
+		})
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	h, err := NewWebhook(parseRules(t, testRules), nil, nil, Options{})
+	require.NoError(t, err)
+
+	req := admissionRequest(admissionv1.Update, podsGVR, newPod("default", "web"), "alice")
+	body, err := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+		Request:  req,
+	})
+	require.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	var review admissionv1.AdmissionReview
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &review))
+	require.Equal(t, "AdmissionReview", review.Kind)
+	require.Nil(t, review.Request)
+	require.NotNil(t, review.Response)
+	require.Equal(t, req.UID, review.Response.UID)
+	require.True(t, review.Response.Allowed)
+
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"kind":"AdmissionReview"}`)))
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(make([]byte, MaxAdmissionReviewBytes+1))))
+	require.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+}
+
+func TestConfirm(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	interval := distributedtx.RemovalPollInterval
+	distributedtx.RemovalPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { distributedtx.RemovalPollInterval = interval })
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+	_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: []*v1.RelationshipUpdate{
+		{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: rel("namespace", "default", "creator", "alice")},
+	}})
+	require.NoError(t, err)
+
+	kube := &kubeObjects{objects: map[string]*metav1.PartialObjectMetadata{}}
+	workflowClient, worker, err := distributedtx.SetupWithSQLiteBackend(ctx, psc, newKubeClient(kube), filepath.Join(t.TempDir(), "workflows.db"))
+	require.NoError(t, err)
+	require.NoError(t, worker.Start(ctx))
+	t.Cleanup(func() { require.NoError(t, worker.Shutdown(context.Background())) })
+
+	h, err := NewWebhook(parseRules(t, testRules), workflowClient, psc, Options{ConfirmTimeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+
+	// a write that kube persists is confirmed
+	created := newPod("default", "web")
+	require.True(t, h.Admit(ctx, admissionRequest(admissionv1.Create, podsGVR, created, "alice")).Allowed)
+	kube.set("/api/v1/namespaces/default/pods/web", created)
+	require.Eventually(t, func() bool {
+		return hasRelationship(ctx, t, psc, rel("pod", "default/web", "creator", "alice"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a delete is confirmed once kube removed the object
+	require.True(t, h.Admit(ctx, admissionRequest(admissionv1.Delete, podsGVR, created, "alice")).Allowed)
+	time.Sleep(5 * distributedtx.RemovalPollInterval)
+	require.True(t, hasRelationship(ctx, t, psc, rel("pod", "default/web", "creator", "alice")))
+	kube.set("/api/v1/namespaces/default/pods/web", nil)
+	require.Eventually(t, func() bool {
+		return !hasRelationship(ctx, t, psc, rel("pod", "default/web", "creator", "alice"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a create with a generated name is confirmed by the object with the
+	// name that the webhook patched in
+	resp := h.Admit(ctx, admissionRequest(admissionv1.Create, podsGVR, newGeneratedPod("default", "web-"), "alice"))
+	require.True(t, resp.Allowed)
+	var patch []struct {
+		Value string `json:"value"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Patch, &patch))
+	require.Len(t, patch, 1)
+	kube.set("/api/v1/namespaces/default/pods/"+patch[0].Value, newPod("default", patch[0].Value))
+	require.Eventually(t, func() bool {
+		return hasRelationship(ctx, t, psc, rel("pod", "default/"+patch[0].Value, "creator", "alice"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// an update isn't confirmed by another write, like the status write of
+	// a controller, but by the object that it admitted
+	old := newNamespace("default")
+	old.ResourceVersion = "1"
+	updated := old.DeepCopy()
+	updated.Labels = map[string]string{"team": "web"}
+	require.True(t, h.Admit(ctx, updateRequest(namespacesGVR, old, updated, "alice")).Allowed)
+	statusWrite := old.DeepCopy()
+	statusWrite.ResourceVersion = "2"
+	kube.set("/api/v1/namespaces/default", statusWrite)
+	time.Sleep(5 * distributedtx.RemovalPollInterval)
+	require.False(t, hasRelationship(ctx, t, psc, rel("namespace", "default", "viewer", "alice")))
+	persisted := updated.DeepCopy()
+	persisted.ResourceVersion = "3"
+	kube.set("/api/v1/namespaces/default", persisted)
+	require.Eventually(t, func() bool {
+		return hasRelationship(ctx, t, psc, rel("namespace", "default", "viewer", "alice"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a write that kube never persists is dropped
+	rejected := admissionRequest(admissionv1.Create, podsGVR, newPod("default", "rejected"), "alice")
+	require.True(t, h.Admit(ctx, rejected).Allowed)
+	awaitDone(ctx, t, worker, rejected)
+	require.False(t, hasRelationship(ctx, t, psc, rel("pod", "default/rejected", "creator", "alice")))
+
+	// a write whose preconditions no longer hold once it is persisted is
+	// dropped
+	late := admissionRequest(admissionv1.Create, podsGVR, newPod("default", "late"), "alice")
+	require.True(t, h.Admit(ctx, late).Allowed)
+	_, err = psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: []*v1.RelationshipUpdate{
+		{Operation: v1.RelationshipUpdate_OPERATION_DELETE, Relationship: rel("namespace", "default", "creator", "alice")},
+	}})
+	require.NoError(t, err)
+	kube.set("/api/v1/namespaces/default/pods/late", newPod("default", "late"))
+	awaitDone(ctx, t, worker, late)
+	require.False(t, hasRelationship(ctx, t, psc, rel("pod", "default/late", "creator", "alice")))
+}
+
+// awaitDone waits until the workflow that confirms an admission request is
+// done.
+func awaitDone(ctx context.Context, t *testing.T, worker *distributedtx.Worker, req *admissionv1.AdmissionRequest) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		active, err := distributedtx.ActiveInstanceIDs(ctx, worker.Backend().(diag.Backend))
+		require.NoError(t, err)
+		_, ok := active[distributedtx.AdmissionInstanceID(string(req.UID))]
+		return !ok
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func parseRules(t *testing.T, config string) []proxyrule.Config {
+	t.Helper()
+	configs, err := proxyrule.Parse(strings.NewReader(config))
+	require.NoError(t, err)
+	return configs
+}
+
+func admissionRequest(operation admissionv1.Operation, gvr schema.GroupVersionResource, obj *metav1.PartialObjectMetadata, username string) *admissionv1.AdmissionRequest {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	req := &admissionv1.AdmissionRequest{
+		UID:       types.UID("review-" + strings.ToLower(string(operation)) + "-" + obj.Name),
+		Resource:  metav1.GroupVersionResource{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource},
+		Namespace: obj.Namespace,
+		Name:      obj.Name,
+		Operation: operation,
+		UserInfo:  authenticationv1.UserInfo{Username: username},
+	}
+	switch operation {
+	case admissionv1.Create:
+		req.Object.Raw = raw
+	case admissionv1.Update:
+		req.Object.Raw = raw
+		req.OldObject.Raw = raw
+	case admissionv1.Delete:
+		req.OldObject.Raw = raw
+	}
+	return req
+}
+
+func updateRequest(gvr schema.GroupVersionResource, old, obj *metav1.PartialObjectMetadata, username string) *admissionv1.AdmissionRequest {
+	req := admissionRequest(admissionv1.Update, gvr, obj, username)
+	raw, err := json.Marshal(old)
+	if err != nil {
+		panic(err)
+	}
+	req.OldObject.Raw = raw
+	return req
+}
+
+func rel(resourceType, id, relation, subject string) *v1.Relationship {
+	return &v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: resourceType, ObjectId: id},
+		Relation: relation,
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: subject}},
+	}
+}
+
+func hasRelationship(ctx context.Context, t *testing.T, psc v1.PermissionsServiceClient, r *v1.Relationship) bool {
+	resp, err := psc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+		Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+		Resource:    r.Resource,
+		Permission:  r.Relation,
+		Subject:     r.Subject,
+	})
+	require.NoError(t, err)
+	return resp.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+}
+
+// kubeObjects are the objects that a fake kube client serves by path.
+type kubeObjects struct {
+	sync.Mutex
+	objects map[string]*metav1.PartialObjectMetadata
+}
+
+func (k *kubeObjects) set(path string, obj *metav1.PartialObjectMetadata) {
+	k.Lock()
+	defer k.Unlock()
+	if obj == nil {
+		delete(k.objects, path)
+		return
+	}
+	k.objects[path] = obj
+}
+
+func (k *kubeObjects) get(path string) *metav1.PartialObjectMetadata {
+	if k == nil {
+		return nil
+	}
+	k.Lock()
+	defer k.Unlock()
+	return k.objects[path]
+}
+
+// newKubeClient returns a kube client that serves gets of the objects.
+func newKubeClient(kube *kubeObjects) *fake.RESTClient {
+	return &fake.RESTClient{
+		Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Set("Content-Type", runtime.ContentTypeJSON)
+			obj := kube.get(req.URL.Path)
+			if req.Method != http.MethodGet || obj == nil {
+				return &http.Response{
+					Header:     header,
+					StatusCode: http.StatusNotFound,
+					Body:       io.NopCloser(strings.NewReader(`{"kind":"Status","code":404}`)),
+				}, nil
+			}
+			body, err := json.Marshal(obj)
+			if err != nil {
+				return nil, err
+			}
+			return &http.Response{
+				Header:     header,
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewReader(body)),
+			}, nil
+		}),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+}
+
+func newPod(namespace, name string) *metav1.PartialObjectMetadata {
+	return &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			UID:       types.UID("uid-" + name),
+		},
+	}
+}
+
+func newGeneratedPod(namespace, generateName string) *metav1.PartialObjectMetadata {
+	return &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:    namespace,
+			GenerateName: generateName,
+		},
+	}
+}
+
+func newNamespace(name string) *metav1.PartialObjectMetadata {
+	return &metav1.PartialObjectMetadata{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, UID: types.UID("uid-" + name)},
+	}
+}
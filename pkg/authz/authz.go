@@ -20,7 +20,7 @@ import (
 var updateVerbs = []string{"create", "update", "patch", "delete"}
 
 // WithAuthorization wraps the provided handler with authorization logic.
-func WithAuthorization(handler, failed http.Handler, restMapper meta.RESTMapper, permissionsClient v1.PermissionsServiceClient, watchClient v1.WatchServiceClient, workflowClient *client.Client, matcher *rules.Matcher, inputExtractor rules.ResolveInputExtractor) http.Handler {
+func WithAuthorization(handler, failed http.Handler, restMapper meta.RESTMapper, permissionsClient v1.PermissionsServiceClient, watchClient v1.WatchServiceClient, workflowClient *client.Client, matcher *rules.Matcher, inputExtractor rules.ResolveInputExtractor, writeOptions WriteOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -45,6 +45,16 @@ func WithAuthorization(handler, failed http.Handler, restMapper meta.RESTMapper,
 			return
 		}
 
+		// Self subject reviews are answered with the rules, rather than by
+		// kube for the identity of the proxy.
+		if isSelfSubjectReview(input.Request) {
+			if err := performSelfSubjectReview(ctx, w, req, restMapper, *matcher, permissionsClient, input); err != nil {
+				klog.FromContext(ctx).V(2).Error(err, "failed to answer self subject review")
+				handleError(w, failed, req, err)
+			}
+			return
+		}
+
 		// Otherwise, we need to match rule(s) against the request.
 		matchingRules := (*matcher).Match(input.Request)
 		if len(matchingRules) == 0 {
@@ -116,7 +126,19 @@ func WithAuthorization(handler, failed http.Handler, restMapper meta.RESTMapper,
 			}
 
 			klog.FromContext(ctx).V(4).Info("single update rule", "rule", updateRule)
-			if err := performUpdate(ctx, w, updateRule, input, req.RequestURI, workflowClient); err != nil {
+
+			// Dry runs are forwarded to kube without a workflow, since
+			// nothing may be written to SpiceDB.
+			if isDryRun(req) {
+				req = req.WithContext(WithResponseFilterer(req.Context(), NewEmptyResponseFilterer(restMapper, input)))
+				if err := performDryRun(ctx, w, req, handler, updateRule, input, permissionsClient, writeOptions); err != nil {
+					klog.FromContext(ctx).V(2).Error(err, "failed to perform dry run", inputKeyValues...)
+					handleError(w, failed, req, err)
+				}
+				return
+			}
+
+			if err := performUpdate(ctx, w, updateRule, input, req.RequestURI, workflowClient, writeOptions); err != nil {
 				klog.FromContext(ctx).V(2).Error(err, "failed to perform update", inputKeyValues...)
 				handleError(w, failed, req, err)
 			}
@@ -140,7 +162,7 @@ func WithAuthorization(handler, failed http.Handler, restMapper meta.RESTMapper,
 				return
 			}
 
-			responseFilterer, err := NewResponseFiltererForWatch(restMapper, input, foundWatchRule, watchClient, permissionsClient)
+			responseFilterer, err := NewResponseFiltererForWatch(restMapper, input, foundWatchRule, postFilterRules(filteredRules), watchClient, permissionsClient)
 			if err != nil {
 				klog.FromContext(ctx).V(2).Error(err, "failed to create response filterer", inputKeyValues...)
 				handleError(w, failed, req, err)
@@ -248,7 +270,7 @@ func createPostCheckHandler(handler, failed http.Handler, ctx context.Context, f
 		// Only run PostChecks if the upstream request succeeded (2xx status)
 		if recorder.statusCode >= 200 && recorder.statusCode < 300 {
 			// Run PostChecks
-			if err := runAllMatchingPostChecks(ctx, filteredRules, input, permissionsClient); err != nil {
+			if err := runAllMatchingPostChecks(ctx, filteredRules, withResponseObject(input, recorder.body), permissionsClient); err != nil {
 				klog.FromContext(ctx).V(2).Error(err, "input failed post-authorization checks", "input", input)
 				// Return the original error handler instead of the successful response
 				failed.ServeHTTP(w, req)
@@ -0,0 +1,99 @@
+package authz
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+func TestWithAuthorizationFetchesObjectAfterChecks(t *testing.T) {
+	var gets atomic.Int32
+	kubeClient := &fake.RESTClient{
+		NegotiatedSerializer: serializer.NewCodecFactory(scheme.Scheme),
+		Client: fake.CreateHTTPClient(func(r *http.Request) (*http.Response, error) {
+			gets.Add(1)
+			header := http.Header{}
+			header.Set("Content-Type", runtime.ContentTypeJSON)
+			return &http.Response{
+				Header:     header,
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewBufferString(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web","namespace":"default","labels":{"team":"a"}}}`)),
+			}, nil
+		}),
+	}
+
+	psc := &mockPermissionsClient{responses: map[string]*v1.CheckPermissionResponse{
+		"pod:default/web#edit@user:janedoe": {Permissionship: v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION},
+		"team:a#member@user:janedoe":        {Permissionship: v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION},
+	}}
+
+	serve := func(t *testing.T, check, userName string) int {
+		t.Helper()
+		var matcher rules.Matcher
+		matcher, err := rules.NewMapMatcher([]proxyrule.Config{{Spec: proxyrule.Spec{
+			Matches: []proxyrule.Match{{GroupVersion: "v1", Resource: "pods", Verbs: []string{"patch"}}},
+			Checks:  []proxyrule.StringOrTemplate{{Template: check}},
+		}}})
+		require.NoError(t, err)
+
+		handler := WithAuthorization(
+			http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+			http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			}),
+			meta.NewDefaultRESTMapper(nil), psc, nil, nil, &matcher, rules.NewKubeResolveInputExtractor(kubeClient), WriteOptions{},
+		)
+
+		path := "/api/v1/namespaces/default/pods/web"
+		req := httptest.NewRequest(http.MethodPatch, path, bytes.NewBufferString(`{"metadata":{"labels":{"team":"b"}}}`))
+		req.Header.Set("Content-Type", string(k8stypes.MergePatchType))
+		ctx := request.WithRequestInfo(req.Context(), &request.RequestInfo{
+			IsResourceRequest: true,
+			Path:              path,
+			Verb:              "patch",
+			APIVersion:        "v1",
+			Namespace:         "default",
+			Resource:          "pods",
+			Name:              "web",
+		})
+		ctx = request.WithUser(ctx, &user.DefaultInfo{Name: userName})
+
+		gets.Store(0)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req.WithContext(ctx))
+		return recorder.Code
+	}
+
+	t.Run("denied", func(t *testing.T) {
+		require.Equal(t, http.StatusForbidden, serve(t, "pod:{{namespacedName}}#edit@user:{{user.name}}", "mallory"))
+		require.Zero(t, gets.Load(), "the object must not be fetched for unauthorized requests")
+	})
+	t.Run("checks that don't use the object", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, serve(t, "pod:{{namespacedName}}#edit@user:{{user.name}}", "janedoe"))
+		require.Zero(t, gets.Load())
+	})
+	t.Run("checks that use the object", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, serve(t, "team:{{oldObject.metadata.labels.team}}#member@user:{{user.name}}", "janedoe"))
+		require.EqualValues(t, 1, gets.Load())
+	})
+}
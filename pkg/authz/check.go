@@ -2,10 +2,13 @@ package authz
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
 
@@ -52,11 +55,13 @@ func checkRelationships(ctx context.Context, client v1.PermissionsServiceClient,
 
 	// All checks must pass
 	for i, pair := range bulkResp.Pairs {
-		if pair.GetError() != nil {
+		if pairErr := pair.GetError(); pairErr != nil {
+			// the error of an item is a status like the error of the whole
+			// request, so that callers can tell it from a failed check
 			rel := resolvedRels[i]
-			return fmt.Errorf("bulk %s error for %s:%s#%s@%s:%s: %v",
+			return status.Errorf(codes.Code(pairErr.GetCode()), "bulk %s error for %s:%s#%s@%s:%s: %s",
 				checkType, rel.ResourceType, rel.ResourceID, rel.ResourceRelation,
-				rel.SubjectType, rel.SubjectID, pair.GetError())
+				rel.SubjectType, rel.SubjectID, pairErr.GetMessage())
 		}
 
 		responseItem := pair.GetItem()
@@ -112,3 +117,22 @@ func runAllMatchingPostChecks(ctx context.Context, matchingRules []*rules.Runnab
 	}
 	return postCheckGroup.Wait()
 }
+
+// withResponseObject returns an input for the object returned by kube, so
+// that post-checks can refer to fields that are set by kube, like
+// `object.metadata.uid`. The original input is returned if the response
+// doesn't contain a JSON encoded object.
+func withResponseObject(input *rules.ResolveInput, body []byte) *rules.ResolveInput {
+	var object map[string]any
+	if err := json.Unmarshal(body, &object); err != nil || object == nil {
+		return input
+	}
+	if kind := object["kind"]; kind == "Status" || kind == "Table" {
+		return input
+	}
+
+	responseInput := rules.NewResolveInputFromObject(input.Request, input.User, object)
+	responseInput.Body = input.Body
+	responseInput.Headers = input.Headers
+	return responseInput
+}
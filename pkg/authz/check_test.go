@@ -0,0 +1,79 @@
+package authz
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+func TestWithResponseObject(t *testing.T) {
+	input := rules.NewResolveInput(
+		&request.RequestInfo{Verb: "get", Resource: "pods", Namespace: "default", Name: "web"},
+		&user.DefaultInfo{Name: "janedoe"},
+		nil, nil, http.Header{"Accept": []string{"application/json"}},
+	)
+
+	rule, err := rules.Compile(proxyrule.Config{Spec: proxyrule.Spec{
+		Matches: []proxyrule.Match{{
+			GroupVersion: "v1",
+			Resource:     "pods",
+			Verbs:        []string{"get"},
+		}},
+		PostChecks: []proxyrule.StringOrTemplate{{Template: "pod:{{object.metadata.uid}}#view@user:{{user.name}}"}},
+	}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		body    string
+		wantUID string
+		same    bool
+	}{
+		{
+			name:    "object",
+			body:    `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web","namespace":"default","uid":"c0ffee"}}`,
+			wantUID: "c0ffee",
+		},
+		{
+			name: "status",
+			body: `{"apiVersion":"v1","kind":"Status","status":"Success"}`,
+			same: true,
+		},
+		{
+			name: "table",
+			body: `{"apiVersion":"meta.k8s.io/v1","kind":"Table","rows":[]}`,
+			same: true,
+		},
+		{
+			name: "not json",
+			body: "\x00k8s",
+			same: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withResponseObject(input, []byte(tt.body))
+			if tt.same {
+				require.Same(t, input, got)
+				return
+			}
+			require.Equal(t, "web", got.Name)
+			require.Equal(t, "default/web", got.NamespacedName)
+			require.Equal(t, input.Headers, got.Headers)
+			require.Equal(t, metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "c0ffee"}, got.Object.ObjectMeta)
+
+			rels, err := rule.PostChecks[0].GenerateRelationships(got)
+			require.NoError(t, err)
+			require.Len(t, rels, 1)
+			require.Equal(t, tt.wantUID, rels[0].ResourceID)
+		})
+	}
+}
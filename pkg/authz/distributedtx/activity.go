@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/cschleiden/go-workflows/client"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -41,6 +43,12 @@ type KubeResp struct {
 type ActivityHandler struct {
 	PermissionClient v1.PermissionsServiceClient
 	KubeClient       rest.Interface
+
+	// WorkflowClient is used by activities that start other workflows.
+	WorkflowClient *client.Client
+
+	// Locks stores the locks of pessimistic workflows.
+	Locks LockBackend
 }
 
 // WriteToSpiceDB writes relationships to spicedb and returns any errors.
@@ -230,6 +238,22 @@ func (h *ActivityHandler) WriteToKube(ctx context.Context, req *KubeReqInput) (*
 	return &resp, nonKerr
 }
 
+// PreflightKube sends the request to kube with dryRun=All, so that kube
+// validates and admits the object without persisting it.
+func (h *ActivityHandler) PreflightKube(ctx context.Context, req *KubeReqInput) (*KubeResp, error) {
+	uri, err := url.Parse(req.RequestURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request URI for kube preflight: %w", err)
+	}
+	query := uri.Query()
+	query.Set("dryRun", metav1.DryRunAll)
+	uri.RawQuery = query.Encode()
+
+	dryRun := *req
+	dryRun.RequestURI = uri.String()
+	return h.WriteToKube(ctx, &dryRun)
+}
+
 func (h *ActivityHandler) CheckKubeResource(ctx context.Context, req *KubeReqInput) (bool, error) {
 	// TODO: this is somewhat janky - may not work for all request types
 	uri := req.RequestInfo.Path + "/" + req.ObjectMeta.GetName()
@@ -81,6 +81,31 @@ func TestWriteToKubeError(t *testing.T) {
 	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 }
 
+func TestPreflightKube(t *testing.T) {
+	var query string
+	kubeClient := &fake.RESTClient{
+		Client: fake.CreateHTTPClient(func(request *http.Request) (*http.Response, error) {
+			query = request.URL.RawQuery
+			return testRoundTripper{T: t, expectedPath: "/my_way", status: http.StatusCreated}.roundtripper(request)
+		}),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+	ah := ActivityHandler{KubeClient: kubeClient}
+
+	input := &KubeReqInput{
+		RequestInfo: &request.RequestInfo{Path: "my_way", Namespace: "ns", Verb: "create"},
+		RequestURI:  "/my_way?fieldManager=kubectl",
+		ObjectMeta:  &metav1.ObjectMeta{Name: "my_object_meta"},
+		Body:        []byte(`{"hi":"bye"}`),
+	}
+	resp, err := ah.PreflightKube(t.Context(), input)
+
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "dryRun=All&fieldManager=kubectl", query)
+	require.Equal(t, "/my_way?fieldManager=kubectl", input.RequestURI)
+}
+
 func TestCheckKubeResource(t *testing.T) {
 	trt := testRoundTripper{T: t, expectedPath: "/a_path/object_name", status: http.StatusOK}
 	ah := ActivityHandler{KubeClient: trt.toKubeClient()}
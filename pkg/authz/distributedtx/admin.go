@@ -0,0 +1,409 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/cschleiden/go-workflows/backend"
+	"github.com/cschleiden/go-workflows/backend/history"
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/cschleiden/go-workflows/core"
+	"github.com/cschleiden/go-workflows/diag"
+	"github.com/cschleiden/go-workflows/workflow"
+	"github.com/google/uuid"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/spicedb/pkg/tuple"
+)
+
+// States of the workflows listed by the Admin.
+const (
+	WorkflowStateRunning   = "Running"
+	WorkflowStateFailed    = "Failed"
+	WorkflowStateCompleted = "Completed"
+
+	// WorkflowStatePendingApproval is the state of running ApproveWrite
+	// workflows that haven't been approved or rejected yet.
+	WorkflowStatePendingApproval = "PendingApproval"
+)
+
+// writeToSpiceDBActivity is the name that the WriteToSpiceDB activity is
+// recorded with in the history of a workflow.
+const writeToSpiceDBActivity = "WriteToSpiceDB"
+
+var (
+	// ErrWorkflowNotFound is returned for workflow instances that don't
+	// exist in the backend.
+	ErrWorkflowNotFound = errors.New("workflow instance not found")
+
+	// ErrWorkflowRunning is returned when retrying a workflow instance
+	// that hasn't finished.
+	ErrWorkflowRunning = errors.New("workflow instance is still running")
+
+	// ErrWorkflowNotRetryable is returned when retrying a workflow
+	// instance that isn't a dual write.
+	ErrWorkflowNotRetryable = errors.New("only dual write workflows can be retried")
+)
+
+// WorkflowSummary describes a workflow instance and the request that
+// started it.
+type WorkflowSummary struct {
+	InstanceID  string     `json:"instanceID"`
+	ExecutionID string     `json:"executionID"`
+	Workflow    string     `json:"workflow"`
+	State       string     `json:"state"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+
+	User      string `json:"user,omitempty"`
+	Verb      string `json:"verb,omitempty"`
+	Resource  string `json:"resource,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+// WorkflowDetails is a workflow instance with its input and history.
+type WorkflowDetails struct {
+	WorkflowSummary
+
+	// Input is set for dual write workflows, and for approval workflows,
+	// which also set Approval.
+	Input    *WriteObjInput  `json:"input,omitempty"`
+	Approval *ApprovalInput  `json:"approval,omitempty"`
+	History  []*HistoryEvent `json:"history"`
+}
+
+// HistoryEvent is an event in the history of a workflow instance.
+type HistoryEvent struct {
+	SequenceID      int64     `json:"sequenceID"`
+	Type            string    `json:"type"`
+	Timestamp       time.Time `json:"timestamp"`
+	ScheduleEventID int64     `json:"scheduleEventID,omitempty"`
+	Activity        string    `json:"activity,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// Admin inspects the workflows in a backend, and retries or rolls back
+// those that failed or got stuck.
+type Admin struct {
+	backend diag.Backend
+	client  *client.Client
+
+	// MaxUpdatesPerWrite is the size of the chunks that rollbacks are
+	// written in, see WriteObjInput.
+	MaxUpdatesPerWrite int
+
+	// PermissionsClient runs the checks of users who approve writes.
+	PermissionsClient v1.PermissionsServiceClient
+}
+
+// NewAdmin returns an Admin for the workflows in the backend. The client
+// starts the workflows that retry or roll back other workflows.
+func NewAdmin(b backend.Backend, c *client.Client) (*Admin, error) {
+	diagBackend, ok := b.(diag.Backend)
+	if !ok {
+		return nil, fmt.Errorf("workflow backend %T doesn't support listing workflows", b)
+	}
+	return &Admin{backend: diagBackend, client: c}, nil
+}
+
+// List returns the workflow instances that are in one of the given states,
+// or all of them if no state is given.
+func (a *Admin) List(ctx context.Context, states ...string) ([]*WorkflowSummary, error) {
+	var summaries []*WorkflowSummary
+	err := eachInstance(ctx, a.backend, func(ref *diag.WorkflowInstanceRef) error {
+		details, err := a.details(ctx, ref)
+		if err != nil {
+			return err
+		}
+		if len(states) == 0 || slices.Contains(states, details.State) {
+			summaries = append(summaries, &details.WorkflowSummary)
+		}
+		return nil
+	})
+	return summaries, err
+}
+
+// Get returns the workflow instance with the given ID.
+func (a *Admin) Get(ctx context.Context, instanceID string) (*WorkflowDetails, error) {
+	ref, err := a.find(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return a.details(ctx, ref)
+}
+
+// Retry starts a new instance of a finished dual write workflow with the
+// same input, and returns it. The new instance runs the current version of
+// the workflow.
+func (a *Admin) Retry(ctx context.Context, instanceID string) (*workflow.Instance, error) {
+	details, err := a.Get(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if details.State == WorkflowStateRunning || details.State == WorkflowStatePendingApproval {
+		return nil, ErrWorkflowRunning
+	}
+	if details.Input == nil {
+		return nil, ErrWorkflowNotRetryable
+	}
+
+	// writes that need an approval wait for a new one
+	var input any = details.Input
+	if details.Approval != nil {
+		approval := *details.Approval
+		approval.Workflow = CurrentWorkflow(WorkflowName(approval.Workflow))
+		input = &approval
+	}
+
+	instance, err := a.client.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+		InstanceID: uuid.NewString(),
+	}, CurrentWorkflow(WorkflowName(details.Workflow)), input)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retry workflow %s: %w", instanceID, err)
+	}
+	klog.FromContext(ctx).Info("retrying workflow", "instanceID", instanceID, "retryInstanceID", instance.InstanceID)
+	return instance, nil
+}
+
+// Rollback reverts the relationships that a workflow instance wrote to
+// SpiceDB, including its lock. A running instance is canceled first.
+// Kube writes of the instance are not reverted.
+func (a *Admin) Rollback(ctx context.Context, instanceID string) (*workflow.Instance, error) {
+	ref, err := a.find(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if ref.State == core.WorkflowInstanceStateActive {
+		if err := a.client.CancelWorkflowInstance(ctx, ref.Instance); err != nil {
+			return nil, fmt.Errorf("unable to cancel workflow %s: %w", instanceID, err)
+		}
+		if err := a.client.WaitForWorkflowInstance(ctx, ref.Instance, DefaultWorkflowTimeout); err != nil {
+			return nil, fmt.Errorf("workflow %s didn't stop after it was canceled: %w", instanceID, err)
+		}
+	}
+
+	events, err := a.backend.GetWorkflowInstanceHistory(ctx, ref.Instance, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read history of workflow %s: %w", instanceID, err)
+	}
+	updates, err := a.writtenUpdates(events)
+	if err != nil {
+		return nil, err
+	}
+
+	instance, err := a.client.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+		InstanceID: uuid.NewString(),
+	}, CurrentWorkflow("RollbackWorkflow"), &RollbackInput{InstanceID: instanceID, Updates: updates, MaxUpdatesPerWrite: a.MaxUpdatesPerWrite})
+	if err != nil {
+		return nil, fmt.Errorf("unable to roll back workflow %s: %w", instanceID, err)
+	}
+	klog.FromContext(ctx).Info("rolling back workflow", "instanceID", instanceID, "rollbackInstanceID", instance.InstanceID, "count", len(updates))
+	return instance, nil
+}
+
+// RollbackInput is the input to the RollbackWorkflow workflow.
+type RollbackInput struct {
+	// InstanceID is the workflow instance that is rolled back.
+	InstanceID string
+
+	// Updates are the updates that the instance wrote, they are inverted
+	// by the rollback.
+	Updates []*v1.RelationshipUpdate
+
+	// MaxUpdatesPerWrite is the size of the chunks the rollback is written
+	// in, see WriteObjInput.
+	MaxUpdatesPerWrite int
+}
+
+// RollbackWorkflow reverts the relationship updates of another workflow.
+func RollbackWorkflow(ctx workflow.Context, input *RollbackInput) error {
+	instance := workflow.WorkflowInstance(ctx)
+	if len(input.Updates) > 0 {
+		NewRollbackRelationships(input.Updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "forced rollback of workflow "+input.InstanceID)
+	}
+	return nil
+}
+
+// writtenUpdates returns the net relationship updates of the completed
+// WriteToSpiceDB activities of a workflow, as updates that Cleanup inverts.
+// Relationships that the workflow touched are assumed not to have existed
+// before, like they are for the rollbacks of the workflow itself.
+func (a *Admin) writtenUpdates(events []*history.Event) ([]*v1.RelationshipUpdate, error) {
+	type relState struct {
+		rel           *v1.Relationship
+		before, after bool
+	}
+
+	converter := a.backend.Options().Converter
+	scheduled := make(map[int64]*v1.WriteRelationshipsRequest)
+	states := make(map[string]*relState)
+	var order []string
+	for _, event := range events {
+		switch attrs := event.Attributes.(type) {
+		case *history.ActivityScheduledAttributes:
+			if attrs.Name != writeToSpiceDBActivity || len(attrs.Inputs) == 0 {
+				continue
+			}
+			var req *v1.WriteRelationshipsRequest
+			if err := converter.From(attrs.Inputs[0], &req); err != nil {
+				return nil, fmt.Errorf("unable to decode relationship write: %w", err)
+			}
+			scheduled[event.ScheduleEventID] = req
+		case *history.ActivityCompletedAttributes:
+			req, ok := scheduled[event.ScheduleEventID]
+			if !ok {
+				continue
+			}
+			for _, update := range req.Updates {
+				key := tuple.V1StringRelationshipWithoutCaveatOrExpiration(update.Relationship)
+				state, ok := states[key]
+				if !ok {
+					state = &relState{rel: update.Relationship, before: update.Operation == v1.RelationshipUpdate_OPERATION_DELETE}
+					states[key] = state
+					order = append(order, key)
+				}
+				state.after = update.Operation != v1.RelationshipUpdate_OPERATION_DELETE
+			}
+		}
+	}
+
+	var updates []*v1.RelationshipUpdate
+	for _, key := range order {
+		state := states[key]
+		switch {
+		case state.after && !state.before:
+			updates = append(updates, &v1.RelationshipUpdate{Operation: v1.RelationshipUpdate_OPERATION_CREATE, Relationship: state.rel})
+		case !state.after && state.before:
+			updates = append(updates, &v1.RelationshipUpdate{Operation: v1.RelationshipUpdate_OPERATION_DELETE, Relationship: state.rel})
+		}
+	}
+	return updates, nil
+}
+
+// details reads the history of a workflow instance.
+func (a *Admin) details(ctx context.Context, ref *diag.WorkflowInstanceRef) (*WorkflowDetails, error) {
+	events, err := a.backend.GetWorkflowInstanceHistory(ctx, ref.Instance, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read history of workflow %s: %w", ref.Instance.InstanceID, err)
+	}
+
+	details := &WorkflowDetails{
+		WorkflowSummary: WorkflowSummary{
+			InstanceID:  ref.Instance.InstanceID,
+			ExecutionID: ref.Instance.ExecutionID,
+			State:       WorkflowStateCompleted,
+			CreatedAt:   ref.CreatedAt,
+			CompletedAt: ref.CompletedAt,
+		},
+		History: make([]*HistoryEvent, 0, len(events)),
+	}
+	if ref.State == core.WorkflowInstanceStateActive {
+		details.State = WorkflowStateRunning
+	}
+
+	activities := make(map[int64]string)
+	decided := false
+	for _, event := range events {
+		historyEvent := &HistoryEvent{
+			SequenceID:      event.SequenceID,
+			Type:            event.Type.String(),
+			Timestamp:       event.Timestamp,
+			ScheduleEventID: event.ScheduleEventID,
+		}
+		details.History = append(details.History, historyEvent)
+
+		switch attrs := event.Attributes.(type) {
+		case *history.ExecutionStartedAttributes:
+			details.Workflow = attrs.Name
+			if err := a.decodeInput(details, attrs); err != nil {
+				return nil, err
+			}
+		case *history.ActivityScheduledAttributes:
+			activities[event.ScheduleEventID] = attrs.Name
+			historyEvent.Activity = attrs.Name
+		case *history.ActivityCompletedAttributes:
+			historyEvent.Activity = activities[event.ScheduleEventID]
+		case *history.ActivityFailedAttributes:
+			historyEvent.Activity = activities[event.ScheduleEventID]
+			if attrs.Error != nil {
+				historyEvent.Error = attrs.Error.Error()
+			}
+		case *history.SignalReceivedAttributes:
+			decided = true
+		case *history.ExecutionCompletedAttributes:
+			if attrs.Error != nil {
+				historyEvent.Error = attrs.Error.Error()
+				details.Error = historyEvent.Error
+				details.State = WorkflowStateFailed
+			}
+		}
+	}
+	if details.State == WorkflowStateRunning && details.Approval != nil && !decided {
+		details.State = WorkflowStatePendingApproval
+	}
+	return details, nil
+}
+
+// decodeInput sets the input of dual write and approval workflows.
+func (a *Admin) decodeInput(details *WorkflowDetails, attrs *history.ExecutionStartedAttributes) error {
+	if len(attrs.Inputs) == 0 {
+		return nil
+	}
+	converter := a.backend.Options().Converter
+	switch WorkflowName(details.Workflow) {
+	case "PessimisticWriteToSpiceDBAndKube", "OptimisticWriteToSpiceDBAndKube", "EventualWriteToSpiceDBAndKube":
+		if err := converter.From(attrs.Inputs[0], &details.Input); err != nil {
+			return fmt.Errorf("unable to decode input of workflow %s: %w", details.InstanceID, err)
+		}
+	case "ApproveWrite":
+		if err := converter.From(attrs.Inputs[0], &details.Approval); err != nil {
+			return fmt.Errorf("unable to decode input of workflow %s: %w", details.InstanceID, err)
+		}
+		details.Input = details.Approval.Write
+	default:
+		return nil
+	}
+	if details.Input == nil {
+		return nil
+	}
+
+	input := details.Input
+	if input.UserInfo != nil {
+		details.User = input.UserInfo.Name
+	}
+	if input.RequestInfo != nil {
+		details.Verb = input.RequestInfo.Verb
+		details.Resource = input.RequestInfo.Resource
+		details.Namespace = input.RequestInfo.Namespace
+		details.Name = input.RequestInfo.Name
+	}
+	if input.ObjectMeta != nil && input.ObjectMeta.Name != "" {
+		details.Name = input.ObjectMeta.Name
+	}
+	return nil
+}
+
+// find returns the latest execution of the workflow instance with the
+// given ID.
+func (a *Admin) find(ctx context.Context, instanceID string) (*diag.WorkflowInstanceRef, error) {
+	var found *diag.WorkflowInstanceRef
+	err := eachInstance(ctx, a.backend, func(ref *diag.WorkflowInstanceRef) error {
+		if ref.Instance.InstanceID == instanceID && (found == nil || ref.CreatedAt.After(found.CreatedAt)) {
+			found = ref
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrWorkflowNotFound, instanceID)
+	}
+	return found, nil
+}
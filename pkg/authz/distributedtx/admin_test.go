@@ -0,0 +1,147 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cschleiden/go-workflows/backend/sqlite"
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+func TestAdmin(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	var kubeDown atomic.Bool
+	kubeClient := &fake.RESTClient{
+		Client: fake.CreateHTTPClient(func(request *http.Request) (*http.Response, error) {
+			if kubeDown.Load() {
+				return nil, errors.New("connection refused")
+			}
+			header := http.Header{}
+			header.Set("Content-Type", runtime.ContentTypeJSON)
+			return &http.Response{
+				Header:     header,
+				StatusCode: http.StatusCreated,
+				Body:       io.NopCloser(strings.NewReader(`{"hi":"myfriend"}`)),
+			}, nil
+		}),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+
+	workflowClient, worker, err := SetupWithBackend(ctx, psc, kubeClient, sqlite.NewInMemoryBackend())
+	require.NoError(t, err)
+	require.NoError(t, worker.Start(ctx))
+	defer func() {
+		require.NoError(t, worker.Shutdown(ctx))
+	}()
+	admin, err := NewAdmin(worker.Backend(), workflowClient)
+	require.NoError(t, err)
+
+	hasPermission := func() bool {
+		cpr, err := psc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+			Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+			Resource:    &v1.ObjectReference{ObjectType: "namespace", ObjectId: "admin"},
+			Permission:  "view",
+			Subject:     &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+		})
+		require.NoError(t, err)
+		return cpr.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+	}
+
+	// the workflow fails because kube is down
+	kubeDown.Store(true)
+	failed, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+		InstanceID: uuid.NewString(),
+	}, CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"), &WriteObjInput{
+		RequestInfo: &request.RequestInfo{Verb: "create", Resource: "namespaces"},
+		RequestURI:  "/api/v1/namespaces",
+		UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+		ObjectMeta:  &metav1.ObjectMeta{Name: "admin"},
+		CreateRelationships: []*v1.Relationship{{
+			Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: "admin"},
+			Relation: "creator",
+			Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+		}},
+		Body: []byte("{}"),
+	})
+	require.NoError(t, err)
+	_, err = client.GetWorkflowResult[*KubeResp](ctx, workflowClient, failed, DefaultWorkflowTimeout)
+	require.ErrorContains(t, err, "failed to communicate with kubernetes")
+	require.False(t, hasPermission())
+
+	summaries, err := admin.List(ctx, WorkflowStateFailed)
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	require.Equal(t, failed.InstanceID, summaries[0].InstanceID)
+	require.Equal(t, CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"), summaries[0].Workflow)
+	require.Equal(t, "janedoe", summaries[0].User)
+	require.Equal(t, "create", summaries[0].Verb)
+	require.Equal(t, "namespaces", summaries[0].Resource)
+	require.Equal(t, "admin", summaries[0].Name)
+	require.Contains(t, summaries[0].Error, "failed to communicate with kubernetes")
+
+	details, err := admin.Get(ctx, failed.InstanceID)
+	require.NoError(t, err)
+	require.Equal(t, WorkflowStateFailed, details.State)
+	require.Len(t, details.Input.CreateRelationships, 1)
+	var activities []string
+	for _, event := range details.History {
+		if event.Type == "ActivityScheduled" {
+			activities = append(activities, event.Activity)
+		}
+	}
+	require.Contains(t, activities, "WriteToSpiceDB")
+	require.Contains(t, activities, "WriteToKube")
+
+	_, err = admin.Get(ctx, "unknown")
+	require.ErrorIs(t, err, ErrWorkflowNotFound)
+
+	// the retry succeeds once kube is back
+	kubeDown.Store(false)
+	retried, err := admin.Retry(ctx, failed.InstanceID)
+	require.NoError(t, err)
+	resp, err := client.GetWorkflowResult[*KubeResp](ctx, workflowClient, retried, DefaultWorkflowTimeout)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.True(t, hasPermission())
+
+	summaries, err = admin.List(ctx, WorkflowStateCompleted)
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	require.Equal(t, retried.InstanceID, summaries[0].InstanceID)
+
+	// the failed workflow already rolled back its own writes
+	rollback, err := admin.Rollback(ctx, failed.InstanceID)
+	require.NoError(t, err)
+	require.NoError(t, workflowClient.WaitForWorkflowInstance(ctx, rollback, DefaultWorkflowTimeout))
+	require.True(t, hasPermission())
+
+	// a forced rollback of the retry removes its relationships
+	rollback, err = admin.Rollback(ctx, retried.InstanceID)
+	require.NoError(t, err)
+	require.NoError(t, workflowClient.WaitForWorkflowInstance(ctx, rollback, DefaultWorkflowTimeout))
+	require.False(t, hasPermission())
+
+	_, err = admin.Retry(ctx, rollback.InstanceID)
+	require.ErrorIs(t, err, ErrWorkflowNotRetryable)
+}
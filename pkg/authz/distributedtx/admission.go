@@ -0,0 +1,132 @@
+package distributedtx
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cschleiden/go-workflows/workflow"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+)
+
+// ConfirmAdmissionInput is the input to the ConfirmAdmission workflow.
+type ConfirmAdmissionInput struct {
+	// Object identifies the state of the object that confirms the write.
+	Object *AdmittedObject
+
+	// Preconditions are the preconditions of the rule, which are checked
+	// again when the relationships are written.
+	Preconditions  []*v1.Precondition
+	Updates        []*v1.RelationshipUpdate
+	DeleteByFilter []*v1.RelationshipFilter
+	Timeout        time.Duration
+
+	// MaxUpdatesPerWrite is the size of the chunks the updates are written
+	// in, see WriteObjInput.
+	MaxUpdatesPerWrite int
+}
+
+// AdmittedObject is the input to the IsAdmittedInKube activity. It
+// describes the object that an admitted create or update persists.
+type AdmittedObject struct {
+	// Path is the kube API path of the object.
+	Path string
+
+	// UID is the uid of the object, if the admission knew it. An object
+	// with the same name but a different uid was written by another
+	// request.
+	UID string
+
+	// ResourceVersion is the version of the object before an update. The
+	// update is persisted once the object has another version that matches
+	// the admitted object: its generation is at least Generation, and it
+	// has the Labels and Annotations that the update set. This tells the
+	// update apart from other writes, such as status writes of controllers.
+	ResourceVersion string
+	Generation      int64
+	Labels          map[string]string
+	Annotations     map[string]string
+}
+
+// ConfirmAdmission polls kube until the write that an admission webhook
+// admitted is persisted, and then writes its relationship updates. A write
+// that isn't persisted before the timeout, i.e. because kube or another
+// admission webhook rejected it, is dropped, and the workflow returns false.
+// So is a write whose preconditions no longer hold once it is persisted.
+//
+// Like AwaitRemoval, the wait is persisted by the workflow backend, so
+// admitted writes survive restarts of the proxy and are confirmed by any
+// replica that shares the backend.
+func ConfirmAdmission(ctx workflow.Context, input *ConfirmAdmissionInput) (bool, error) {
+	instance := workflow.WorkflowInstance(ctx)
+	persisted, err := pollKube(ctx, input.Timeout, activityHandler.IsAdmittedInKube, input.Object, input.Object.Path)
+	if err != nil {
+		return false, err
+	}
+	if !persisted {
+		klog.V(2).InfoS("dropped admitted write that wasn't persisted in kube", "path", input.Object.Path, "timeout", input.Timeout)
+		return false, nil
+	}
+
+	written, err := writeUpdates(ctx, workflow.DefaultActivityOptions, instance.InstanceID, input.Preconditions, input.Updates, input.DeleteByFilter, input.MaxUpdatesPerWrite)
+	if err != nil && isRejectedBySpiceDB(err) {
+		klog.ErrorS(err, "dropped admitted write, SpiceDB rejected its relationships", "path", input.Object.Path)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to write relationships of admitted write: %w", err)
+	}
+	klog.V(2).InfoS("wrote relationships of admitted write", "path", input.Object.Path, "count", len(written))
+	return true, nil
+}
+
+// AdmissionInstanceID returns the instance id of the workflow that confirms
+// the admission review with the given uid. Kube uses the same uid when it
+// calls a webhook again for a request, so that a write isn't confirmed
+// twice.
+func AdmissionInstanceID(reviewUID string) string {
+	return "admission-" + reviewUID
+}
+
+// IsAdmittedInKube returns whether kube persisted the object that an
+// admitted write describes.
+func (h *ActivityHandler) IsAdmittedInKube(ctx context.Context, input *AdmittedObject) (bool, error) {
+	body, err := h.KubeClient.Get().RequestURI(input.Path).Do(ctx).Raw()
+	if k8serrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var obj metav1.PartialObjectMetadata
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return false, fmt.Errorf("unable to decode object: %w", err)
+	}
+	if input.UID != "" && string(obj.UID) != input.UID {
+		return false, nil
+	}
+	if input.ResourceVersion == "" {
+		return true, nil
+	}
+	if obj.ResourceVersion == input.ResourceVersion || obj.Generation < input.Generation {
+		return false, nil
+	}
+	return hasValues(obj.Labels, input.Labels) && hasValues(obj.Annotations, input.Annotations), nil
+}
+
+// hasValues returns whether m has all the keys of values, with the same
+// values.
+func hasValues(m, values map[string]string) bool {
+	for k, v := range values {
+		if got, ok := m[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
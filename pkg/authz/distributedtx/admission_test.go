@@ -0,0 +1,67 @@
+package distributedtx
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest/fake"
+)
+
+const admittedPod = `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web","namespace":"default","uid":"c0ffee","resourceVersion":"2","generation":2,"labels":{"app":"web","tier":"front"}}}`
+
+func TestIsAdmittedInKube(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		input   AdmittedObject
+		want    bool
+		wantErr bool
+	}{
+		{name: "not found", status: http.StatusNotFound, body: `{"kind":"Status","code":404}`, want: false},
+		{name: "created", status: http.StatusOK, body: admittedPod, want: true},
+		{name: "created with uid", status: http.StatusOK, body: admittedPod, input: AdmittedObject{UID: "c0ffee"}, want: true},
+		{name: "another object", status: http.StatusOK, body: admittedPod, input: AdmittedObject{UID: "decaf"}, want: false},
+		{name: "update not persisted", status: http.StatusOK, body: admittedPod, input: AdmittedObject{ResourceVersion: "2"}, want: false},
+		{name: "update persisted", status: http.StatusOK, body: admittedPod, input: AdmittedObject{ResourceVersion: "1", Generation: 2, Labels: map[string]string{"tier": "front"}}, want: true},
+		{name: "update with a later generation", status: http.StatusOK, body: admittedPod, input: AdmittedObject{ResourceVersion: "1", Generation: 1}, want: true},
+		{name: "other write with an earlier generation", status: http.StatusOK, body: admittedPod, input: AdmittedObject{ResourceVersion: "1", Generation: 3}, want: false},
+		{name: "other write without the labels", status: http.StatusOK, body: admittedPod, input: AdmittedObject{ResourceVersion: "1", Labels: map[string]string{"tier": "back"}}, want: false},
+		{name: "other write without the annotations", status: http.StatusOK, body: admittedPod, input: AdmittedObject{ResourceVersion: "1", Annotations: map[string]string{"owner": "alice"}}, want: false},
+		{name: "error", status: http.StatusInternalServerError, body: `{}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ah := ActivityHandler{KubeClient: &fake.RESTClient{
+				Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+					require.Equal(t, http.MethodGet, req.Method)
+					require.Equal(t, "/api/v1/namespaces/default/pods/web", req.URL.Path)
+					header := http.Header{}
+					header.Set("Content-Type", runtime.ContentTypeJSON)
+					return &http.Response{
+						Header:     header,
+						StatusCode: tt.status,
+						Body:       io.NopCloser(strings.NewReader(tt.body)),
+					}, nil
+				}),
+				NegotiatedSerializer: &serializer.CodecFactory{},
+			}}
+
+			input := tt.input
+			input.Path = "/api/v1/namespaces/default/pods/web"
+			persisted, err := ah.IsAdmittedInKube(t.Context(), &input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, persisted)
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/cschleiden/go-workflows/workflow"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+// ApprovalSignal is the name of the signal that approves or rejects a
+// write that waits in the ApproveWrite workflow.
+const ApprovalSignal = "approval"
+
+var (
+	// ErrNotPendingApproval is returned when approving or rejecting a
+	// workflow instance that doesn't wait for an approval.
+	ErrNotPendingApproval = errors.New("workflow instance is not pending approval")
+
+	// ErrSelfApproval is returned when a user approves or rejects their own
+	// write.
+	ErrSelfApproval = errors.New("writes can't be approved or rejected by the user who requested them")
+
+	// ErrApprovalDenied is returned when a user doesn't pass the approval
+	// checks of a write, or when a check isn't about the user.
+	ErrApprovalDenied = errors.New("user is not allowed to approve or reject the write")
+)
+
+// ApprovalInput is the input to the ApproveWrite workflow.
+type ApprovalInput struct {
+	// Write is the input of the dual write that runs once the write is
+	// approved.
+	Write *WriteObjInput
+
+	// Workflow is the registered name of the dual write workflow, which is
+	// chosen when the write is requested so that replays run the same
+	// version.
+	Workflow string
+
+	// Approval holds the checks that the user who approves the write must
+	// pass.
+	Approval proxyrule.Approval
+
+	// Timeout is how long the write waits for an approval.
+	Timeout time.Duration
+}
+
+// ApprovalDecision is the payload of the ApprovalSignal.
+type ApprovalDecision struct {
+	Approved bool
+	User     string
+}
+
+// ApproveWrite holds a write until it is approved, rejected or times out.
+// An approved write runs the dual write workflow as a sub-workflow and
+// returns its result. Nothing is written before the write is approved, so a
+// write that is rejected or times out is dropped, and a Forbidden response
+// is returned.
+func ApproveWrite(ctx workflow.Context, input *ApprovalInput) (*KubeResp, error) {
+	if err := input.Write.validate(); err != nil {
+		return nil, fmt.Errorf("invalid input to ApproveWrite: %w", err)
+	}
+
+	instance := workflow.WorkflowInstance(ctx)
+	timeout := input.Timeout
+	if timeout <= 0 {
+		timeout = rules.DefaultApprovalTimeout
+	}
+
+	timerCtx, cancelTimer := workflow.WithCancel(ctx)
+	timer := workflow.ScheduleTimer(timerCtx, timeout)
+	decisions := workflow.NewSignalChannel[*ApprovalDecision](ctx, ApprovalSignal)
+
+	var decision *ApprovalDecision
+	workflow.Select(ctx,
+		workflow.Receive(decisions, func(_ workflow.Context, d *ApprovalDecision, _ bool) {
+			decision = d
+		}),
+		workflow.Await(timer, func(workflow.Context, workflow.Future[any]) {}),
+	)
+	cancelTimer()
+
+	verb := input.Write.RequestInfo.Verb
+	switch {
+	case decision == nil:
+		klog.InfoS("write was not approved before the timeout", "workflow", instance.InstanceID, "timeout", timeout)
+		return approvalRefused(input.Write, fmt.Errorf("the %s was not approved within %s", verb, timeout)), nil
+	case !decision.Approved:
+		klog.InfoS("write was rejected", "workflow", instance.InstanceID, "user", decision.User)
+		return approvalRefused(input.Write, fmt.Errorf("the %s was rejected by %s", verb, decision.User)), nil
+	}
+
+	klog.InfoS("write was approved", "workflow", instance.InstanceID, "user", decision.User)
+	return workflow.CreateSubWorkflowInstance[*KubeResp](ctx, workflow.SubWorkflowOptions{
+		InstanceID:   ApprovedWriteInstanceID(instance.InstanceID),
+		RetryOptions: workflow.DefaultSubWorkflowRetryOptions,
+	}, input.Workflow, input.Write).Get(ctx)
+}
+
+// ApprovedWriteInstanceID returns the instance id of the dual write that
+// the ApproveWrite workflow with the given id starts once it is approved.
+func ApprovedWriteInstanceID(workflowID string) string {
+	return workflowID + "-write"
+}
+
+// approvalRefused returns a Forbidden response for a write that wasn't
+// approved.
+func approvalRefused(input *WriteObjInput, err error) *KubeResp {
+	var name string
+	if input.ObjectMeta != nil {
+		name = input.ObjectMeta.Name
+	}
+	statusError := k8serrors.NewForbidden(schema.GroupResource{
+		Group:    input.RequestInfo.APIGroup,
+		Resource: input.RequestInfo.Resource,
+	}, name, err)
+
+	out := &KubeResp{
+		StatusCode: http.StatusForbidden,
+		Err:        *statusError,
+	}
+	out.Body, _ = json.Marshal(statusError)
+	return out
+}
+
+// Approve approves a write that waits for an approval, as the approver. The
+// approver must pass the approval checks of the write, and must not be the
+// user who requested it, by name or by uid.
+func (a *Admin) Approve(ctx context.Context, instanceID string, approver *user.DefaultInfo) error {
+	return a.decide(ctx, instanceID, approver, true)
+}
+
+// Reject rejects a write that waits for an approval, as the approver, who
+// must be allowed to approve it.
+func (a *Admin) Reject(ctx context.Context, instanceID string, approver *user.DefaultInfo) error {
+	return a.decide(ctx, instanceID, approver, false)
+}
+
+func (a *Admin) decide(ctx context.Context, instanceID string, approver *user.DefaultInfo, approved bool) error {
+	details, err := a.Get(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	if details.State != WorkflowStatePendingApproval || details.Approval == nil {
+		return fmt.Errorf("%w: %s", ErrNotPendingApproval, instanceID)
+	}
+	if isRequester(approver, details.Approval.Write.UserInfo) {
+		return ErrSelfApproval
+	}
+	if err := a.checkApprover(ctx, details.Approval, approver); err != nil {
+		return err
+	}
+
+	decision := &ApprovalDecision{Approved: approved, User: approver.GetName()}
+	if err := a.client.SignalWorkflow(ctx, instanceID, ApprovalSignal, decision); err != nil {
+		return fmt.Errorf("unable to signal workflow %s: %w", instanceID, err)
+	}
+	klog.FromContext(ctx).Info("decided approval of workflow", "instanceID", instanceID, "approved", approved, "user", approver.GetName())
+	return nil
+}
+
+// isRequester returns whether the approver is the user who requested the
+// write. Users are the same if their names are, or if both have a uid and
+// the uids are the same, i.e. a user who is known by another name.
+func isRequester(approver, requester user.Info) bool {
+	if requester == nil {
+		return false
+	}
+	if approver.GetName() == requester.GetName() {
+		return true
+	}
+	return approver.GetUID() != "" && approver.GetUID() == requester.GetUID()
+}
+
+// isApproverSubject returns whether the subject of a check is the approver,
+// by name or uid, or one of the approver's groups.
+func isApproverSubject(rel *rules.ResolvedRel, approver user.Info) bool {
+	switch {
+	case rel.SubjectID == approver.GetName():
+		return true
+	case approver.GetUID() != "" && rel.SubjectID == approver.GetUID():
+		return true
+	default:
+		return slices.Contains(approver.GetGroups(), rel.SubjectID)
+	}
+}
+
+// checkApprover runs the approval checks of a write for the approver. The
+// checks are resolved against the request of the write, and each of them
+// has to check a permission of the approver: a check whose subject isn't
+// the approver or one of their groups would allow any authenticated user.
+func (a *Admin) checkApprover(ctx context.Context, input *ApprovalInput, approver *user.DefaultInfo) error {
+	if a.PermissionsClient == nil {
+		return fmt.Errorf("approvals need a permissions client")
+	}
+	approval, err := rules.CompileApproval(input.Approval)
+	if err != nil {
+		return err
+	}
+
+	write := input.Write
+	object := &metav1.PartialObjectMetadata{}
+	if write.ObjectMeta != nil {
+		object.ObjectMeta = *write.ObjectMeta
+	}
+	resolved, err := approval.ResolveChecks(rules.NewResolveInput(write.RequestInfo, approver, object, write.Body, write.Header))
+	if err != nil {
+		return err
+	}
+
+	// checks that resolve to no relationships don't allow anyone
+	if len(resolved) == 0 {
+		return ErrApprovalDenied
+	}
+	for _, rel := range resolved {
+		if !isApproverSubject(rel, approver) {
+			return fmt.Errorf("%w: the approval check %s:%s#%s@%s:%s is not about the approver", ErrApprovalDenied,
+				rel.ResourceType, rel.ResourceID, rel.ResourceRelation, rel.SubjectType, rel.SubjectID)
+		}
+	}
+
+	items := make([]*v1.CheckBulkPermissionsRequestItem, 0, len(resolved))
+	for _, rel := range resolved {
+		items = append(items, &v1.CheckBulkPermissionsRequestItem{
+			Resource:   &v1.ObjectReference{ObjectType: rel.ResourceType, ObjectId: rel.ResourceID},
+			Permission: rel.ResourceRelation,
+			Subject: &v1.SubjectReference{
+				Object:           &v1.ObjectReference{ObjectType: rel.SubjectType, ObjectId: rel.SubjectID},
+				OptionalRelation: rel.SubjectRelation,
+			},
+		})
+	}
+	resp, err := a.PermissionsClient.CheckBulkPermissions(ctx, &v1.CheckBulkPermissionsRequest{
+		Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+		Items:       items,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to check approval: %w", err)
+	}
+	for _, pair := range resp.Pairs {
+		if pair.GetError() != nil {
+			return fmt.Errorf("unable to check approval: %s", pair.GetError().GetMessage())
+		}
+		if pair.GetItem().GetPermissionship() != v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION {
+			return ErrApprovalDenied
+		}
+	}
+	return nil
+}
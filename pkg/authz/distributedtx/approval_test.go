@@ -0,0 +1,175 @@
+package distributedtx
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cschleiden/go-workflows/backend/sqlite"
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/cschleiden/go-workflows/workflow"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+func TestApproveWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	kubeClient := &fake.RESTClient{
+		Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Set("Content-Type", runtime.ContentTypeJSON)
+			return &http.Response{
+				Header:     header,
+				StatusCode: http.StatusCreated,
+				Body:       io.NopCloser(strings.NewReader(`{"hi":"myfriend"}`)),
+			}, nil
+		}),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+
+	workflowClient, worker, err := SetupWithBackend(ctx, psc, kubeClient, sqlite.NewInMemoryBackend())
+	require.NoError(t, err)
+	require.NoError(t, worker.Start(ctx))
+	defer func() {
+		require.NoError(t, worker.Shutdown(ctx))
+	}()
+	admin, err := NewAdmin(worker.Backend(), workflowClient)
+	require.NoError(t, err)
+	admin.PermissionsClient = psc
+
+	// bob can approve writes, since he can view the approvers namespace
+	_, err = psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{
+		Updates: []*v1.RelationshipUpdate{{
+			Operation: v1.RelationshipUpdate_OPERATION_TOUCH,
+			Relationship: &v1.Relationship{
+				Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: "approvers"},
+				Relation: "viewer",
+				Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "bob"}},
+			},
+		}},
+	})
+	require.NoError(t, err)
+
+	hasCreator := func(name string) bool {
+		cpr, err := psc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+			Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+			Resource:    &v1.ObjectReference{ObjectType: "namespace", ObjectId: name},
+			Permission:  "admin",
+			Subject:     &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+		})
+		require.NoError(t, err)
+		return cpr.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+	}
+	requestWrite := func(name string, timeout time.Duration, check string) *workflow.Instance {
+		instance, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+			InstanceID: uuid.NewString(),
+		}, CurrentWorkflow("ApproveWrite"), &ApprovalInput{
+			Write: &WriteObjInput{
+				RequestInfo: &request.RequestInfo{Verb: "create", Resource: "namespaces"},
+				RequestURI:  "/api/v1/namespaces",
+				UserInfo:    &user.DefaultInfo{Name: "janedoe", UID: "1234"},
+				ObjectMeta:  &metav1.ObjectMeta{Name: name},
+				CreateRelationships: []*v1.Relationship{{
+					Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: name},
+					Relation: "creator",
+					Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+				}},
+				Body: []byte(`{"metadata":{"name":"` + name + `"}}`),
+			},
+			Workflow: CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"),
+			Approval: proxyrule.Approval{
+				Checks: []proxyrule.StringOrTemplate{{Template: check}},
+			},
+			Timeout: timeout,
+		})
+		require.NoError(t, err)
+		return instance
+	}
+	awaitPending := func(instance *workflow.Instance) {
+		require.Eventually(t, func() bool {
+			details, err := admin.Get(ctx, instance.InstanceID)
+			require.NoError(t, err)
+			return details.State == WorkflowStatePendingApproval
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// an approved write is applied
+	const approverCheck = "namespace:approvers#view@user:{{user.name}}"
+	approved := requestWrite("approved", time.Hour, approverCheck)
+	awaitPending(approved)
+	summaries, err := admin.List(ctx, WorkflowStatePendingApproval)
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	require.Equal(t, "janedoe", summaries[0].User)
+	require.Equal(t, "approved", summaries[0].Name)
+	require.False(t, hasCreator("approved"))
+
+	require.ErrorIs(t, admin.Approve(ctx, approved.InstanceID, &user.DefaultInfo{Name: "janedoe"}), ErrSelfApproval)
+	// the requester is recognized by their uid under another name
+	require.ErrorIs(t, admin.Approve(ctx, approved.InstanceID, &user.DefaultInfo{Name: "jane", UID: "1234"}), ErrSelfApproval)
+	require.ErrorIs(t, admin.Approve(ctx, approved.InstanceID, &user.DefaultInfo{Name: "mallory"}), ErrApprovalDenied)
+	require.NoError(t, admin.Approve(ctx, approved.InstanceID, &user.DefaultInfo{Name: "bob"}))
+
+	resp, err := client.GetWorkflowResult[*KubeResp](ctx, workflowClient, approved, DefaultWorkflowTimeout)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.True(t, hasCreator("approved"))
+	require.ErrorIs(t, admin.Approve(ctx, approved.InstanceID, &user.DefaultInfo{Name: "bob"}), ErrNotPendingApproval)
+
+	// a rejected write is dropped
+	rejected := requestWrite("rejected", time.Hour, approverCheck)
+	awaitPending(rejected)
+	require.NoError(t, admin.Reject(ctx, rejected.InstanceID, &user.DefaultInfo{Name: "bob"}))
+	resp, err = client.GetWorkflowResult[*KubeResp](ctx, workflowClient, rejected, DefaultWorkflowTimeout)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Contains(t, resp.Err.ErrStatus.Message, "rejected by bob")
+	require.False(t, hasCreator("rejected"))
+
+	// a check that isn't about the approver doesn't allow others, even
+	// though it passes
+	unrelated := requestWrite("unrelated", time.Hour, "namespace:approvers#view@user:bob")
+	awaitPending(unrelated)
+	require.ErrorIs(t, admin.Approve(ctx, unrelated.InstanceID, &user.DefaultInfo{Name: "mallory"}), ErrApprovalDenied)
+	require.NoError(t, admin.Reject(ctx, unrelated.InstanceID, &user.DefaultInfo{Name: "bob"}))
+
+	// a write that isn't approved in time is dropped
+	expired := requestWrite("expired", 10*time.Millisecond, approverCheck)
+	resp, err = client.GetWorkflowResult[*KubeResp](ctx, workflowClient, expired, DefaultWorkflowTimeout)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Contains(t, resp.Err.ErrStatus.Message, "not approved within 10ms")
+	require.False(t, hasCreator("expired"))
+}
+
+func TestIsApproverSubject(t *testing.T) {
+	approver := &user.DefaultInfo{Name: "bob", UID: "42", Groups: []string{"approvers"}}
+	subject := func(id string) *rules.ResolvedRel {
+		return &rules.ResolvedRel{ResourceType: "namespace", ResourceID: "prod", ResourceRelation: "approve", SubjectType: "user", SubjectID: id}
+	}
+
+	require.True(t, isApproverSubject(subject("bob"), approver))
+	require.True(t, isApproverSubject(subject("42"), approver))
+	require.True(t, isApproverSubject(subject("approvers"), approver))
+	require.False(t, isApproverSubject(subject("alice"), approver))
+	require.False(t, isApproverSubject(subject(""), &user.DefaultInfo{Name: "bob"}))
+}
@@ -0,0 +1,207 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/cschleiden/go-workflows/workflow"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/failpoints"
+)
+
+// DefaultMaxUpdatesPerWrite is how many updates SpiceDB accepts in a single
+// WriteRelationships request, unless it is configured otherwise with
+// --write-relationships-max-updates-per-call.
+const DefaultMaxUpdatesPerWrite = 1000
+
+// RelationshipsPage is a page of the relationships that match a filter.
+type RelationshipsPage struct {
+	Relationships []*v1.Relationship
+
+	// Cursor continues the read after the page. It is nil for the last
+	// page.
+	Cursor *v1.Cursor
+}
+
+// chunkSize returns how many relationship updates are written with one
+// request. Every request also writes the idempotency key of its chunk, so
+// one update of maxUpdatesPerWrite is left for it.
+func chunkSize(maxUpdatesPerWrite int) int {
+	if maxUpdatesPerWrite <= 0 {
+		maxUpdatesPerWrite = DefaultMaxUpdatesPerWrite
+	}
+	return max(maxUpdatesPerWrite-1, 1)
+}
+
+// writeChunks writes the updates to SpiceDB in chunks that fit into a single
+// request. Every chunk is written by its own WriteToSpiceDB activity with its
+// own idempotency key, so that a retried activity doesn't write its chunk
+// twice. Only the first chunk is written with the preconditions, since the
+// chunks before a later one may change what they match.
+//
+// Chunks aren't written atomically. The returned updates are those of the
+// chunks that were written before an error, which a rollback has to invert.
+func writeChunks(
+	ctx workflow.Context,
+	opts workflow.ActivityOptions,
+	workflowID string,
+	preconditions []*v1.Precondition,
+	updates []*v1.RelationshipUpdate,
+	maxUpdatesPerWrite int,
+) ([]*v1.RelationshipUpdate, error) {
+	size := chunkSize(maxUpdatesPerWrite)
+	for i := 0; i < len(updates); i += size {
+		chunk := updates[i:min(i+size, len(updates))]
+		req := &v1.WriteRelationshipsRequest{Updates: chunk}
+		if i == 0 {
+			req.OptionalPreconditions = preconditions
+		}
+
+		_, err := workflow.ExecuteActivity[*v1.ZedToken](ctx,
+			opts,
+			activityHandler.WriteToSpiceDB,
+			req, workflowID).Get(ctx)
+		if err != nil {
+			return updates[:i], fmt.Errorf("unable to write chunk of %d relationship updates at %d of %d: %w", len(chunk), i, len(updates), err)
+		}
+	}
+	if len(updates) > size {
+		klog.V(3).InfoS("wrote relationship updates in chunks", "count", len(updates), "chunkSize", size)
+	}
+	return updates, nil
+}
+
+// writeUpdates deletes the relationships that match the delete filters, and
+// then writes the updates, both in chunks, see writeChunks. The matches of a
+// filter are read and deleted one page at a time, with pages of the size of
+// a chunk, instead of being collected before anything is written. They are
+// deleted before the updates are written, so that a filter doesn't match
+// relationships that the updates create.
+//
+// The preconditions are written with the first chunk that is written, or
+// checked on their own if there is nothing to write. The returned updates
+// are those of the chunks that were written, also if an error occurred,
+// which a rollback has to invert.
+func writeUpdates(
+	ctx workflow.Context,
+	opts workflow.ActivityOptions,
+	workflowID string,
+	preconditions []*v1.Precondition,
+	updates []*v1.RelationshipUpdate,
+	filters []*v1.RelationshipFilter,
+	maxUpdatesPerWrite int,
+) ([]*v1.RelationshipUpdate, error) {
+	var written []*v1.RelationshipUpdate
+	write := func(chunk []*v1.RelationshipUpdate) error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		w, err := writeChunks(ctx, opts, workflowID, preconditions, chunk, maxUpdatesPerWrite)
+		written = append(written, w...)
+		if len(w) > 0 {
+			preconditions = nil
+		}
+		return err
+	}
+
+	pageSize := chunkSize(maxUpdatesPerWrite)
+	for _, filter := range filters {
+		klog.V(3).InfoS("deleting relationships for delete filter", "filter", filter.String())
+
+		var (
+			cursor *v1.Cursor
+			count  int
+		)
+		for {
+			page, err := workflow.ExecuteActivity[*RelationshipsPage](ctx,
+				opts,
+				activityHandler.ReadRelationshipsPage,
+				&v1.ReadRelationshipsRequest{
+					RelationshipFilter: filter,
+					OptionalLimit:      uint32(pageSize),
+					OptionalCursor:     cursor,
+				}).Get(ctx)
+			if err != nil {
+				return written, fmt.Errorf("unable to read relationships for delete by filter (%v): %w", filter, err)
+			}
+
+			deletes := make([]*v1.RelationshipUpdate, 0, len(page.Relationships))
+			for _, rel := range page.Relationships {
+				deletes = append(deletes, &v1.RelationshipUpdate{
+					Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
+					Relationship: rel,
+				})
+			}
+			if err := write(deletes); err != nil {
+				return written, err
+			}
+			count += len(deletes)
+
+			if page.Cursor == nil {
+				break
+			}
+			cursor = page.Cursor
+		}
+
+		klog.V(3).InfoS("deleted relationships for delete filter", "count", count, "filter", filter.String())
+	}
+
+	if err := write(updates); err != nil {
+		return written, err
+	}
+
+	// a write without updates only writes the idempotency key, which fails
+	// like any other write if the preconditions don't hold
+	if len(preconditions) > 0 {
+		_, err := workflow.ExecuteActivity[*v1.ZedToken](ctx,
+			opts,
+			activityHandler.WriteToSpiceDB,
+			&v1.WriteRelationshipsRequest{OptionalPreconditions: preconditions}, workflowID).Get(ctx)
+		if err != nil {
+			return written, fmt.Errorf("unable to check preconditions: %w", err)
+		}
+	}
+	return written, nil
+}
+
+// ReadRelationshipsPage reads a page of at most OptionalLimit relationships
+// that match the request, starting at its OptionalCursor. The page has a
+// cursor if it is full, since more relationships may follow it.
+func (h *ActivityHandler) ReadRelationshipsPage(ctx context.Context, input *v1.ReadRelationshipsRequest) (*RelationshipsPage, error) {
+	failpoints.FailPoint("panicReadSpiceDB")
+	stream, err := h.PermissionClient.ReadRelationships(ctx, input)
+	failpoints.FailPoint("panicSpiceDBReadResp")
+	if err != nil {
+		return nil, err
+	}
+
+	page := &RelationshipsPage{}
+	var cursor *v1.Cursor
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		page.Relationships = append(page.Relationships, resp.Relationship)
+		cursor = resp.AfterResultCursor
+	}
+
+	if input.OptionalLimit > 0 && len(page.Relationships) >= int(input.OptionalLimit) {
+		page.Cursor = cursor
+	}
+	return page, nil
+}
+
+// chunks splits the updates into chunks that fit into a single request.
+func chunks(updates []*v1.RelationshipUpdate, maxUpdatesPerWrite int) [][]*v1.RelationshipUpdate {
+	return slices.Collect(slices.Chunk(updates, chunkSize(maxUpdatesPerWrite)))
+}
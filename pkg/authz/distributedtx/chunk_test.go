@@ -0,0 +1,325 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+func TestChunkSize(t *testing.T) {
+	require.Equal(t, DefaultMaxUpdatesPerWrite-1, chunkSize(0))
+	require.Equal(t, 99, chunkSize(100))
+	require.Equal(t, 1, chunkSize(1))
+
+	updates := make([]*v1.RelationshipUpdate, 5)
+	require.Len(t, chunks(updates, 3), 3)
+	require.Empty(t, chunks(nil, 3))
+}
+
+func TestChunkedWrites(t *testing.T) {
+	const maxUpdatesPerWrite = 3
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	kubeClient := &fake.RESTClient{
+		Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Set("Content-Type", runtime.ContentTypeJSON)
+			code := http.StatusCreated
+			switch {
+			case strings.Contains(req.URL.Path, "rejected"):
+				code = http.StatusUnprocessableEntity
+			case req.Method == http.MethodDelete:
+				code = http.StatusOK
+			}
+			return &http.Response{
+				Header:     header,
+				StatusCode: code,
+				Body:       io.NopCloser(strings.NewReader(`{}`)),
+			}, nil
+		}),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+
+	// SpiceDB rejects writes with more updates than a chunk and its
+	// idempotency key, and creates of "poisoned" relationships
+	recorder := &recordingClient{PermissionsServiceClient: psc}
+	limited := &maxUpdatesClient{PermissionsServiceClient: &poisonedClient{PermissionsServiceClient: recorder}, max: maxUpdatesPerWrite}
+	workflowClient, worker, err := SetupWithMemoryBackend(ctx, limited, kubeClient)
+	require.NoError(t, err)
+	require.NoError(t, worker.Start(ctx))
+	defer func() {
+		require.NoError(t, worker.Shutdown(ctx))
+	}()
+
+	creators := func(prefix string) []*v1.Relationship {
+		rels := make([]*v1.Relationship, 0, 5)
+		for i := range 5 {
+			rels = append(rels, &v1.Relationship{
+				Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: fmt.Sprintf("%s-%d", prefix, i)},
+				Relation: "creator",
+				Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: prefix}},
+			})
+		}
+		return rels
+	}
+	count := func(prefix string) int {
+		stream, err := psc.ReadRelationships(ctx, &v1.ReadRelationshipsRequest{
+			Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+			RelationshipFilter: &v1.RelationshipFilter{
+				ResourceType:          "namespace",
+				OptionalRelation:      "creator",
+				OptionalSubjectFilter: &v1.SubjectFilter{SubjectType: "user", OptionalSubjectId: prefix},
+			},
+		})
+		require.NoError(t, err)
+		n := 0
+		for {
+			_, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return n
+			}
+			require.NoError(t, err)
+			n++
+		}
+	}
+	write := func(wf any, input *WriteObjInput) *KubeResp {
+		input.UserInfo = &user.DefaultInfo{Name: "janedoe"}
+		input.MaxUpdatesPerWrite = maxUpdatesPerWrite
+		id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+			InstanceID: uuid.NewString(),
+		}, wf, input)
+		require.NoError(t, err)
+		resp, err := client.GetWorkflowResult[KubeResp](ctx, workflowClient, id, DefaultWorkflowTimeout)
+		require.NoError(t, err)
+		return &resp
+	}
+
+	tests := []struct {
+		name string
+		wf   string
+	}{
+		{name: StrategyPessimisticWriteToSpiceDBAndKube, wf: CurrentWorkflow("PessimisticWriteToSpiceDBAndKube")},
+		{name: StrategyOptimisticWriteToSpiceDBAndKube, wf: CurrentWorkflow("OptimisticWriteToSpiceDBAndKube")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wf := tt.wf
+			written := strings.ToLower(tt.name)
+
+			// more creates than fit into a single write are written in chunks
+			resp := write(wf, &WriteObjInput{
+				RequestInfo:         &request.RequestInfo{Verb: "create", Path: "/api/v1/namespaces"},
+				RequestURI:          "/api/v1/namespaces",
+				ObjectMeta:          &metav1.ObjectMeta{Name: written},
+				CreateRelationships: creators(written),
+			})
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			require.Equal(t, 5, count(written))
+
+			// deletes by filter are read and deleted page by page
+			recorder.record(written)
+			resp = write(wf, &WriteObjInput{
+				RequestInfo: &request.RequestInfo{Verb: "delete", Path: "/api/v1/namespaces/" + written, Name: written},
+				RequestURI:  "/api/v1/namespaces/" + written,
+				DeleteByFilter: []*v1.RelationshipFilter{{
+					ResourceType:          "namespace",
+					OptionalRelation:      "creator",
+					OptionalSubjectFilter: &v1.SubjectFilter{SubjectType: "user", OptionalSubjectId: written},
+				}},
+			})
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Zero(t, count(written))
+			require.Equal(t, []string{"read", "delete", "read", "delete", "read", "delete"}, recorder.recorded())
+
+			// a filter doesn't delete the relationships that the write
+			// creates
+			resp = write(wf, &WriteObjInput{
+				RequestInfo:         &request.RequestInfo{Verb: "create", Path: "/api/v1/namespaces"},
+				RequestURI:          "/api/v1/namespaces",
+				ObjectMeta:          &metav1.ObjectMeta{Name: written},
+				CreateRelationships: creators(written),
+				DeleteByFilter: []*v1.RelationshipFilter{{
+					ResourceType:          "namespace",
+					OptionalRelation:      "creator",
+					OptionalSubjectFilter: &v1.SubjectFilter{SubjectType: "user", OptionalSubjectId: written},
+				}},
+			})
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			require.Equal(t, 5, count(written))
+
+			// a failed chunk rolls back only the chunks before it, so that
+			// the deletes after it aren't inverted into creates
+			poisoned := strings.ToLower(tt.name) + "-poisoned"
+			rels := creators(poisoned)
+			rels[2].Resource.ObjectId = "poisoned"
+			resp = write(wf, &WriteObjInput{
+				RequestInfo:         &request.RequestInfo{Verb: "create", Path: "/api/v1/namespaces"},
+				RequestURI:          "/api/v1/namespaces",
+				ObjectMeta:          &metav1.ObjectMeta{Name: poisoned},
+				CreateRelationships: rels,
+				DeleteRelationships: creators(poisoned + "-deleted"),
+			})
+			require.Equal(t, http.StatusConflict, resp.StatusCode)
+			require.Zero(t, count(poisoned))
+			require.Zero(t, count(poisoned+"-deleted"))
+		})
+	}
+
+	// a kube write that the pessimistic workflow rolls back rolls back
+	// every chunk
+	resp := write(CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"), &WriteObjInput{
+		RequestInfo:         &request.RequestInfo{Verb: "create", Path: "/api/v1/namespaces"},
+		RequestURI:          "/api/v1/namespaces/rejected",
+		ObjectMeta:          &metav1.ObjectMeta{Name: "rejected"},
+		CreateRelationships: creators("rejected"),
+	})
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	require.Zero(t, count("rejected"))
+}
+
+func TestReadRelationshipsPage(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	updates := make([]*v1.RelationshipUpdate, 0, 5)
+	for i := range 5 {
+		updates = append(updates, &v1.RelationshipUpdate{
+			Operation: v1.RelationshipUpdate_OPERATION_CREATE,
+			Relationship: &v1.Relationship{
+				Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: fmt.Sprintf("paged-%d", i)},
+				Relation: "creator",
+				Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "paged"}},
+			},
+		})
+	}
+	_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: updates})
+	require.NoError(t, err)
+
+	handler := &ActivityHandler{PermissionClient: psc}
+	req := &v1.ReadRelationshipsRequest{
+		Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+		RelationshipFilter: &v1.RelationshipFilter{
+			ResourceType:          "namespace",
+			OptionalSubjectFilter: &v1.SubjectFilter{SubjectType: "user", OptionalSubjectId: "paged"},
+		},
+		OptionalLimit: 2,
+	}
+
+	var sizes []int
+	seen := make(map[string]struct{})
+	for {
+		page, err := handler.ReadRelationshipsPage(ctx, req)
+		require.NoError(t, err)
+		sizes = append(sizes, len(page.Relationships))
+		for _, rel := range page.Relationships {
+			seen[rel.Resource.ObjectId] = struct{}{}
+		}
+		if page.Cursor == nil {
+			break
+		}
+		req.OptionalCursor = page.Cursor
+	}
+	require.Equal(t, []int{2, 2, 1}, sizes)
+	require.Len(t, seen, 5)
+}
+
+// maxUpdatesClient rejects writes with more than max updates, like SpiceDB
+// with --write-relationships-max-updates-per-call.
+type maxUpdatesClient struct {
+	v1.PermissionsServiceClient
+	max int
+}
+
+func (c *maxUpdatesClient) WriteRelationships(ctx context.Context, in *v1.WriteRelationshipsRequest, opts ...grpc.CallOption) (*v1.WriteRelationshipsResponse, error) {
+	if len(in.Updates) > c.max {
+		return nil, status.Errorf(codes.InvalidArgument, "update count of %d is greater than maximum allowed of %d", len(in.Updates), c.max)
+	}
+	return c.PermissionsServiceClient.WriteRelationships(ctx, in, opts...)
+}
+
+// poisonedClient rejects writes that create relationships of the resource
+// "namespace:poisoned".
+type poisonedClient struct {
+	v1.PermissionsServiceClient
+}
+
+func (c *poisonedClient) WriteRelationships(ctx context.Context, in *v1.WriteRelationshipsRequest, opts ...grpc.CallOption) (*v1.WriteRelationshipsResponse, error) {
+	for _, u := range in.Updates {
+		if u.Operation == v1.RelationshipUpdate_OPERATION_CREATE && u.Relationship.Resource.ObjectId == "poisoned" {
+			return nil, status.Error(codes.FailedPrecondition, "poisoned relationship")
+		}
+	}
+	return c.PermissionsServiceClient.WriteRelationships(ctx, in, opts...)
+}
+
+// recordingClient records the reads of the relationships of a subject, and
+// the writes that delete them.
+type recordingClient struct {
+	v1.PermissionsServiceClient
+
+	mu      sync.Mutex
+	subject string
+	calls   []string
+}
+
+func (c *recordingClient) record(subject string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subject = subject
+	c.calls = nil
+}
+
+func (c *recordingClient) recorded() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.calls...)
+}
+
+func (c *recordingClient) ReadRelationships(ctx context.Context, in *v1.ReadRelationshipsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[v1.ReadRelationshipsResponse], error) {
+	c.mu.Lock()
+	if in.RelationshipFilter.GetOptionalSubjectFilter().GetOptionalSubjectId() == c.subject {
+		c.calls = append(c.calls, "read")
+	}
+	c.mu.Unlock()
+	return c.PermissionsServiceClient.ReadRelationships(ctx, in, opts...)
+}
+
+func (c *recordingClient) WriteRelationships(ctx context.Context, in *v1.WriteRelationshipsRequest, opts ...grpc.CallOption) (*v1.WriteRelationshipsResponse, error) {
+	c.mu.Lock()
+	for _, u := range in.Updates {
+		if u.Operation == v1.RelationshipUpdate_OPERATION_DELETE && u.Relationship.Subject.Object.ObjectId == c.subject {
+			c.calls = append(c.calls, "delete")
+			break
+		}
+	}
+	c.mu.Unlock()
+	return c.PermissionsServiceClient.WriteRelationships(ctx, in, opts...)
+}
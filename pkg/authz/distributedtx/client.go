@@ -2,13 +2,16 @@ package distributedtx
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 
 	"github.com/cschleiden/go-workflows/backend"
 	"github.com/cschleiden/go-workflows/backend/monoprocess"
+	"github.com/cschleiden/go-workflows/backend/redis"
 	"github.com/cschleiden/go-workflows/backend/sqlite"
 	"github.com/cschleiden/go-workflows/client"
 	"github.com/cschleiden/go-workflows/worker"
+	goredis "github.com/redis/go-redis/v9"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 
@@ -29,23 +32,57 @@ func SetupWithSQLiteBackend(ctx context.Context, permissionClient v1.Permissions
 	return SetupWithBackend(ctx, permissionClient, kubeClient, sqlite.NewSqliteBackend(sqlitePath, sqlite.WithBackendOptions(backend.WithLogger(slog.New(newKlogToSlogAdapter(klog.FromContext(ctx)))))))
 }
 
+// SetupWithRedisBackend stores workflows in Redis, so that several replicas
+// of the proxy share them. Workflows that a replica started are picked up by
+// the other replicas if it dies before they complete.
+//
+// Unlike the other backends it isn't wrapped in a monoprocess backend: workers
+// of a monoprocess backend only poll again when a workflow of their own
+// process signals them, so they'd never pick up the abandoned workflows of
+// other replicas.
+func SetupWithRedisBackend(ctx context.Context, permissionClient v1.PermissionsServiceClient, kubeClient rest.Interface, rdb goredis.UniversalClient, keyPrefix string, opts ...backend.BackendOption) (*client.Client, *Worker, error) {
+	ctx = klog.NewContext(ctx, klog.FromContext(ctx).WithValues("backend", "redis", "keyPrefix", keyPrefix))
+	opts = append([]backend.BackendOption{backend.WithLogger(slog.New(newKlogToSlogAdapter(klog.FromContext(ctx))))}, opts...)
+	b, err := redis.NewRedisBackend(rdb, redis.WithKeyPrefix(keyPrefix), redis.WithBackendOptions(opts...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create redis workflow backend: %w", err)
+	}
+	return setup(ctx, permissionClient, kubeClient, b)
+}
+
 func SetupWithBackend(ctx context.Context, permissionClient v1.PermissionsServiceClient, kubeClient rest.Interface, backend backend.Backend) (*client.Client, *Worker, error) {
+	workflowClient, w, err := setup(ctx, permissionClient, kubeClient, monoprocess.NewMonoprocessBackend(backend))
+	if err != nil {
+		return nil, nil, err
+	}
+	// the monoprocess backend doesn't implement the diagnostics of the
+	// backend it wraps
+	w.backend = backend
+	return workflowClient, w, nil
+}
+
+func setup(ctx context.Context, permissionClient v1.PermissionsServiceClient, kubeClient rest.Interface, backend backend.Backend) (*client.Client, *Worker, error) {
 	klog.FromContext(ctx).Info("starting workflow engine")
-	txHandler := ActivityHandler{
+	workflowClient := client.New(backend)
+	w := worker.New(backend, &worker.DefaultOptions)
+
+	txHandler := &ActivityHandler{
 		PermissionClient: permissionClient,
 		KubeClient:       kubeClient,
+		WorkflowClient:   workflowClient,
+		Locks:            &SpiceDBLockBackend{PermissionClient: permissionClient},
 	}
 
-	monoBackend := monoprocess.NewMonoprocessBackend(backend)
-	w := worker.New(monoBackend, &worker.DefaultOptions)
-
-	if err := w.RegisterWorkflow(PessimisticWriteToSpiceDBAndKube); err != nil {
+	if err := registerWorkflows(w); err != nil {
 		return nil, nil, err
 	}
-	if err := w.RegisterWorkflow(OptimisticWriteToSpiceDBAndKube); err != nil {
+	if err := w.RegisterActivity(txHandler.WriteToKube); err != nil {
 		return nil, nil, err
 	}
-	if err := w.RegisterActivity(txHandler.WriteToKube); err != nil {
+	if err := w.RegisterActivity(txHandler.ResolveKubeWrites); err != nil {
+		return nil, nil, err
+	}
+	if err := w.RegisterActivity(txHandler.PreflightKube); err != nil {
 		return nil, nil, err
 	}
 	if err := w.RegisterActivity(txHandler.CheckKubeResource); err != nil {
@@ -57,15 +94,55 @@ func SetupWithBackend(ctx context.Context, permissionClient v1.PermissionsServic
 	if err := w.RegisterActivity(txHandler.ReadRelationships); err != nil {
 		return nil, nil, err
 	}
+	if err := w.RegisterActivity(txHandler.ReadRelationshipsPage); err != nil {
+		return nil, nil, err
+	}
+	if err := w.RegisterActivity(txHandler.ResolveRelationships); err != nil {
+		return nil, nil, err
+	}
+	if err := w.RegisterActivity(txHandler.StartAwaitRemoval); err != nil {
+		return nil, nil, err
+	}
+	if err := w.RegisterActivity(txHandler.IsRemovedFromKube); err != nil {
+		return nil, nil, err
+	}
+	if err := w.RegisterActivity(txHandler.IsAdmittedInKube); err != nil {
+		return nil, nil, err
+	}
+	if err := w.RegisterActivity(txHandler.StartOutbox); err != nil {
+		return nil, nil, err
+	}
+	if err := w.RegisterActivity(txHandler.AcquireLock); err != nil {
+		return nil, nil, err
+	}
+	if err := w.RegisterActivity(txHandler.ReleaseLock); err != nil {
+		return nil, nil, err
+	}
+	if err := w.RegisterActivity(txHandler.RenewLock); err != nil {
+		return nil, nil, err
+	}
 
-	return client.New(monoBackend), &Worker{worker: w}, nil
+	return workflowClient, &Worker{worker: w, backend: backend, handler: txHandler}, nil
 }
 
 type Worker struct {
 	worker       *worker.Worker
+	backend      backend.Backend
+	handler      *ActivityHandler
 	shutdownFunc func()
 }
 
+// SetLockBackend replaces the SpiceDB relationships that pessimistic
+// workflows lock objects with. It must be called before the worker starts.
+func (w *Worker) SetLockBackend(locks LockBackend) {
+	w.handler.Locks = locks
+}
+
+// Backend returns the backend that stores the workflows of the worker.
+func (w *Worker) Backend() backend.Backend {
+	return w.backend
+}
+
 func (w *Worker) Start(ctx context.Context) error {
 	ctx, w.shutdownFunc = context.WithCancel(ctx)
 	return w.worker.Start(ctx)
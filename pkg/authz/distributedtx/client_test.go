@@ -0,0 +1,153 @@
+package distributedtx
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cschleiden/go-workflows/backend"
+	"github.com/cschleiden/go-workflows/backend/redis"
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/cschleiden/go-workflows/workflow"
+	"github.com/google/uuid"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+func TestRedisBackendFailover(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// crashDuringTask makes the replica that starts the workflow take
+		// its first task before it dies, so that the task must be recovered
+		// after its lock expires.
+		crashDuringTask bool
+	}{
+		{name: "replica dies before running the workflow"},
+		{name: "replica dies while running the workflow", crashDuringTask: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+
+			psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+			kubeClient := &fake.RESTClient{
+				Client: fake.CreateHTTPClient(func(request *http.Request) (*http.Response, error) {
+					header := http.Header{}
+					header.Set("Content-Type", runtime.ContentTypeJSON)
+					return &http.Response{
+						Header:     header,
+						StatusCode: http.StatusCreated,
+						Body:       io.NopCloser(strings.NewReader(`{"hi":"myfriend"}`)),
+					}, nil
+				}),
+				NegotiatedSerializer: &serializer.CodecFactory{},
+			}
+
+			mr := miniredis.RunT(t)
+			newRedisClient := func() goredis.UniversalClient {
+				rdb := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+				t.Cleanup(func() { _ = rdb.Close() })
+				return rdb
+			}
+			lockTimeout := func(o *backend.Options) {
+				o.WorkflowLockTimeout = time.Second
+				o.ActivityLockTimeout = time.Second
+				o.ContextPropagators = append(o.ContextPropagators, nonEmptyMetadata{})
+			}
+
+			// the first replica accepts the request and dies before the
+			// workflow completes, so its worker never runs
+			deadClient, _, err := SetupWithRedisBackend(ctx, psc, kubeClient, newRedisClient(), "test:", lockTimeout)
+			require.NoError(t, err)
+			instance, err := deadClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+				InstanceID: uuid.NewString(),
+			}, CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"), &WriteObjInput{
+				RequestInfo: &request.RequestInfo{Verb: "create"},
+				RequestURI:  "/api/v1/namespaces",
+				UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+				ObjectMeta:  &metav1.ObjectMeta{Name: "failover"},
+				CreateRelationships: []*v1.Relationship{{
+					Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: "failover"},
+					Relation: "creator",
+					Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+				}},
+				Body: []byte("{}"),
+			})
+			require.NoError(t, err)
+
+			if tt.crashDuringTask {
+				deadBackend, err := redis.NewRedisBackend(newRedisClient(), redis.WithKeyPrefix("test:"), redis.WithBackendOptions(lockTimeout))
+				require.NoError(t, err)
+				queues := []workflow.Queue{workflow.QueueDefault}
+				require.NoError(t, deadBackend.PrepareWorkflowQueues(ctx, queues))
+				task, err := deadBackend.GetWorkflowTask(ctx, queues)
+				require.NoError(t, err)
+				require.NotNil(t, task)
+				require.Equal(t, instance.InstanceID, task.WorkflowInstance.InstanceID)
+			}
+
+			// a surviving replica picks up the workflow
+			workflowClient, worker, err := SetupWithRedisBackend(ctx, psc, kubeClient, newRedisClient(), "test:", lockTimeout)
+			require.NoError(t, err)
+			require.NoError(t, worker.Start(ctx))
+			defer func() {
+				require.NoError(t, worker.Shutdown(ctx))
+			}()
+
+			resp, err := client.GetWorkflowResult[KubeResp](ctx, workflowClient, instance, DefaultWorkflowTimeout)
+			require.NoError(t, err)
+			require.Empty(t, resp.Err, "workflow returned error: %s", resp.Err)
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+			cpr, err := psc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+				Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+				Resource:    &v1.ObjectReference{ObjectType: "namespace", ObjectId: "failover"},
+				Permission:  "view",
+				Subject:     &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+			})
+			require.NoError(t, err)
+			require.Equal(t, v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION, cpr.Permissionship)
+		})
+	}
+}
+
+// nonEmptyMetadata keeps the metadata of workflow instances from being empty.
+// The lua scripts of miniredis encode an empty map as a JSON array, which the
+// redis backend can't decode, while a real redis encodes it as an object.
+type nonEmptyMetadata struct{}
+
+func (nonEmptyMetadata) Inject(_ context.Context, m *workflow.Metadata) error {
+	m.Set("test", "miniredis")
+	return nil
+}
+
+func (nonEmptyMetadata) Extract(ctx context.Context, _ *workflow.Metadata) (context.Context, error) {
+	return ctx, nil
+}
+
+func (nonEmptyMetadata) InjectFromWorkflow(_ workflow.Context, m *workflow.Metadata) error {
+	m.Set("test", "miniredis")
+	return nil
+}
+
+func (nonEmptyMetadata) ExtractToWorkflow(ctx workflow.Context, _ *workflow.Metadata) (workflow.Context, error) {
+	return ctx, nil
+}
@@ -0,0 +1,217 @@
+package distributedtx
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cschleiden/go-workflows/workflow"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog/v2"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+// DeferredUpdate holds relationship templates that can only be resolved once
+// the object has been written to kube, i.e. because kube generates the name
+// or uid of the object. They are resolved against the object returned by
+// kube, and written to SpiceDB before the workflow completes.
+type DeferredUpdate struct {
+	Update proxyrule.Update
+
+	// Object is the serialized object that the templates are resolved
+	// against if kube doesn't return the object, i.e. the existing object
+	// for deletes that return a Status.
+	Object []byte
+
+	// OldObject is the serialized object before the write, which the
+	// templates are resolved against as the oldObject. It is nil for
+	// creates and if the object didn't exist.
+	OldObject []byte
+}
+
+// ResolveRelationshipsInput is the input to the ResolveRelationships
+// activity.
+type ResolveRelationshipsInput struct {
+	RequestInfo *request.RequestInfo
+	UserInfo    *user.DefaultInfo
+	Header      http.Header
+	Body        []byte
+	Update      proxyrule.Update
+
+	// Object is the serialized object returned by kube, and
+	// FallbackObject is used instead if kube didn't return an object.
+	Object         []byte
+	FallbackObject []byte
+
+	// OldObject is the serialized object before the write, if any.
+	OldObject []byte
+}
+
+// ResolveRelationships resolves the relationship templates of a deferred
+// update against the object returned by kube.
+func (h *ActivityHandler) ResolveRelationships(_ context.Context, input *ResolveRelationshipsInput) (*rules.ResolvedUpdate, error) {
+	update, err := rules.CompileUpdate(input.Update)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile deferred update: %w", err)
+	}
+	if update == nil {
+		return &rules.ResolvedUpdate{}, nil
+	}
+
+	var object map[string]any
+	if err := json.Unmarshal(input.Object, &object); err != nil {
+		return nil, fmt.Errorf("unable to decode object returned by kube: %w", err)
+	}
+	if object["kind"] == "Status" && len(input.FallbackObject) > 0 {
+		object = nil
+		if err := json.Unmarshal(input.FallbackObject, &object); err != nil {
+			return nil, fmt.Errorf("unable to decode object: %w", err)
+		}
+	}
+
+	resolveInput := rules.NewResolveInputFromObject(input.RequestInfo, input.UserInfo, object)
+	resolveInput.Body = input.Body
+	resolveInput.Headers = input.Header
+	if len(input.OldObject) > 0 {
+		var oldObject metav1.PartialObjectMetadata
+		if err := json.Unmarshal(input.OldObject, &oldObject); err != nil {
+			return nil, fmt.Errorf("unable to decode existing object: %w", err)
+		}
+		resolveInput.OldObject = &oldObject
+		resolveInput.OldObjectBody = input.OldObject
+	}
+	return update.ResolveWrites(resolveInput)
+}
+
+// writeDeferredRelationships resolves and writes the relationships of a
+// deferred update after the object has been successfully written to kube.
+// If the relationships can't be written, a created object is deleted again,
+// along with the objects of its kube writes, so that the write exists in
+// both SpiceDB and kube, or neither. If kube can't be rolled back, the
+// relationships that were written are kept and the error is returned.
+func writeDeferredRelationships(ctx workflow.Context, input *WriteObjInput, out *KubeResp, kubeWrites []*KubeReqInput) (*KubeResp, error) {
+	instance := workflow.WorkflowInstance(ctx)
+
+	resolved, err := workflow.ExecuteActivity[*rules.ResolvedUpdate](ctx,
+		input.activityOptions(),
+		activityHandler.ResolveRelationships,
+		&ResolveRelationshipsInput{
+			RequestInfo:    input.RequestInfo,
+			UserInfo:       input.UserInfo,
+			Header:         input.Header,
+			Body:           input.Body,
+			Update:         input.DeferredUpdate.Update,
+			Object:         out.Body,
+			FallbackObject: input.DeferredUpdate.Object,
+			OldObject:      input.DeferredUpdate.OldObject,
+		}).Get(ctx)
+	if err != nil {
+		klog.ErrorS(err, "unable to resolve deferred relationships")
+		return rollbackKubeWrites(ctx, input, out, kubeWrites, err)
+	}
+
+	updates := updatesForRelationships(resolved.CreateRelationships, resolved.TouchRelationships, resolved.DeleteRelationships)
+	if input.waitsForRemoval() {
+		if err := awaitRemoval(ctx, input, out, updates, resolved.DeleteByFilter); err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+	written, err := writeUpdates(ctx, input.activityOptions(), instance.InstanceID, nil, updates, resolved.DeleteByFilter, input.MaxUpdatesPerWrite)
+	if err != nil {
+		klog.ErrorS(err, "deferred spicedb write failed")
+		// the relationships that were written are only rolled back if kube
+		// is, otherwise they still belong to the written object
+		resp, err := rollbackKubeWrites(ctx, input, out, kubeWrites, err)
+		if err != nil {
+			return nil, err
+		}
+		NewRollbackRelationships(written...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed deferred SpiceDB write")
+		return resp, nil
+	}
+
+	return out, nil
+}
+
+// compensateKubeWrite undoes a kube write whose relationships couldn't be
+// written. Only creates can be undone, by deleting the created object,
+// which is retried with the backoff of the kube write; the error is
+// returned for any other verb.
+func compensateKubeWrite(ctx workflow.Context, input *WriteObjInput, out *KubeResp, cause error) (*KubeResp, error) {
+	if input.RequestInfo.Verb != "create" {
+		return nil, fmt.Errorf("kube %s succeeded, but relationships could not be written: %w", input.RequestInfo.Verb, cause)
+	}
+
+	var created metav1.PartialObjectMetadata
+	if err := json.Unmarshal(out.Body, &created); err != nil || created.Name == "" {
+		return nil, fmt.Errorf("unable to determine created object to roll back after %w", cause)
+	}
+
+	deleteInput, err := deleteCreatedObjectInput(input.RequestInfo, &created)
+	if err != nil {
+		return nil, err
+	}
+
+	maxAttempts := input.maxKubeAttempts()
+	backoff := input.kubeBackoff()
+	for i := 0; i < maxAttempts; i++ {
+		resp, err := workflow.ExecuteActivity[*KubeResp](ctx,
+			input.activityOptions(),
+			activityHandler.WriteToKube,
+			deleteInput).Get(ctx)
+		if err != nil {
+			klog.V(2).ErrorS(err, "kube delete of created object failed, retrying")
+			if i < maxAttempts-1 {
+				if err := workflow.Sleep(ctx, backoff.Step()); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if !isSuccessfulDelete(resp) {
+			return nil, fmt.Errorf("unable to delete created object %s after failed relationship write: %s", created.Name, resp.Body)
+		}
+
+		klog.V(3).InfoS("deleted created object after failed relationship write", "name", created.Name, "namespace", created.Namespace)
+		return KubeConflict(cause, input), nil
+	}
+
+	return nil, fmt.Errorf("failed to delete created object %s after %d attempts: %w", created.Name, maxAttempts, cause)
+}
+
+// deleteCreatedObjectInput returns the request that deletes an object that
+// was created by the workflow with a request to the collection of the
+// request info, as long as it is still the same object.
+func deleteCreatedObjectInput(createInfo *request.RequestInfo, created *metav1.PartialObjectMetadata) (*KubeReqInput, error) {
+	opts := metav1.DeleteOptions{
+		TypeMeta: metav1.TypeMeta{Kind: "DeleteOptions", APIVersion: "v1"},
+	}
+	if created.UID != "" {
+		opts.Preconditions = metav1.NewUIDPreconditions(string(created.UID))
+	}
+	body, err := json.Marshal(opts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode delete options: %w", err)
+	}
+
+	requestInfo := *createInfo
+	requestInfo.Verb = "delete"
+	requestInfo.Name = created.Name
+	requestInfo.Path = strings.TrimSuffix(createInfo.Path, "/") + "/" + created.Name
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return &KubeReqInput{
+		RequestInfo: &requestInfo,
+		RequestURI:  requestInfo.Path,
+		Header:      header,
+		ObjectMeta:  &created.ObjectMeta,
+		Body:        body,
+	}, nil
+}
@@ -0,0 +1,137 @@
+package distributedtx
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+)
+
+func TestResolveRelationships(t *testing.T) {
+	const pod = `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web","namespace":"default","uid":"c0ffee"}}`
+
+	uidRel := &v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: "pod", ObjectId: "c0ffee"},
+		Relation: "creator",
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+	}
+
+	tests := []struct {
+		name           string
+		verb           string
+		update         proxyrule.Update
+		object         string
+		fallbackObject string
+		oldObject      string
+		wantCreates    []*v1.Relationship
+		wantDeletes    []*v1.Relationship
+		wantErr        string
+	}{
+		{
+			name: "create uses the uid of the returned object",
+			verb: "create",
+			update: proxyrule.Update{
+				CreateRelationships: []proxyrule.StringOrTemplate{{Template: "pod:{{object.metadata.uid}}#creator@user:{{user.name}}"}},
+			},
+			object:      pod,
+			wantCreates: []*v1.Relationship{uidRel},
+		},
+		{
+			name: "delete uses the returned object",
+			verb: "delete",
+			update: proxyrule.Update{
+				DeleteRelationships: []proxyrule.StringOrTemplate{{Template: "pod:{{object.metadata.uid}}#creator@user:{{user.name}}"}},
+			},
+			object:         pod,
+			fallbackObject: `{"metadata":{"name":"web","namespace":"default","uid":"other"}}`,
+			wantDeletes:    []*v1.Relationship{uidRel},
+		},
+		{
+			name: "delete returning a status uses the fallback object",
+			verb: "delete",
+			update: proxyrule.Update{
+				DeleteRelationships: []proxyrule.StringOrTemplate{{Template: "pod:{{object.metadata.uid}}#creator@user:{{user.name}}"}},
+			},
+			object:         `{"apiVersion":"v1","kind":"Status","status":"Success","details":{"name":"web","kind":"pods","uid":"c0ffee"}}`,
+			fallbackObject: pod,
+			wantDeletes:    []*v1.Relationship{uidRel},
+		},
+		{
+			name: "update uses the old object",
+			verb: "update",
+			update: proxyrule.Update{
+				CreateRelationships: []proxyrule.StringOrTemplate{{Template: "pod:{{object.metadata.uid}}#creator@user:{{object.metadata.labels.owner}}"}},
+				DeleteRelationships: []proxyrule.StringOrTemplate{{Template: "pod:{{object.metadata.uid}}#creator@user:{{oldObject.metadata.labels.owner}}"}},
+			},
+			object:      `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web","namespace":"default","uid":"c0ffee","labels":{"owner":"janedoe"}}}`,
+			oldObject:   `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web","namespace":"default","uid":"c0ffee","labels":{"owner":"johndoe"}}}`,
+			wantCreates: []*v1.Relationship{uidRel},
+			wantDeletes: []*v1.Relationship{{
+				Resource: &v1.ObjectReference{ObjectType: "pod", ObjectId: "c0ffee"},
+				Relation: "creator",
+				Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "johndoe"}},
+			}},
+		},
+		{
+			name:   "no relationships",
+			verb:   "create",
+			object: pod,
+		},
+		{
+			name: "invalid template",
+			verb: "create",
+			update: proxyrule.Update{
+				CreateRelationships: []proxyrule.StringOrTemplate{{Template: "pod:{{object.metadata.uid"}},
+			},
+			object:  pod,
+			wantErr: "unable to compile deferred update",
+		},
+		{
+			name: "undecodable object",
+			verb: "create",
+			update: proxyrule.Update{
+				CreateRelationships: []proxyrule.StringOrTemplate{{Template: "pod:{{object.metadata.uid}}#creator@user:{{user.name}}"}},
+			},
+			object:  "not json",
+			wantErr: "unable to decode object returned by kube",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h ActivityHandler
+			input := &ResolveRelationshipsInput{
+				RequestInfo: &request.RequestInfo{Verb: tt.verb, Resource: "pods", Namespace: "default"},
+				UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+				Update:      tt.update,
+				Object:      []byte(tt.object),
+			}
+			if tt.fallbackObject != "" {
+				input.FallbackObject = []byte(tt.fallbackObject)
+			}
+			if tt.oldObject != "" {
+				input.OldObject = []byte(tt.oldObject)
+			}
+
+			resolved, err := h.ResolveRelationships(t.Context(), input)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, resolved.CreateRelationships, len(tt.wantCreates))
+			for i, rel := range tt.wantCreates {
+				require.True(t, rel.EqualVT(resolved.CreateRelationships[i]), "got %s", resolved.CreateRelationships[i])
+			}
+			require.Len(t, resolved.DeleteRelationships, len(tt.wantDeletes))
+			for i, rel := range tt.wantDeletes {
+				require.True(t, rel.EqualVT(resolved.DeleteRelationships[i]), "got %s", resolved.DeleteRelationships[i])
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package distributedtx
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cschleiden/go-workflows/core"
+	"github.com/cschleiden/go-workflows/diag"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+)
+
+// instancesPageSize is the number of workflow instances read per page.
+const instancesPageSize = 100
+
+// LockFilter returns a filter that matches the relationships that workflows
+// write to lock the objects they write to.
+func LockFilter() *v1.RelationshipFilter {
+	return &v1.RelationshipFilter{
+		ResourceType:     lockResourceType,
+		OptionalRelation: lockRelationName,
+		OptionalSubjectFilter: &v1.SubjectFilter{
+			SubjectType: workflowResourceType,
+		},
+	}
+}
+
+// ActiveInstanceIDs returns the IDs of the workflow instances in the backend
+// that haven't finished. Locks held by any other workflow were left behind,
+// e.g. by a workflow that was interrupted and never resumed.
+func ActiveInstanceIDs(ctx context.Context, b diag.Backend) (map[string]struct{}, error) {
+	active := make(map[string]struct{})
+	err := eachInstance(ctx, b, func(instance *diag.WorkflowInstanceRef) error {
+		if instance.State == core.WorkflowInstanceStateActive {
+			active[instance.Instance.InstanceID] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return active, nil
+}
+
+// eachInstance calls fn with every workflow instance in the backend.
+func eachInstance(ctx context.Context, b diag.Backend, fn func(*diag.WorkflowInstanceRef) error) error {
+	var afterInstanceID, afterExecutionID string
+	for {
+		instances, err := b.GetWorkflowInstances(ctx, afterInstanceID, afterExecutionID, instancesPageSize)
+		if err != nil {
+			return fmt.Errorf("unable to list workflow instances: %w", err)
+		}
+		for _, instance := range instances {
+			if err := fn(instance); err != nil {
+				return err
+			}
+		}
+		if len(instances) < instancesPageSize {
+			return nil
+		}
+		last := instances[len(instances)-1].Instance
+		afterInstanceID, afterExecutionID = last.InstanceID, last.ExecutionID
+	}
+}
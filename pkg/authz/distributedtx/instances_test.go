@@ -0,0 +1,47 @@
+package distributedtx
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cschleiden/go-workflows/backend/sqlite"
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/cschleiden/go-workflows/worker"
+	"github.com/cschleiden/go-workflows/workflow"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActiveInstanceIDs(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	b := sqlite.NewInMemoryBackend()
+	c := client.New(b)
+	noop := func(ctx workflow.Context) error { return nil }
+
+	// finish one workflow before the worker is stopped
+	workerCtx, stopWorker := context.WithCancel(ctx)
+	w := worker.New(b, nil)
+	require.NoError(t, w.RegisterWorkflow(noop))
+	require.NoError(t, w.Start(workerCtx))
+	finished, err := c.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{InstanceID: "finished"}, noop)
+	require.NoError(t, err)
+	require.NoError(t, c.WaitForWorkflowInstance(ctx, finished, 5*time.Second))
+	stopWorker()
+	require.NoError(t, w.WaitForCompletion())
+
+	// more instances than fit on one page are still running
+	want := make(map[string]struct{})
+	for i := range instancesPageSize + 1 {
+		id := fmt.Sprintf("running-%d", i)
+		_, err := c.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{InstanceID: id}, noop)
+		require.NoError(t, err)
+		want[id] = struct{}{}
+	}
+
+	active, err := ActiveInstanceIDs(ctx, b)
+	require.NoError(t, err)
+	require.Equal(t, want, active)
+}
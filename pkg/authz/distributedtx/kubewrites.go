@@ -0,0 +1,194 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/cschleiden/go-workflows/workflow"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog/v2"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+// ResolveKubeWritesInput is the input to the ResolveKubeWrites activity.
+type ResolveKubeWritesInput struct {
+	RequestInfo *request.RequestInfo
+	UserInfo    *user.DefaultInfo
+	Header      http.Header
+	Body        []byte
+	KubeWrites  []proxyrule.KubeWrite
+
+	// Response is the serialized object returned by kube for the request.
+	Response []byte
+}
+
+// ResolveKubeWrites resolves the manifests of the kube writes of an update
+// against the request and the object returned by kube, and returns the
+// requests that create them.
+func (h *ActivityHandler) ResolveKubeWrites(_ context.Context, input *ResolveKubeWritesInput) ([]*KubeReqInput, error) {
+	var object metav1.PartialObjectMetadata
+	if err := json.Unmarshal(input.Body, &object); err != nil {
+		// the body of a patch isn't an object, templates can refer to the
+		// response instead
+		object = metav1.PartialObjectMetadata{}
+	}
+	resolveInput := rules.NewResolveInput(input.RequestInfo, input.UserInfo, &object, input.Body, input.Header)
+
+	var response map[string]any
+	if err := json.Unmarshal(input.Response, &response); err != nil {
+		return nil, fmt.Errorf("unable to decode object returned by kube: %w", err)
+	}
+
+	reqs := make([]*KubeReqInput, 0, len(input.KubeWrites))
+	for _, write := range input.KubeWrites {
+		expr, err := rules.CompileKubeWrite(write)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := expr.Resolve(resolveInput, response)
+		if err != nil {
+			return nil, err
+		}
+		body, err := manifest.MarshalJSON()
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode kube write for %s: %w", write.Resource, err)
+		}
+
+		requestInfo := rules.NewRequestInfo("create", expr.GroupVersionResource(manifest), manifest.GetNamespace(), "")
+		header := http.Header{}
+		header.Set("Content-Type", "application/json")
+		reqs = append(reqs, &KubeReqInput{
+			RequestInfo: requestInfo,
+			RequestURI:  requestInfo.Path,
+			Header:      header,
+			ObjectMeta: &metav1.ObjectMeta{
+				Name:         manifest.GetName(),
+				GenerateName: manifest.GetGenerateName(),
+				Namespace:    manifest.GetNamespace(),
+			},
+			Body: body,
+		})
+	}
+	return reqs, nil
+}
+
+// writeKubeWrites creates the objects of the kube writes of the input, after
+// the object of the request has been written to kube. It returns the
+// requests that delete the objects it created again, which deleteKubeWrites
+// sends if the workflow rolls back. Objects that already exist are left as
+// they are.
+func writeKubeWrites(ctx workflow.Context, input *WriteObjInput, out *KubeResp) ([]*KubeReqInput, error) {
+	reqs, err := workflow.ExecuteActivity[[]*KubeReqInput](ctx,
+		input.activityOptions(),
+		activityHandler.ResolveKubeWrites,
+		&ResolveKubeWritesInput{
+			RequestInfo: input.RequestInfo,
+			UserInfo:    input.UserInfo,
+			Header:      input.Header,
+			Body:        input.Body,
+			KubeWrites:  input.KubeWrites,
+			Response:    out.Body,
+		}).Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve kube writes: %w", err)
+	}
+
+	var deletes []*KubeReqInput
+	for _, req := range reqs {
+		resp, err := sendKubeRequest(ctx, input, req)
+		if err != nil {
+			return deletes, fmt.Errorf("unable to create %s %s: %w", req.RequestInfo.Resource, req.ObjectMeta.Name, err)
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+			var created metav1.PartialObjectMetadata
+			if err := json.Unmarshal(resp.Body, &created); err != nil || created.Name == "" {
+				return deletes, fmt.Errorf("unable to determine created %s %s", req.RequestInfo.Resource, req.ObjectMeta.Name)
+			}
+			deleteInput, err := deleteCreatedObjectInput(req.RequestInfo, &created)
+			if err != nil {
+				return deletes, err
+			}
+			deletes = append(deletes, deleteInput)
+			klog.V(3).InfoS("created object of kube write", "resource", req.RequestInfo.Resource, "name", created.Name, "namespace", created.Namespace)
+		case http.StatusConflict:
+			klog.V(3).InfoS("object of kube write already exists", "resource", req.RequestInfo.Resource, "name", req.ObjectMeta.Name, "namespace", req.ObjectMeta.Namespace)
+		default:
+			return deletes, fmt.Errorf("kube rejected %s %s: %s", req.RequestInfo.Resource, req.ObjectMeta.Name, resp.Body)
+		}
+	}
+	return deletes, nil
+}
+
+// deleteKubeWrites deletes the objects that writeKubeWrites created, in
+// reverse order. Objects that can't be deleted are left behind, and
+// returned as an error once the others have been deleted.
+func deleteKubeWrites(ctx workflow.Context, input *WriteObjInput, deletes []*KubeReqInput) error {
+	var errs []error
+	for _, req := range slices.Backward(deletes) {
+		resp, err := sendKubeRequest(ctx, input, req)
+		if err == nil && !isSuccessfulDelete(resp) {
+			err = fmt.Errorf("kube rejected the delete: %s", resp.Body)
+		}
+		if err != nil {
+			klog.ErrorS(err, "unable to delete object of kube write during rollback", "path", req.RequestURI)
+			errs = append(errs, fmt.Errorf("unable to delete %s: %w", req.RequestURI, err))
+			continue
+		}
+		klog.V(3).InfoS("deleted object of kube write during rollback", "path", req.RequestURI)
+	}
+	return errors.Join(errs...)
+}
+
+// sendKubeRequest sends a request to kube with the WriteToKube activity, and
+// retries it until kube responds, at most as often as the input allows.
+func sendKubeRequest(ctx workflow.Context, input *WriteObjInput, req *KubeReqInput) (*KubeResp, error) {
+	maxAttempts := input.maxKubeAttempts()
+	backoff := input.kubeBackoff()
+
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		var resp *KubeResp
+		resp, err = workflow.ExecuteActivity[*KubeResp](ctx,
+			input.activityOptions(),
+			activityHandler.WriteToKube,
+			req).Get(ctx)
+		if err == nil {
+			return resp, nil
+		}
+		klog.V(2).ErrorS(err, "kube request failed, retrying", "verb", req.RequestInfo.Verb, "path", req.RequestURI)
+		if i < maxAttempts-1 {
+			if err := workflow.Sleep(ctx, backoff.Step()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("failed after %d attempts: %w", maxAttempts, err)
+}
+
+// rollbackKubeWrites undoes the write of a workflow whose kube writes
+// couldn't be created: the objects that were created are deleted, and so
+// is the object of the request if it was created.
+//
+// It returns an error if anything that the write changed in kube is left
+// behind, i.e. the object of an update or patch, which can't be undone.
+// The relationships of the write must then be kept, since the object that
+// they belong to still exists.
+func rollbackKubeWrites(ctx workflow.Context, input *WriteObjInput, out *KubeResp, deletes []*KubeReqInput, cause error) (*KubeResp, error) {
+	klog.ErrorS(cause, "kube writes failed, rolling back")
+	if err := deleteKubeWrites(ctx, input, deletes); err != nil {
+		// the object of the request is kept along with the objects of
+		// its kube writes that are left behind
+		return nil, fmt.Errorf("kube %s succeeded, but its kube writes could not be rolled back: %w", input.RequestInfo.Verb, errors.Join(cause, err))
+	}
+	return compensateKubeWrite(ctx, input, out, cause)
+}
@@ -0,0 +1,258 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+func TestResolveKubeWrites(t *testing.T) {
+	reqs, err := (&ActivityHandler{}).ResolveKubeWrites(t.Context(), &ResolveKubeWritesInput{
+		RequestInfo: &request.RequestInfo{Verb: "create", Resource: "namespaces", Path: "/api/v1/namespaces"},
+		UserInfo:    &user.DefaultInfo{Name: "alice"},
+		Body:        []byte(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"team"}}`),
+		Response:    []byte(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"team","uid":"1234"}}`),
+		KubeWrites: []proxyrule.KubeWrite{{
+			Resource: "rolebindings",
+			Template: `{"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "RoleBinding", "metadata": {"name": this.user.name, "namespace": this.response.metadata.name}}`,
+		}},
+	})
+	require.NoError(t, err)
+	require.Len(t, reqs, 1)
+	require.Equal(t, "/apis/rbac.authorization.k8s.io/v1/namespaces/team/rolebindings", reqs[0].RequestURI)
+	require.Equal(t, "create", reqs[0].RequestInfo.Verb)
+	require.Equal(t, "alice", reqs[0].ObjectMeta.Name)
+	require.Equal(t, "team", reqs[0].ObjectMeta.Namespace)
+	require.JSONEq(t, `{"apiVersion":"rbac.authorization.k8s.io/v1","kind":"RoleBinding","metadata":{"name":"alice","namespace":"team"}}`, string(reqs[0].Body))
+}
+
+func TestKubeWrites(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	// kube creates every object with a uid, except role bindings in
+	// namespaces named "rejected-*" or "flaky-*", and network policies,
+	// which exist. The first delete of a "flaky-*" namespace fails.
+	var (
+		mu       sync.Mutex
+		requests []string
+		deletes  []time.Time
+	)
+	kubeClient := &fake.RESTClient{
+		Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			requests = append(requests, req.Method+" "+req.URL.Path)
+			flaky := req.Method == http.MethodDelete && strings.HasPrefix(req.URL.Path, "/api/v1/namespaces/flaky-") && strings.Count(req.URL.Path, "/") == 4
+			if flaky {
+				deletes = append(deletes, time.Now())
+				flaky = len(deletes) == 1
+			}
+			mu.Unlock()
+			if flaky {
+				return nil, errors.New("connection refused")
+			}
+
+			header := http.Header{}
+			header.Set("Content-Type", runtime.ContentTypeJSON)
+			respond := func(code int, body string) (*http.Response, error) {
+				return &http.Response{Header: header, StatusCode: code, Body: io.NopCloser(strings.NewReader(body))}, nil
+			}
+			switch {
+			case req.Method == http.MethodDelete:
+				return respond(http.StatusOK, `{"kind":"Status","status":"Success"}`)
+			case strings.HasSuffix(req.URL.Path, "/rolebindings") && (strings.Contains(req.URL.Path, "/rejected-") || strings.Contains(req.URL.Path, "/flaky-")):
+				return respond(http.StatusForbidden, `{"kind":"Status","status":"Failure","reason":"Forbidden","code":403}`)
+			case strings.HasSuffix(req.URL.Path, "/networkpolicies"):
+				return respond(http.StatusConflict, `{"kind":"Status","status":"Failure","reason":"AlreadyExists","code":409}`)
+			}
+
+			var object map[string]any
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(body, &object))
+			object["metadata"].(map[string]any)["uid"] = uuid.NewString()
+			created, err := json.Marshal(object)
+			require.NoError(t, err)
+			return respond(http.StatusCreated, string(created))
+		}),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+
+	workflowClient, worker, err := SetupWithMemoryBackend(ctx, psc, kubeClient)
+	require.NoError(t, err)
+	require.NoError(t, worker.Start(ctx))
+	defer func() {
+		require.NoError(t, worker.Shutdown(ctx))
+	}()
+
+	hasCreator := func(name string) bool {
+		cpr, err := psc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+			Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+			Resource:    &v1.ObjectReference{ObjectType: "namespace", ObjectId: name},
+			Permission:  "view",
+			Subject:     &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+		})
+		require.NoError(t, err)
+		return cpr.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+	}
+
+	kubeWrites := []proxyrule.KubeWrite{
+		{
+			Resource: "configmaps",
+			Template: `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "owner", "namespace": this.name}, "data": {"uid": this.response.metadata.uid}}`,
+		},
+		{
+			Resource: "networkpolicies",
+			Template: `{"apiVersion": "networking.k8s.io/v1", "kind": "NetworkPolicy", "metadata": {"name": "default", "namespace": this.name}}`,
+		},
+		{
+			Resource: "rolebindings",
+			Template: `{"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "RoleBinding", "metadata": {"name": "admin", "namespace": this.name}}`,
+		},
+	}
+
+	tests := []struct {
+		name string
+		wf   any
+	}{
+		{name: "pessimistic", wf: CurrentWorkflow("PessimisticWriteToSpiceDBAndKube")},
+		{name: "optimistic", wf: CurrentWorkflow("OptimisticWriteToSpiceDBAndKube")},
+		{name: "eventual", wf: CurrentWorkflow("EventualWriteToSpiceDBAndKube")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write := func(name string, retry *RetryPolicy) *KubeResp {
+				mu.Lock()
+				requests = nil
+				deletes = nil
+				mu.Unlock()
+
+				id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+					InstanceID: uuid.NewString(),
+				}, tt.wf, &WriteObjInput{
+					RequestInfo: &request.RequestInfo{Verb: "create", Resource: "namespaces", Path: "/api/v1/namespaces"},
+					RequestURI:  "/api/v1/namespaces",
+					UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+					ObjectMeta:  &metav1.ObjectMeta{Name: name},
+					CreateRelationships: []*v1.Relationship{{
+						Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: name},
+						Relation: "creator",
+						Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+					}},
+					Body:       []byte(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"` + name + `"}}`),
+					KubeWrites: kubeWrites,
+					Retry:      retry,
+				})
+				require.NoError(t, err)
+				resp, err := client.GetWorkflowResult[KubeResp](ctx, workflowClient, id, DefaultWorkflowTimeout)
+				require.NoError(t, err)
+				return &resp
+			}
+			sent := func() []string {
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]string(nil), requests...)
+			}
+
+			// the kube writes are created after the namespace
+			name := tt.name + "-created"
+			resp := write(name, nil)
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			require.Equal(t, []string{
+				"POST /api/v1/namespaces",
+				"POST /api/v1/namespaces/" + name + "/configmaps",
+				"POST /apis/networking.k8s.io/v1/namespaces/" + name + "/networkpolicies",
+				"POST /apis/rbac.authorization.k8s.io/v1/namespaces/" + name + "/rolebindings",
+			}, sent())
+			require.Eventually(t, func() bool {
+				return hasCreator(name)
+			}, 5*time.Second, 10*time.Millisecond)
+
+			// if a kube write fails, the objects that were created are
+			// deleted again, but the network policy that existed is kept
+			name = "rejected-" + tt.name
+			resp = write(name, nil)
+			require.Equal(t, http.StatusConflict, resp.StatusCode)
+			require.Equal(t, []string{
+				"POST /api/v1/namespaces",
+				"POST /api/v1/namespaces/" + name + "/configmaps",
+				"POST /apis/networking.k8s.io/v1/namespaces/" + name + "/networkpolicies",
+				"POST /apis/rbac.authorization.k8s.io/v1/namespaces/" + name + "/rolebindings",
+				"DELETE /api/v1/namespaces/" + name + "/configmaps/owner",
+				"DELETE /api/v1/namespaces/" + name,
+			}, sent())
+			require.False(t, hasCreator(name))
+
+			// the update of an object can't be undone, so if its kube
+			// writes fail, the relationships are kept and the error is
+			// returned
+			name = "rejected-update-" + tt.name
+			mu.Lock()
+			requests = nil
+			mu.Unlock()
+			id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+				InstanceID: uuid.NewString(),
+			}, tt.wf, &WriteObjInput{
+				RequestInfo: &request.RequestInfo{Verb: "update", Resource: "namespaces", Name: name, Path: "/api/v1/namespaces/" + name},
+				RequestURI:  "/api/v1/namespaces/" + name,
+				UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+				ObjectMeta:  &metav1.ObjectMeta{Name: name},
+				TouchRelationships: []*v1.Relationship{{
+					Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: name},
+					Relation: "creator",
+					Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+				}},
+				Body:       []byte(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"` + name + `"}}`),
+				KubeWrites: kubeWrites,
+			})
+			require.NoError(t, err)
+			_, err = client.GetWorkflowResult[KubeResp](ctx, workflowClient, id, DefaultWorkflowTimeout)
+			require.ErrorContains(t, err, "kube update succeeded")
+			require.Equal(t, []string{
+				"PUT /api/v1/namespaces/" + name,
+				"POST /api/v1/namespaces/" + name + "/configmaps",
+				"POST /apis/networking.k8s.io/v1/namespaces/" + name + "/networkpolicies",
+				"POST /apis/rbac.authorization.k8s.io/v1/namespaces/" + name + "/rolebindings",
+				"DELETE /api/v1/namespaces/" + name + "/configmaps/owner",
+			}, sent())
+			require.Eventually(t, func() bool {
+				return hasCreator(name)
+			}, 5*time.Second, 10*time.Millisecond)
+
+			// a failed delete of the created namespace is retried with the
+			// backoff of the kube write
+			name = "flaky-" + tt.name
+			resp = write(name, &RetryPolicy{KubeBackoff: 200 * time.Millisecond, MaxActivityAttempts: 1})
+			require.Equal(t, http.StatusConflict, resp.StatusCode)
+			mu.Lock()
+			attempts := append([]time.Time(nil), deletes...)
+			mu.Unlock()
+			require.Len(t, attempts, 2)
+			require.GreaterOrEqual(t, attempts[1].Sub(attempts[0]), 150*time.Millisecond)
+			require.False(t, hasCreator(name))
+		})
+	}
+}
@@ -0,0 +1,610 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/cschleiden/go-workflows/workflow"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+)
+
+const (
+	LockBackendSpiceDB = "SpiceDB"
+	LockBackendLease   = "Lease"
+
+	// LockGranularityObjectVerb locks an object for writes with the same
+	// verb, LockGranularityObject for writes with any verb, and
+	// LockGranularityNamespace locks every object in its namespace.
+	LockGranularityObjectVerb = "ObjectVerb"
+	LockGranularityObject     = "Object"
+	LockGranularityNamespace  = "Namespace"
+
+	// DefaultLockTTL is how long a lock is held before it expires and
+	// another workflow may take it. Workflows renew their locks between
+	// their steps, so the TTL only has to outlast the longest step. Locks
+	// aren't held while a delete waits for the removal of its object.
+	DefaultLockTTL = 5 * time.Minute
+
+	// DefaultLeaseNamespace is the namespace of the leases of lease locks.
+	DefaultLeaseNamespace = "kube-system"
+
+	leaseNamePrefix = "spicedb-kubeapi-proxy-lock-"
+
+	// sweepChunkSize is the number of locks deleted per write.
+	sweepChunkSize = 100
+)
+
+// ErrLocked is returned when another workflow holds the lock on an object.
+var ErrLocked = errors.New("the object is locked by another write")
+
+// ErrLockLost is returned when a workflow renews a lock that it doesn't hold
+// anymore, i.e. because the lock expired and another workflow took it over.
+var ErrLockLost = errors.New("the lock on the object was lost")
+
+// Lock is the lock that a pessimistic workflow holds on an object while it
+// writes it.
+type Lock struct {
+	// Key identifies the locked object, see LockKey.
+	Key string
+
+	// Holder is the id of the workflow that holds the lock.
+	Holder string
+}
+
+// LockBackend stores the locks of pessimistic workflows.
+type LockBackend interface {
+	// Acquire takes the lock for its holder. It returns ErrLocked if another
+	// workflow holds the lock, and succeeds if the holder already holds it,
+	// so that it can be retried.
+	Acquire(ctx context.Context, lock *Lock) error
+
+	// Release gives up the lock if its holder still holds it.
+	Release(ctx context.Context, lock *Lock) error
+
+	// Renew extends the lock of a holder that still holds it by its TTL,
+	// so that workflows that run longer than the TTL keep their lock. It
+	// returns ErrLockLost if the holder doesn't hold the lock anymore.
+	Renew(ctx context.Context, lock *Lock) error
+
+	// Held returns whether any workflow holds the lock with the key, i.e.
+	// whether acquiring it would fail with ErrLocked.
+	Held(ctx context.Context, key string) (bool, error)
+
+	// Sweep removes the locks that were left behind, i.e. by workflows that
+	// crashed, and returns how many it removed. Locks without a TTL are left
+	// behind if their holder isn't one of the active workflows.
+	Sweep(ctx context.Context, active ActiveWorkflows) (int, error)
+}
+
+// ActiveWorkflows returns the ids of the workflows that haven't finished.
+type ActiveWorkflows func(ctx context.Context) (map[string]struct{}, error)
+
+// LockKey returns the key of the lock that a workflow takes on the object
+// of the input, according to the LockGranularity of the input.
+func LockKey(input *WriteObjInput, workflowID string) string {
+	// Delete names come from the request, Create names come from the object
+	// TODO: this could benefit from an objectid helper shared with bloblang
+	name := input.RequestInfo.Name
+	if input.ObjectMeta != nil {
+		name = input.ObjectMeta.Name
+	}
+	if name == "" && input.ObjectMeta != nil && input.ObjectMeta.GenerateName != "" {
+		// kube generates a unique name, so creates with generated names
+		// never conflict with each other
+		name = input.ObjectMeta.GenerateName + workflowID
+	}
+
+	var lockKey string
+	switch granularity := input.LockGranularity; {
+	case granularity == LockGranularityNamespace && input.RequestInfo.Namespace != "":
+		lockKey = "namespace/" + input.RequestInfo.Namespace
+	case granularity == LockGranularityObject, granularity == LockGranularityNamespace:
+		// the path of a create ends in the resource and the path of a
+		// delete in the name, so the object is identified without it
+		lockKey = "object/" + input.RequestInfo.APIGroup + "/" + input.RequestInfo.Resource + "/" + input.RequestInfo.Namespace + "/" + name
+	default:
+		lockKey = input.RequestInfo.Path + "/" + name + "/" + input.RequestInfo.Verb
+	}
+	return fmt.Sprintf("%x", xxhash.Sum64String(lockKey))
+}
+
+// AcquireLock takes the lock on an object. A lock held by another workflow
+// fails the activity without retries.
+func (h *ActivityHandler) AcquireLock(ctx context.Context, lock *Lock) error {
+	err := h.Locks.Acquire(ctx, lock)
+	if errors.Is(err, ErrLocked) {
+		return workflow.NewPermanentError(err)
+	}
+	return err
+}
+
+// ReleaseLock gives up the lock on an object.
+func (h *ActivityHandler) ReleaseLock(ctx context.Context, lock *Lock) error {
+	return h.Locks.Release(ctx, lock)
+}
+
+// RenewLock extends the lock on an object. A lock that was lost fails the
+// activity without retries.
+func (h *ActivityHandler) RenewLock(ctx context.Context, lock *Lock) error {
+	err := h.Locks.Renew(ctx, lock)
+	if errors.Is(err, ErrLockLost) {
+		return workflow.NewPermanentError(err)
+	}
+	return err
+}
+
+// renewLock renews the lock of a workflow before a step that needs it.
+func renewLock(ctx workflow.Context, input *WriteObjInput, lock *Lock) error {
+	_, err := workflow.ExecuteActivity[any](ctx,
+		input.activityOptions(),
+		activityHandler.RenewLock,
+		lock).Get(ctx)
+	return err
+}
+
+// releaseLock releases the lock of a workflow. Locks that can't be released
+// are left behind, drift detection reports them.
+func releaseLock(ctx workflow.Context, lock *Lock) {
+	_, err := workflow.ExecuteActivity[any](ctx,
+		workflow.DefaultActivityOptions,
+		activityHandler.ReleaseLock,
+		lock).Get(ctx)
+	if err != nil {
+		klog.ErrorS(err, "unable to release lock", "key", lock.Key, "holder", lock.Holder)
+	}
+}
+
+// SpiceDBLockBackend stores locks as lock:<key>#workflow@workflow:<holder>
+// relationships. The schema needs the lock and workflow definitions.
+//
+// If TTL is set, the relationships expire after it, which needs
+// `use expiration` and a `workflow with expiration` relation in the schema.
+type SpiceDBLockBackend struct {
+	PermissionClient v1.PermissionsServiceClient
+	TTL              time.Duration
+}
+
+func (b *SpiceDBLockBackend) Acquire(ctx context.Context, lock *Lock) error {
+	rel := lockRel(lock)
+	if b.TTL > 0 {
+		rel.OptionalExpiresAt = timestamppb.New(time.Now().Add(b.TTL))
+	}
+	_, err := b.PermissionClient.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{
+		OptionalPreconditions: []*v1.Precondition{resourceLockDoesNotExist(rel)},
+		Updates: []*v1.RelationshipUpdate{{
+			Operation:    v1.RelationshipUpdate_OPERATION_CREATE,
+			Relationship: rel,
+		}},
+	})
+	if err == nil {
+		return nil
+	}
+
+	// the lock may have been written by an earlier attempt whose response
+	// was lost
+	held, _, relErr := isRelExists(ctx, b.PermissionClient, rel)
+	if relErr != nil {
+		return relErr
+	}
+	if held {
+		return nil
+	}
+	if s, ok := status.FromError(err); ok && s.Code() == codes.FailedPrecondition {
+		return fmt.Errorf("%w: %w", ErrLocked, err)
+	}
+	return err
+}
+
+func (b *SpiceDBLockBackend) Release(ctx context.Context, lock *Lock) error {
+	_, err := b.PermissionClient.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{
+		Updates: []*v1.RelationshipUpdate{{
+			Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
+			Relationship: lockRel(lock),
+		}},
+	})
+	return err
+}
+
+// Renew moves the expiration of the lock relationship to the TTL from now,
+// if the holder still holds the lock. SpiceDB ignores expired relationships,
+// so a lock that expired can't be renewed. Without a TTL, locks don't expire,
+// and Renew only checks that the holder still holds the lock.
+func (b *SpiceDBLockBackend) Renew(ctx context.Context, lock *Lock) error {
+	rel := lockRel(lock)
+	if b.TTL <= 0 {
+		held, _, err := isRelExists(ctx, b.PermissionClient, rel)
+		if err != nil {
+			return err
+		}
+		if !held {
+			return fmt.Errorf("%w: lock %s is not held by workflow %s", ErrLockLost, lock.Key, lock.Holder)
+		}
+		return nil
+	}
+
+	rel.OptionalExpiresAt = timestamppb.New(time.Now().Add(b.TTL))
+	_, err := b.PermissionClient.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{
+		OptionalPreconditions: []*v1.Precondition{resourceLockHeld(rel)},
+		Updates: []*v1.RelationshipUpdate{{
+			Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
+			Relationship: rel,
+		}},
+	})
+	if s, ok := status.FromError(err); ok && s.Code() == codes.FailedPrecondition {
+		return fmt.Errorf("%w: lock %s is not held by workflow %s: %w", ErrLockLost, lock.Key, lock.Holder, err)
+	}
+	return err
+}
+
+// Held reads whether a lock relationship with the key exists. SpiceDB
+// ignores expired relationships, so expired locks aren't held.
+func (b *SpiceDBLockBackend) Held(ctx context.Context, key string) (bool, error) {
+	filter := LockFilter()
+	filter.OptionalResourceId = key
+	stream, err := b.PermissionClient.ReadRelationships(ctx, &v1.ReadRelationshipsRequest{
+		Consistency: &v1.Consistency{
+			Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true},
+		},
+		RelationshipFilter: filter,
+		OptionalLimit:      1,
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to read lock %s: %w", key, err)
+	}
+	_, err = stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to read lock %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// Sweep deletes the lock relationships without an expiration whose holder
+// isn't active. SpiceDB ignores expired relationships, so they need no
+// sweeping.
+func (b *SpiceDBLockBackend) Sweep(ctx context.Context, active ActiveWorkflows) (int, error) {
+	// the locks are read before the active workflows, so that a lock taken
+	// in between isn't deleted
+	stream, err := b.PermissionClient.ReadRelationships(ctx, &v1.ReadRelationshipsRequest{
+		Consistency: &v1.Consistency{
+			Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true},
+		},
+		RelationshipFilter: LockFilter(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to read locks: %w", err)
+	}
+	var locks []*v1.Relationship
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("unable to read locks: %w", err)
+		}
+		if resp.Relationship.OptionalExpiresAt == nil {
+			locks = append(locks, resp.Relationship)
+		}
+	}
+	if len(locks) == 0 {
+		return 0, nil
+	}
+
+	workflows, err := active(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var updates []*v1.RelationshipUpdate
+	for _, rel := range locks {
+		if _, ok := workflows[rel.Subject.Object.ObjectId]; ok {
+			continue
+		}
+		updates = append(updates, &v1.RelationshipUpdate{
+			Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
+			Relationship: rel,
+		})
+	}
+	for chunk := range slices.Chunk(updates, sweepChunkSize) {
+		if _, err := b.PermissionClient.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: chunk}); err != nil {
+			return 0, fmt.Errorf("unable to delete locks: %w", err)
+		}
+	}
+	return len(updates), nil
+}
+
+// LeaseLockBackend stores locks as coordination.k8s.io/v1 Leases, so that
+// locks need no definitions in the schema. A lease that isn't released
+// expires after its TTL, and the next workflow takes it over.
+type LeaseLockBackend struct {
+	KubeClient rest.Interface
+	Namespace  string
+	TTL        time.Duration
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+func (b *LeaseLockBackend) Acquire(ctx context.Context, lock *Lock) error {
+	now := metav1.NewMicroTime(b.clock())
+	lease := &coordinationv1.Lease{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"},
+		ObjectMeta: metav1.ObjectMeta{Name: leaseNamePrefix + lock.Key, Namespace: b.namespace()},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       ptr.To(lock.Holder),
+			LeaseDurationSeconds: ptr.To(int32(b.ttl().Seconds())),
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}
+
+	code, _, err := b.do(ctx, b.KubeClient.Post().AbsPath(b.leasesPath()), lease)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case http.StatusCreated, http.StatusOK:
+		return nil
+	case http.StatusConflict:
+	default:
+		return fmt.Errorf("unable to create lease %s: status %d", lease.Name, code)
+	}
+
+	existing, err := b.get(ctx, lease.Name)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		// released in the meantime, the next attempt may take it
+		return fmt.Errorf("lease %s was released while it was acquired", lease.Name)
+	}
+	if ptr.Deref(existing.Spec.HolderIdentity, "") == lock.Holder {
+		return nil
+	}
+	if !leaseExpired(existing, now.Time) {
+		return fmt.Errorf("%w: lease %s is held by workflow %s", ErrLocked, lease.Name, ptr.Deref(existing.Spec.HolderIdentity, ""))
+	}
+
+	// the holder abandoned the lease, it is taken over. The resource version
+	// makes sure that only one workflow does.
+	klog.V(2).InfoS("taking over expired lease lock", "lease", lease.Name, "holder", ptr.Deref(existing.Spec.HolderIdentity, ""))
+	lease.ResourceVersion = existing.ResourceVersion
+	code, _, err = b.do(ctx, b.KubeClient.Put().AbsPath(b.leasesPath(), lease.Name), lease)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return fmt.Errorf("%w: lease %s was taken over by another workflow", ErrLocked, lease.Name)
+	default:
+		return fmt.Errorf("unable to take over lease %s: status %d", lease.Name, code)
+	}
+}
+
+func (b *LeaseLockBackend) Release(ctx context.Context, lock *Lock) error {
+	name := leaseNamePrefix + lock.Key
+	existing, err := b.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	if existing == nil || ptr.Deref(existing.Spec.HolderIdentity, "") != lock.Holder {
+		return nil
+	}
+
+	// the precondition keeps a lease that was taken over in the meantime
+	code, _, err := b.do(ctx, b.KubeClient.Delete().AbsPath(b.leasesPath(), name), &metav1.DeleteOptions{
+		TypeMeta:      metav1.TypeMeta{APIVersion: "v1", Kind: "DeleteOptions"},
+		Preconditions: &metav1.Preconditions{ResourceVersion: &existing.ResourceVersion},
+	})
+	if err != nil {
+		return err
+	}
+	switch code {
+	case http.StatusOK, http.StatusAccepted, http.StatusNotFound, http.StatusConflict:
+		return nil
+	default:
+		return fmt.Errorf("unable to delete lease %s: status %d", name, code)
+	}
+}
+
+// Renew sets the renew time of the lease to now, and its duration to the
+// TTL. A lease that expired is renewed as well, as long as no other workflow
+// took it over.
+func (b *LeaseLockBackend) Renew(ctx context.Context, lock *Lock) error {
+	name := leaseNamePrefix + lock.Key
+	existing, err := b.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	if existing == nil || ptr.Deref(existing.Spec.HolderIdentity, "") != lock.Holder {
+		return fmt.Errorf("%w: lease %s is not held by workflow %s", ErrLockLost, name, lock.Holder)
+	}
+
+	// the resource version makes sure that the lease wasn't taken over in
+	// the meantime
+	now := metav1.NewMicroTime(b.clock())
+	existing.TypeMeta = metav1.TypeMeta{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+	existing.Spec.RenewTime = &now
+	existing.Spec.LeaseDurationSeconds = ptr.To(int32(b.ttl().Seconds()))
+	code, _, err := b.do(ctx, b.KubeClient.Put().AbsPath(b.leasesPath(), name), existing)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return fmt.Errorf("%w: lease %s was changed by another workflow", ErrLockLost, name)
+	default:
+		return fmt.Errorf("unable to renew lease %s: status %d", name, code)
+	}
+}
+
+// Held returns whether the lease with the key exists and hasn't expired.
+// Expired leases are taken over by the next workflow, so they aren't held.
+func (b *LeaseLockBackend) Held(ctx context.Context, key string) (bool, error) {
+	existing, err := b.get(ctx, leaseNamePrefix+key)
+	if err != nil {
+		return false, err
+	}
+	return existing != nil && !leaseExpired(existing, b.clock()), nil
+}
+
+// Sweep deletes the leases that expired. Leases always have a TTL, so the
+// active workflows aren't needed.
+func (b *LeaseLockBackend) Sweep(ctx context.Context, _ ActiveWorkflows) (int, error) {
+	code, body, err := b.do(ctx, b.KubeClient.Get().AbsPath(b.leasesPath()), nil)
+	if err != nil {
+		return 0, err
+	}
+	if code != http.StatusOK {
+		return 0, fmt.Errorf("unable to list leases in %s: status %d", b.namespace(), code)
+	}
+	var leases coordinationv1.LeaseList
+	if err := json.Unmarshal(body, &leases); err != nil {
+		return 0, fmt.Errorf("unable to decode leases: %w", err)
+	}
+
+	now := b.clock()
+	swept := 0
+	for _, lease := range leases.Items {
+		if !strings.HasPrefix(lease.Name, leaseNamePrefix) || !leaseExpired(&lease, now) {
+			continue
+		}
+		// the precondition keeps a lease that was taken over in the meantime
+		code, _, err := b.do(ctx, b.KubeClient.Delete().AbsPath(b.leasesPath(), lease.Name), &metav1.DeleteOptions{
+			TypeMeta:      metav1.TypeMeta{APIVersion: "v1", Kind: "DeleteOptions"},
+			Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+		})
+		if err != nil {
+			return swept, err
+		}
+		if code == http.StatusOK || code == http.StatusAccepted {
+			klog.V(2).InfoS("deleted expired lease lock", "lease", lease.Name, "holder", ptr.Deref(lease.Spec.HolderIdentity, ""))
+			swept++
+		}
+	}
+	return swept, nil
+}
+
+// get returns the lease with the name, or nil if it doesn't exist.
+func (b *LeaseLockBackend) get(ctx context.Context, name string) (*coordinationv1.Lease, error) {
+	code, body, err := b.do(ctx, b.KubeClient.Get().AbsPath(b.leasesPath(), name), nil)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unable to get lease %s: status %d", name, code)
+	}
+
+	var lease coordinationv1.Lease
+	if err := json.Unmarshal(body, &lease); err != nil {
+		return nil, fmt.Errorf("unable to decode lease %s: %w", name, err)
+	}
+	return &lease, nil
+}
+
+// do sends the request with the body, if any, and returns the status code
+// and body of the response. Responses with an error status are returned
+// without an error, so that callers can tell conflicts apart.
+func (b *LeaseLockBackend) do(ctx context.Context, req *rest.Request, body any) (int, []byte, error) {
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		req = req.SetHeader("Content-Type", "application/json").Body(data)
+	}
+
+	var code int
+	raw, err := req.Do(ctx).StatusCode(&code).Raw()
+	if err == nil {
+		return code, raw, nil
+	}
+	var apiStatus k8serrors.APIStatus
+	if errors.As(err, &apiStatus) {
+		return int(apiStatus.Status().Code), raw, nil
+	}
+	return 0, nil, err
+}
+
+func (b *LeaseLockBackend) leasesPath() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + b.namespace() + "/leases"
+}
+
+func (b *LeaseLockBackend) namespace() string {
+	if b.Namespace == "" {
+		return DefaultLeaseNamespace
+	}
+	return b.Namespace
+}
+
+func (b *LeaseLockBackend) ttl() time.Duration {
+	if b.TTL <= 0 {
+		return DefaultLockTTL
+	}
+	return b.TTL
+}
+
+func (b *LeaseLockBackend) clock() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+	return b.now()
+}
+
+// leaseExpired returns whether the holder of the lease didn't renew it
+// within its duration.
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	renewed := lease.Spec.RenewTime
+	if renewed == nil {
+		renewed = lease.Spec.AcquireTime
+	}
+	if renewed == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// lockRel returns the relationship that stores the lock in SpiceDB.
+func lockRel(lock *Lock) *v1.Relationship {
+	return &v1.Relationship{
+		Resource: &v1.ObjectReference{
+			ObjectType: lockResourceType,
+			ObjectId:   lock.Key,
+		},
+		Relation: lockRelationName,
+		Subject: &v1.SubjectReference{
+			Object: &v1.ObjectReference{
+				ObjectType: workflowResourceType,
+				ObjectId:   lock.Holder,
+			},
+		},
+	}
+}
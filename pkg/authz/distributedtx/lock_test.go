@@ -0,0 +1,500 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cschleiden/go-workflows/backend/sqlite"
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/cschleiden/go-workflows/workflow"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest/fake"
+	"k8s.io/utils/ptr"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+func TestSpiceDBLockBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	testLockBackend(t, &SpiceDBLockBackend{PermissionClient: spicedbtest.NewPermissionsClient(ctx, t)})
+}
+
+func TestLockKey(t *testing.T) {
+	key := func(granularity, verb, namespace, name string) string {
+		info := &request.RequestInfo{
+			Verb:      verb,
+			Resource:  "configmaps",
+			Namespace: namespace,
+			Path:      "/api/v1/namespaces/" + namespace + "/configmaps",
+		}
+		if verb == "delete" {
+			info.Name = name
+			info.Path += "/" + name
+			return LockKey(&WriteObjInput{RequestInfo: info, LockGranularity: granularity}, "")
+		}
+		return LockKey(&WriteObjInput{RequestInfo: info, ObjectMeta: &metav1.ObjectMeta{Name: name}, LockGranularity: granularity}, "")
+	}
+
+	tests := []struct {
+		name        string
+		granularity string
+		a, b        [3]string
+		wantSame    bool
+	}{
+		{
+			name:        "object verb: verbs of an object differ",
+			granularity: LockGranularityObjectVerb,
+			a:           [3]string{"create", "default", "a"},
+			b:           [3]string{"delete", "default", "a"},
+			wantSame:    false,
+		},
+		{
+			name:        "default is object verb",
+			granularity: "",
+			a:           [3]string{"create", "default", "a"},
+			b:           [3]string{"delete", "default", "a"},
+			wantSame:    false,
+		},
+		{
+			name:        "object: verbs of an object are the same",
+			granularity: LockGranularityObject,
+			a:           [3]string{"create", "default", "a"},
+			b:           [3]string{"delete", "default", "a"},
+			wantSame:    true,
+		},
+		{
+			name:        "object: objects differ",
+			granularity: LockGranularityObject,
+			a:           [3]string{"create", "default", "a"},
+			b:           [3]string{"create", "default", "b"},
+			wantSame:    false,
+		},
+		{
+			name:        "namespace: objects of a namespace are the same",
+			granularity: LockGranularityNamespace,
+			a:           [3]string{"create", "default", "a"},
+			b:           [3]string{"delete", "default", "b"},
+			wantSame:    true,
+		},
+		{
+			name:        "namespace: namespaces differ",
+			granularity: LockGranularityNamespace,
+			a:           [3]string{"create", "default", "a"},
+			b:           [3]string{"create", "other", "a"},
+			wantSame:    false,
+		},
+		{
+			name:        "namespace: cluster scoped objects are locked by object",
+			granularity: LockGranularityNamespace,
+			a:           [3]string{"create", "", "a"},
+			b:           [3]string{"create", "", "b"},
+			wantSame:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := key(tt.granularity, tt.a[0], tt.a[1], tt.a[2])
+			b := key(tt.granularity, tt.b[0], tt.b[1], tt.b[2])
+			if tt.wantSame {
+				require.Equal(t, a, b)
+			} else {
+				require.NotEqual(t, a, b)
+			}
+		})
+	}
+
+	// the default keeps the keys of locks taken before granularities existed
+	require.Equal(t,
+		key(LockGranularityObjectVerb, "create", "default", "a"),
+		key("", "create", "default", "a"),
+	)
+}
+
+func TestSpiceDBLockBackendTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	locks := &SpiceDBLockBackend{PermissionClient: spicedbtest.NewPermissionsClient(ctx, t), TTL: time.Second}
+	require.NoError(t, locks.Acquire(ctx, &Lock{Key: "abandoned", Holder: "crashed"}))
+	require.ErrorIs(t, locks.Acquire(ctx, &Lock{Key: "abandoned", Holder: "next"}), ErrLocked)
+
+	// the lock of a crashed holder expires without a sweep
+	require.Eventually(t, func() bool {
+		return locks.Acquire(ctx, &Lock{Key: "abandoned", Holder: "next"}) == nil
+	}, 10*time.Second, 100*time.Millisecond)
+	require.ErrorIs(t, locks.Renew(ctx, &Lock{Key: "abandoned", Holder: "crashed"}), ErrLockLost)
+
+	// a renewed lock outlives its TTL
+	renewed := &Lock{Key: "renewed", Holder: "slow"}
+	require.NoError(t, locks.Acquire(ctx, renewed))
+	for range 4 {
+		time.Sleep(500 * time.Millisecond)
+		require.NoError(t, locks.Renew(ctx, renewed))
+	}
+	require.ErrorIs(t, locks.Acquire(ctx, &Lock{Key: "renewed", Holder: "next"}), ErrLocked)
+
+	// locks of others aren't renewed
+	require.ErrorIs(t, locks.Renew(ctx, &Lock{Key: "renewed", Holder: "next"}), ErrLockLost)
+	require.ErrorIs(t, locks.Acquire(ctx, &Lock{Key: "renewed", Holder: "next"}), ErrLocked)
+}
+
+func TestLockSweeper(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	// no worker runs, so the instance stays active
+	b := sqlite.NewInMemoryBackend()
+	_, err := client.New(b).CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{InstanceID: "running"}, func(ctx workflow.Context) error { return nil })
+	require.NoError(t, err)
+
+	locks := &SpiceDBLockBackend{PermissionClient: psc}
+	expiring := &SpiceDBLockBackend{PermissionClient: psc, TTL: time.Hour}
+	require.NoError(t, locks.Acquire(ctx, &Lock{Key: "running", Holder: "running"}))
+	require.NoError(t, locks.Acquire(ctx, &Lock{Key: "crashed", Holder: "crashed"}))
+	require.NoError(t, expiring.Acquire(ctx, &Lock{Key: "expiring", Holder: "crashed"}))
+
+	sweeper := NewLockSweeper(locks, b, 0)
+	swept, err := sweeper.Sweep(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, swept)
+
+	// only the lock of the crashed workflow without an expiration is gone
+	require.NoError(t, locks.Acquire(ctx, &Lock{Key: "crashed", Holder: "next"}))
+	require.ErrorIs(t, locks.Acquire(ctx, &Lock{Key: "running", Holder: "next"}), ErrLocked)
+	require.ErrorIs(t, locks.Acquire(ctx, &Lock{Key: "expiring", Holder: "next"}), ErrLocked)
+
+	// the lock taken by next belongs to no workflow either
+	swept, err = sweeper.Sweep(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, swept)
+}
+
+func TestLeaseLockBackendSweep(t *testing.T) {
+	now := time.Now()
+	leases := newLeaseServer(t)
+	locks := &LeaseLockBackend{
+		KubeClient: leases.client(),
+		Namespace:  "locks",
+		TTL:        time.Minute,
+		now:        func() time.Time { return now },
+	}
+	ctx := t.Context()
+
+	require.NoError(t, locks.Acquire(ctx, &Lock{Key: "old", Holder: "crashed"}))
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, locks.Acquire(ctx, &Lock{Key: "new", Holder: "running"}))
+	// leases of others are left alone, even once expired
+	leases.mu.Lock()
+	leases.leases["leader"] = &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "leader", ResourceVersion: "0"},
+		Spec:       coordinationv1.LeaseSpec{HolderIdentity: ptr.To("controller")},
+	}
+	leases.mu.Unlock()
+
+	swept, err := locks.Sweep(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, swept)
+	require.ElementsMatch(t, []string{leaseNamePrefix + "new", "leader"}, leases.names())
+}
+
+func TestLeaseLockBackend(t *testing.T) {
+	now := time.Now()
+	locks := &LeaseLockBackend{
+		KubeClient: newLeaseServer(t).client(),
+		Namespace:  "locks",
+		TTL:        time.Minute,
+		now:        func() time.Time { return now },
+	}
+	testLockBackend(t, locks)
+
+	// an abandoned lease is taken over once it expires
+	ctx := t.Context()
+	abandoned := &Lock{Key: "abandoned", Holder: "crashed"}
+	require.NoError(t, locks.Acquire(ctx, abandoned))
+	require.ErrorIs(t, locks.Acquire(ctx, &Lock{Key: "abandoned", Holder: "next"}), ErrLocked)
+
+	now = now.Add(2 * time.Minute)
+	held, err := locks.Held(ctx, "abandoned")
+	require.NoError(t, err)
+	require.False(t, held, "expired leases aren't held")
+	require.NoError(t, locks.Acquire(ctx, &Lock{Key: "abandoned", Holder: "next"}))
+	require.ErrorIs(t, locks.Acquire(ctx, &Lock{Key: "abandoned", Holder: "other"}), ErrLocked)
+
+	// the crashed holder doesn't release the lease that was taken over
+	require.NoError(t, locks.Release(ctx, abandoned))
+	require.ErrorIs(t, locks.Acquire(ctx, &Lock{Key: "abandoned", Holder: "other"}), ErrLocked)
+
+	// nor can it renew it
+	require.ErrorIs(t, locks.Renew(ctx, abandoned), ErrLockLost)
+
+	// a renewed lease outlives its TTL
+	renewed := &Lock{Key: "renewed", Holder: "slow"}
+	require.NoError(t, locks.Acquire(ctx, renewed))
+	now = now.Add(45 * time.Second)
+	require.NoError(t, locks.Renew(ctx, renewed))
+	now = now.Add(45 * time.Second)
+	require.ErrorIs(t, locks.Acquire(ctx, &Lock{Key: "renewed", Holder: "next"}), ErrLocked)
+	require.NoError(t, locks.Renew(ctx, renewed))
+}
+
+// testLockBackend checks the behavior that every LockBackend shares.
+func testLockBackend(t *testing.T, locks LockBackend) {
+	ctx := t.Context()
+	first := &Lock{Key: "object", Holder: "first"}
+	second := &Lock{Key: "object", Holder: "second"}
+
+	held, err := locks.Held(ctx, "object")
+	require.NoError(t, err)
+	require.False(t, held)
+
+	require.NoError(t, locks.Acquire(ctx, first))
+	held, err = locks.Held(ctx, "object")
+	require.NoError(t, err)
+	require.True(t, held)
+	// acquiring again succeeds, so that activities can be retried
+	require.NoError(t, locks.Acquire(ctx, first))
+	require.ErrorIs(t, locks.Acquire(ctx, second), ErrLocked)
+
+	// other objects aren't locked
+	require.NoError(t, locks.Acquire(ctx, &Lock{Key: "other", Holder: "second"}))
+
+	// only the holder releases the lock
+	require.NoError(t, locks.Release(ctx, second))
+	require.ErrorIs(t, locks.Acquire(ctx, second), ErrLocked)
+
+	// only the holder renews the lock
+	require.NoError(t, locks.Renew(ctx, first))
+	require.ErrorIs(t, locks.Renew(ctx, second), ErrLockLost)
+
+	require.NoError(t, locks.Release(ctx, first))
+	require.NoError(t, locks.Release(ctx, first))
+	require.ErrorIs(t, locks.Renew(ctx, first), ErrLockLost)
+	held, err = locks.Held(ctx, "object")
+	require.NoError(t, err)
+	require.False(t, held)
+	require.NoError(t, locks.Acquire(ctx, second))
+}
+
+func TestWorkflowLeaseLock(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	leases := newLeaseServer(t)
+	locks := &LeaseLockBackend{KubeClient: leases.client(), Namespace: "locks"}
+
+	workflowClient, worker, err := SetupWithMemoryBackend(ctx, psc, leases.client())
+	require.NoError(t, err)
+	worker.SetLockBackend(locks)
+	require.NoError(t, worker.Start(ctx))
+	defer func() {
+		require.NoError(t, worker.Shutdown(ctx))
+	}()
+
+	write := func(name string, retry *RetryPolicy) *KubeResp {
+		id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+			InstanceID: uuid.NewString(),
+		}, CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"), &WriteObjInput{
+			RequestInfo: &request.RequestInfo{Verb: "create", Resource: "namespaces", Path: "/api/v1/namespaces"},
+			RequestURI:  "/api/v1/namespaces",
+			UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+			ObjectMeta:  &metav1.ObjectMeta{Name: name},
+			CreateRelationships: []*v1.Relationship{{
+				Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: name},
+				Relation: "creator",
+				Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+			}},
+			Body:  []byte(`{"metadata":{"name":"` + name + `"}}`),
+			Retry: retry,
+		})
+		require.NoError(t, err)
+		resp, err := client.GetWorkflowResult[KubeResp](ctx, workflowClient, id, DefaultWorkflowTimeout)
+		require.NoError(t, err)
+		return &resp
+	}
+
+	// the lease is released once the write is complete
+	require.Equal(t, http.StatusCreated, write("free", nil).StatusCode)
+	require.Empty(t, leases.names())
+
+	// a held lease fails the write without writing relationships
+	held := &Lock{
+		Key: LockKey(&WriteObjInput{
+			RequestInfo: &request.RequestInfo{Verb: "create", Path: "/api/v1/namespaces"},
+			ObjectMeta:  &metav1.ObjectMeta{Name: "held"},
+		}, ""),
+		Holder: "other",
+	}
+	require.NoError(t, locks.Acquire(ctx, held))
+	resp := write("held", nil)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.Contains(t, string(resp.Body), ErrLocked.Error())
+	require.Equal(t, []string{leaseNamePrefix + held.Key}, leases.names())
+
+	canView := func(name string) bool {
+		cpr, err := psc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+			Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+			Resource:    &v1.ObjectReference{ObjectType: "namespace", ObjectId: name},
+			Permission:  "view",
+			Subject:     &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+		})
+		require.NoError(t, err)
+		return cpr.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+	}
+	require.False(t, canView("held"))
+
+	// a lease that is taken over while kube is retried fails the write
+	// before the next attempt, and rolls back its relationships
+	var attempts int
+	leases.kube = func(req *http.Request) (*http.Response, error) {
+		attempts++
+		for _, lease := range leases.leases {
+			lease.Spec.HolderIdentity = ptr.To("other")
+			lease.ResourceVersion += "-taken"
+		}
+		return nil, errors.New("connection refused")
+	}
+	resp = write("stolen", &RetryPolicy{KubeBackoff: time.Millisecond, MaxActivityAttempts: 1})
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.Contains(t, string(resp.Body), ErrLockLost.Error())
+	require.Equal(t, 1, attempts)
+	require.False(t, canView("stolen"))
+}
+
+// leaseServer fakes the leases of a kube API server. Other requests are
+// answered as successful creates.
+type leaseServer struct {
+	t       *testing.T
+	mu      sync.Mutex
+	version int
+	leases  map[string]*coordinationv1.Lease
+
+	// kube answers the requests that aren't for leases, while the server
+	// is locked. Without it, they are answered as successful creates.
+	kube func(req *http.Request) (*http.Response, error)
+}
+
+func newLeaseServer(t *testing.T) *leaseServer {
+	return &leaseServer{t: t, leases: make(map[string]*coordinationv1.Lease)}
+}
+
+func (s *leaseServer) client() *fake.RESTClient {
+	return &fake.RESTClient{
+		Client:               fake.CreateHTTPClient(s.handle),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+}
+
+func (s *leaseServer) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.leases))
+	for name := range s.leases {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (s *leaseServer) handle(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(req.URL.Path, "/apis/coordination.k8s.io/v1/namespaces/locks/leases") {
+		if s.kube != nil {
+			return s.kube(req)
+		}
+		return s.respond(http.StatusCreated, `{}`), nil
+	}
+
+	var lease coordinationv1.Lease
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(s.t, err)
+		if req.Method != http.MethodDelete {
+			require.NoError(s.t, json.Unmarshal(body, &lease))
+		}
+	}
+
+	if req.Method == http.MethodGet && path.Base(req.URL.Path) == "leases" {
+		list := coordinationv1.LeaseList{}
+		for _, lease := range s.leases {
+			list.Items = append(list.Items, *lease)
+		}
+		body, err := json.Marshal(list)
+		require.NoError(s.t, err)
+		return s.respond(http.StatusOK, string(body)), nil
+	}
+
+	name := path.Base(req.URL.Path)
+	existing, exists := s.leases[name]
+	switch req.Method {
+	case http.MethodGet:
+		if !exists {
+			return s.respond(http.StatusNotFound, `{}`), nil
+		}
+		return s.respondLease(http.StatusOK, existing), nil
+	case http.MethodPost:
+		if _, exists := s.leases[lease.Name]; exists {
+			return s.respond(http.StatusConflict, `{}`), nil
+		}
+		return s.store(http.StatusCreated, &lease), nil
+	case http.MethodPut:
+		if !exists || existing.ResourceVersion != lease.ResourceVersion {
+			return s.respond(http.StatusConflict, `{}`), nil
+		}
+		return s.store(http.StatusOK, &lease), nil
+	case http.MethodDelete:
+		if !exists {
+			return s.respond(http.StatusNotFound, `{}`), nil
+		}
+		delete(s.leases, name)
+		return s.respond(http.StatusOK, `{}`), nil
+	}
+	return s.respond(http.StatusMethodNotAllowed, `{}`), nil
+}
+
+func (s *leaseServer) store(code int, lease *coordinationv1.Lease) *http.Response {
+	s.version++
+	lease.ResourceVersion = strconv.Itoa(s.version)
+	s.leases[lease.Name] = lease
+	return s.respondLease(code, lease)
+}
+
+func (s *leaseServer) respondLease(code int, lease *coordinationv1.Lease) *http.Response {
+	body, err := json.Marshal(lease)
+	require.NoError(s.t, err)
+	return s.respond(code, string(body))
+}
+
+func (s *leaseServer) respond(code int, body string) *http.Response {
+	header := http.Header{}
+	header.Set("Content-Type", runtime.ContentTypeJSON)
+	return &http.Response{
+		Header:     header,
+		StatusCode: code,
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
@@ -0,0 +1,283 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cschleiden/go-workflows/backend"
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/cschleiden/go-workflows/core"
+	"github.com/cschleiden/go-workflows/diag"
+	"github.com/cschleiden/go-workflows/workflow"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+const (
+	StrategyEventualWriteToSpiceDBAndKube = "Eventual"
+
+	// MaxOutboxRetryInterval is the longest time between two attempts to
+	// apply the relationships of an outbox entry.
+	MaxOutboxRetryInterval = time.Minute
+
+	outboxInstanceSuffix = "-outbox"
+)
+
+// OutboxRetryInterval is the time between the first two attempts to apply
+// the relationships of an outbox entry. It doubles after every attempt, up
+// to MaxOutboxRetryInterval.
+var OutboxRetryInterval = time.Second
+
+// OutboxInput is the input to the ApplyRelationships workflow, an entry of
+// the outbox of relationship updates that are applied after kube has been
+// written.
+type OutboxInput struct {
+	Preconditions  []*v1.Precondition
+	Updates        []*v1.RelationshipUpdate
+	DeleteByFilter []*v1.RelationshipFilter
+
+	// MaxUpdatesPerWrite is the size of the chunks the updates are written
+	// in, see WriteObjInput.
+	MaxUpdatesPerWrite int
+}
+
+// EventualWriteToSpiceDBAndKube writes to kube first, and then puts the
+// relationship updates into the outbox, which is applied to SpiceDB in the
+// background by the ApplyRelationships workflow. The kube response is
+// returned as soon as the updates are in the outbox, so SpiceDB lags behind
+// kube until they are applied.
+func EventualWriteToSpiceDBAndKube(ctx workflow.Context, input *WriteObjInput) (*KubeResp, error) {
+	if err := input.validate(); err != nil {
+		return nil, fmt.Errorf("invalid input to EventualWriteToSpiceDBAndKube: %w", err)
+	}
+
+	instance := workflow.WorkflowInstance(ctx)
+	maxAttempts := input.maxKubeAttempts()
+	backoff := input.kubeBackoff()
+
+	var (
+		out *KubeResp
+		err error
+	)
+	for i := 0; i < maxAttempts; i++ {
+		out, err = workflow.ExecuteActivity[*KubeResp](ctx,
+			input.activityOptions(),
+			activityHandler.WriteToKube,
+			input.toKubeReqInput()).Get(ctx)
+		if err == nil {
+			break
+		}
+		klog.V(2).ErrorS(err, "kube write failed, retrying")
+		if err := workflow.Sleep(ctx, backoff.Step()); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to communicate with kubernetes after %d attempts: %w", maxAttempts, err)
+	}
+
+	// nothing is written to SpiceDB if kube didn't write the object. A
+	// create that conflicts is someone else's object.
+	if input.RequestInfo.Verb == "delete" {
+		if !isSuccessfulDelete(out) {
+			return out, nil
+		}
+	} else if !isWrittenToKube(out) {
+		return out, nil
+	}
+
+	// nothing has been written to SpiceDB yet, so only kube is rolled back
+	// if the kube writes fail. If kube can't be rolled back, the
+	// relationships of the written object are queued anyway, and the error
+	// is returned once they are.
+	var kubeWritesErr error
+	if input.hasKubeWrites(out) {
+		kubeWrites, err := writeKubeWrites(ctx, input, out)
+		if err != nil {
+			resp, err := rollbackKubeWrites(ctx, input, out, kubeWrites, err)
+			if err == nil {
+				return resp, nil
+			}
+			kubeWritesErr = err
+		}
+	}
+
+	outbox := &OutboxInput{
+		Preconditions:  input.Preconditions,
+		Updates:        updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships),
+		DeleteByFilter: input.DeleteByFilter,
+
+		MaxUpdatesPerWrite: input.MaxUpdatesPerWrite,
+	}
+	if input.DeferredUpdate != nil {
+		resolved, err := workflow.ExecuteActivity[*rules.ResolvedUpdate](ctx,
+			input.activityOptions(),
+			activityHandler.ResolveRelationships,
+			&ResolveRelationshipsInput{
+				RequestInfo:    input.RequestInfo,
+				UserInfo:       input.UserInfo,
+				Header:         input.Header,
+				Body:           input.Body,
+				Update:         input.DeferredUpdate.Update,
+				Object:         out.Body,
+				FallbackObject: input.DeferredUpdate.Object,
+			}).Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("kube %s succeeded, but relationships could not be resolved: %w", input.RequestInfo.Verb, err)
+		}
+		outbox.Updates = updatesForRelationships(resolved.CreateRelationships, resolved.TouchRelationships, resolved.DeleteRelationships)
+		outbox.DeleteByFilter = resolved.DeleteByFilter
+	}
+
+	if input.waitsForRemoval() {
+		return out, awaitRemoval(ctx, input, out, outbox.Updates, outbox.DeleteByFilter)
+	}
+
+	_, err = workflow.ExecuteActivity[any](ctx,
+		input.activityOptions(),
+		activityHandler.StartOutbox,
+		outbox, instance.InstanceID).Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("kube %s succeeded, but relationships could not be queued: %w", input.RequestInfo.Verb, err)
+	}
+	if kubeWritesErr != nil {
+		return nil, kubeWritesErr
+	}
+	return out, nil
+}
+
+// ApplyRelationships applies an outbox entry to SpiceDB. Failed writes are
+// retried until they succeed, unless SpiceDB rejects them, i.e. because a
+// precondition doesn't hold.
+//
+// Timers are persisted by the workflow backend, so an entry that is
+// interrupted by a restart of the proxy is applied once it is back.
+func ApplyRelationships(ctx workflow.Context, input *OutboxInput) error {
+	instance := workflow.WorkflowInstance(ctx)
+	interval := OutboxRetryInterval
+
+	for {
+		err := applyOutbox(ctx, instance.InstanceID, input)
+		if err == nil {
+			return nil
+		}
+		if isRejectedBySpiceDB(err) {
+			klog.ErrorS(err, "unrecoverable error when applying relationships from the outbox")
+			return fmt.Errorf("unable to apply relationships: %w", err)
+		}
+		klog.V(2).ErrorS(err, "unable to apply relationships from the outbox, retrying", "interval", interval)
+
+		if err := workflow.Sleep(ctx, interval); err != nil {
+			return err
+		}
+		interval = min(interval*2, MaxOutboxRetryInterval)
+	}
+}
+
+func applyOutbox(ctx workflow.Context, workflowID string, input *OutboxInput) error {
+	// chunks that were written before a failure are skipped by their
+	// idempotency keys when the entry is retried, and relationships that
+	// were deleted by a filter don't match it anymore
+	_, err := writeUpdates(ctx, workflow.DefaultActivityOptions, workflowID, input.Preconditions, input.Updates, input.DeleteByFilter, input.MaxUpdatesPerWrite)
+	return err
+}
+
+// isRejectedBySpiceDB returns whether SpiceDB rejected a write, so that
+// retrying it can't succeed. Activity errors only keep the message of the
+// gRPC status once they are persisted, so the code is matched in it.
+func isRejectedBySpiceDB(err error) bool {
+	for _, code := range []codes.Code{codes.InvalidArgument, codes.FailedPrecondition} {
+		if strings.Contains(err.Error(), "code = "+code.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// StartOutbox starts the ApplyRelationships workflow for a write. The
+// instance id is derived from the id of the write workflow, so that the
+// activity can be retried without queueing the updates twice.
+func (h *ActivityHandler) StartOutbox(ctx context.Context, input *OutboxInput, workflowID string) error {
+	_, err := h.WorkflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+		InstanceID: OutboxInstanceID(workflowID),
+	}, CurrentWorkflow("ApplyRelationships"), input)
+	if errors.Is(err, backend.ErrInstanceAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+// OutboxInstanceID returns the instance id of the ApplyRelationships
+// workflow that is started by the write workflow with the given id.
+func OutboxInstanceID(workflowID string) string {
+	return workflowID + outboxInstanceSuffix
+}
+
+// OutboxLag returns the number of outbox entries that haven't been applied
+// yet, and how long ago the oldest of them was queued.
+func OutboxLag(ctx context.Context, b diag.Backend, now time.Time) (int, time.Duration, error) {
+	var (
+		pending int
+		lag     time.Duration
+	)
+	err := eachInstance(ctx, b, func(instance *diag.WorkflowInstanceRef) error {
+		if instance.State != core.WorkflowInstanceStateActive || !strings.HasSuffix(instance.Instance.InstanceID, outboxInstanceSuffix) {
+			return nil
+		}
+		pending++
+		lag = max(lag, now.Sub(instance.CreatedAt))
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return pending, lag, nil
+}
+
+// outboxCollector reports the outbox lag whenever metrics are collected.
+type outboxCollector struct {
+	backend diag.Backend
+	pending *prometheus.Desc
+	lag     *prometheus.Desc
+}
+
+// NewOutboxCollector returns a collector for the pending entries of the
+// outbox of the Eventual lock mode and the age of the oldest of them.
+func NewOutboxCollector(b backend.Backend) (prometheus.Collector, error) {
+	diagBackend, ok := b.(diag.Backend)
+	if !ok {
+		return nil, fmt.Errorf("workflow backend %T doesn't support listing workflows", b)
+	}
+	return &outboxCollector{
+		backend: diagBackend,
+		pending: prometheus.NewDesc("spicedb_kubeapi_proxy_outbox_pending",
+			"The number of relationship updates that are written to kube, but not yet to SpiceDB.", nil, nil),
+		lag: prometheus.NewDesc("spicedb_kubeapi_proxy_outbox_lag_seconds",
+			"How long ago the oldest relationship update that is not yet written to SpiceDB was queued.", nil, nil),
+	}, nil
+}
+
+func (c *outboxCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.pending
+	ch <- c.lag
+}
+
+func (c *outboxCollector) Collect(ch chan<- prometheus.Metric) {
+	pending, lag, err := OutboxLag(context.Background(), c.backend, time.Now())
+	if err != nil {
+		klog.ErrorS(err, "unable to determine outbox lag")
+		ch <- prometheus.NewInvalidMetric(c.pending, err)
+		ch <- prometheus.NewInvalidMetric(c.lag, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(pending))
+	ch <- prometheus.MustNewConstMetric(c.lag, prometheus.GaugeValue, lag.Seconds())
+}
@@ -0,0 +1,208 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cschleiden/go-workflows/backend/sqlite"
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/cschleiden/go-workflows/diag"
+	"github.com/cschleiden/go-workflows/workflow"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+func TestEventualWorkflow(t *testing.T) {
+	const invalid = `{"kind":"Status","apiVersion":"v1","status":"Failure","message":"namespace is invalid","reason":"Invalid","code":422}`
+
+	tests := []struct {
+		name           string
+		object         string
+		wantStatusCode int
+		wantOutbox     bool
+	}{
+		{
+			name:           "kube write succeeds",
+			object:         "written",
+			wantStatusCode: http.StatusCreated,
+			wantOutbox:     true,
+		},
+		{
+			name:           "kube write is rejected",
+			object:         "rejected",
+			wantStatusCode: http.StatusUnprocessableEntity,
+			wantOutbox:     false,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	kubeClient := &fake.RESTClient{
+		Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Set("Content-Type", runtime.ContentTypeJSON)
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			if strings.Contains(string(body), "rejected") {
+				return &http.Response{
+					Header:     header,
+					StatusCode: http.StatusUnprocessableEntity,
+					Body:       io.NopCloser(strings.NewReader(invalid)),
+				}, nil
+			}
+			return &http.Response{
+				Header:     header,
+				StatusCode: http.StatusCreated,
+				Body:       io.NopCloser(strings.NewReader(`{"hi":"myfriend"}`)),
+			}, nil
+		}),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+
+	workflowClient, worker, err := SetupWithMemoryBackend(ctx, psc, kubeClient)
+	require.NoError(t, err)
+	require.NoError(t, worker.Start(ctx))
+	defer func() {
+		require.NoError(t, worker.Shutdown(ctx))
+	}()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+				InstanceID: uuid.NewString(),
+			}, CurrentWorkflow("EventualWriteToSpiceDBAndKube"), &WriteObjInput{
+				RequestInfo: &request.RequestInfo{Verb: "create", Resource: "namespaces", Path: "/api/v1/namespaces"},
+				RequestURI:  "/api/v1/namespaces",
+				UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+				ObjectMeta:  &metav1.ObjectMeta{Name: tt.object},
+				CreateRelationships: []*v1.Relationship{{
+					Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: tt.object},
+					Relation: "creator",
+					Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+				}},
+				Body: []byte(`{"metadata":{"name":"` + tt.object + `"}}`),
+			})
+			require.NoError(t, err)
+
+			resp, err := client.GetWorkflowResult[KubeResp](ctx, workflowClient, id, DefaultWorkflowTimeout)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatusCode, resp.StatusCode)
+
+			queued := false
+			require.NoError(t, eachInstance(ctx, worker.Backend().(diag.Backend), func(instance *diag.WorkflowInstanceRef) error {
+				queued = queued || instance.Instance.InstanceID == OutboxInstanceID(id.InstanceID)
+				return nil
+			}))
+			require.Equal(t, tt.wantOutbox, queued)
+			if !tt.wantOutbox {
+				return
+			}
+
+			require.Eventually(t, func() bool {
+				cpr, err := psc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+					Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+					Resource:    &v1.ObjectReference{ObjectType: "namespace", ObjectId: tt.object},
+					Permission:  "view",
+					Subject:     &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+				})
+				require.NoError(t, err)
+				return cpr.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestApplyRelationshipsRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	workflowClient, worker, err := SetupWithMemoryBackend(ctx, psc, &fake.RESTClient{})
+	require.NoError(t, err)
+	require.NoError(t, worker.Start(ctx))
+	defer func() {
+		require.NoError(t, worker.Shutdown(ctx))
+	}()
+
+	id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+		InstanceID: OutboxInstanceID(uuid.NewString()),
+	}, CurrentWorkflow("ApplyRelationships"), &OutboxInput{
+		Preconditions: []*v1.Precondition{{
+			Operation: v1.Precondition_OPERATION_MUST_MATCH,
+			Filter:    &v1.RelationshipFilter{ResourceType: "namespace", OptionalResourceId: "missing"},
+		}},
+		Updates: []*v1.RelationshipUpdate{{
+			Operation: v1.RelationshipUpdate_OPERATION_TOUCH,
+			Relationship: &v1.Relationship{
+				Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: "outbox"},
+				Relation: "creator",
+				Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+			},
+		}},
+	})
+	require.NoError(t, err)
+
+	// a failed precondition is not retried
+	_, err = client.GetWorkflowResult[any](ctx, workflowClient, id, DefaultWorkflowTimeout)
+	require.ErrorContains(t, err, "unable to apply relationships")
+}
+
+func TestIsRejectedBySpiceDB(t *testing.T) {
+	require.True(t, isRejectedBySpiceDB(errors.New("rpc error: code = FailedPrecondition desc = unable to satisfy write precondition")))
+	require.True(t, isRejectedBySpiceDB(errors.New("rpc error: code = InvalidArgument desc = object definition `foo` not found")))
+	require.False(t, isRejectedBySpiceDB(errors.New("rpc error: code = Unavailable desc = connection refused")))
+}
+
+func TestOutboxLag(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	b := sqlite.NewInMemoryBackend()
+	c := client.New(b)
+	noop := func(ctx workflow.Context) error { return nil }
+
+	collector, err := NewOutboxCollector(b)
+	require.NoError(t, err)
+	require.Equal(t, 2, testutil.CollectAndCount(collector))
+
+	pending, lag, err := OutboxLag(ctx, b, time.Now())
+	require.NoError(t, err)
+	require.Zero(t, pending)
+	require.Zero(t, lag)
+
+	// no worker runs, so the instances stay pending
+	for _, id := range []string{OutboxInstanceID("first"), OutboxInstanceID("second"), "other"} {
+		_, err := c.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{InstanceID: id}, noop)
+		require.NoError(t, err)
+	}
+
+	pending, lag, err = OutboxLag(ctx, b, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 2, pending)
+	require.GreaterOrEqual(t, lag, time.Minute)
+	require.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP spicedb_kubeapi_proxy_outbox_pending The number of relationship updates that are written to kube, but not yet to SpiceDB.
+# TYPE spicedb_kubeapi_proxy_outbox_pending gauge
+spicedb_kubeapi_proxy_outbox_pending 2
+`), "spicedb_kubeapi_proxy_outbox_pending"))
+}
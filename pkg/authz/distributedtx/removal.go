@@ -0,0 +1,226 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cschleiden/go-workflows/backend"
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/cschleiden/go-workflows/workflow"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+)
+
+const (
+	// DefaultRemovalTimeout is how long a delete waits for kube to remove
+	// the object if WaitForRemoval doesn't specify a timeout.
+	DefaultRemovalTimeout = 10 * time.Minute
+
+	// MaxRemovalPollInterval is the longest time between two checks of
+	// whether a deleted object has been removed.
+	MaxRemovalPollInterval = 30 * time.Second
+)
+
+// RemovalPollInterval is the time between the first two checks of whether a
+// deleted object has been removed, or an admitted write persisted. It
+// doubles after every check, up to MaxRemovalPollInterval.
+var RemovalPollInterval = time.Second
+
+// WaitForRemoval configures a delete to write its relationships only once
+// kube has removed the object, instead of as soon as kube accepts the delete.
+type WaitForRemoval struct {
+	Timeout time.Duration
+
+	// UID is the uid of the object when the delete was authorized, if it
+	// existed. It identifies the deleted object if kube doesn't return it,
+	// so that an object that reuses its name isn't taken for it.
+	UID string
+}
+
+// AwaitRemovalInput is the input to the AwaitRemoval workflow.
+type AwaitRemovalInput struct {
+	// Path is the kube API path of the deleted object, and UID its uid if it
+	// is known. An object with the same name but a different uid is a new
+	// object, and the deleted one counts as removed. So is an object that
+	// isn't being deleted if the uid isn't known.
+	Path string
+	UID  string
+
+	// Preconditions are checked with the first chunk of updates, see
+	// WriteObjInput.
+	Preconditions  []*v1.Precondition
+	Updates        []*v1.RelationshipUpdate
+	DeleteByFilter []*v1.RelationshipFilter
+	Timeout        time.Duration
+
+	// MaxUpdatesPerWrite is the size of the chunks the updates are written
+	// in, see WriteObjInput.
+	MaxUpdatesPerWrite int
+}
+
+// RemovalInput is the input to the IsRemovedFromKube activity.
+type RemovalInput struct {
+	Path string
+	UID  string
+}
+
+// AwaitRemoval polls kube until a deleted object has been removed, and then
+// writes the relationship updates of the delete. If the object still exists
+// after the timeout, the relationships are kept and the workflow returns
+// false.
+//
+// Timers are persisted by the workflow backend, so a wait that is
+// interrupted by a restart of the proxy resumes where it left off.
+func AwaitRemoval(ctx workflow.Context, input *AwaitRemovalInput) (bool, error) {
+	instance := workflow.WorkflowInstance(ctx)
+	removed, err := pollKube(ctx, input.Timeout, activityHandler.IsRemovedFromKube, &RemovalInput{Path: input.Path, UID: input.UID}, input.Path)
+	if err != nil {
+		return false, err
+	}
+	if !removed {
+		klog.InfoS("object was not removed before the timeout, keeping its relationships", "path", input.Path, "timeout", input.Timeout)
+		return false, nil
+	}
+
+	written, err := writeUpdates(ctx, workflow.DefaultActivityOptions, instance.InstanceID, input.Preconditions, input.Updates, input.DeleteByFilter, input.MaxUpdatesPerWrite)
+	if err != nil {
+		return false, fmt.Errorf("unable to write relationships after object was removed: %w", err)
+	}
+
+	if len(written) > 0 {
+		klog.V(3).InfoS("wrote relationships after object was removed", "path", input.Path, "count", len(written))
+	}
+	return true, nil
+}
+
+// pollKube runs an activity that checks the state of the object at path in
+// kube until it returns true, or until the timeout passes, in which case it
+// returns false. The checks are RemovalPollInterval apart at first, and the
+// interval doubles after every check, up to MaxRemovalPollInterval.
+func pollKube(ctx workflow.Context, timeout time.Duration, activity, input any, path string) (bool, error) {
+	deadline := workflow.Now(ctx).Add(timeout)
+	interval := RemovalPollInterval
+
+	for {
+		done, err := workflow.ExecuteActivity[bool](ctx,
+			workflow.DefaultActivityOptions,
+			activity,
+			input).Get(ctx)
+		if err != nil {
+			klog.V(2).ErrorS(err, "unable to check object in kube, retrying", "path", path)
+		} else if done {
+			return true, nil
+		}
+
+		if !workflow.Now(ctx).Before(deadline) {
+			return false, nil
+		}
+
+		if err := workflow.Sleep(ctx, interval); err != nil {
+			return false, err
+		}
+		interval = min(interval*2, MaxRemovalPollInterval)
+	}
+}
+
+// awaitRemoval starts the AwaitRemoval workflow for the relationship
+// updates of a delete that kube has accepted.
+func awaitRemoval(ctx workflow.Context, input *WriteObjInput, out *KubeResp, updates []*v1.RelationshipUpdate, filters []*v1.RelationshipFilter) error {
+	instance := workflow.WorkflowInstance(ctx)
+
+	timeout := input.WaitForRemoval.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRemovalTimeout
+	}
+
+	var uid string
+	if out != nil {
+		uid = deletedObjectUID(out.Body)
+	}
+	if uid == "" {
+		uid = input.WaitForRemoval.UID
+	}
+
+	_, err := workflow.ExecuteActivity[any](ctx,
+		input.activityOptions(),
+		activityHandler.StartAwaitRemoval,
+		&AwaitRemovalInput{
+			Path:           input.RequestInfo.Path,
+			UID:            uid,
+			Updates:        updates,
+			DeleteByFilter: filters,
+			Timeout:        timeout,
+
+			MaxUpdatesPerWrite: input.MaxUpdatesPerWrite,
+		}, instance.InstanceID).Get(ctx)
+	if err != nil {
+		return fmt.Errorf("kube delete succeeded, but waiting for the object to be removed failed: %w", err)
+	}
+	return nil
+}
+
+// deletedObjectUID returns the uid of the object that kube returned for a
+// delete, either as the object itself or in the details of a Status.
+func deletedObjectUID(body []byte) string {
+	var obj metav1.PartialObjectMetadata
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return ""
+	}
+	if obj.Kind != "Status" {
+		return string(obj.UID)
+	}
+
+	var status metav1.Status
+	if err := json.Unmarshal(body, &status); err != nil || status.Details == nil {
+		return ""
+	}
+	return string(status.Details.UID)
+}
+
+// StartAwaitRemoval starts the AwaitRemoval workflow for a delete. The
+// instance id is derived from the id of the delete workflow, so that the
+// activity can be retried without starting the wait twice.
+func (h *ActivityHandler) StartAwaitRemoval(ctx context.Context, input *AwaitRemovalInput, workflowID string) error {
+	_, err := h.WorkflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+		InstanceID: AwaitRemovalInstanceID(workflowID),
+	}, CurrentWorkflow("AwaitRemoval"), input)
+	if errors.Is(err, backend.ErrInstanceAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+// AwaitRemovalInstanceID returns the instance id of the AwaitRemoval
+// workflow that is started by the delete workflow with the given id.
+func AwaitRemovalInstanceID(workflowID string) string {
+	return workflowID + "-await-removal"
+}
+
+// IsRemovedFromKube returns whether a deleted object has been removed from
+// kube. Kube marks an object as being deleted before it accepts the delete,
+// so an object with the same name that isn't marked replaced the deleted
+// one.
+func (h *ActivityHandler) IsRemovedFromKube(ctx context.Context, input *RemovalInput) (bool, error) {
+	body, err := h.KubeClient.Get().RequestURI(input.Path).Do(ctx).Raw()
+	if k8serrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var obj metav1.PartialObjectMetadata
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return false, fmt.Errorf("unable to decode object: %w", err)
+	}
+	if input.UID == "" {
+		return obj.DeletionTimestamp == nil, nil
+	}
+	return string(obj.UID) != input.UID, nil
+}
@@ -0,0 +1,189 @@
+package distributedtx
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+const terminatingPod = `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web","namespace":"default","uid":"c0ffee","finalizers":["example.com/cleanup"],"deletionTimestamp":"2025-01-01T00:00:00Z"}}`
+
+func TestIsRemovedFromKube(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		uid     string
+		want    bool
+		wantErr bool
+	}{
+		{name: "not found", status: http.StatusNotFound, body: `{"kind":"Status","code":404}`, uid: "c0ffee", want: true},
+		{name: "terminating", status: http.StatusOK, body: terminatingPod, uid: "c0ffee", want: false},
+		{name: "recreated", status: http.StatusOK, body: terminatingPod, uid: "decaf", want: true},
+		{name: "unknown uid", status: http.StatusOK, body: terminatingPod, want: false},
+		{name: "recreated with unknown uid", status: http.StatusOK, body: `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web","namespace":"default","uid":"decaf"}}`, want: true},
+		{name: "error", status: http.StatusInternalServerError, body: `{}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ah := ActivityHandler{KubeClient: &fake.RESTClient{
+				Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+					require.Equal(t, http.MethodGet, req.Method)
+					require.Equal(t, "/api/v1/namespaces/default/pods/web", req.URL.Path)
+					header := http.Header{}
+					header.Set("Content-Type", runtime.ContentTypeJSON)
+					return &http.Response{
+						Header:     header,
+						StatusCode: tt.status,
+						Body:       io.NopCloser(strings.NewReader(tt.body)),
+					}, nil
+				}),
+				NegotiatedSerializer: &serializer.CodecFactory{},
+			}}
+
+			removed, err := ah.IsRemovedFromKube(t.Context(), &RemovalInput{Path: "/api/v1/namespaces/default/pods/web", UID: tt.uid})
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, removed)
+		})
+	}
+}
+
+func TestDeletedObjectUID(t *testing.T) {
+	require.Equal(t, "c0ffee", deletedObjectUID([]byte(terminatingPod)))
+	require.Equal(t, "c0ffee", deletedObjectUID([]byte(`{"kind":"Status","status":"Success","details":{"name":"web","kind":"pods","uid":"c0ffee"}}`)))
+	require.Empty(t, deletedObjectUID([]byte(`{"kind":"Status","status":"Success"}`)))
+	require.Empty(t, deletedObjectUID(nil))
+}
+
+func TestWorkflowWaitForRemoval(t *testing.T) {
+	interval := RemovalPollInterval
+	RemovalPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { RemovalPollInterval = interval })
+
+	for name, workflowFunc := range map[string]string{
+		StrategyPessimisticWriteToSpiceDBAndKube: CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"),
+		StrategyOptimisticWriteToSpiceDBAndKube:  CurrentWorkflow("OptimisticWriteToSpiceDBAndKube"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+
+			psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+			var removed atomic.Bool
+			kubeClient := &fake.RESTClient{
+				Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+					header := http.Header{}
+					header.Set("Content-Type", runtime.ContentTypeJSON)
+					resp := &http.Response{
+						Header:     header,
+						StatusCode: http.StatusOK,
+						Body:       io.NopCloser(strings.NewReader(terminatingPod)),
+					}
+					if req.Method == http.MethodGet && removed.Load() {
+						resp.StatusCode = http.StatusNotFound
+						resp.Body = io.NopCloser(strings.NewReader(`{"kind":"Status","code":404,"reason":"NotFound"}`))
+					}
+					return resp, nil
+				}),
+				NegotiatedSerializer: &serializer.CodecFactory{},
+			}
+
+			workflowClient, worker, err := SetupWithMemoryBackend(ctx, psc, kubeClient)
+			require.NoError(t, err)
+			require.NoError(t, worker.Start(ctx))
+			defer func() {
+				require.NoError(t, worker.Shutdown(ctx))
+			}()
+
+			creator := &v1.Relationship{
+				Resource: &v1.ObjectReference{ObjectType: "pod", ObjectId: "default/web"},
+				Relation: "creator",
+				Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+			}
+			relationshipExists := func() bool {
+				exists, _, err := isRelExists(ctx, psc, creator)
+				require.NoError(t, err)
+				return exists
+			}
+
+			_, err = psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: []*v1.RelationshipUpdate{{
+				Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
+				Relationship: creator,
+			}}})
+			require.NoError(t, err)
+
+			t.Run("relationships are deleted once the object is removed", func(t *testing.T) {
+				id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+					InstanceID: uuid.NewString(),
+				}, workflowFunc, &WriteObjInput{
+					RequestInfo:         &request.RequestInfo{Verb: "delete", Path: "/api/v1/namespaces/default/pods/web", Namespace: "default", Resource: "pods", Name: "web"},
+					RequestURI:          "/api/v1/namespaces/default/pods/web",
+					UserInfo:            &user.DefaultInfo{Name: "janedoe"},
+					DeleteRelationships: []*v1.Relationship{creator},
+					WaitForRemoval:      &WaitForRemoval{Timeout: time.Minute},
+				})
+				require.NoError(t, err)
+
+				resp, err := client.GetWorkflowResult[KubeResp](ctx, workflowClient, id, DefaultWorkflowTimeout)
+				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+
+				// the relationships are kept while the object still exists
+				time.Sleep(5 * RemovalPollInterval)
+				require.True(t, relationshipExists())
+
+				removed.Store(true)
+				require.Eventually(t, func() bool {
+					return !relationshipExists()
+				}, 10*time.Second, RemovalPollInterval)
+			})
+
+			t.Run("relationships are kept if the object is not removed before the timeout", func(t *testing.T) {
+				removed.Store(false)
+				_, err = psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: []*v1.RelationshipUpdate{{
+					Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
+					Relationship: creator,
+				}}})
+				require.NoError(t, err)
+
+				id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+					InstanceID: uuid.NewString(),
+				}, CurrentWorkflow("AwaitRemoval"), &AwaitRemovalInput{
+					Path:    "/api/v1/namespaces/default/pods/web",
+					UID:     "c0ffee",
+					Updates: updatesForRelationships(nil, nil, []*v1.Relationship{creator}),
+					Timeout: 50 * time.Millisecond,
+				})
+				require.NoError(t, err)
+
+				written, err := client.GetWorkflowResult[bool](ctx, workflowClient, id, DefaultWorkflowTimeout)
+				require.NoError(t, err)
+				require.False(t, written)
+				require.True(t, relationshipExists())
+			})
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package distributedtx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+
+	"github.com/benbjohnson/clock"
+	"github.com/cschleiden/go-workflows/backend"
+	"github.com/cschleiden/go-workflows/backend/converter"
+	"github.com/cschleiden/go-workflows/backend/history"
+	"github.com/cschleiden/go-workflows/core"
+	"github.com/cschleiden/go-workflows/diag"
+	"github.com/cschleiden/go-workflows/registry"
+	"github.com/cschleiden/go-workflows/workflow/executor"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// WorkflowHistory is the recorded history of a workflow instance.
+type WorkflowHistory struct {
+	Instance *core.WorkflowInstance `json:"instance"`
+	Events   []*history.Event       `json:"events"`
+}
+
+// RecordHistories returns the histories of the workflow instances in the
+// backend.
+func RecordHistories(ctx context.Context, b diag.Backend) ([]*WorkflowHistory, error) {
+	var histories []*WorkflowHistory
+	err := eachInstance(ctx, b, func(ref *diag.WorkflowInstanceRef) error {
+		events, err := b.GetWorkflowInstanceHistory(ctx, ref.Instance, nil)
+		if err != nil {
+			return fmt.Errorf("unable to read history of workflow %s: %w", ref.Instance.InstanceID, err)
+		}
+		histories = append(histories, &WorkflowHistory{Instance: ref.Instance, Events: events})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return histories, nil
+}
+
+// ReplayHistory replays the recorded history of a workflow instance against
+// the registered versions of the workflows, like a worker does when it
+// continues the instance. It returns an error if the workflow doesn't make
+// the same decisions as it did when the history was recorded, i.e. because
+// a change to the workflow should have added a new version.
+func ReplayHistory(ctx context.Context, h *WorkflowHistory) error {
+	if len(h.Events) == 0 {
+		return fmt.Errorf("history of workflow %s is empty", h.Instance.InstanceID)
+	}
+	started := startedAttributes(h.Events)
+	if started == nil {
+		return fmt.Errorf("history of workflow %s doesn't contain the start of its execution", h.Instance.InstanceID)
+	}
+
+	r := registry.New()
+	if err := registerWorkflows(r); err != nil {
+		return err
+	}
+
+	e, err := executor.NewExecutor(
+		slog.New(slog.DiscardHandler),
+		noop.NewTracerProvider().Tracer("replay"),
+		r,
+		converter.DefaultConverter,
+		nil,
+		&recordedHistory{events: h.Events},
+		h.Instance,
+		started.Metadata,
+		clock.New(),
+		math.MaxInt64,
+		false,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create executor for workflow %s: %w", h.Instance.InstanceID, err)
+	}
+	defer e.Close()
+
+	result, err := e.ExecuteTask(ctx, &backend.WorkflowTask{
+		WorkflowInstance:      h.Instance,
+		WorkflowInstanceState: core.WorkflowInstanceStateActive,
+		Metadata:              started.Metadata,
+		LastSequenceID:        h.Events[len(h.Events)-1].SequenceID,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to replay workflow %s (%s): %w", h.Instance.InstanceID, started.Name, err)
+	}
+
+	// the executor fails the workflow if its replay diverges from the
+	// history, so the replay has to complete the workflow like the
+	// recorded execution did
+	recorded := finishedAttributes(h.Events)
+	replayed := finishedAttributes(result.Executed)
+	switch {
+	case replayed == nil && recorded == nil:
+		return nil
+	case replayed == nil:
+		return fmt.Errorf("replay of workflow %s (%s) didn't complete it", h.Instance.InstanceID, started.Name)
+	case recorded == nil:
+		return fmt.Errorf("replay of workflow %s (%s) completed it before its history ended: %v", h.Instance.InstanceID, started.Name, replayed.Error)
+	case !sameError(recorded, replayed):
+		return fmt.Errorf("replay of workflow %s (%s) completed it with error %q instead of %q", h.Instance.InstanceID, started.Name, errorMessage(replayed), errorMessage(recorded))
+	case !bytes.Equal(recorded.Result, replayed.Result):
+		return fmt.Errorf("replay of workflow %s (%s) completed it with result %s instead of %s", h.Instance.InstanceID, started.Name, replayed.Result, recorded.Result)
+	}
+	return nil
+}
+
+// recordedHistory provides a recorded history to an executor.
+type recordedHistory struct {
+	events []*history.Event
+}
+
+func (h *recordedHistory) GetWorkflowInstanceHistory(_ context.Context, _ *core.WorkflowInstance, lastSequenceID *int64) ([]*history.Event, error) {
+	if lastSequenceID == nil {
+		return h.events, nil
+	}
+	for i, event := range h.events {
+		if event.SequenceID > *lastSequenceID {
+			return h.events[i:], nil
+		}
+	}
+	return nil, nil
+}
+
+// startedAttributes returns the attributes of the event that started the
+// workflow, if any.
+func startedAttributes(events []*history.Event) *history.ExecutionStartedAttributes {
+	for _, event := range events {
+		if attrs, ok := event.Attributes.(*history.ExecutionStartedAttributes); ok {
+			return attrs
+		}
+	}
+	return nil
+}
+
+// finishedAttributes returns the attributes of the event that finished the
+// workflow, if any.
+func finishedAttributes(events []*history.Event) *history.ExecutionCompletedAttributes {
+	for _, event := range events {
+		if attrs, ok := event.Attributes.(*history.ExecutionCompletedAttributes); ok {
+			return attrs
+		}
+	}
+	return nil
+}
+
+func sameError(a, b *history.ExecutionCompletedAttributes) bool {
+	return errorMessage(a) == errorMessage(b)
+}
+
+func errorMessage(attrs *history.ExecutionCompletedAttributes) string {
+	if attrs.Error == nil {
+		return ""
+	}
+	return attrs.Error.Error()
+}
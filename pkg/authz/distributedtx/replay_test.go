@@ -0,0 +1,211 @@
+package distributedtx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cschleiden/go-workflows/backend/history"
+	"github.com/cschleiden/go-workflows/backend/sqlite"
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/cschleiden/go-workflows/diag"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+var recordHistories = flag.Bool("record-histories", false, "record the workflow histories that TestReplayHistories replays")
+
+const historiesDir = "testdata/histories"
+
+// TestReplayHistories replays workflow histories that were recorded with
+// earlier versions of the workflows. A failure means that a change to a
+// workflow breaks instances that are in flight during an upgrade, and has to
+// add a new version of the workflow instead, see docs/workflow-versioning.md.
+func TestReplayHistories(t *testing.T) {
+	histories := loadHistories(t)
+	require.NotEmpty(t, histories)
+
+	for name, h := range histories {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, ReplayHistory(t.Context(), h))
+		})
+	}
+}
+
+func TestReplayHistoryDiverged(t *testing.T) {
+	h := loadHistories(t)["pessimistic-create"]
+	require.NotNil(t, h)
+
+	// the history scheduled an activity that the workflow doesn't schedule
+	for _, event := range h.Events {
+		if attrs, ok := event.Attributes.(*history.ActivityScheduledAttributes); ok {
+			attrs.Name = "SomeOtherActivity"
+			break
+		}
+	}
+	require.ErrorContains(t, ReplayHistory(t.Context(), h), "scheduled different type of activity")
+
+	// the history was recorded by a version that isn't registered anymore
+	h = loadHistories(t)["pessimistic-create"]
+	startedAttributes(h.Events).Name = CurrentWorkflow("PessimisticWriteToSpiceDBAndKube") + "/v0"
+	require.ErrorContains(t, ReplayHistory(t.Context(), h), "not found")
+}
+
+func TestWorkflowVersions(t *testing.T) {
+	require.Equal(t, "PessimisticWriteToSpiceDBAndKube", WorkflowVersion{Name: "PessimisticWriteToSpiceDBAndKube", Version: 1}.RegisteredName())
+	require.Equal(t, "PessimisticWriteToSpiceDBAndKube/v2", WorkflowVersion{Name: "PessimisticWriteToSpiceDBAndKube", Version: 2}.RegisteredName())
+	require.Equal(t, "PessimisticWriteToSpiceDBAndKube", WorkflowName("PessimisticWriteToSpiceDBAndKube/v2"))
+	require.Equal(t, "PessimisticWriteToSpiceDBAndKube", WorkflowName("PessimisticWriteToSpiceDBAndKube"))
+	require.Equal(t, "Unknown", CurrentWorkflow("Unknown"))
+
+	registered := make(map[string]struct{})
+	for _, v := range WorkflowVersions() {
+		require.Equal(t, v.Name, WorkflowName(v.RegisteredName()))
+		require.NotContains(t, registered, v.RegisteredName())
+		registered[v.RegisteredName()] = struct{}{}
+	}
+	for _, v := range WorkflowVersions() {
+		require.Contains(t, registered, CurrentWorkflow(v.Name))
+	}
+}
+
+// TestRecordHistories records the histories that TestReplayHistories
+// replays, when the tests run with -record-histories.
+func TestRecordHistories(t *testing.T) {
+	if !*recordHistories {
+		t.Skip("histories are only recorded with -record-histories")
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	kubeClient := &fake.RESTClient{
+		Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Set("Content-Type", runtime.ContentTypeJSON)
+			code := http.StatusCreated
+			switch {
+			case strings.Contains(req.URL.Path, "down"):
+				return nil, errors.New("connection refused")
+			case strings.Contains(req.URL.Path, "rejected"):
+				code = http.StatusUnprocessableEntity
+			}
+			return &http.Response{
+				Header:     header,
+				StatusCode: code,
+				Body:       io.NopCloser(strings.NewReader(`{"hi":"myfriend"}`)),
+			}, nil
+		}),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+
+	workflowClient, worker, err := SetupWithBackend(ctx, psc, kubeClient, sqlite.NewInMemoryBackend())
+	require.NoError(t, err)
+	require.NoError(t, worker.Start(ctx))
+	defer func() {
+		require.NoError(t, worker.Shutdown(ctx))
+	}()
+
+	creator := func(name string) *v1.Relationship {
+		return &v1.Relationship{
+			Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: name},
+			Relation: "creator",
+			Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+		}
+	}
+	create := func(name string) *WriteObjInput {
+		return &WriteObjInput{
+			RequestInfo:         &request.RequestInfo{Verb: "create", Resource: "namespaces", Path: "/api/v1/namespaces"},
+			RequestURI:          "/api/v1/namespaces/" + name,
+			UserInfo:            &user.DefaultInfo{Name: "janedoe"},
+			ObjectMeta:          &metav1.ObjectMeta{Name: name},
+			CreateRelationships: []*v1.Relationship{creator(name)},
+			Body:                []byte(`{"metadata":{"name":"` + name + `"}}`),
+		}
+	}
+
+	scenarios := []struct {
+		instanceID string
+		workflow   string
+		input      any
+	}{
+		{instanceID: "pessimistic-create", workflow: "PessimisticWriteToSpiceDBAndKube", input: create("pessimistic")},
+		{instanceID: "pessimistic-rejected", workflow: "PessimisticWriteToSpiceDBAndKube", input: create("rejected")},
+		{instanceID: "pessimistic-kube-down", workflow: "PessimisticWriteToSpiceDBAndKube", input: create("down")},
+		{instanceID: "optimistic-create", workflow: "OptimisticWriteToSpiceDBAndKube", input: create("optimistic")},
+		{instanceID: "eventual-create", workflow: "EventualWriteToSpiceDBAndKube", input: create("eventual")},
+		{instanceID: "rollback", workflow: "RollbackWorkflow", input: &RollbackInput{
+			InstanceID: "pessimistic-create",
+			Updates:    []*v1.RelationshipUpdate{{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: creator("pessimistic")}},
+		}},
+		{instanceID: "approval-timeout", workflow: "ApproveWrite", input: &ApprovalInput{
+			Write:    create("approval"),
+			Workflow: CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"),
+			Approval: proxyrule.Approval{Checks: []proxyrule.StringOrTemplate{{Template: "namespace:{{name}}#admin@user:{{user.name}}"}}},
+			Timeout:  10 * time.Millisecond,
+		}},
+	}
+	for _, s := range scenarios {
+		instance, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+			InstanceID: s.instanceID,
+		}, CurrentWorkflow(s.workflow), s.input)
+		require.NoError(t, err)
+		require.NoError(t, workflowClient.WaitForWorkflowInstance(ctx, instance, DefaultWorkflowTimeout))
+	}
+
+	// child workflows, like the outbox of eventual writes, finish after
+	// their parents
+	b := worker.Backend().(diag.Backend)
+	require.Eventually(t, func() bool {
+		active, err := ActiveInstanceIDs(ctx, b)
+		require.NoError(t, err)
+		return len(active) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	histories, err := RecordHistories(ctx, b)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(historiesDir, 0o755))
+	for _, h := range histories {
+		data, err := json.MarshalIndent(h, "", "  ")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(historiesDir, h.Instance.InstanceID+".json"), append(data, '\n'), 0o644))
+	}
+}
+
+// loadHistories loads the recorded histories by the id of their instance.
+func loadHistories(t *testing.T) map[string]*WorkflowHistory {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(historiesDir, "*.json"))
+	require.NoError(t, err)
+
+	histories := make(map[string]*WorkflowHistory, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		var h WorkflowHistory
+		require.NoError(t, json.Unmarshal(data, &h), file)
+		histories[strings.TrimSuffix(filepath.Base(file), ".json")] = &h
+	}
+	return histories
+}
@@ -0,0 +1,57 @@
+package distributedtx
+
+import (
+	"time"
+
+	"github.com/cschleiden/go-workflows/workflow"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// RetryPolicy configures how often a dual-write workflow retries its writes.
+// Zero values fall back to MaxKubeAttempts, KubeBackoff and
+// workflow.DefaultActivityOptions.
+type RetryPolicy struct {
+	// MaxKubeAttempts is how often the workflow attempts the write to kube
+	// before it rolls back.
+	MaxKubeAttempts int
+
+	// KubeBackoff is the delay before the first retry of the write to kube.
+	// It doubles with every further retry.
+	KubeBackoff time.Duration
+
+	// MaxActivityAttempts is how often each activity of the workflow, i.e.
+	// a single write to SpiceDB, is attempted before it fails.
+	MaxActivityAttempts int
+}
+
+// maxKubeAttempts returns how often the workflow attempts the kube write.
+func (input *WriteObjInput) maxKubeAttempts() int {
+	if input.Retry != nil && input.Retry.MaxKubeAttempts > 0 {
+		return input.Retry.MaxKubeAttempts
+	}
+	return MaxKubeAttempts
+}
+
+// kubeBackoff returns the backoff between attempts of the kube write.
+func (input *WriteObjInput) kubeBackoff() wait.Backoff {
+	backoff := wait.Backoff{
+		Duration: KubeBackoff.Duration,
+		Factor:   KubeBackoff.Factor,
+		Jitter:   KubeBackoff.Jitter,
+		Steps:    input.maxKubeAttempts(),
+		Cap:      KubeBackoff.Cap,
+	}
+	if input.Retry != nil && input.Retry.KubeBackoff > 0 {
+		backoff.Duration = input.Retry.KubeBackoff
+	}
+	return backoff
+}
+
+// activityOptions returns the options for the activities of the workflow.
+func (input *WriteObjInput) activityOptions() workflow.ActivityOptions {
+	opts := workflow.DefaultActivityOptions
+	if input.Retry != nil && input.Retry.MaxActivityAttempts > 0 {
+		opts.RetryOptions.MaxAttempts = input.Retry.MaxActivityAttempts
+	}
+	return opts
+}
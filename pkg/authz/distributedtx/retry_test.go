@@ -0,0 +1,130 @@
+package distributedtx
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/cschleiden/go-workflows/workflow"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest/fake"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name                    string
+		retry                   *RetryPolicy
+		wantKubeAttempts        int
+		wantBackoff             time.Duration
+		wantMaxActivityAttempts int
+	}{
+		{
+			name:                    "defaults",
+			wantKubeAttempts:        MaxKubeAttempts,
+			wantBackoff:             KubeBackoff.Duration,
+			wantMaxActivityAttempts: workflow.DefaultRetryOptions.MaxAttempts,
+		},
+		{
+			name:                    "zero values",
+			retry:                   &RetryPolicy{},
+			wantKubeAttempts:        MaxKubeAttempts,
+			wantBackoff:             KubeBackoff.Duration,
+			wantMaxActivityAttempts: workflow.DefaultRetryOptions.MaxAttempts,
+		},
+		{
+			name:                    "overridden",
+			retry:                   &RetryPolicy{MaxKubeAttempts: 10, KubeBackoff: time.Second, MaxActivityAttempts: 1},
+			wantKubeAttempts:        10,
+			wantBackoff:             time.Second,
+			wantMaxActivityAttempts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := &WriteObjInput{Retry: tt.retry}
+			require.Equal(t, tt.wantKubeAttempts, input.maxKubeAttempts())
+			require.Equal(t, tt.wantBackoff, input.kubeBackoff().Duration)
+			require.Equal(t, tt.wantKubeAttempts, input.kubeBackoff().Steps)
+			require.Equal(t, tt.wantMaxActivityAttempts, input.activityOptions().RetryOptions.MaxAttempts)
+		})
+	}
+
+	// the defaults are not modified by overrides
+	require.Equal(t, 3, workflow.DefaultActivityOptions.RetryOptions.MaxAttempts)
+}
+
+func TestWorkflowRetryPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	var kubeRequests atomic.Int32
+	kubeClient := &fake.RESTClient{
+		Client: fake.CreateHTTPClient(func(request *http.Request) (*http.Response, error) {
+			kubeRequests.Add(1)
+			return nil, errors.New("connection refused")
+		}),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+
+	workflowClient, worker, err := SetupWithMemoryBackend(ctx, psc, kubeClient)
+	require.NoError(t, err)
+	require.NoError(t, worker.Start(ctx))
+	defer func() {
+		require.NoError(t, worker.Shutdown(ctx))
+	}()
+
+	write := func(t *testing.T, name string, retry *RetryPolicy) error {
+		t.Helper()
+		kubeRequests.Store(0)
+		id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+			InstanceID: uuid.NewString(),
+		}, CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"), &WriteObjInput{
+			RequestInfo: &request.RequestInfo{Verb: "create", Resource: "namespaces"},
+			RequestURI:  "/api/v1/namespaces",
+			UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+			ObjectMeta:  &metav1.ObjectMeta{Name: name},
+			Body:        []byte("{}"),
+			Retry:       retry,
+		})
+		require.NoError(t, err)
+
+		_, err = client.GetWorkflowResult[KubeResp](ctx, workflowClient, id, DefaultWorkflowTimeout)
+		return err
+	}
+
+	t.Run("overridden", func(t *testing.T) {
+		err := write(t, "retried", &RetryPolicy{
+			MaxKubeAttempts:     2,
+			KubeBackoff:         time.Millisecond,
+			MaxActivityAttempts: 1,
+		})
+		require.ErrorContains(t, err, "failed to communicate with kubernetes after 2 attempts")
+		require.Equal(t, int32(2), kubeRequests.Load())
+	})
+
+	// the default is MaxKubeAttempts attempts in total, one less than
+	// before the retry policy was configurable, see
+	// docs/timeouts-and-retries.md
+	t.Run("default", func(t *testing.T) {
+		err := write(t, "defaulted", &RetryPolicy{
+			KubeBackoff:         time.Millisecond,
+			MaxActivityAttempts: 1,
+		})
+		require.ErrorContains(t, err, "failed to communicate with kubernetes after 5 attempts")
+		require.Equal(t, int32(MaxKubeAttempts), kubeRequests.Load())
+	})
+}
@@ -0,0 +1,56 @@
+package distributedtx
+
+import (
+	"context"
+	"time"
+
+	"github.com/cschleiden/go-workflows/diag"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// DefaultLockSweepInterval is the time between two sweeps of left behind
+// locks.
+const DefaultLockSweepInterval = time.Minute
+
+// LockSweeper periodically removes the locks that workflows left behind,
+// so that a workflow that crashed doesn't block writes of its object until
+// someone deletes its lock.
+type LockSweeper struct {
+	locks    LockBackend
+	backend  diag.Backend
+	interval time.Duration
+}
+
+// NewLockSweeper returns a sweeper for the locks of the lock backend. The
+// workflow backend tells which workflows are still active.
+func NewLockSweeper(locks LockBackend, backend diag.Backend, interval time.Duration) *LockSweeper {
+	if interval <= 0 {
+		interval = DefaultLockSweepInterval
+	}
+	return &LockSweeper{locks: locks, backend: backend, interval: interval}
+}
+
+// Run sweeps the locks until the context is canceled. Failed sweeps are
+// logged and retried with the next one.
+func (s *LockSweeper) Run(ctx context.Context) error {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		swept, err := s.Sweep(ctx)
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "unable to sweep locks")
+			return
+		}
+		if swept > 0 {
+			klog.FromContext(ctx).Info("swept left behind locks", "count", swept)
+		}
+	}, s.interval)
+	return nil
+}
+
+// Sweep removes the locks that were left behind once, and returns how many
+// it removed.
+func (s *LockSweeper) Sweep(ctx context.Context) (int, error) {
+	return s.locks.Sweep(ctx, func(ctx context.Context) (map[string]struct{}, error) {
+		return ActiveInstanceIDs(ctx, s.backend)
+	})
+}
@@ -0,0 +1,102 @@
+package distributedtx
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cschleiden/go-workflows/registry"
+	"github.com/cschleiden/go-workflows/workflow"
+)
+
+// versionSeparator separates the name of a workflow from its version in the
+// name that the version is registered under.
+const versionSeparator = "/v"
+
+// WorkflowVersion is a version of a workflow.
+//
+// A worker replays the history of a workflow whenever it continues it, so a
+// workflow that is in flight during a rolling upgrade must replay against
+// the code that it was started with. A change to a workflow that alters the
+// sequence of its activities, timers or child workflows therefore adds a new
+// version, and keeps the previous version registered until no instance of it
+// is running anymore.
+type WorkflowVersion struct {
+	// Name is the name of the workflow, which all of its versions share.
+	Name string
+
+	// Version is the version of the workflow, starting at 1.
+	Version int
+
+	// Workflow is the workflow function of the version.
+	Workflow workflow.Workflow
+}
+
+// RegisteredName returns the name that the version is registered and
+// started under. The first version is registered under the name of the
+// workflow, which workflows that were started before versioning use.
+func (v WorkflowVersion) RegisteredName() string {
+	if v.Version <= 1 {
+		return v.Name
+	}
+	return v.Name + versionSeparator + strconv.Itoa(v.Version)
+}
+
+// WorkflowVersions returns the versions of the workflows that workers run.
+// The version of a workflow with the highest number is its current
+// version, which new instances are started with.
+func WorkflowVersions() []WorkflowVersion {
+	return []WorkflowVersion{
+		{Name: "PessimisticWriteToSpiceDBAndKube", Version: 1, Workflow: pessimisticWriteToSpiceDBAndKubeV1},
+		{Name: "PessimisticWriteToSpiceDBAndKube", Version: 2, Workflow: pessimisticWriteToSpiceDBAndKubeV2},
+		{Name: "PessimisticWriteToSpiceDBAndKube", Version: 3, Workflow: PessimisticWriteToSpiceDBAndKube},
+		{Name: "OptimisticWriteToSpiceDBAndKube", Version: 1, Workflow: optimisticWriteToSpiceDBAndKubeV1},
+		{Name: "OptimisticWriteToSpiceDBAndKube", Version: 2, Workflow: optimisticWriteToSpiceDBAndKubeV2},
+		{Name: "OptimisticWriteToSpiceDBAndKube", Version: 3, Workflow: OptimisticWriteToSpiceDBAndKube},
+		{Name: "EventualWriteToSpiceDBAndKube", Version: 1, Workflow: eventualWriteToSpiceDBAndKubeV1},
+		{Name: "EventualWriteToSpiceDBAndKube", Version: 2, Workflow: EventualWriteToSpiceDBAndKube},
+		{Name: "ApplyRelationships", Version: 1, Workflow: applyRelationshipsV1},
+		{Name: "ApplyRelationships", Version: 2, Workflow: ApplyRelationships},
+		{Name: "AwaitRemoval", Version: 1, Workflow: awaitRemovalV1},
+		{Name: "AwaitRemoval", Version: 2, Workflow: AwaitRemoval},
+		{Name: "ConfirmAdmission", Version: 1, Workflow: ConfirmAdmission},
+		{Name: "RollbackWorkflow", Version: 1, Workflow: RollbackWorkflow},
+		{Name: "ApproveWrite", Version: 1, Workflow: ApproveWrite},
+	}
+}
+
+// CurrentWorkflow returns the registered name of the current version of the
+// workflow with the name.
+func CurrentWorkflow(name string) string {
+	current := WorkflowVersion{Name: name}
+	for _, v := range WorkflowVersions() {
+		if v.Name == name && v.Version > current.Version {
+			current = v
+		}
+	}
+	// unknown workflows keep their name, and fail to start since no worker
+	// runs them
+	return current.RegisteredName()
+}
+
+// WorkflowName returns the name of the workflow that the registered name of
+// a version belongs to.
+func WorkflowName(registeredName string) string {
+	name, _, _ := strings.Cut(registeredName, versionSeparator)
+	return name
+}
+
+// workflowRegistry is implemented by workers and registries.
+type workflowRegistry interface {
+	RegisterWorkflow(wf workflow.Workflow, opts ...registry.RegisterOption) error
+}
+
+// registerWorkflows registers every version of the workflows.
+func registerWorkflows(r workflowRegistry) error {
+	for _, v := range WorkflowVersions() {
+		if err := r.RegisterWorkflow(v.Workflow, registry.WithName(v.RegisteredName())); err != nil {
+			return fmt.Errorf("unable to register workflow %s: %w", v.RegisteredName(), err)
+		}
+	}
+	return nil
+}
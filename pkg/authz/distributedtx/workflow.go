@@ -5,7 +5,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/cespare/xxhash/v2"
 	"github.com/cschleiden/go-workflows/workflow"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -19,6 +18,8 @@ import (
 	"k8s.io/klog/v2"
 
 	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
 )
 
 const (
@@ -46,11 +47,44 @@ type WriteObjInput struct {
 	ObjectMeta  *metav1.ObjectMeta
 	Body        []byte
 
+	// Preconditions are checked with the first chunk of relationship
+	// updates that is written, and not for the chunks after it, see
+	// writeUpdates.
 	Preconditions       []*v1.Precondition
 	CreateRelationships []*v1.Relationship
 	TouchRelationships  []*v1.Relationship
 	DeleteRelationships []*v1.Relationship
 	DeleteByFilter      []*v1.RelationshipFilter
+
+	// DeferredUpdate, if set, holds relationships that are resolved and
+	// written after the object has been written to kube.
+	DeferredUpdate *DeferredUpdate
+
+	// WaitForRemoval, if set, delays the relationship writes of a delete
+	// until kube has removed the object.
+	WaitForRemoval *WaitForRemoval
+
+	// KubeWrites are objects that are created in kube after the object of
+	// a create, update or patch has been written, and deleted again if the
+	// workflow rolls back.
+	KubeWrites []proxyrule.KubeWrite
+
+	// Retry, if set, overrides how often the workflow retries its writes.
+	Retry *RetryPolicy
+
+	// MaxUpdatesPerWrite is how many updates SpiceDB accepts in a single
+	// request. Larger writes are split into chunks. It defaults to
+	// DefaultMaxUpdatesPerWrite.
+	MaxUpdatesPerWrite int
+
+	// LockGranularity is what the pessimistic workflow locks, one of the
+	// LockGranularity constants. It defaults to LockGranularityObjectVerb.
+	LockGranularity string
+
+	// Preflight, if set, sends the request to kube with dryRun=All before
+	// anything is written to SpiceDB. Only the optimistic workflow
+	// preflights requests.
+	Preflight bool
 }
 
 func (input *WriteObjInput) validate() error {
@@ -61,6 +95,18 @@ func (input *WriteObjInput) validate() error {
 	return nil
 }
 
+// waitsForRemoval returns whether the relationships of the input are written
+// once kube has removed the deleted object.
+func (input *WriteObjInput) waitsForRemoval() bool {
+	return input.WaitForRemoval != nil && input.RequestInfo.Verb == "delete"
+}
+
+// hasKubeWrites returns whether the kube writes of the input are created
+// after kube responded to the request with out.
+func (input *WriteObjInput) hasKubeWrites(out *KubeResp) bool {
+	return len(input.KubeWrites) > 0 && input.RequestInfo.Verb != "delete" && isWrittenToKube(out)
+}
+
 func (input *WriteObjInput) toKubeReqInput() *KubeReqInput {
 	return &KubeReqInput{
 		RequestInfo: input.RequestInfo,
@@ -83,7 +129,7 @@ func (r *RollbackRelationships) WithRels(relationships ...*v1.RelationshipUpdate
 	return r
 }
 
-func (r *RollbackRelationships) Cleanup(ctx workflow.Context, workflowID, reason string) {
+func (r *RollbackRelationships) Cleanup(ctx workflow.Context, workflowID string, maxUpdatesPerWrite int, reason string) {
 	invert := func(op v1.RelationshipUpdate_Operation) v1.RelationshipUpdate_Operation {
 		switch op {
 		case v1.RelationshipUpdate_OPERATION_CREATE:
@@ -105,6 +151,21 @@ func (r *RollbackRelationships) Cleanup(ctx workflow.Context, workflowID, reason
 		})
 	}
 
+	// every chunk is retried until it is rolled back, so that a failure
+	// doesn't leave the chunks after it behind
+	for _, chunk := range chunks(updates, maxUpdatesPerWrite) {
+		if !cleanupChunk(ctx, workflowID, chunk, reason) {
+			return
+		}
+	}
+	if len(updates) > 0 {
+		klog.V(4).InfoS("rolled back relationships", "count", len(updates), "reason", reason)
+	}
+}
+
+// cleanupChunk writes a chunk of the inverted updates of a rollback. It
+// returns false if the rollback can't continue.
+func cleanupChunk(ctx workflow.Context, workflowID string, updates []*v1.RelationshipUpdate, reason string) bool {
 	for {
 		f := workflow.ExecuteActivity[*v1.ZedToken](ctx,
 			workflow.DefaultActivityOptions,
@@ -112,10 +173,16 @@ func (r *RollbackRelationships) Cleanup(ctx workflow.Context, workflowID, reason
 			&v1.WriteRelationshipsRequest{Updates: updates}, workflowID)
 
 		if _, err := f.Get(ctx); err != nil {
+			// activities of a canceled workflow fail right away, the
+			// rollback is left to whoever canceled it
+			if ctx.Err() != nil {
+				klog.ErrorS(err, "workflow canceled, not rolling back tuples", "reason", reason)
+				return false
+			}
 			if s, ok := status.FromError(err); ok {
 				if s.Code() == codes.InvalidArgument {
 					klog.ErrorS(err, "unrecoverable error when rolling back tuples", "reason", reason)
-					break
+					return false
 				}
 			}
 			klog.ErrorS(err, "error rolling back tuples", "reason", reason)
@@ -123,8 +190,7 @@ func (r *RollbackRelationships) Cleanup(ctx workflow.Context, workflowID, reason
 		}
 
 		// no error, delete succeeded, exit loop
-		klog.V(4).InfoS("rolled back relationships", "count", len(updates), "reason", reason)
-		break
+		return true
 	}
 }
 
@@ -137,62 +203,47 @@ func PessimisticWriteToSpiceDBAndKube(ctx workflow.Context, input *WriteObjInput
 	}
 
 	instance := workflow.WorkflowInstance(ctx)
-	resourceLockRel := ResourceLockRel(input, instance.InstanceID)
-
-	// tuples to remove when the workflow is complete.
-	// in some cases we will roll back the input, in all cases we remove
-	// the lock when complete.
-	rollback := NewRollbackRelationships(resourceLockRel)
-
-	preconditions := []*v1.Precondition{
-		resourceLockDoesNotExist(resourceLockRel.Relationship),
-	}
-	preconditions = append(preconditions, input.Preconditions...)
+	lock := &Lock{Key: LockKey(input, instance.InstanceID), Holder: instance.InstanceID}
 
-	updates := make([]*v1.RelationshipUpdate, 0, len(input.CreateRelationships)+len(input.TouchRelationships)+len(input.DeleteRelationships))
-	for _, r := range input.CreateRelationships {
-		updates = append(updates, &v1.RelationshipUpdate{
-			Operation:    v1.RelationshipUpdate_OPERATION_CREATE,
-			Relationship: r,
-		})
-	}
-	for _, r := range input.TouchRelationships {
-		updates = append(updates, &v1.RelationshipUpdate{
-			Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
-			Relationship: r,
-		})
-	}
-	for _, r := range input.DeleteRelationships {
-		updates = append(updates, &v1.RelationshipUpdate{
-			Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
-			Relationship: r,
-		})
-	}
+	// the lock is released when the workflow is complete, after any
+	// rollback. Releasing a lock that the workflow doesn't hold is a no-op.
+	defer releaseLock(ctx, lock)
 
-	// Issue a read relationships for any delete filter(s) and add those relationships
-	// to be deleted to the updates list. This is to ensure we have consistent deletion
-	// on retries.
-	if err := appendDeletesFromFilters(ctx, input.DeleteByFilter, &updates); err != nil {
-		return nil, fmt.Errorf("failed to append deletes from filters: %w", err)
+	_, err := workflow.ExecuteActivity[any](ctx,
+		input.activityOptions(),
+		activityHandler.AcquireLock,
+		lock).Get(ctx)
+	if err != nil {
+		klog.V(2).ErrorS(err, "unable to acquire lock", "key", lock.Key)
+		return KubeConflict(err, input), nil
 	}
 
-	arg := &v1.WriteRelationshipsRequest{
-		OptionalPreconditions: preconditions,
-		Updates:               append(updates, resourceLockRel),
+	// tuples to remove when the workflow is complete.
+	// in some cases we will roll back the input.
+	rollback := NewRollbackRelationships()
+
+	// if the workflow waits for the object to be removed, or defers its
+	// updates, nothing is written before the kube write, but the
+	// preconditions are still checked.
+	requested := updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships)
+	filters := input.DeleteByFilter
+	if input.waitsForRemoval() {
+		requested, filters = nil, nil
 	}
 
-	_, err := workflow.ExecuteActivity[*v1.ZedToken](ctx,
-		workflow.DefaultActivityOptions,
-		activityHandler.WriteToSpiceDB,
-		arg, instance.InstanceID).Get(ctx)
+	// the relationships that match the delete filters are read and
+	// deleted page by page before the updates are written. updates holds
+	// what has been written, which is rolled back if the kube write fails.
+	updates, err := writeUpdates(ctx, input.activityOptions(), instance.InstanceID, input.Preconditions, requested, filters, input.MaxUpdatesPerWrite)
 	if err != nil {
 		// request failed for some reason
 		klog.ErrorS(err, "spicedb write failed")
-		for _, u := range updates {
+		for _, u := range requested {
 			klog.V(3).InfoS("update details", "update", u.String(), "relationship", u)
 		}
 
-		rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, "rollback due to failed SpiceDB write")
+		// only the chunks that were written are rolled back
+		rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed SpiceDB write")
 
 		// if the spicedb write fails, report it as a kube conflict error
 		// we return this for any error, not just lock conflicts, so that the
@@ -201,17 +252,23 @@ func PessimisticWriteToSpiceDBAndKube(ctx workflow.Context, input *WriteObjInput
 		return KubeConflict(err, input), nil
 	}
 
-	backoff := wait.Backoff{
-		Duration: KubeBackoff.Duration,
-		Factor:   KubeBackoff.Factor,
-		Jitter:   KubeBackoff.Jitter,
-		Steps:    KubeBackoff.Steps,
-		Cap:      KubeBackoff.Cap,
-	}
-	for i := 0; i <= MaxKubeAttempts; i++ {
+	maxAttempts := input.maxKubeAttempts()
+	backoff := input.kubeBackoff()
+	for i := 0; i < maxAttempts; i++ {
+		// retries can outlast the TTL of the lock, so it is renewed before
+		// each of them. Without the lock, another write may have changed
+		// the object in the meantime.
+		if i > 0 {
+			if err := renewLock(ctx, input, lock); err != nil {
+				klog.V(2).ErrorS(err, "unable to renew lock", "key", lock.Key)
+				rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to lost lock")
+				return KubeConflict(err, input), nil
+			}
+		}
+
 		// Attempt to write to kube
 		out, err := workflow.ExecuteActivity[*KubeResp](ctx,
-			workflow.DefaultActivityOptions,
+			input.activityOptions(),
 			activityHandler.WriteToKube,
 			input.toKubeReqInput()).Get(ctx)
 		if err != nil {
@@ -231,22 +288,53 @@ func PessimisticWriteToSpiceDBAndKube(ctx workflow.Context, input *WriteObjInput
 		isSuccessful, err := isSuccessfulKuberentesOperation(input, out)
 		if err != nil {
 			klog.V(1).ErrorS(err, "error checking kube response", "response", out, "verb", input.RequestInfo.Verb)
-			rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, "rollback due to failed kube operation after max attempts")
-			return nil, fmt.Errorf("failed to communicate with kubernetes after %d attempts: %w", MaxKubeAttempts, err)
+			rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed kube operation after max attempts")
+			return nil, fmt.Errorf("failed to communicate with kubernetes after %d attempts: %w", maxAttempts, err)
 		}
 
 		if isSuccessful {
-			rollback.Cleanup(ctx, instance.InstanceID, fmt.Sprintf("cleanup after successful kube operation: %s", input.RequestInfo.Verb))
-			return out, nil
+			// kube already accepted the write, so the steps that follow it
+			// run even if the lock can't be renewed
+			if input.hasKubeWrites(out) || (input.DeferredUpdate != nil && isWrittenToKube(out)) {
+				if err := renewLock(ctx, input, lock); err != nil {
+					klog.ErrorS(err, "unable to renew lock after kube write", "key", lock.Key)
+				}
+			}
+
+			var kubeWrites []*KubeReqInput
+			if input.hasKubeWrites(out) {
+				kubeWrites, err = writeKubeWrites(ctx, input, out)
+				if err != nil {
+					// the relationships are only rolled back if kube is,
+					// otherwise they still belong to the written object
+					resp, err := rollbackKubeWrites(ctx, input, out, kubeWrites, err)
+					if err != nil {
+						return nil, err
+					}
+					rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed kube writes")
+					return resp, nil
+				}
+			}
+
+			switch {
+			case input.DeferredUpdate != nil && isWrittenToKube(out):
+				out, err = writeDeferredRelationships(ctx, input, out, kubeWrites)
+			case input.waitsForRemoval():
+				err = awaitRemoval(ctx, input, out,
+					updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships),
+					input.DeleteByFilter)
+			}
+			rollback.Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, fmt.Sprintf("cleanup after successful kube operation: %s", input.RequestInfo.Verb))
+			return out, err
 		}
 
 		klog.V(3).ErrorS(err, "unsuccessful Kube API operation on PessimisticWriteToSpiceDBAndKube", "response", out, "verb", input.RequestInfo.Verb)
-		rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, "rollback due to unsuccessful kube operation")
+		rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to unsuccessful kube operation")
 		return out, nil
 	}
 
-	rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, "rollback due to failed kube operation after max attempts")
-	return nil, fmt.Errorf("failed to communicate with kubernetes after %d attempts", MaxKubeAttempts)
+	rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed kube operation after max attempts")
+	return nil, fmt.Errorf("failed to communicate with kubernetes after %d attempts", maxAttempts)
 }
 
 func isSuccessfulKuberentesOperation(input *WriteObjInput, out *KubeResp) (bool, error) {
@@ -266,6 +354,12 @@ func isSuccessfulKuberentesOperation(input *WriteObjInput, out *KubeResp) (bool,
 	}
 }
 
+// isWrittenToKube returns whether kube accepted the write and returned the
+// written object.
+func isWrittenToKube(out *KubeResp) bool {
+	return out != nil && (out.StatusCode == http.StatusOK || out.StatusCode == http.StatusCreated || out.StatusCode == http.StatusAccepted)
+}
+
 func isSuccessfulDelete(out *KubeResp) bool {
 	return out.StatusCode == http.StatusNotFound || out.StatusCode == http.StatusOK
 }
@@ -274,6 +368,16 @@ func isSuccessfulCreateOrUpdate(out *KubeResp) bool {
 	return out.StatusCode == http.StatusConflict || out.StatusCode == http.StatusCreated || out.StatusCode == http.StatusOK
 }
 
+// isSuccessfulPreflight returns whether kube accepted the dry run of the
+// request. Deletes of objects that don't exist are written anyway, since
+// the workflow then only deletes their relationships.
+func isSuccessfulPreflight(input *WriteObjInput, out *KubeResp) bool {
+	if input.RequestInfo.Verb == "delete" && out.StatusCode == http.StatusNotFound {
+		return true
+	}
+	return out.StatusCode >= 200 && out.StatusCode < 300
+}
+
 // OptimisticWriteToSpiceDBAndKube ensures that a write exists in both SpiceDB and kube,
 // or neither. It attempts to perform the writes and rolls back if errors are
 // encountered, leaving the user to retry on write conflicts.
@@ -282,51 +386,43 @@ func OptimisticWriteToSpiceDBAndKube(ctx workflow.Context, input *WriteObjInput)
 		return nil, fmt.Errorf("invalid input to PessimisticWriteToSpiceDBAndKube: %w", err)
 	}
 
-	// TODO: this could optionally use dry-run to preflight the kube request
-	updates := make([]*v1.RelationshipUpdate, 0, len(input.CreateRelationships)+len(input.TouchRelationships)+len(input.DeleteRelationships))
-	for _, r := range input.CreateRelationships {
-		updates = append(updates, &v1.RelationshipUpdate{
-			Operation:    v1.RelationshipUpdate_OPERATION_CREATE,
-			Relationship: r,
-		})
-	}
-	for _, r := range input.TouchRelationships {
-		updates = append(updates, &v1.RelationshipUpdate{
-			Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
-			Relationship: r,
-		})
-	}
-	for _, r := range input.DeleteRelationships {
-		updates = append(updates, &v1.RelationshipUpdate{
-			Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
-			Relationship: r,
-		})
-	}
-
-	// Issue a read relationships for any delete filter(s) and add those relationships
-	// to be deleted to the updates list. This is to ensure we have consistent deletion
-	// on retries.
-	if err := appendDeletesFromFilters(ctx, input.DeleteByFilter, &updates); err != nil {
-		return nil, fmt.Errorf("failed to append deletes from filters: %w", err)
+	// kube rejects objects i.e. because of validation, quotas or admission
+	// webhooks. The preflight finds those before SpiceDB is written, so that
+	// nothing has to be rolled back.
+	if input.Preflight {
+		out, err := workflow.ExecuteActivity[*KubeResp](ctx,
+			input.activityOptions(),
+			activityHandler.PreflightKube,
+			input.toKubeReqInput()).Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("kube preflight failed: %w", err)
+		}
+		if !isSuccessfulPreflight(input, out) {
+			klog.V(3).InfoS("kube rejected preflight", "verb", input.RequestInfo.Verb, "status", out.StatusCode)
+			return out, nil
+		}
 	}
 
+	// if the workflow waits for the object to be removed, nothing is written
+	// before the kube write. The relationships that match the delete filters
+	// are read and deleted page by page before the updates are written.
 	instance := workflow.WorkflowInstance(ctx)
-	rollback := NewRollbackRelationships(updates...)
-	_, err := workflow.ExecuteActivity[*v1.ZedToken](ctx,
-		workflow.DefaultActivityOptions,
-		activityHandler.WriteToSpiceDB,
-		&v1.WriteRelationshipsRequest{
-			Updates: updates,
-		}, instance.InstanceID).Get(ctx)
-	if err != nil {
-		rollback.Cleanup(ctx, instance.InstanceID, "rollback due to failed SpiceDB write")
-		klog.ErrorS(err, "SpiceDB write failed")
-		// report spicedb write errors as conflicts
-		return KubeConflict(err, input), nil
+	rollback := NewRollbackRelationships()
+	if !input.waitsForRemoval() {
+		written, err := writeUpdates(ctx, input.activityOptions(), instance.InstanceID, nil,
+			updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships),
+			input.DeleteByFilter, input.MaxUpdatesPerWrite)
+		rollback.WithRels(written...)
+		if err != nil {
+			rollback.Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed SpiceDB write")
+			klog.ErrorS(err, "SpiceDB write failed")
+			// report spicedb write errors as conflicts
+			return KubeConflict(err, input), nil
+		}
 	}
 
 	out, err := workflow.ExecuteActivity[*KubeResp](ctx,
-		workflow.DefaultActivityOptions,
+		input.activityOptions(),
 		activityHandler.WriteToKube,
 		input.toKubeReqInput()).Get(ctx)
 	if err != nil {
@@ -334,7 +430,7 @@ func OptimisticWriteToSpiceDBAndKube(ctx workflow.Context, input *WriteObjInput)
 
 		// check if object exists - the activity may have failed, but the write to Kube could have succeeded
 		exists, err := workflow.ExecuteActivity[bool](ctx,
-			workflow.DefaultActivityOptions,
+			input.activityOptions(),
 			activityHandler.CheckKubeResource,
 			input.toKubeReqInput()).Get(ctx)
 		if err != nil {
@@ -343,78 +439,71 @@ func OptimisticWriteToSpiceDBAndKube(ctx workflow.Context, input *WriteObjInput)
 
 		// if the object doesn't exist, clean up the spicedb write
 		if !exists {
-			rollback.Cleanup(ctx, instance.InstanceID, "rollback due to failed Kube write")
+			rollback.Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed Kube write")
 			return nil, err
 		}
 	}
 
-	return out, nil
-}
-
-func appendDeletesFromFilters(
-	ctx workflow.Context,
-	filters []*v1.RelationshipFilter,
-	updates *[]*v1.RelationshipUpdate,
-) error {
-	for _, deleteByFilterExpr := range filters {
-		klog.V(3).InfoS("loading relationships for delete filter", "filter", deleteByFilterExpr.String())
-
-		// We need to read the relationships that match the filter and delete them
-		// in the updates list. This is to ensure we have consistent deletion on
-		// retries.
-		f := workflow.ExecuteActivity[[]*v1.ReadRelationshipsResponse](ctx,
-			workflow.DefaultActivityOptions,
-			activityHandler.ReadRelationships,
-			&v1.ReadRelationshipsRequest{
-				RelationshipFilter: deleteByFilterExpr,
-			})
-
-		results, err := f.Get(ctx)
+	var kubeWrites []*KubeReqInput
+	if input.hasKubeWrites(out) {
+		kubeWrites, err = writeKubeWrites(ctx, input, out)
 		if err != nil {
-			klog.V(3).ErrorS(err, "failed to read relationships for delete by filter", "filter", deleteByFilterExpr.String())
-			return fmt.Errorf("unable to read relationships for delete by filter (%v): %w", deleteByFilterExpr, err)
+			// the relationships are only rolled back if kube is, otherwise
+			// they still belong to the written object
+			resp, err := rollbackKubeWrites(ctx, input, out, kubeWrites, err)
+			if err != nil {
+				return nil, err
+			}
+			rollback.Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed kube writes")
+			return resp, nil
 		}
+	}
 
-		for _, resp := range results {
-			*updates = append(*updates, &v1.RelationshipUpdate{
-				Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
-				Relationship: resp.Relationship,
-			})
-		}
+	if input.DeferredUpdate != nil && isWrittenToKube(out) {
+		return writeDeferredRelationships(ctx, input, out, kubeWrites)
+	}
 
-		klog.V(3).InfoS("found relationships for delete filter", "count", len(results), "filter", deleteByFilterExpr.String())
+	if input.waitsForRemoval() && (out == nil || isSuccessfulDelete(out)) {
+		err := awaitRemoval(ctx, input, out,
+			updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships),
+			input.DeleteByFilter)
+		return out, err
 	}
 
-	return nil
+	return out, nil
+}
+
+// updatesForRelationships returns the updates that create, touch and delete
+// the given relationships.
+func updatesForRelationships(creates, touches, deletes []*v1.Relationship) []*v1.RelationshipUpdate {
+	updates := make([]*v1.RelationshipUpdate, 0, len(creates)+len(touches)+len(deletes))
+	for _, r := range creates {
+		updates = append(updates, &v1.RelationshipUpdate{
+			Operation:    v1.RelationshipUpdate_OPERATION_CREATE,
+			Relationship: r,
+		})
+	}
+	for _, r := range touches {
+		updates = append(updates, &v1.RelationshipUpdate{
+			Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
+			Relationship: r,
+		})
+	}
+	for _, r := range deletes {
+		updates = append(updates, &v1.RelationshipUpdate{
+			Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
+			Relationship: r,
+		})
+	}
+	return updates
 }
 
 // ResourceLockRel generates a relationship representing a worfklow's lock over a
 // specific resource in kube.
 func ResourceLockRel(input *WriteObjInput, workflowID string) *v1.RelationshipUpdate {
-	// Delete names come from the request, Create names come from the object
-	// TODO: this could benefit from an objectid helper shared with bloblang
-	name := input.RequestInfo.Name
-	if input.ObjectMeta != nil {
-		name = input.ObjectMeta.Name
-	}
-
-	lockKey := input.RequestInfo.Path + "/" + name + "/" + input.RequestInfo.Verb
-	lockHash := fmt.Sprintf("%x", xxhash.Sum64String(lockKey))
 	return &v1.RelationshipUpdate{
-		Operation: v1.RelationshipUpdate_OPERATION_CREATE,
-		Relationship: &v1.Relationship{
-			Resource: &v1.ObjectReference{
-				ObjectType: lockResourceType,
-				ObjectId:   lockHash,
-			},
-			Relation: lockRelationName,
-			Subject: &v1.SubjectReference{
-				Object: &v1.ObjectReference{
-					ObjectType: workflowResourceType,
-					ObjectId:   workflowID,
-				},
-			},
-		},
+		Operation:    v1.RelationshipUpdate_OPERATION_CREATE,
+		Relationship: lockRel(&Lock{Key: LockKey(input, workflowID), Holder: workflowID}),
 	}
 }
 
@@ -462,11 +551,32 @@ func resourceLockDoesNotExist(lockRel *v1.Relationship) *v1.Precondition {
 	}
 }
 
-func WorkflowForLockMode(lockMode string) (any, error) {
-	f := PessimisticWriteToSpiceDBAndKube
-	if lockMode == StrategyOptimisticWriteToSpiceDBAndKube {
-		f = OptimisticWriteToSpiceDBAndKube
+// resourceLockHeld is a precondition that the lock is held by the holder of
+// the lock relationship.
+func resourceLockHeld(lockRel *v1.Relationship) *v1.Precondition {
+	return &v1.Precondition{
+		Operation: v1.Precondition_OPERATION_MUST_MATCH,
+		Filter: &v1.RelationshipFilter{
+			ResourceType:       lockResourceType,
+			OptionalResourceId: lockRel.Resource.ObjectId,
+			OptionalRelation:   lockRelationName,
+			OptionalSubjectFilter: &v1.SubjectFilter{
+				SubjectType:       workflowResourceType,
+				OptionalSubjectId: lockRel.Subject.Object.ObjectId,
+			},
+		},
 	}
+}
 
-	return f, nil
+// WorkflowForLockMode returns the registered name of the current version of
+// the workflow that writes with the lock mode.
+func WorkflowForLockMode(lockMode string) (string, error) {
+	switch lockMode {
+	case StrategyOptimisticWriteToSpiceDBAndKube:
+		return CurrentWorkflow("OptimisticWriteToSpiceDBAndKube"), nil
+	case StrategyEventualWriteToSpiceDBAndKube:
+		return CurrentWorkflow("EventualWriteToSpiceDBAndKube"), nil
+	default:
+		return CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"), nil
+	}
 }
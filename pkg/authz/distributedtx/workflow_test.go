@@ -9,7 +9,6 @@ import (
 	"testing"
 
 	"github.com/cschleiden/go-workflows/client"
-	"github.com/cschleiden/go-workflows/workflow"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -21,28 +20,20 @@ import (
 
 	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
 
-	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
 )
 
 func TestWorkflow(t *testing.T) {
-	for name, workflowFunc := range map[string]func(ctx workflow.Context, input *WriteObjInput) (*KubeResp, error){
-		StrategyPessimisticWriteToSpiceDBAndKube: PessimisticWriteToSpiceDBAndKube,
-		StrategyOptimisticWriteToSpiceDBAndKube:  OptimisticWriteToSpiceDBAndKube,
+	for name, workflowFunc := range map[string]string{
+		StrategyPessimisticWriteToSpiceDBAndKube: CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"),
+		StrategyOptimisticWriteToSpiceDBAndKube:  CurrentWorkflow("OptimisticWriteToSpiceDBAndKube"),
 	} {
 		t.Run(name, func(t *testing.T) {
 			ctx, cancel := context.WithCancel(t.Context())
 			defer cancel()
 
-			srv, err := spicedb.NewServer(ctx, "", nil)
-			require.NoError(t, err)
-			go func() {
-				require.NoError(t, srv.Run(ctx)) // nolint:testifylint
-			}()
-
-			dialCtx, err := srv.GRPCDialContext(ctx)
-			require.NoError(t, err)
-
-			psc := v1.NewPermissionsServiceClient(dialCtx)
+			psc := spicedbtest.NewPermissionsClient(ctx, t)
 
 			kubeClient := &fake.RESTClient{
 				Client: fake.CreateHTTPClient(func(request *http.Request) (*http.Response, error) {
@@ -61,7 +52,6 @@ func TestWorkflow(t *testing.T) {
 				NegotiatedSerializer: &serializer.CodecFactory{},
 			}
 
-			require.NoError(t, err)
 			workflowClient, worker, err := SetupWithMemoryBackend(ctx, psc, kubeClient)
 			require.NoError(t, err)
 			require.NoError(t, worker.Start(ctx))
@@ -211,3 +201,258 @@ func TestKubeConflict(t *testing.T) {
 		})
 	}
 }
+
+func TestWorkflowGeneratedName(t *testing.T) {
+	const createdPod = `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web-x7k2p","generateName":"web-","namespace":"default","uid":"c0ffee"}}`
+
+	for name, workflowFunc := range map[string]string{
+		StrategyPessimisticWriteToSpiceDBAndKube: CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"),
+		StrategyOptimisticWriteToSpiceDBAndKube:  CurrentWorkflow("OptimisticWriteToSpiceDBAndKube"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+
+			psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+			var deleted []string
+			kubeClient := &fake.RESTClient{
+				Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+					header := http.Header{}
+					header.Set("Content-Type", runtime.ContentTypeJSON)
+					if req.Method == http.MethodDelete {
+						body, err := io.ReadAll(req.Body)
+						require.NoError(t, err)
+						require.Contains(t, string(body), `"uid":"c0ffee"`)
+						deleted = append(deleted, req.URL.Path)
+						return &http.Response{
+							Header:     header,
+							StatusCode: http.StatusOK,
+							Body:       io.NopCloser(strings.NewReader(createdPod)),
+						}, nil
+					}
+					require.Equal(t, http.MethodPost, req.Method)
+					return &http.Response{
+						Header:     header,
+						StatusCode: http.StatusCreated,
+						Body:       io.NopCloser(strings.NewReader(createdPod)),
+					}, nil
+				}),
+				NegotiatedSerializer: &serializer.CodecFactory{},
+			}
+
+			workflowClient, worker, err := SetupWithMemoryBackend(ctx, psc, kubeClient)
+			require.NoError(t, err)
+			require.NoError(t, worker.Start(ctx))
+			defer func() {
+				require.NoError(t, worker.Shutdown(ctx))
+			}()
+
+			run := func(tpl string) *KubeResp {
+				id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+					InstanceID: uuid.NewString(),
+				}, workflowFunc, &WriteObjInput{
+					RequestInfo: &request.RequestInfo{Verb: "create", Path: "/api/v1/namespaces/default/pods", Namespace: "default", Resource: "pods"},
+					RequestURI:  "/api/v1/namespaces/default/pods",
+					UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+					ObjectMeta:  &metav1.ObjectMeta{GenerateName: "web-", Namespace: "default"},
+					Body:        []byte(`{"metadata":{"generateName":"web-"}}`),
+					DeferredUpdate: &DeferredUpdate{Update: proxyrule.Update{
+						CreateRelationships: []proxyrule.StringOrTemplate{{Template: tpl}},
+					}},
+				})
+				require.NoError(t, err)
+
+				resp, err := client.GetWorkflowResult[KubeResp](ctx, workflowClient, id, DefaultWorkflowTimeout)
+				require.NoError(t, err)
+				return &resp
+			}
+
+			t.Run("relationships use the generated name", func(t *testing.T) {
+				resp := run("pod:{{namespacedName}}#creator@user:{{user.name}}")
+				require.Equal(t, http.StatusCreated, resp.StatusCode)
+				require.JSONEq(t, createdPod, string(resp.Body))
+				require.Empty(t, deleted)
+
+				cpr, err := psc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+					Consistency: &v1.Consistency{
+						Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true},
+					},
+					Resource:   &v1.ObjectReference{ObjectType: "pod", ObjectId: "default/web-x7k2p"},
+					Permission: "edit",
+					Subject:    &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+				})
+				require.NoError(t, err)
+				require.Equal(t, v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION, cpr.Permissionship)
+			})
+
+			t.Run("created object is deleted if relationships can't be written", func(t *testing.T) {
+				resp := run("pod:{{namespacedName}}#unknown@user:{{user.name}}")
+				require.Equal(t, http.StatusConflict, resp.StatusCode)
+				require.Equal(t, []string{"/api/v1/namespaces/default/pods/web-x7k2p"}, deleted)
+			})
+		})
+	}
+}
+
+func TestWorkflowDeferredPrecondition(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	var kubeWrites int
+	kubeClient := &fake.RESTClient{
+		Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+			kubeWrites++
+			return nil, errors.New("unexpected kube write")
+		}),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+
+	workflowClient, worker, err := SetupWithMemoryBackend(ctx, psc, kubeClient)
+	require.NoError(t, err)
+	require.NoError(t, worker.Start(ctx))
+	defer func() {
+		require.NoError(t, worker.Shutdown(ctx))
+	}()
+
+	// nothing is written before the kube write of a deferred create, but
+	// its preconditions are still checked
+	id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+		InstanceID: uuid.NewString(),
+	}, CurrentWorkflow("PessimisticWriteToSpiceDBAndKube"), &WriteObjInput{
+		RequestInfo: &request.RequestInfo{Verb: "create", Path: "/api/v1/namespaces/default/pods", Namespace: "default", Resource: "pods"},
+		RequestURI:  "/api/v1/namespaces/default/pods",
+		UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+		ObjectMeta:  &metav1.ObjectMeta{GenerateName: "web-", Namespace: "default"},
+		Body:        []byte(`{"metadata":{"generateName":"web-"}}`),
+		Preconditions: []*v1.Precondition{{
+			Operation: v1.Precondition_OPERATION_MUST_MATCH,
+			Filter: &v1.RelationshipFilter{
+				ResourceType:       "namespace",
+				OptionalResourceId: "default",
+				OptionalRelation:   "creator",
+			},
+		}},
+		DeferredUpdate: &DeferredUpdate{Update: proxyrule.Update{
+			CreateRelationships: []proxyrule.StringOrTemplate{{Template: "pod:{{namespacedName}}#creator@user:{{user.name}}"}},
+		}},
+	})
+	require.NoError(t, err)
+
+	resp, err := client.GetWorkflowResult[KubeResp](ctx, workflowClient, id, DefaultWorkflowTimeout)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.Contains(t, string(resp.Body), "FailedPrecondition")
+	require.Zero(t, kubeWrites)
+}
+
+func TestWorkflowPreflight(t *testing.T) {
+	const invalid = `{"kind":"Status","apiVersion":"v1","status":"Failure","message":"namespace is invalid","reason":"Invalid","code":422}`
+
+	tests := []struct {
+		name           string
+		object         string
+		preflight      bool
+		wantStatusCode int
+		wantRequests   []string
+		wantPermission bool
+	}{
+		{
+			name:           "preflight rejected",
+			object:         "rejected",
+			preflight:      true,
+			wantStatusCode: http.StatusUnprocessableEntity,
+			wantRequests:   []string{"dryRun=All"},
+			wantPermission: false,
+		},
+		{
+			name:           "preflight accepted",
+			object:         "accepted",
+			preflight:      true,
+			wantStatusCode: http.StatusCreated,
+			wantRequests:   []string{"dryRun=All", ""},
+			wantPermission: true,
+		},
+		{
+			name:           "no preflight",
+			object:         "unchecked",
+			wantStatusCode: http.StatusCreated,
+			wantRequests:   []string{""},
+			wantPermission: true,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	var requests []string
+	kubeClient := &fake.RESTClient{
+		Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+			requests = append(requests, req.URL.RawQuery)
+			header := http.Header{}
+			header.Set("Content-Type", runtime.ContentTypeJSON)
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			if strings.Contains(string(body), "rejected") {
+				return &http.Response{
+					Header:     header,
+					StatusCode: http.StatusUnprocessableEntity,
+					Body:       io.NopCloser(strings.NewReader(invalid)),
+				}, nil
+			}
+			return &http.Response{
+				Header:     header,
+				StatusCode: http.StatusCreated,
+				Body:       io.NopCloser(strings.NewReader(`{"hi":"myfriend"}`)),
+			}, nil
+		}),
+		NegotiatedSerializer: &serializer.CodecFactory{},
+	}
+
+	workflowClient, worker, err := SetupWithMemoryBackend(ctx, psc, kubeClient)
+	require.NoError(t, err)
+	require.NoError(t, worker.Start(ctx))
+	defer func() {
+		require.NoError(t, worker.Shutdown(ctx))
+	}()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = nil
+			id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+				InstanceID: uuid.NewString(),
+			}, CurrentWorkflow("OptimisticWriteToSpiceDBAndKube"), &WriteObjInput{
+				RequestInfo: &request.RequestInfo{Verb: "create", Resource: "namespaces", Path: "/api/v1/namespaces"},
+				RequestURI:  "/api/v1/namespaces",
+				UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+				ObjectMeta:  &metav1.ObjectMeta{Name: tt.object},
+				CreateRelationships: []*v1.Relationship{{
+					Resource: &v1.ObjectReference{ObjectType: "namespace", ObjectId: tt.object},
+					Relation: "creator",
+					Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+				}},
+				Body:      []byte(`{"metadata":{"name":"` + tt.object + `"}}`),
+				Preflight: tt.preflight,
+			})
+			require.NoError(t, err)
+
+			resp, err := client.GetWorkflowResult[KubeResp](ctx, workflowClient, id, DefaultWorkflowTimeout)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatusCode, resp.StatusCode)
+			require.Equal(t, tt.wantRequests, requests)
+
+			cpr, err := psc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+				Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+				Resource:    &v1.ObjectReference{ObjectType: "namespace", ObjectId: tt.object},
+				Permission:  "view",
+				Subject:     &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "janedoe"}},
+			})
+			require.NoError(t, err)
+			require.Equal(t, tt.wantPermission, cpr.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION)
+		})
+	}
+}
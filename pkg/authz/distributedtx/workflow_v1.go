@@ -0,0 +1,590 @@
+package distributedtx
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cschleiden/go-workflows/workflow"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+// The functions in this file are version 1 of the workflows, which
+// instances that were started before version 2 keep running until they
+// complete. Version 1 of PessimisticWriteToSpiceDBAndKube and
+// OptimisticWriteToSpiceDBAndKube is the code that proxies before
+// versioning ran. They are frozen copies, and must not change, see
+// docs/workflow-versioning.md.
+
+// pessimisticWriteToSpiceDBAndKubeV1 is version 1 of
+// PessimisticWriteToSpiceDBAndKube, which proxies before versioning ran. It
+// writes the lock relationship together with the updates.
+func pessimisticWriteToSpiceDBAndKubeV1(ctx workflow.Context, input *WriteObjInput) (*KubeResp, error) {
+	if err := input.validate(); err != nil {
+		return nil, fmt.Errorf("invalid input to PessimisticWriteToSpiceDBAndKube: %w", err)
+	}
+
+	instance := workflow.WorkflowInstance(ctx)
+	resourceLockRel := ResourceLockRel(input, instance.InstanceID)
+
+	// tuples to remove when the workflow is complete.
+	// in some cases we will roll back the input, in all cases we remove
+	// the lock when complete.
+	rollback := NewRollbackRelationships(resourceLockRel)
+
+	preconditions := []*v1.Precondition{
+		resourceLockDoesNotExist(resourceLockRel.Relationship),
+	}
+	preconditions = append(preconditions, input.Preconditions...)
+
+	updates := updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships)
+
+	// Issue a read relationships for any delete filter(s) and add those relationships
+	// to be deleted to the updates list. This is to ensure we have consistent deletion
+	// on retries.
+	if err := appendAllDeletesFromFiltersV1(ctx, input.DeleteByFilter, &updates); err != nil {
+		return nil, fmt.Errorf("failed to append deletes from filters: %w", err)
+	}
+
+	arg := &v1.WriteRelationshipsRequest{
+		OptionalPreconditions: preconditions,
+		Updates:               append(updates, resourceLockRel),
+	}
+
+	_, err := workflow.ExecuteActivity[*v1.ZedToken](ctx,
+		workflow.DefaultActivityOptions,
+		activityHandler.WriteToSpiceDB,
+		arg, instance.InstanceID).Get(ctx)
+	if err != nil {
+		// request failed for some reason
+		klog.ErrorS(err, "spicedb write failed")
+		for _, u := range updates {
+			klog.V(3).InfoS("update details", "update", u.String(), "relationship", u)
+		}
+
+		cleanupV1(ctx, rollback.WithRels(updates...), instance.InstanceID, "rollback due to failed SpiceDB write")
+
+		// if the spicedb write fails, report it as a kube conflict error
+		// we return this for any error, not just lock conflicts, so that the
+		// user will attempt to retry instead of the workflow (nothing from the
+		// workflow has succeeded, so there's not much use in retrying automatically).
+		return KubeConflict(err, input), nil
+	}
+
+	backoff := wait.Backoff{
+		Duration: KubeBackoff.Duration,
+		Factor:   KubeBackoff.Factor,
+		Jitter:   KubeBackoff.Jitter,
+		Steps:    KubeBackoff.Steps,
+		Cap:      KubeBackoff.Cap,
+	}
+	for i := 0; i <= MaxKubeAttempts; i++ {
+		// Attempt to write to kube
+		out, err := workflow.ExecuteActivity[*KubeResp](ctx,
+			workflow.DefaultActivityOptions,
+			activityHandler.WriteToKube,
+			input.toKubeReqInput()).Get(ctx)
+		if err != nil {
+			// didn't get a response from kube, try again
+			klog.V(2).ErrorS(err, "kube write failed, retrying")
+			time.Sleep(backoff.Step())
+			continue
+		}
+
+		details := out.Err.ErrStatus.Details
+		if details != nil && details.RetryAfterSeconds > 0 {
+			time.Sleep(time.Duration(out.Err.ErrStatus.Details.RetryAfterSeconds) * time.Second)
+			continue
+		}
+
+		// Ensure we have a valid response status code for the Kubernetes request.
+		isSuccessful, err := isSuccessfulKuberentesOperation(input, out)
+		if err != nil {
+			klog.V(1).ErrorS(err, "error checking kube response", "response", out, "verb", input.RequestInfo.Verb)
+			cleanupV1(ctx, rollback.WithRels(updates...), instance.InstanceID, "rollback due to failed kube operation after max attempts")
+			return nil, fmt.Errorf("failed to communicate with kubernetes after %d attempts: %w", MaxKubeAttempts, err)
+		}
+
+		if isSuccessful {
+			cleanupV1(ctx, rollback, instance.InstanceID, fmt.Sprintf("cleanup after successful kube operation: %s", input.RequestInfo.Verb))
+			return out, nil
+		}
+
+		klog.V(3).ErrorS(err, "unsuccessful Kube API operation on PessimisticWriteToSpiceDBAndKube", "response", out, "verb", input.RequestInfo.Verb)
+		cleanupV1(ctx, rollback.WithRels(updates...), instance.InstanceID, "rollback due to unsuccessful kube operation")
+		return out, nil
+	}
+
+	cleanupV1(ctx, rollback.WithRels(updates...), instance.InstanceID, "rollback due to failed kube operation after max attempts")
+	return nil, fmt.Errorf("failed to communicate with kubernetes after %d attempts", MaxKubeAttempts)
+}
+
+// optimisticWriteToSpiceDBAndKubeV1 is version 1 of
+// OptimisticWriteToSpiceDBAndKube, which proxies before versioning ran.
+func optimisticWriteToSpiceDBAndKubeV1(ctx workflow.Context, input *WriteObjInput) (*KubeResp, error) {
+	if err := input.validate(); err != nil {
+		return nil, fmt.Errorf("invalid input to PessimisticWriteToSpiceDBAndKube: %w", err)
+	}
+
+	updates := updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships)
+
+	// Issue a read relationships for any delete filter(s) and add those relationships
+	// to be deleted to the updates list. This is to ensure we have consistent deletion
+	// on retries.
+	if err := appendAllDeletesFromFiltersV1(ctx, input.DeleteByFilter, &updates); err != nil {
+		return nil, fmt.Errorf("failed to append deletes from filters: %w", err)
+	}
+
+	instance := workflow.WorkflowInstance(ctx)
+	rollback := NewRollbackRelationships(updates...)
+	_, err := workflow.ExecuteActivity[*v1.ZedToken](ctx,
+		workflow.DefaultActivityOptions,
+		activityHandler.WriteToSpiceDB,
+		&v1.WriteRelationshipsRequest{
+			Updates: updates,
+		}, instance.InstanceID).Get(ctx)
+	if err != nil {
+		cleanupV1(ctx, rollback, instance.InstanceID, "rollback due to failed SpiceDB write")
+		klog.ErrorS(err, "SpiceDB write failed")
+		// report spicedb write errors as conflicts
+		return KubeConflict(err, input), nil
+	}
+
+	out, err := workflow.ExecuteActivity[*KubeResp](ctx,
+		workflow.DefaultActivityOptions,
+		activityHandler.WriteToKube,
+		input.toKubeReqInput()).Get(ctx)
+	if err != nil {
+		// if there's an error, might need to roll back the spicedb write
+
+		// check if object exists - the activity may have failed, but the write to Kube could have succeeded
+		exists, err := workflow.ExecuteActivity[bool](ctx,
+			workflow.DefaultActivityOptions,
+			activityHandler.CheckKubeResource,
+			input.toKubeReqInput()).Get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// if the object doesn't exist, clean up the spicedb write
+		if !exists {
+			cleanupV1(ctx, rollback, instance.InstanceID, "rollback due to failed Kube write")
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// cleanupV1 is RollbackRelationships.Cleanup as version 1 of the workflows
+// runs it, which writes all inverted updates at once.
+func cleanupV1(ctx workflow.Context, r *RollbackRelationships, workflowID, reason string) {
+	invert := func(op v1.RelationshipUpdate_Operation) v1.RelationshipUpdate_Operation {
+		switch op {
+		case v1.RelationshipUpdate_OPERATION_CREATE:
+			fallthrough
+		case v1.RelationshipUpdate_OPERATION_TOUCH:
+			return v1.RelationshipUpdate_OPERATION_DELETE
+		case v1.RelationshipUpdate_OPERATION_DELETE:
+			return v1.RelationshipUpdate_OPERATION_TOUCH
+		}
+		return v1.RelationshipUpdate_OPERATION_UNSPECIFIED
+	}
+
+	updates := make([]*v1.RelationshipUpdate, 0, len(*r))
+	for _, rel := range *r {
+		updates = append(updates, &v1.RelationshipUpdate{
+			Operation:    invert(rel.Operation),
+			Relationship: rel.Relationship,
+		})
+	}
+
+	for {
+		f := workflow.ExecuteActivity[*v1.ZedToken](ctx,
+			workflow.DefaultActivityOptions,
+			activityHandler.WriteToSpiceDB,
+			&v1.WriteRelationshipsRequest{Updates: updates}, workflowID)
+
+		if _, err := f.Get(ctx); err != nil {
+			if s, ok := status.FromError(err); ok {
+				if s.Code() == codes.InvalidArgument {
+					klog.ErrorS(err, "unrecoverable error when rolling back tuples", "reason", reason)
+					break
+				}
+			}
+			klog.ErrorS(err, "error rolling back tuples", "reason", reason)
+			continue
+		}
+
+		// no error, delete succeeded, exit loop
+		klog.V(4).InfoS("rolled back relationships", "count", len(updates), "reason", reason)
+		break
+	}
+}
+
+// appendAllDeletesFromFiltersV1 is appendDeletesFromFilters as version 1 of
+// the workflows runs it, which reads all relationships that match a filter
+// with a single activity.
+func appendAllDeletesFromFiltersV1(
+	ctx workflow.Context,
+	filters []*v1.RelationshipFilter,
+	updates *[]*v1.RelationshipUpdate,
+) error {
+	for _, deleteByFilterExpr := range filters {
+		klog.V(3).InfoS("loading relationships for delete filter", "filter", deleteByFilterExpr.String())
+
+		// We need to read the relationships that match the filter and delete them
+		// in the updates list. This is to ensure we have consistent deletion on
+		// retries.
+		f := workflow.ExecuteActivity[[]*v1.ReadRelationshipsResponse](ctx,
+			workflow.DefaultActivityOptions,
+			activityHandler.ReadRelationships,
+			&v1.ReadRelationshipsRequest{
+				RelationshipFilter: deleteByFilterExpr,
+			})
+
+		results, err := f.Get(ctx)
+		if err != nil {
+			klog.V(3).ErrorS(err, "failed to read relationships for delete by filter", "filter", deleteByFilterExpr.String())
+			return fmt.Errorf("unable to read relationships for delete by filter (%v): %w", deleteByFilterExpr, err)
+		}
+
+		for _, resp := range results {
+			*updates = append(*updates, &v1.RelationshipUpdate{
+				Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
+				Relationship: resp.Relationship,
+			})
+		}
+
+		klog.V(3).InfoS("found relationships for delete filter", "count", len(results), "filter", deleteByFilterExpr.String())
+	}
+
+	return nil
+}
+
+// eventualWriteToSpiceDBAndKubeV1 is version 1 of
+// EventualWriteToSpiceDBAndKube.
+func eventualWriteToSpiceDBAndKubeV1(ctx workflow.Context, input *WriteObjInput) (*KubeResp, error) {
+	if err := input.validate(); err != nil {
+		return nil, fmt.Errorf("invalid input to EventualWriteToSpiceDBAndKube: %w", err)
+	}
+
+	instance := workflow.WorkflowInstance(ctx)
+	maxAttempts := input.maxKubeAttempts()
+	backoff := input.kubeBackoff()
+
+	var (
+		out *KubeResp
+		err error
+	)
+	for i := 0; i < maxAttempts; i++ {
+		out, err = workflow.ExecuteActivity[*KubeResp](ctx,
+			input.activityOptions(),
+			activityHandler.WriteToKube,
+			input.toKubeReqInput()).Get(ctx)
+		if err == nil {
+			break
+		}
+		klog.V(2).ErrorS(err, "kube write failed, retrying")
+		if err := workflow.Sleep(ctx, backoff.Step()); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to communicate with kubernetes after %d attempts: %w", maxAttempts, err)
+	}
+
+	// nothing is written to SpiceDB if kube didn't write the object. A
+	// create that conflicts is someone else's object.
+	if input.RequestInfo.Verb == "delete" {
+		if !isSuccessfulDelete(out) {
+			return out, nil
+		}
+	} else if !isWrittenToKube(out) {
+		return out, nil
+	}
+
+	// nothing has been written to SpiceDB yet, so only kube is rolled back
+	// if the kube writes fail
+	if input.hasKubeWrites(out) {
+		kubeWrites, err := writeKubeWrites(ctx, input, out)
+		if err != nil {
+			return rollbackKubeWritesV1(ctx, input, out, kubeWrites, err)
+		}
+	}
+
+	outbox := &OutboxInput{
+		Preconditions:  input.Preconditions,
+		Updates:        updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships),
+		DeleteByFilter: input.DeleteByFilter,
+
+		MaxUpdatesPerWrite: input.MaxUpdatesPerWrite,
+	}
+	if input.DeferredUpdate != nil {
+		resolved, err := workflow.ExecuteActivity[*rules.ResolvedUpdate](ctx,
+			input.activityOptions(),
+			activityHandler.ResolveRelationships,
+			&ResolveRelationshipsInput{
+				RequestInfo:    input.RequestInfo,
+				UserInfo:       input.UserInfo,
+				Header:         input.Header,
+				Body:           input.Body,
+				Update:         input.DeferredUpdate.Update,
+				Object:         out.Body,
+				FallbackObject: input.DeferredUpdate.Object,
+			}).Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("kube %s succeeded, but relationships could not be resolved: %w", input.RequestInfo.Verb, err)
+		}
+		outbox.Updates = updatesForRelationships(resolved.CreateRelationships, resolved.TouchRelationships, resolved.DeleteRelationships)
+		outbox.DeleteByFilter = resolved.DeleteByFilter
+	}
+
+	if input.waitsForRemoval() {
+		return out, awaitRemoval(ctx, input, out, outbox.Updates, outbox.DeleteByFilter)
+	}
+
+	_, err = workflow.ExecuteActivity[any](ctx,
+		input.activityOptions(),
+		activityHandler.StartOutbox,
+		outbox, instance.InstanceID).Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("kube %s succeeded, but relationships could not be queued: %w", input.RequestInfo.Verb, err)
+	}
+	return out, nil
+}
+
+// writeDeferredRelationshipsV1 is writeDeferredRelationships as version 1
+// of the workflows runs it.
+func writeDeferredRelationshipsV1(ctx workflow.Context, input *WriteObjInput, out *KubeResp, kubeWrites []*KubeReqInput) (*KubeResp, error) {
+	instance := workflow.WorkflowInstance(ctx)
+
+	resolved, err := workflow.ExecuteActivity[*rules.ResolvedUpdate](ctx,
+		input.activityOptions(),
+		activityHandler.ResolveRelationships,
+		&ResolveRelationshipsInput{
+			RequestInfo:    input.RequestInfo,
+			UserInfo:       input.UserInfo,
+			Header:         input.Header,
+			Body:           input.Body,
+			Update:         input.DeferredUpdate.Update,
+			Object:         out.Body,
+			FallbackObject: input.DeferredUpdate.Object,
+		}).Get(ctx)
+	if err != nil {
+		klog.ErrorS(err, "unable to resolve deferred relationships")
+		return rollbackKubeWritesV1(ctx, input, out, kubeWrites, err)
+	}
+
+	updates := updatesForRelationships(resolved.CreateRelationships, resolved.TouchRelationships, resolved.DeleteRelationships)
+	if input.waitsForRemoval() {
+		if err := awaitRemoval(ctx, input, out, updates, resolved.DeleteByFilter); err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+	if err := appendDeletesFromFilters(ctx, input.activityOptions(), resolved.DeleteByFilter, input.MaxUpdatesPerWrite, &updates); err != nil {
+		return rollbackKubeWritesV1(ctx, input, out, kubeWrites, err)
+	}
+
+	written, err := writeChunks(ctx, input.activityOptions(), instance.InstanceID, nil, updates, input.MaxUpdatesPerWrite)
+	if err != nil {
+		klog.ErrorS(err, "deferred spicedb write failed")
+		NewRollbackRelationships(written...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed deferred SpiceDB write")
+		return rollbackKubeWritesV1(ctx, input, out, kubeWrites, err)
+	}
+
+	return out, nil
+}
+
+// rollbackKubeWritesV1 is rollbackKubeWrites as version 1 of the workflows
+// runs it.
+func rollbackKubeWritesV1(ctx workflow.Context, input *WriteObjInput, out *KubeResp, deletes []*KubeReqInput, cause error) (*KubeResp, error) {
+	klog.ErrorS(cause, "kube writes failed, rolling back")
+	deleteKubeWrites(ctx, input, deletes)
+	return compensateKubeWriteV1(ctx, input, out, cause)
+}
+
+// compensateKubeWriteV1 is compensateKubeWrite as version 1 of the
+// workflows runs it, which retries the delete without a backoff.
+func compensateKubeWriteV1(ctx workflow.Context, input *WriteObjInput, out *KubeResp, cause error) (*KubeResp, error) {
+	if input.RequestInfo.Verb != "create" {
+		return nil, fmt.Errorf("kube %s succeeded, but relationships could not be written: %w", input.RequestInfo.Verb, cause)
+	}
+
+	var created metav1.PartialObjectMetadata
+	if err := json.Unmarshal(out.Body, &created); err != nil || created.Name == "" {
+		return nil, fmt.Errorf("unable to determine created object to roll back after %w", cause)
+	}
+
+	deleteInput, err := deleteCreatedObjectInput(input.RequestInfo, &created)
+	if err != nil {
+		return nil, err
+	}
+
+	maxAttempts := input.maxKubeAttempts()
+	for i := 0; i < maxAttempts; i++ {
+		resp, err := workflow.ExecuteActivity[*KubeResp](ctx,
+			input.activityOptions(),
+			activityHandler.WriteToKube,
+			deleteInput).Get(ctx)
+		if err != nil {
+			klog.V(2).ErrorS(err, "kube delete of created object failed, retrying")
+			continue
+		}
+		if !isSuccessfulDelete(resp) {
+			return nil, fmt.Errorf("unable to delete created object %s after failed relationship write: %s", created.Name, resp.Body)
+		}
+
+		klog.V(3).InfoS("deleted created object after failed relationship write", "name", created.Name, "namespace", created.Namespace)
+		return KubeConflict(cause, input), nil
+	}
+
+	return nil, fmt.Errorf("failed to delete created object %s after %d attempts: %w", created.Name, maxAttempts, cause)
+}
+
+// applyRelationshipsV1 is version 1 of ApplyRelationships.
+func applyRelationshipsV1(ctx workflow.Context, input *OutboxInput) error {
+	instance := workflow.WorkflowInstance(ctx)
+	interval := OutboxRetryInterval
+
+	for {
+		err := applyOutboxV1(ctx, instance.InstanceID, input)
+		if err == nil {
+			return nil
+		}
+		if isRejectedBySpiceDB(err) {
+			klog.ErrorS(err, "unrecoverable error when applying relationships from the outbox")
+			return fmt.Errorf("unable to apply relationships: %w", err)
+		}
+		klog.V(2).ErrorS(err, "unable to apply relationships from the outbox, retrying", "interval", interval)
+
+		if err := workflow.Sleep(ctx, interval); err != nil {
+			return err
+		}
+		interval = min(interval*2, MaxOutboxRetryInterval)
+	}
+}
+
+// applyOutboxV1 is applyOutbox as version 1 of ApplyRelationships runs it.
+func applyOutboxV1(ctx workflow.Context, workflowID string, input *OutboxInput) error {
+	updates := input.Updates
+	if err := appendDeletesFromFilters(ctx, workflow.DefaultActivityOptions, input.DeleteByFilter, input.MaxUpdatesPerWrite, &updates); err != nil {
+		return err
+	}
+
+	// chunks that were written before a failure are skipped by their
+	// idempotency keys when the entry is retried
+	_, err := writeChunks(ctx, workflow.DefaultActivityOptions, workflowID, input.Preconditions, updates, input.MaxUpdatesPerWrite)
+	return err
+}
+
+// awaitRemovalV1 is version 1 of AwaitRemoval.
+func awaitRemovalV1(ctx workflow.Context, input *AwaitRemovalInput) (bool, error) {
+	instance := workflow.WorkflowInstance(ctx)
+	deadline := workflow.Now(ctx).Add(input.Timeout)
+	interval := RemovalPollInterval
+
+	for {
+		removed, err := workflow.ExecuteActivity[bool](ctx,
+			workflow.DefaultActivityOptions,
+			activityHandler.IsRemovedFromKube,
+			&RemovalInput{Path: input.Path, UID: input.UID}).Get(ctx)
+		if err != nil {
+			klog.V(2).ErrorS(err, "unable to determine whether object was removed, retrying", "path", input.Path)
+		} else if removed {
+			break
+		}
+
+		if !workflow.Now(ctx).Before(deadline) {
+			klog.InfoS("object was not removed before the timeout, keeping its relationships", "path", input.Path, "timeout", input.Timeout)
+			return false, nil
+		}
+
+		if err := workflow.Sleep(ctx, interval); err != nil {
+			return false, err
+		}
+		interval = min(interval*2, MaxRemovalPollInterval)
+	}
+
+	updates := input.Updates
+	if err := appendDeletesFromFilters(ctx, workflow.DefaultActivityOptions, input.DeleteByFilter, input.MaxUpdatesPerWrite, &updates); err != nil {
+		return false, fmt.Errorf("failed to append deletes from filters: %w", err)
+	}
+	if len(updates) == 0 {
+		return true, nil
+	}
+
+	_, err := writeChunks(ctx, workflow.DefaultActivityOptions, instance.InstanceID, nil, updates, input.MaxUpdatesPerWrite)
+	if err != nil {
+		return false, fmt.Errorf("unable to write relationships after object was removed: %w", err)
+	}
+
+	klog.V(3).InfoS("wrote relationships after object was removed", "path", input.Path, "count", len(updates))
+	return true, nil
+}
+
+// appendDeletesFromFilters reads the relationships that match the delete
+// filters, and appends updates that delete them, before version 2 of the
+// workflows writes anything. The relationships are read
+// page by page, with pages of the size of a chunk of writeChunks, so that no
+// single activity result grows with the number of matches.
+func appendDeletesFromFilters(
+	ctx workflow.Context,
+	opts workflow.ActivityOptions,
+	filters []*v1.RelationshipFilter,
+	maxUpdatesPerWrite int,
+	updates *[]*v1.RelationshipUpdate,
+) error {
+	pageSize := chunkSize(maxUpdatesPerWrite)
+	for _, deleteByFilterExpr := range filters {
+		klog.V(3).InfoS("loading relationships for delete filter", "filter", deleteByFilterExpr.String())
+
+		// We need to read the relationships that match the filter and delete them
+		// in the updates list. This is to ensure we have consistent deletion on
+		// retries.
+		var (
+			cursor *v1.Cursor
+			count  int
+		)
+		for {
+			page, err := workflow.ExecuteActivity[*RelationshipsPage](ctx,
+				opts,
+				activityHandler.ReadRelationshipsPage,
+				&v1.ReadRelationshipsRequest{
+					RelationshipFilter: deleteByFilterExpr,
+					OptionalLimit:      uint32(pageSize),
+					OptionalCursor:     cursor,
+				}).Get(ctx)
+			if err != nil {
+				klog.V(3).ErrorS(err, "failed to read relationships for delete by filter", "filter", deleteByFilterExpr.String())
+				return fmt.Errorf("unable to read relationships for delete by filter (%v): %w", deleteByFilterExpr, err)
+			}
+
+			for _, rel := range page.Relationships {
+				*updates = append(*updates, &v1.RelationshipUpdate{
+					Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
+					Relationship: rel,
+				})
+			}
+			count += len(page.Relationships)
+
+			if page.Cursor == nil {
+				break
+			}
+			cursor = page.Cursor
+		}
+
+		klog.V(3).InfoS("found relationships for delete filter", "count", count, "filter", deleteByFilterExpr.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,230 @@
+package distributedtx
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cschleiden/go-workflows/workflow"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+)
+
+// The functions in this file are version 2 of the workflows that existed
+// before versioning, which instances that were started before version 3
+// keep running until they complete. They are frozen copies, and must not
+// change, see docs/workflow-versioning.md.
+
+// pessimisticWriteToSpiceDBAndKubeV2 is version 2 of
+// PessimisticWriteToSpiceDBAndKube.
+func pessimisticWriteToSpiceDBAndKubeV2(ctx workflow.Context, input *WriteObjInput) (*KubeResp, error) {
+	if err := input.validate(); err != nil {
+		return nil, fmt.Errorf("invalid input to PessimisticWriteToSpiceDBAndKube: %w", err)
+	}
+
+	instance := workflow.WorkflowInstance(ctx)
+	lock := &Lock{Key: LockKey(input, instance.InstanceID), Holder: instance.InstanceID}
+
+	// the lock is released when the workflow is complete, after any
+	// rollback. Releasing a lock that the workflow doesn't hold is a no-op.
+	defer releaseLock(ctx, lock)
+
+	_, err := workflow.ExecuteActivity[any](ctx,
+		input.activityOptions(),
+		activityHandler.AcquireLock,
+		lock).Get(ctx)
+	if err != nil {
+		klog.V(2).ErrorS(err, "unable to acquire lock", "key", lock.Key)
+		return KubeConflict(err, input), nil
+	}
+
+	// tuples to remove when the workflow is complete.
+	// in some cases we will roll back the input.
+	rollback := NewRollbackRelationships()
+
+	// if the workflow waits for the object to be removed, nothing is
+	// written before the kube write.
+	var updates []*v1.RelationshipUpdate
+	if !input.waitsForRemoval() {
+		updates = updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships)
+
+		// Issue a read relationships for any delete filter(s) and add those relationships
+		// to be deleted to the updates list. This is to ensure we have consistent deletion
+		// on retries.
+		if err := appendDeletesFromFilters(ctx, input.activityOptions(), input.DeleteByFilter, input.MaxUpdatesPerWrite, &updates); err != nil {
+			return nil, fmt.Errorf("failed to append deletes from filters: %w", err)
+		}
+	}
+
+	if len(updates) > 0 {
+		_, err := writeChunks(ctx, input.activityOptions(), instance.InstanceID, input.Preconditions, updates, input.MaxUpdatesPerWrite)
+		if err != nil {
+			// request failed for some reason
+			klog.ErrorS(err, "spicedb write failed")
+			for _, u := range updates {
+				klog.V(3).InfoS("update details", "update", u.String(), "relationship", u)
+			}
+
+			rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed SpiceDB write")
+
+			// if the spicedb write fails, report it as a kube conflict error
+			// we return this for any error, not just lock conflicts, so that the
+			// user will attempt to retry instead of the workflow (nothing from the
+			// workflow has succeeded, so there's not much use in retrying automatically).
+			return KubeConflict(err, input), nil
+		}
+	}
+
+	maxAttempts := input.maxKubeAttempts()
+	backoff := input.kubeBackoff()
+	for i := 0; i < maxAttempts; i++ {
+		// Attempt to write to kube
+		out, err := workflow.ExecuteActivity[*KubeResp](ctx,
+			input.activityOptions(),
+			activityHandler.WriteToKube,
+			input.toKubeReqInput()).Get(ctx)
+		if err != nil {
+			// didn't get a response from kube, try again
+			klog.V(2).ErrorS(err, "kube write failed, retrying")
+			time.Sleep(backoff.Step())
+			continue
+		}
+
+		details := out.Err.ErrStatus.Details
+		if details != nil && details.RetryAfterSeconds > 0 {
+			time.Sleep(time.Duration(out.Err.ErrStatus.Details.RetryAfterSeconds) * time.Second)
+			continue
+		}
+
+		// Ensure we have a valid response status code for the Kubernetes request.
+		isSuccessful, err := isSuccessfulKuberentesOperation(input, out)
+		if err != nil {
+			klog.V(1).ErrorS(err, "error checking kube response", "response", out, "verb", input.RequestInfo.Verb)
+			rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed kube operation after max attempts")
+			return nil, fmt.Errorf("failed to communicate with kubernetes after %d attempts: %w", maxAttempts, err)
+		}
+
+		if isSuccessful {
+			var kubeWrites []*KubeReqInput
+			if input.hasKubeWrites(out) {
+				kubeWrites, err = writeKubeWrites(ctx, input, out)
+				if err != nil {
+					rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed kube writes")
+					return rollbackKubeWritesV1(ctx, input, out, kubeWrites, err)
+				}
+			}
+
+			switch {
+			case input.DeferredUpdate != nil && isWrittenToKube(out):
+				out, err = writeDeferredRelationshipsV1(ctx, input, out, kubeWrites)
+			case input.waitsForRemoval():
+				err = awaitRemoval(ctx, input, out,
+					updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships),
+					input.DeleteByFilter)
+			}
+			rollback.Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, fmt.Sprintf("cleanup after successful kube operation: %s", input.RequestInfo.Verb))
+			return out, err
+		}
+
+		klog.V(3).ErrorS(err, "unsuccessful Kube API operation on PessimisticWriteToSpiceDBAndKube", "response", out, "verb", input.RequestInfo.Verb)
+		rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to unsuccessful kube operation")
+		return out, nil
+	}
+
+	rollback.WithRels(updates...).Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed kube operation after max attempts")
+	return nil, fmt.Errorf("failed to communicate with kubernetes after %d attempts", maxAttempts)
+}
+
+// optimisticWriteToSpiceDBAndKubeV2 is version 2 of
+// OptimisticWriteToSpiceDBAndKube.
+func optimisticWriteToSpiceDBAndKubeV2(ctx workflow.Context, input *WriteObjInput) (*KubeResp, error) {
+	if err := input.validate(); err != nil {
+		return nil, fmt.Errorf("invalid input to PessimisticWriteToSpiceDBAndKube: %w", err)
+	}
+
+	// kube rejects objects i.e. because of validation, quotas or admission
+	// webhooks. The preflight finds those before SpiceDB is written, so that
+	// nothing has to be rolled back.
+	if input.Preflight {
+		out, err := workflow.ExecuteActivity[*KubeResp](ctx,
+			input.activityOptions(),
+			activityHandler.PreflightKube,
+			input.toKubeReqInput()).Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("kube preflight failed: %w", err)
+		}
+		if !isSuccessfulPreflight(input, out) {
+			klog.V(3).InfoS("kube rejected preflight", "verb", input.RequestInfo.Verb, "status", out.StatusCode)
+			return out, nil
+		}
+	}
+
+	// if the workflow waits for the object to be removed, nothing is written
+	// before the kube write.
+	var updates []*v1.RelationshipUpdate
+	if !input.waitsForRemoval() {
+		updates = updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships)
+
+		// Issue a read relationships for any delete filter(s) and add those relationships
+		// to be deleted to the updates list. This is to ensure we have consistent deletion
+		// on retries.
+		if err := appendDeletesFromFilters(ctx, input.activityOptions(), input.DeleteByFilter, input.MaxUpdatesPerWrite, &updates); err != nil {
+			return nil, fmt.Errorf("failed to append deletes from filters: %w", err)
+		}
+	}
+
+	instance := workflow.WorkflowInstance(ctx)
+	rollback := NewRollbackRelationships(updates...)
+	_, err := writeChunks(ctx, input.activityOptions(), instance.InstanceID, nil, updates, input.MaxUpdatesPerWrite)
+	if err != nil {
+		rollback.Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed SpiceDB write")
+		klog.ErrorS(err, "SpiceDB write failed")
+		// report spicedb write errors as conflicts
+		return KubeConflict(err, input), nil
+	}
+
+	out, err := workflow.ExecuteActivity[*KubeResp](ctx,
+		input.activityOptions(),
+		activityHandler.WriteToKube,
+		input.toKubeReqInput()).Get(ctx)
+	if err != nil {
+		// if there's an error, might need to roll back the spicedb write
+
+		// check if object exists - the activity may have failed, but the write to Kube could have succeeded
+		exists, err := workflow.ExecuteActivity[bool](ctx,
+			input.activityOptions(),
+			activityHandler.CheckKubeResource,
+			input.toKubeReqInput()).Get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// if the object doesn't exist, clean up the spicedb write
+		if !exists {
+			rollback.Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed Kube write")
+			return nil, err
+		}
+	}
+
+	var kubeWrites []*KubeReqInput
+	if input.hasKubeWrites(out) {
+		kubeWrites, err = writeKubeWrites(ctx, input, out)
+		if err != nil {
+			rollback.Cleanup(ctx, instance.InstanceID, input.MaxUpdatesPerWrite, "rollback due to failed kube writes")
+			return rollbackKubeWritesV1(ctx, input, out, kubeWrites, err)
+		}
+	}
+
+	if input.DeferredUpdate != nil && isWrittenToKube(out) {
+		return writeDeferredRelationshipsV1(ctx, input, out, kubeWrites)
+	}
+
+	if input.waitsForRemoval() && (out == nil || isSuccessfulDelete(out)) {
+		err := awaitRemoval(ctx, input, out,
+			updatesForRelationships(input.CreateRelationships, input.TouchRelationships, input.DeleteRelationships),
+			input.DeleteByFilter)
+		return out, err
+	}
+
+	return out, nil
+}
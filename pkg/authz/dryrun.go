@@ -0,0 +1,162 @@
+package authz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/spicedb/pkg/tuple"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+// isDryRun returns whether the request asks kube not to persist the write,
+// i.e. `kubectl apply --dry-run=server`.
+func isDryRun(req *http.Request) bool {
+	return slices.Contains(req.URL.Query()["dryRun"], "All")
+}
+
+// performDryRun evaluates whether the relationship writes of the passed rule
+// would succeed, without writing them or starting a workflow. If they would,
+// the dry-run request is forwarded to kube, and a warning in the response
+// says so. Otherwise, the client gets the same conflict that the write would
+// have returned.
+func performDryRun(ctx context.Context, w http.ResponseWriter, req *http.Request, handler http.Handler, r *rules.RunnableRule, input *rules.ResolveInput, permissionsClient v1.PermissionsServiceClient, writeOptions WriteOptions) error {
+	var (
+		resolved *rules.ResolvedUpdate
+		err      error
+	)
+	deferred := resolveFromResponse(r.Update, input)
+	if deferred {
+		// the relationships can only be resolved against the object that
+		// kube writes, so only the preconditions are evaluated
+		resolved = &rules.ResolvedUpdate{}
+		resolved.Preconditions, err = r.Update.ResolvePreconditions(input)
+	} else {
+		resolved, err = r.Update.Resolve(input)
+	}
+	if err != nil {
+		return err
+	}
+
+	writeInput := &distributedtx.WriteObjInput{
+		RequestInfo:     input.Request,
+		LockGranularity: writeOptions.forRule(r).LockGranularity,
+	}
+	if input.Object != nil {
+		writeInput.ObjectMeta = &input.Object.ObjectMeta
+	}
+
+	if err := EvaluateRelationshipWrites(ctx, permissionsClient, writeOptions.Locks, r.LockMode, writeInput, resolved); err != nil {
+		klog.FromContext(ctx).V(3).Info("dry run relationship writes would fail", "reason", err.Error())
+		resp := distributedtx.KubeConflict(err, writeInput)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		if _, err := w.Write(resp.Body); err != nil {
+			return fmt.Errorf("failed to write response: %w", err)
+		}
+		return nil
+	}
+
+	message := "dry run: the relationship writes would succeed"
+	if deferred {
+		message = "dry run: the relationship preconditions would succeed, relationships that are resolved from the response were not evaluated"
+	}
+	warning, err := utilnet.NewWarningHeader(299, "-", message)
+	if err != nil {
+		return fmt.Errorf("failed to create warning: %w", err)
+	}
+	w.Header().Add("Warning", warning)
+
+	handler.ServeHTTP(w, req)
+	return nil
+}
+
+// EvaluateRelationshipWrites returns an error if writing the resolved
+// relationships would fail, by reading the relationships that the
+// preconditions and the creates filter on and, in pessimistic mode, whether
+// the lock of the object is held in the lock backend. If locks is nil, the
+// locks are read from SpiceDB.
+func EvaluateRelationshipWrites(ctx context.Context, permissionsClient v1.PermissionsServiceClient, locks distributedtx.LockBackend, lockMode proxyrule.LockMode, input *distributedtx.WriteObjInput, resolved *rules.ResolvedUpdate) error {
+	if lockMode != proxyrule.OptimisticLockMode && lockMode != proxyrule.EventualLockMode {
+		if locks == nil {
+			locks = &distributedtx.SpiceDBLockBackend{PermissionClient: permissionsClient}
+		}
+		held, err := locks.Held(ctx, distributedtx.LockKey(input, "dryrun"))
+		if err != nil {
+			return err
+		}
+		if held {
+			return distributedtx.ErrLocked
+		}
+	}
+
+	for _, precondition := range resolved.Preconditions {
+		matches, err := anyRelationshipMatches(ctx, permissionsClient, precondition.Filter)
+		if err != nil {
+			return err
+		}
+		switch {
+		case precondition.Operation == v1.Precondition_OPERATION_MUST_MATCH && !matches:
+			return fmt.Errorf("precondition failed: no relationship matches %s", precondition.Filter)
+		case precondition.Operation == v1.Precondition_OPERATION_MUST_NOT_MATCH && matches:
+			return fmt.Errorf("precondition failed: a relationship matches %s", precondition.Filter)
+		}
+	}
+
+	for _, rel := range resolved.CreateRelationships {
+		filter := &v1.RelationshipFilter{
+			ResourceType:       rel.Resource.ObjectType,
+			OptionalResourceId: rel.Resource.ObjectId,
+			OptionalRelation:   rel.Relation,
+			OptionalSubjectFilter: &v1.SubjectFilter{
+				SubjectType:       rel.Subject.Object.ObjectType,
+				OptionalSubjectId: rel.Subject.Object.ObjectId,
+			},
+		}
+		if rel.Subject.OptionalRelation != "" {
+			filter.OptionalSubjectFilter.OptionalRelation = &v1.SubjectFilter_RelationFilter{Relation: rel.Subject.OptionalRelation}
+		}
+		exists, err := anyRelationshipMatches(ctx, permissionsClient, filter)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("relationship %s already exists", tuple.V1StringRelationshipWithoutCaveatOrExpiration(rel))
+		}
+	}
+
+	return nil
+}
+
+// anyRelationshipMatches returns whether SpiceDB has a relationship that
+// matches the filter.
+func anyRelationshipMatches(ctx context.Context, permissionsClient v1.PermissionsServiceClient, filter *v1.RelationshipFilter) (bool, error) {
+	stream, err := permissionsClient.ReadRelationships(ctx, &v1.ReadRelationshipsRequest{
+		Consistency: &v1.Consistency{
+			Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true},
+		},
+		RelationshipFilter: filter,
+		OptionalLimit:      1,
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to read relationships of %s: %w", filter.ResourceType, err)
+	}
+	_, err = stream.Recv()
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("unable to read relationships of %s: %w", filter.ResourceType, err)
+	}
+	return false, nil
+}
@@ -0,0 +1,193 @@
+package authz
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/spicedb/pkg/tuple"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+func TestIsDryRun(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want bool
+	}{
+		{name: "no dry run", url: "/api/v1/namespaces", want: false},
+		{name: "dry run", url: "/api/v1/namespaces?dryRun=All", want: true},
+		{name: "dry run with other params", url: "/api/v1/namespaces?fieldManager=kubectl&dryRun=All", want: true},
+		{name: "empty dry run", url: "/api/v1/namespaces?dryRun=", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.url, nil)
+			require.Equal(t, tt.want, isDryRun(req))
+		})
+	}
+}
+
+func TestPerformDryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	write := func(rels ...string) {
+		updates := make([]*v1.RelationshipUpdate, 0, len(rels))
+		for _, rel := range rels {
+			updates = append(updates, &v1.RelationshipUpdate{
+				Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
+				Relationship: tuple.MustParseV1Rel(rel),
+			})
+		}
+		_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: updates})
+		require.NoError(t, err)
+	}
+	write(
+		"namespace:taken#creator@user:janedoe",
+		"namespace:banned#viewer@user:banned",
+	)
+	input := func(name string) *rules.ResolveInput {
+		return rules.NewResolveInput(
+			&request.RequestInfo{Verb: "create", Resource: "namespaces", Path: "/api/v1/namespaces"},
+			&user.DefaultInfo{Name: "janedoe"},
+			&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: name}},
+			[]byte("{}"), nil)
+	}
+	lock := distributedtx.ResourceLockRel(&distributedtx.WriteObjInput{
+		RequestInfo: input("locked").Request,
+		ObjectMeta:  &input("locked").Object.ObjectMeta,
+	}, "other").Relationship
+	_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: []*v1.RelationshipUpdate{{
+		Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
+		Relationship: lock,
+	}}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		lockMode      proxyrule.LockMode
+		locks         distributedtx.LockBackend
+		resolveFrom   proxyrule.ResolveMode
+		object        string
+		wantStatus    int
+		wantForwarded bool
+		wantWarning   string
+		wantMessage   string
+	}{
+		{
+			name:          "writes would succeed",
+			object:        "new",
+			wantStatus:    http.StatusCreated,
+			wantForwarded: true,
+			wantWarning:   `299 - "dry run: the relationship writes would succeed"`,
+		},
+		{
+			name:        "relationship already exists",
+			object:      "taken",
+			wantStatus:  http.StatusConflict,
+			wantMessage: "relationship namespace:taken#creator@user:janedoe already exists",
+		},
+		{
+			name:        "precondition fails",
+			object:      "banned",
+			wantStatus:  http.StatusConflict,
+			wantMessage: "precondition failed",
+		},
+		{
+			name:        "object is locked",
+			object:      "locked",
+			wantStatus:  http.StatusConflict,
+			wantMessage: "the object is locked by another write",
+		},
+		{
+			name:        "object is locked in the lock backend",
+			locks:       heldLocks{},
+			object:      "new",
+			wantStatus:  http.StatusConflict,
+			wantMessage: "the object is locked by another write",
+		},
+		{
+			name:          "optimistic mode ignores locks",
+			lockMode:      proxyrule.OptimisticLockMode,
+			object:        "locked",
+			wantStatus:    http.StatusCreated,
+			wantForwarded: true,
+			wantWarning:   `299 - "dry run: the relationship writes would succeed"`,
+		},
+		{
+			name:          "relationships resolved from the response",
+			resolveFrom:   proxyrule.ResolveFromResponse,
+			object:        "taken",
+			wantStatus:    http.StatusCreated,
+			wantForwarded: true,
+			wantWarning:   `299 - "dry run: the relationship preconditions would succeed, relationships that are resolved from the response were not evaluated"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := rules.Compile(proxyrule.Config{Spec: proxyrule.Spec{
+				Locking: tt.lockMode,
+				Matches: []proxyrule.Match{{GroupVersion: "v1", Resource: "namespaces", Verbs: []string{"create"}}},
+				Update: proxyrule.Update{
+					ResolveFrom: tt.resolveFrom,
+					PreconditionDoesNotExist: []proxyrule.StringOrTemplate{{
+						Template: "namespace:{{name}}#viewer@user:banned",
+					}},
+					CreateRelationships: []proxyrule.StringOrTemplate{{
+						Template: "namespace:{{name}}#creator@user:{{user.name}}",
+					}},
+				},
+			}})
+			require.NoError(t, err)
+
+			forwarded := false
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				forwarded = true
+				w.WriteHeader(http.StatusCreated)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/namespaces?dryRun=All", nil)
+			recorder := httptest.NewRecorder()
+			require.NoError(t, performDryRun(ctx, recorder, req, handler, rule, input(tt.object), psc, WriteOptions{Locks: tt.locks}))
+
+			require.Equal(t, tt.wantStatus, recorder.Code)
+			require.Equal(t, tt.wantForwarded, forwarded)
+			require.Equal(t, tt.wantWarning, recorder.Header().Get("Warning"))
+			require.Contains(t, recorder.Body.String(), tt.wantMessage)
+		})
+	}
+
+	// nothing was written to SpiceDB
+	stream, err := psc.ReadRelationships(ctx, &v1.ReadRelationshipsRequest{
+		Consistency:        &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+		RelationshipFilter: &v1.RelationshipFilter{ResourceType: "namespace", OptionalResourceId: "new"},
+	})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+// heldLocks is a lock backend, like the lease backend, whose locks are all
+// held and can't be seen in SpiceDB.
+type heldLocks struct {
+	distributedtx.LockBackend
+}
+
+func (heldLocks) Held(context.Context, string) (bool, error) {
+	return true, nil
+}
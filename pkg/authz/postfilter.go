@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 
 	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
@@ -70,20 +69,9 @@ func filterItemsWithBulkPermissions(ctx context.Context, items []interface{}, fi
 			continue
 		}
 
-		// Convert item to PartialObjectMetadata
-		var objectMeta *metav1.PartialObjectMetadata
-		if metadata, ok := itemMap["metadata"].(map[string]interface{}); ok {
-			objectMeta = &metav1.PartialObjectMetadata{}
-			if name, ok := metadata["name"].(string); ok {
-				objectMeta.Name = name
-			}
-			if namespace, ok := metadata["namespace"].(string); ok {
-				objectMeta.Namespace = namespace
-			}
-		}
-
-		// Create a new input with the current item data
-		itemInput := rules.NewResolveInput(input.Request, input.User, objectMeta, nil, nil)
+		// Create a new input with the full item, so that rules can refer to
+		// any of its fields
+		itemInput := rules.NewResolveInputFromObject(input.Request, input.User, itemMap)
 
 		// Create permission check requests for all PostFilter rules
 		for _, r := range filteredRules {
@@ -377,3 +377,50 @@ func TestShouldRunPostFilters(t *testing.T) {
 	require.False(t, shouldRunPostFilters("delete", []*rules.RunnableRule{rulesWithPostFilter}))
 	require.False(t, shouldRunPostFilters("watch", []*rules.RunnableRule{rulesWithPostFilter}))
 }
+
+func TestFilterItemsWithBulkPermissionsOnSpec(t *testing.T) {
+	mockClient := &mockPermissionsClient{
+		responses: map[string]*v1.CheckPermissionResponse{
+			"node:node-1#view@user:testuser": {
+				Permissionship: v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION,
+			},
+		},
+	}
+
+	filteredRules, err := rules.Compile(proxyrule.Config{
+		Spec: proxyrule.Spec{
+			Matches: []proxyrule.Match{{
+				GroupVersion: "v1",
+				Resource:     "pods",
+				Verbs:        []string{"list"},
+			}},
+			PostFilters: []proxyrule.PostFilter{{
+				CheckPermissionTemplate: &proxyrule.StringOrTemplate{
+					Template: "node:{{object.spec.nodeName}}#view@user:{{user.name}}",
+				},
+			}},
+		},
+	})
+	require.NoError(t, err)
+
+	input := &rules.ResolveInput{
+		Request: &request.RequestInfo{Verb: "list"},
+		User:    &user.DefaultInfo{Name: "testuser"},
+	}
+
+	items := []interface{}{
+		map[string]interface{}{
+			"metadata": map[string]interface{}{"name": "testpod1", "namespace": "default"},
+			"spec":     map[string]interface{}{"nodeName": "node-1"},
+		},
+		map[string]interface{}{
+			"metadata": map[string]interface{}{"name": "testpod2", "namespace": "default"},
+			"spec":     map[string]interface{}{"nodeName": "node-2"},
+		},
+	}
+
+	allowedItems, err := filterItemsWithBulkPermissions(t.Context(), items, []*rules.RunnableRule{filteredRules}, input, mockClient)
+	require.NoError(t, err)
+	require.Len(t, allowedItems, 1)
+	require.Equal(t, "testpod1", allowedItems[0].(map[string]interface{})["metadata"].(map[string]interface{})["name"])
+}
@@ -93,13 +93,16 @@ func NewResponseFilterer(restMapper meta.RESTMapper, input *rules.ResolveInput,
 }
 
 // NewResponseFiltererForWatch creates a new ResponseFilterer specifically for watch requests.
-func NewResponseFiltererForWatch(restMapper meta.RESTMapper, input *rules.ResolveInput, foundWatchRule *rules.RunnableRule, watchClient v1.WatchServiceClient, checkClient v1.PermissionsServiceClient) (*WatchResponseFilterer, error) {
+// Events for objects that pass the pre-filter of the watch rule are
+// additionally checked against the postFilterRules, if any.
+func NewResponseFiltererForWatch(restMapper meta.RESTMapper, input *rules.ResolveInput, foundWatchRule *rules.RunnableRule, postFilterRules []*rules.RunnableRule, watchClient v1.WatchServiceClient, checkClient v1.PermissionsServiceClient) (*WatchResponseFilterer, error) {
 	return &WatchResponseFilterer{
-		restMapper:  restMapper,
-		input:       input,
-		watchRule:   foundWatchRule,
-		checkClient: checkClient,
-		watchClient: watchClient,
+		restMapper:      restMapper,
+		input:           input,
+		watchRule:       foundWatchRule,
+		postFilterRules: postFilterRules,
+		checkClient:     checkClient,
+		watchClient:     watchClient,
 	}, nil
 }
 
@@ -422,11 +425,12 @@ type decodedWatchEvent struct {
 
 // WatchResponseFilterer is used to filter watch responses based on the rules and authz data.
 type WatchResponseFilterer struct {
-	restMapper  meta.RESTMapper
-	input       *rules.ResolveInput
-	watchRule   *rules.RunnableRule
-	checkClient v1.PermissionsServiceClient
-	watchClient v1.WatchServiceClient
+	restMapper      meta.RESTMapper
+	input           *rules.ResolveInput
+	watchRule       *rules.RunnableRule
+	postFilterRules []*rules.RunnableRule
+	checkClient     v1.PermissionsServiceClient
+	watchClient     v1.WatchServiceClient
 
 	watchResultTracker *watchResultTracker
 }
@@ -676,6 +680,11 @@ func (rf *WatchResponseFilterer) filterWatch(resp *http.Response, recognized boo
 						}
 					}
 
+					if !rf.postFilterAllows(resp.Request.Context(), event) {
+						klog.V(4).InfoS("watch event denied by post-filter", "name", pom.Name, "namespace", pom.Namespace)
+						continue
+					}
+
 					_, ok := allowedNames.Load(types.NamespacedName{Name: pom.Name, Namespace: pom.Namespace})
 					klog.V(4).InfoS("checked if resource is allowed", "name", pom.Name, "namespace", pom.Namespace, "allowed", ok)
 					if ok {
@@ -713,6 +722,40 @@ func (rf *WatchResponseFilterer) filterWatch(resp *http.Response, recognized boo
 	return nil
 }
 
+// postFilterAllows runs the post-filter checks against the object of a watch
+// event, and returns whether the event may be sent to the client.
+func (rf *WatchResponseFilterer) postFilterAllows(ctx context.Context, event decodedWatchEvent) bool {
+	if len(rf.postFilterRules) == 0 {
+		return true
+	}
+
+	var items []any
+	if table, ok := event.Object.(*metav1.Table); ok {
+		for _, r := range table.Rows {
+			var item map[string]any
+			if err := json.Unmarshal(r.Object.Raw, &item); err != nil {
+				klog.V(3).ErrorS(err, "error unmarshaling row object")
+				return false
+			}
+			items = append(items, item)
+		}
+	} else {
+		item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(event.Object)
+		if err != nil {
+			klog.V(3).ErrorS(err, "error converting watch event object to unstructured")
+			return false
+		}
+		items = append(items, item)
+	}
+
+	allowed, err := filterItemsWithBulkPermissions(ctx, items, rf.postFilterRules, rf.input, rf.checkClient)
+	if err != nil {
+		klog.V(3).ErrorS(err, "error running post-filters for watch event")
+		return false
+	}
+	return len(allowed) == len(items)
+}
+
 func writeResp(filteredBody bytes.Buffer, filterErr error, resp *http.Response) error {
 	// if there was an error, replace the body with an error message
 	if filterErr != nil {
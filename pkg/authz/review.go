@@ -0,0 +1,356 @@
+package authz
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/samber/lo"
+	"google.golang.org/grpc/status"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/handlers/negotiation"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+// Decision is the answer to whether the rules authorize a request.
+type Decision string
+
+const (
+	// DecisionAllow means that the rules authorize the request.
+	DecisionAllow Decision = "Allow"
+
+	// DecisionDeny means that rules match the request, but fail their
+	// conditions or checks.
+	DecisionDeny Decision = "Deny"
+
+	// DecisionNoOpinion means that no rule matches the request, or that the
+	// rules can't be evaluated without sending the request.
+	DecisionNoOpinion Decision = "NoOpinion"
+)
+
+// AccessReview is the answer of ReviewAccess.
+type AccessReview struct {
+	Decision Decision
+
+	// Reason explains the decision.
+	Reason string
+
+	// EvaluationError is set if the matching rules couldn't be evaluated,
+	// e.g. because their checks refer to the object of the request.
+	EvaluationError string
+
+	// Rules are the names of the rules that match the request and pass
+	// their conditions.
+	Rules []string
+
+	// PreFiltered is whether a list or watch is filtered by a prefilter,
+	// i.e. only returns the objects that the user may see.
+	PreFiltered bool
+
+	// PostFiltered is whether a list or watch is filtered by post-filters.
+	PostFiltered bool
+
+	// PostChecked is whether a get is only allowed if the object that kube
+	// returns passes post-checks.
+	PostChecked bool
+}
+
+// ReviewAccess answers whether the rules authorize the request that the
+// input describes, without sending it to kube. It matches the rules,
+// evaluates their CEL conditions and runs their checks for the user of the
+// input, like WithAuthorization does before forwarding a request.
+//
+// A request that no rule matches gets no opinion. So does a request with
+// checks that can't be resolved from the input alone, e.g. checks on the
+// name of the object for a request without a name; post-checks and
+// post-filters are never run, since they need the response of kube.
+func ReviewAccess(ctx context.Context, matcher rules.Matcher, permissionsClient v1.PermissionsServiceClient, input *rules.ResolveInput) *AccessReview {
+	if alwaysAllow(input.Request) {
+		return &AccessReview{Decision: DecisionAllow, Reason: "API discovery is always allowed"}
+	}
+
+	matchingRules := matcher.Match(input.Request)
+	if len(matchingRules) == 0 {
+		return &AccessReview{Decision: DecisionNoOpinion, Reason: "no rule matches the request"}
+	}
+
+	filteredRules, err := rules.FilterRulesWithCELConditions(matchingRules, input)
+	if err != nil {
+		return &AccessReview{
+			Decision:        DecisionNoOpinion,
+			Reason:          "the conditions of the matching rules can't be evaluated",
+			EvaluationError: err.Error(),
+		}
+	}
+	if len(filteredRules) == 0 {
+		return &AccessReview{Decision: DecisionDeny, Reason: "the request matches rules but fails their conditions"}
+	}
+	names := lo.Map(filteredRules, ruleToString)
+
+	var resolvedRels []*rules.ResolvedRel
+	for _, r := range filteredRules {
+		for _, c := range r.Checks {
+			rels, err := c.GenerateRelationships(input)
+			if err != nil {
+				return &AccessReview{
+					Decision:        DecisionNoOpinion,
+					Reason:          fmt.Sprintf("the checks of rule %s can't be resolved for the request", r.Name),
+					EvaluationError: err.Error(),
+					Rules:           names,
+				}
+			}
+			for _, rel := range rels {
+				if rel.ResourceID == "" || rel.SubjectID == "" {
+					return &AccessReview{
+						Decision: DecisionNoOpinion,
+						Reason:   fmt.Sprintf("the checks of rule %s depend on the object of the request", r.Name),
+						EvaluationError: fmt.Sprintf("check %s:%s#%s@%s:%s has an empty id",
+							rel.ResourceType, rel.ResourceID, rel.ResourceRelation, rel.SubjectType, rel.SubjectID),
+						Rules: names,
+					}
+				}
+			}
+			resolvedRels = append(resolvedRels, rels...)
+		}
+	}
+
+	if err := checkRelationships(ctx, permissionsClient, resolvedRels, "check"); err != nil {
+		// errors of SpiceDB itself, for the whole request or a single
+		// check, say nothing about the user
+		if _, ok := status.FromError(err); ok {
+			return &AccessReview{
+				Decision:        DecisionNoOpinion,
+				Reason:          "the checks of the matching rules can't be run",
+				EvaluationError: err.Error(),
+				Rules:           names,
+			}
+		}
+		return &AccessReview{Decision: DecisionDeny, Reason: err.Error(), Rules: names}
+	}
+
+	review := &AccessReview{
+		Decision: DecisionAllow,
+		Reason:   "allowed by rules " + strings.Join(names, ", "),
+		Rules:    names,
+	}
+	if input.Request.Verb == "list" || input.Request.Verb == "watch" {
+		if prefiltered := preFilterRules(filteredRules); len(prefiltered) > 0 {
+			review.PreFiltered = true
+			review.Reason += fmt.Sprintf("; the %s is filtered by the prefilter of rule %s", input.Request.Verb, prefiltered[0].Name)
+		} else {
+			review.Reason += fmt.Sprintf("; the %s isn't prefiltered", input.Request.Verb)
+		}
+		review.PostFiltered = len(postFilterRules(filteredRules)) > 0
+	}
+	if shouldRunPostChecks(input.Request.Verb) {
+		review.PostChecked = slices.ContainsFunc(filteredRules, func(r *rules.RunnableRule) bool {
+			return len(r.PostChecks) > 0
+		})
+	}
+	return review
+}
+
+// isSelfSubjectReview returns whether the request creates a
+// SelfSubjectAccessReview or SelfSubjectRulesReview. The proxy answers them
+// itself, since kube would answer them for the identity of the proxy.
+func isSelfSubjectReview(info *request.RequestInfo) bool {
+	return info.IsResourceRequest &&
+		info.Verb == "create" &&
+		info.APIGroup == authorizationv1.GroupName &&
+		info.APIVersion == authorizationv1.SchemeGroupVersion.Version &&
+		(info.Resource == "selfsubjectaccessreviews" || info.Resource == "selfsubjectrulesreviews")
+}
+
+// performSelfSubjectReview answers a SelfSubjectAccessReview or
+// SelfSubjectRulesReview for the user of the request with the rules of the
+// proxy.
+func performSelfSubjectReview(ctx context.Context, w http.ResponseWriter, req *http.Request, restMapper meta.RESTMapper, matcher rules.Matcher, permissionsClient v1.PermissionsServiceClient, input *rules.ResolveInput) error {
+	obj, _, err := codecs.UniversalDeserializer().Decode(input.Body, nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to decode review: %w", err)
+	}
+
+	switch review := obj.(type) {
+	case *authorizationv1.SelfSubjectAccessReview:
+		review.Status = reviewSelfSubjectAccess(ctx, restMapper, matcher, permissionsClient, input.User, &review.Spec)
+	case *authorizationv1.SelfSubjectRulesReview:
+		review.Status = reviewSelfSubjectRules(ctx, matcher, permissionsClient, input.User, review.Spec.Namespace)
+	default:
+		return fmt.Errorf("unexpected review type %T", obj)
+	}
+	klog.FromContext(ctx).V(3).Info("answered self subject review", "resource", input.Request.Resource, "user", input.User.GetName())
+
+	responsewriters.WriteObjectNegotiated(codecs, negotiation.DefaultEndpointRestrictions, authorizationv1.SchemeGroupVersion, w, req, http.StatusCreated, obj, false)
+	return nil
+}
+
+func reviewSelfSubjectAccess(ctx context.Context, restMapper meta.RESTMapper, matcher rules.Matcher, permissionsClient v1.PermissionsServiceClient, userInfo *user.DefaultInfo, spec *authorizationv1.SelfSubjectAccessReviewSpec) authorizationv1.SubjectAccessReviewStatus {
+	var info *request.RequestInfo
+	switch {
+	case spec.ResourceAttributes != nil:
+		info = ResourceAttributesRequestInfo(restMapper, spec.ResourceAttributes)
+	case spec.NonResourceAttributes != nil:
+		info = NonResourceAttributesRequestInfo(spec.NonResourceAttributes)
+	default:
+		return authorizationv1.SubjectAccessReviewStatus{EvaluationError: "the review has neither resource nor non-resource attributes"}
+	}
+
+	if isSelfSubjectReview(info) {
+		return authorizationv1.SubjectAccessReviewStatus{Allowed: true, Reason: "self subject reviews are answered by the proxy"}
+	}
+
+	return accessReviewStatus(ReviewAccess(ctx, matcher, permissionsClient, reviewInput(info, userInfo)))
+}
+
+// reviewSelfSubjectRules lists the requests in the namespace that the rules
+// authorize for the user. Requests with checks that depend on the object,
+// e.g. gets of objects that the user is related to, can't be listed, and
+// make the review incomplete.
+func reviewSelfSubjectRules(ctx context.Context, matcher rules.Matcher, permissionsClient v1.PermissionsServiceClient, userInfo *user.DefaultInfo, namespace string) authorizationv1.SubjectRulesReviewStatus {
+	reviewStatus := authorizationv1.SubjectRulesReviewStatus{
+		ResourceRules: []authorizationv1.ResourceRule{{
+			Verbs:     []string{"create"},
+			APIGroups: []string{authorizationv1.GroupName},
+			Resources: []string{"selfsubjectaccessreviews", "selfsubjectrulesreviews"},
+		}},
+		NonResourceRules: []authorizationv1.NonResourceRule{{
+			Verbs:           []string{"get"},
+			NonResourceURLs: []string{"/api", "/apis", "/openapi/v2"},
+		}},
+	}
+
+	lister, ok := matcher.(rules.RequestLister)
+	if !ok {
+		reviewStatus.Incomplete = true
+		reviewStatus.EvaluationError = "the rules of the proxy can't be listed"
+		return reviewStatus
+	}
+
+	type groupResource struct{ group, resource string }
+	var order []groupResource
+	verbs := make(map[groupResource][]string)
+	var evaluationErrors []string
+	for _, meta := range lister.Requests() {
+		if meta.Resource == "" {
+			continue
+		}
+		info := &request.RequestInfo{
+			IsResourceRequest: true,
+			Verb:              meta.Verb,
+			APIGroup:          meta.APIGroup,
+			APIVersion:        meta.APIVersion,
+			Resource:          meta.Resource,
+			Namespace:         namespace,
+		}
+		info.Path, info.Parts = resourcePath(info)
+
+		review := ReviewAccess(ctx, matcher, permissionsClient, reviewInput(info, userInfo))
+		if review.EvaluationError != "" {
+			evaluationErrors = append(evaluationErrors, fmt.Sprintf("%s %s: %s", meta.Verb, schema.GroupResource{Group: meta.APIGroup, Resource: meta.Resource}, review.EvaluationError))
+		}
+		if review.Decision != DecisionAllow {
+			continue
+		}
+
+		key := groupResource{group: meta.APIGroup, resource: meta.Resource}
+		if _, ok := verbs[key]; !ok {
+			order = append(order, key)
+		}
+		if !slices.Contains(verbs[key], meta.Verb) {
+			verbs[key] = append(verbs[key], meta.Verb)
+		}
+	}
+
+	for _, key := range order {
+		reviewStatus.ResourceRules = append(reviewStatus.ResourceRules, authorizationv1.ResourceRule{
+			Verbs:     verbs[key],
+			APIGroups: []string{key.group},
+			Resources: []string{key.resource},
+		})
+	}
+	if len(evaluationErrors) > 0 {
+		reviewStatus.Incomplete = true
+		reviewStatus.EvaluationError = strings.Join(evaluationErrors, "; ")
+	}
+	return reviewStatus
+}
+
+// accessReviewStatus converts an AccessReview to the status of a
+// SubjectAccessReview.
+func accessReviewStatus(review *AccessReview) authorizationv1.SubjectAccessReviewStatus {
+	return authorizationv1.SubjectAccessReviewStatus{
+		Allowed:         review.Decision == DecisionAllow,
+		Denied:          review.Decision == DecisionDeny,
+		Reason:          review.Reason,
+		EvaluationError: review.EvaluationError,
+	}
+}
+
+// reviewInput returns the input that rules are evaluated against for a
+// request that is only described, and has no body.
+func reviewInput(info *request.RequestInfo, userInfo *user.DefaultInfo) *rules.ResolveInput {
+	return rules.NewResolveInput(info, userInfo, &metav1.PartialObjectMetadata{
+		ObjectMeta: metav1.ObjectMeta{Name: info.Name, Namespace: info.Namespace},
+	}, nil, nil)
+}
+
+// ResourceAttributesRequestInfo returns the request info of a request with
+// the attributes of an access review. Reviews often leave the version
+// empty, e.g. `kubectl auth can-i`, so it is set to the preferred version of
+// the resource if the REST mapper knows it.
+func ResourceAttributesRequestInfo(restMapper meta.RESTMapper, attrs *authorizationv1.ResourceAttributes) *request.RequestInfo {
+	info := &request.RequestInfo{
+		IsResourceRequest: true,
+		Verb:              attrs.Verb,
+		APIGroup:          attrs.Group,
+		APIVersion:        attrs.Version,
+		Resource:          attrs.Resource,
+		Subresource:       attrs.Subresource,
+		Namespace:         attrs.Namespace,
+		Name:              attrs.Name,
+	}
+	if info.APIVersion == "" && restMapper != nil {
+		gvr, err := restMapper.ResourceFor(schema.GroupVersionResource{Group: attrs.Group, Resource: attrs.Resource})
+		if err == nil {
+			info.APIVersion = gvr.Version
+		}
+	}
+	info.Path, info.Parts = resourcePath(info)
+	return info
+}
+
+// NonResourceAttributesRequestInfo returns the request info of a
+// non-resource request with the attributes of an access review.
+func NonResourceAttributesRequestInfo(attrs *authorizationv1.NonResourceAttributes) *request.RequestInfo {
+	return &request.RequestInfo{
+		Verb: attrs.Verb,
+		Path: attrs.Path,
+	}
+}
+
+// resourcePath returns the path and the parts of the path after the
+// namespace, like the request info of a real request has them.
+func resourcePath(info *request.RequestInfo) (string, []string) {
+	prefix := path.Join("/apis", info.APIGroup, info.APIVersion)
+	if info.APIGroup == "" {
+		prefix = path.Join("/api", info.APIVersion)
+	}
+	if info.Namespace != "" && info.Resource != "namespaces" {
+		prefix = path.Join(prefix, "namespaces", info.Namespace)
+	}
+	parts := lo.Compact([]string{info.Resource, info.Name, info.Subresource})
+	return path.Join(append([]string{prefix}, parts...)...), parts
+}
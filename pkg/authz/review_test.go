@@ -0,0 +1,192 @@
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/spicedb/pkg/tuple"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+func TestSelfSubjectReviews(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: []*v1.RelationshipUpdate{{
+		Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
+		Relationship: tuple.MustParseV1Rel("namespace:visible#viewer@user:janedoe"),
+	}}})
+	require.NoError(t, err)
+
+	rule := func(name, resource string, verbs []string, spec proxyrule.Spec) proxyrule.Config {
+		spec.Matches = []proxyrule.Match{{GroupVersion: "v1", Resource: resource, Verbs: verbs}}
+		config := proxyrule.Config{Spec: spec}
+		config.Name = name
+		return config
+	}
+	var matcher rules.Matcher
+	matcher, err = rules.NewMapMatcher([]proxyrule.Config{
+		rule("get-namespaces", "namespaces", []string{"get"}, proxyrule.Spec{
+			Checks: []proxyrule.StringOrTemplate{{Template: "namespace:{{name}}#view@user:{{user.name}}"}},
+		}),
+		rule("list-namespaces", "namespaces", []string{"list", "watch"}, proxyrule.Spec{
+			PreFilters: []proxyrule.PreFilter{{
+				FromObjectIDNameExpr:    "{{resourceId}}",
+				LookupMatchingResources: &proxyrule.StringOrTemplate{Template: "namespace:$#view@user:{{user.name}}"},
+			}},
+		}),
+		rule("list-pods", "pods", []string{"list"}, proxyrule.Spec{}),
+		rule("admin-configmaps", "configmaps", []string{"list"}, proxyrule.Spec{
+			Checks: []proxyrule.StringOrTemplate{{Template: "namespace:{{namespace}}#admin@user:{{user.name}}"}},
+		}),
+	})
+	require.NoError(t, err)
+
+	restMapper := meta.NewDefaultRESTMapper(nil)
+	restMapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+
+	handler := WithAuthorization(
+		http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			require.Fail(t, "self subject reviews must not be forwarded")
+		}),
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}),
+		restMapper, psc, nil, nil, &matcher, rules.ResolveInputExtractorFunc(rules.NewResolveInputFromHttp), WriteOptions{},
+	)
+
+	review := func(resource string, in, out any) {
+		t.Helper()
+		body, err := json.Marshal(in)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/apis/authorization.k8s.io/v1/"+resource, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		reqCtx := request.WithRequestInfo(req.Context(), &request.RequestInfo{
+			IsResourceRequest: true,
+			Verb:              "create",
+			APIGroup:          "authorization.k8s.io",
+			APIVersion:        "v1",
+			Resource:          resource,
+		})
+		reqCtx = request.WithUser(reqCtx, &user.DefaultInfo{Name: "janedoe"})
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req.WithContext(reqCtx))
+		require.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), out))
+	}
+	accessReview := func(attrs *authorizationv1.ResourceAttributes) authorizationv1.SubjectAccessReviewStatus {
+		t.Helper()
+		var out authorizationv1.SelfSubjectAccessReview
+		review("selfsubjectaccessreviews", &authorizationv1.SelfSubjectAccessReview{
+			TypeMeta: typeMeta("SelfSubjectAccessReview"),
+			Spec:     authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attrs},
+		}, &out)
+		return out.Status
+	}
+
+	t.Run("allowed by checks", func(t *testing.T) {
+		status := accessReview(&authorizationv1.ResourceAttributes{Verb: "get", Resource: "namespaces", Name: "visible"})
+		require.True(t, status.Allowed)
+		require.Equal(t, "allowed by rules get-namespaces", status.Reason)
+	})
+	t.Run("denied by checks", func(t *testing.T) {
+		status := accessReview(&authorizationv1.ResourceAttributes{Verb: "get", Resource: "namespaces", Name: "hidden"})
+		require.False(t, status.Allowed)
+		require.True(t, status.Denied)
+		require.Contains(t, status.Reason, "namespace:hidden#view@user:janedoe")
+	})
+	t.Run("checks that depend on the object", func(t *testing.T) {
+		status := accessReview(&authorizationv1.ResourceAttributes{Verb: "get", Resource: "namespaces"})
+		require.False(t, status.Allowed)
+		require.False(t, status.Denied)
+		require.Contains(t, status.EvaluationError, "empty id")
+	})
+	t.Run("no matching rule", func(t *testing.T) {
+		status := accessReview(&authorizationv1.ResourceAttributes{Verb: "delete", Resource: "namespaces", Name: "visible"})
+		require.False(t, status.Allowed)
+		require.False(t, status.Denied)
+		require.Equal(t, "no rule matches the request", status.Reason)
+	})
+	t.Run("prefiltered list", func(t *testing.T) {
+		status := accessReview(&authorizationv1.ResourceAttributes{Verb: "list", Resource: "namespaces"})
+		require.True(t, status.Allowed)
+		require.Contains(t, status.Reason, "the list is filtered by the prefilter of rule list-namespaces")
+	})
+	t.Run("unfiltered list", func(t *testing.T) {
+		status := accessReview(&authorizationv1.ResourceAttributes{Verb: "list", Version: "v1", Resource: "pods", Namespace: "visible"})
+		require.True(t, status.Allowed)
+		require.Contains(t, status.Reason, "the list isn't prefiltered")
+	})
+
+	t.Run("rules review", func(t *testing.T) {
+		var out authorizationv1.SelfSubjectRulesReview
+		review("selfsubjectrulesreviews", &authorizationv1.SelfSubjectRulesReview{
+			TypeMeta: typeMeta("SelfSubjectRulesReview"),
+			Spec:     authorizationv1.SelfSubjectRulesReviewSpec{Namespace: "visible"},
+		}, &out)
+		require.Equal(t, []authorizationv1.ResourceRule{
+			{Verbs: []string{"create"}, APIGroups: []string{"authorization.k8s.io"}, Resources: []string{"selfsubjectaccessreviews", "selfsubjectrulesreviews"}},
+			{Verbs: []string{"list", "watch"}, APIGroups: []string{""}, Resources: []string{"namespaces"}},
+			{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+		}, out.Status.ResourceRules)
+		require.True(t, out.Status.Incomplete)
+		require.Contains(t, out.Status.EvaluationError, "get namespaces: check namespace:#view@user:janedoe has an empty id")
+	})
+}
+
+func TestResourcePath(t *testing.T) {
+	tests := []struct {
+		name      string
+		info      *request.RequestInfo
+		wantPath  string
+		wantParts []string
+	}{
+		{
+			name:      "namespaced core resource",
+			info:      &request.RequestInfo{APIVersion: "v1", Resource: "pods", Namespace: "default", Name: "web", Subresource: "log"},
+			wantPath:  "/api/v1/namespaces/default/pods/web/log",
+			wantParts: []string{"pods", "web", "log"},
+		},
+		{
+			name:      "cluster scoped group resource",
+			info:      &request.RequestInfo{APIGroup: "rbac.authorization.k8s.io", APIVersion: "v1", Resource: "clusterroles"},
+			wantPath:  "/apis/rbac.authorization.k8s.io/v1/clusterroles",
+			wantParts: []string{"clusterroles"},
+		},
+		{
+			name:      "namespace",
+			info:      &request.RequestInfo{APIVersion: "v1", Resource: "namespaces", Namespace: "default", Name: "default"},
+			wantPath:  "/api/v1/namespaces/default",
+			wantParts: []string{"namespaces", "default"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, parts := resourcePath(tt.info)
+			require.Equal(t, tt.wantPath, path)
+			require.Equal(t, tt.wantParts, parts)
+		})
+	}
+}
+
+func typeMeta(kind string) metav1.TypeMeta {
+	return metav1.TypeMeta{Kind: kind, APIVersion: authorizationv1.SchemeGroupVersion.String()}
+}
@@ -2,126 +2,125 @@ package authz
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/cschleiden/go-workflows/client"
 	"github.com/cschleiden/go-workflows/workflow"
 	"github.com/google/uuid"
-
-	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
 
 	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
 	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
 	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
 )
 
-func relsFromExprs(exprs []rules.RelationshipExpr, input *rules.ResolveInput) ([]*v1.Relationship, error) {
-	var rels []*v1.Relationship
-	for _, expr := range exprs {
-		resolvedRels, err := expr.GenerateRelationships(input)
-		if err != nil {
-			return nil, fmt.Errorf("unable to resolve write rule: %w", err)
-		}
-		for _, rel := range resolvedRels {
-			relationship := &v1.Relationship{
-				Resource: &v1.ObjectReference{
-					ObjectType: rel.ResourceType,
-					ObjectId:   rel.ResourceID,
-				},
-				Relation: rel.ResourceRelation,
-				Subject: &v1.SubjectReference{
-					Object: &v1.ObjectReference{
-						ObjectType: rel.SubjectType,
-						ObjectId:   rel.SubjectID,
-					},
-					OptionalRelation: rel.SubjectRelation,
-				},
-			}
-			if err := relationship.Validate(); err != nil {
-				return nil, fmt.Errorf("invalid relationship `%s`: %w", relationship, err)
-			}
-			rels = append(rels, relationship)
-		}
-	}
-	return rels, nil
-}
+// StatusReasonPendingApproval is the reason of the Status that the proxy
+// responds with to writes that wait for an approval.
+const StatusReasonPendingApproval metav1.StatusReason = "PendingApproval"
 
-// performUpdate performs a dual update according to the passed rule
-func performUpdate(ctx context.Context, w http.ResponseWriter, r *rules.RunnableRule, input *rules.ResolveInput, requestURI string, workflowClient *client.Client) error {
-	preconditions := make([]*v1.Precondition, 0, len(r.Update.MustExist)+len(r.Update.MustNotExist))
+// WriteOptions are the defaults for the dual writes of rules that don't set
+// their own retry policy or timeout.
+type WriteOptions struct {
+	// Timeout is how long the proxy waits for a dual write before it
+	// responds that the write is still in progress. The default is
+	// distributedtx.DefaultWorkflowTimeout.
+	Timeout time.Duration
 
-	createRels, err := relsFromExprs(r.Update.Creates, input)
-	if err != nil {
-		return fmt.Errorf("unable to resolve create relationships: %w", err)
-	}
+	// Retry is how often the workflows retry their writes.
+	Retry distributedtx.RetryPolicy
 
-	touchRels, err := relsFromExprs(r.Update.Touches, input)
-	if err != nil {
-		return fmt.Errorf("unable to resolve touch relationships: %w", err)
-	}
+	// LockGranularity is what pessimistic writes lock, one of the
+	// distributedtx.LockGranularity constants.
+	LockGranularity string
 
-	deleteRels, err := relsFromExprs(r.Update.Deletes, input)
-	if err != nil {
-		return fmt.Errorf("unable to resolve delete relationships: %w", err)
-	}
+	// MaxUpdatesPerWrite is how many relationship updates SpiceDB accepts
+	// in a single write. Larger writes are split into chunks.
+	MaxUpdatesPerWrite int
 
-	for _, precondition := range r.Update.MustExist {
-		resolvedRels, err := precondition.GenerateRelationships(input)
-		if err != nil {
-			return fmt.Errorf("unable to resolve must rule: %w", err)
-		}
-		// Create a precondition for each resolved relationship
-		for _, rel := range resolvedRels {
-			filterFromRel, err := filterFromRel(rel)
-			if err != nil {
-				return fmt.Errorf("unable to create filter from relationship (%v): %w", rel, err)
-			}
-			p := &v1.Precondition{
-				Filter: filterFromRel,
-			}
-			p.Operation = v1.Precondition_OPERATION_MUST_MATCH
-			preconditions = append(preconditions, p)
-		}
+	// Locks is where pessimistic writes store their locks, which dry runs
+	// check. If nil, the locks are read from SpiceDB.
+	Locks distributedtx.LockBackend
+}
+
+// forRule returns the options for the dual write of the passed rule, which
+// override the defaults field by field.
+func (o WriteOptions) forRule(r *rules.RunnableRule) WriteOptions {
+	if r.Timeout > 0 {
+		o.Timeout = r.Timeout
 	}
-	for _, precondition := range r.Update.MustNotExist {
-		resolvedRels, err := precondition.GenerateRelationships(input)
-		if err != nil {
-			return fmt.Errorf("unable to resolve must not rule: %w", err)
+	if r.Retry != nil {
+		if r.Retry.MaxAttempts > 0 {
+			o.Retry.MaxKubeAttempts = r.Retry.MaxAttempts
 		}
-		// Create a precondition for each resolved relationship
-		for _, rel := range resolvedRels {
-			filterFromRel, err := filterFromRel(rel)
-			if err != nil {
-				return fmt.Errorf("unable to create filter from relationship (%v): %w", rel, err)
-			}
-			p := &v1.Precondition{
-				Filter: filterFromRel,
-			}
-			p.Operation = v1.Precondition_OPERATION_MUST_NOT_MATCH
-			preconditions = append(preconditions, p)
+		if r.Retry.Backoff.Duration > 0 {
+			o.Retry.KubeBackoff = r.Retry.Backoff.Duration
 		}
+		if r.Retry.MaxActivityAttempts > 0 {
+			o.Retry.MaxActivityAttempts = r.Retry.MaxActivityAttempts
+		}
+	}
+	if r.LockGranularity != "" {
+		o.LockGranularity = string(r.LockGranularity)
 	}
+	if o.Timeout <= 0 {
+		o.Timeout = distributedtx.DefaultWorkflowTimeout
+	}
+	return o
+}
 
-	deleteByFilter := make([]*v1.RelationshipFilter, 0, len(r.Update.DeletesByFilter))
-	for _, deleteByFilterExpr := range r.Update.DeletesByFilter {
-		resolvedRels, err := deleteByFilterExpr.GenerateRelationships(input)
+// performUpdate performs a dual update according to the passed rule
+func performUpdate(ctx context.Context, w http.ResponseWriter, r *rules.RunnableRule, input *rules.ResolveInput, requestURI string, workflowClient *client.Client, writeOptions WriteOptions) error {
+	var (
+		resolved *rules.ResolvedUpdate
+		deferred *distributedtx.DeferredUpdate
+		err      error
+	)
+	if resolveFromResponse(r.Update, input) {
+		// the relationships are resolved against the object returned by
+		// kube in the workflow, since i.e. the name or uid of the object is
+		// only known once kube has written it. Preconditions are still
+		// checked before the write.
+		resolved = &rules.ResolvedUpdate{}
+		resolved.Preconditions, err = r.Update.ResolvePreconditions(input)
 		if err != nil {
-			return fmt.Errorf("unable to resolve delete by filter: %w", err)
+			return err
 		}
-		// Create a filter for each resolved relationship
-		for _, rel := range resolvedRels {
-			filter, err := filterFromRel(rel)
-			if err != nil {
-				return fmt.Errorf("unable to create filter from relationship (%v): %w", rel, err)
+		// the existing object is resolved as the oldObject, since it can't
+		// be fetched once kube has written the object, and stands in for
+		// the response of deletes that kube answers with a Status
+		if input.Request.Verb != "create" {
+			if err := input.LoadCurrentObject(); err != nil {
+				return err
 			}
-			deleteByFilter = append(deleteByFilter, filter)
 		}
+		deferred = &distributedtx.DeferredUpdate{
+			Update:    r.Update.Templates,
+			OldObject: input.OldObjectBody,
+		}
+		if input.Request.Verb == "delete" {
+			deferred.Object = input.OldObjectBody
+		}
+		deferred.Update.PreconditionExists = nil
+		deferred.Update.PreconditionDoesNotExist = nil
+		deferred.Update.KubeWrites = nil
+	} else {
+		resolved, err = r.Update.Resolve(input)
+		if err != nil {
+			return err
+		}
+	}
+
+	removal, err := waitForRemoval(r.Update, input)
+	if err != nil {
+		return err
 	}
 
-	resp, err := dualWrite(ctx, workflowClient, input, requestURI, createRels, touchRels, deleteRels, preconditions, deleteByFilter, r.LockMode)
+	resp, err := dualWrite(ctx, workflowClient, input, requestURI, resolved, deferred, r.Update.Templates.KubeWrites, removal, r.LockMode, r.Preflight, r.Approval, writeOptions.forRule(r))
 	if err != nil {
 		return fmt.Errorf("dual write failed: %w", err)
 	}
@@ -148,12 +147,14 @@ func dualWrite(
 	workflowClient *client.Client,
 	input *rules.ResolveInput,
 	requestURI string,
-	createRels []*v1.Relationship,
-	touchRels []*v1.Relationship,
-	deleteRels []*v1.Relationship,
-	preconditions []*v1.Precondition,
-	deleteByFilter []*v1.RelationshipFilter,
+	resolved *rules.ResolvedUpdate,
+	deferred *distributedtx.DeferredUpdate,
+	kubeWrites []proxyrule.KubeWrite,
+	waitForRemoval *distributedtx.WaitForRemoval,
 	lockMode proxyrule.LockMode,
+	preflight bool,
+	approval *rules.Approval,
+	opts WriteOptions,
 ) (*distributedtx.KubeResp, error) {
 	writeInput := &distributedtx.WriteObjInput{
 		RequestInfo:         input.Request,
@@ -161,11 +162,18 @@ func dualWrite(
 		UserInfo:            input.User,
 		Body:                input.Body,
 		Header:              input.Headers,
-		Preconditions:       preconditions,
-		CreateRelationships: createRels,
-		TouchRelationships:  touchRels,
-		DeleteRelationships: deleteRels,
-		DeleteByFilter:      deleteByFilter,
+		Preconditions:       resolved.Preconditions,
+		CreateRelationships: resolved.CreateRelationships,
+		TouchRelationships:  resolved.TouchRelationships,
+		DeleteRelationships: resolved.DeleteRelationships,
+		DeleteByFilter:      resolved.DeleteByFilter,
+		DeferredUpdate:      deferred,
+		KubeWrites:          kubeWrites,
+		WaitForRemoval:      waitForRemoval,
+		Retry:               &opts.Retry,
+		LockGranularity:     opts.LockGranularity,
+		MaxUpdatesPerWrite:  opts.MaxUpdatesPerWrite,
+		Preflight:           preflight,
 	}
 	if input.Object != nil {
 		writeInput.ObjectMeta = &input.Object.ObjectMeta
@@ -175,13 +183,23 @@ func dualWrite(
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create workflow for dual write: %w", err)
 	}
+	if approval != nil {
+		return requestApproval(ctx, workflowClient, input, writeInput, wf, approval)
+	}
+
 	id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
 		InstanceID: uuid.NewString(),
 	}, wf, writeInput)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create new workflow instance for dual write: %w", err)
 	}
-	resp, err := client.GetWorkflowResult[distributedtx.KubeResp](ctx, workflowClient, id, distributedtx.DefaultWorkflowTimeout)
+	if err := workflowClient.WaitForWorkflowInstance(ctx, id, opts.Timeout); err != nil {
+		// the workflow keeps running, so the client is told that the write
+		// is in progress instead of that it failed.
+		klog.V(2).ErrorS(err, "dual write still in progress", "workflow", id.InstanceID, "timeout", opts.Timeout)
+		return writeInProgress(input, id, opts.Timeout)
+	}
+	resp, err := client.GetWorkflowResult[distributedtx.KubeResp](ctx, workflowClient, id, opts.Timeout)
 	if err != nil {
 		var panicError *workflow.PanicError
 		if errors.As(err, &panicError) {
@@ -194,78 +212,117 @@ func dualWrite(
 	return &resp, nil
 }
 
-func validateFieldForDollarUsage(field, fieldName string, allowedTemplate string) error {
-	if !strings.Contains(field, "$") {
-		return nil
+// writeInProgress returns a 504 Timeout response for a dual write that
+// didn't finish within the timeout, like kube does for requests that it is
+// still processing. The write isn't known to have succeeded, so clients see
+// an error rather than a success. The Status names the workflow, which can
+// be inspected with the workflow admin API.
+func writeInProgress(input *rules.ResolveInput, id *workflow.Instance, timeout time.Duration) (*distributedtx.KubeResp, error) {
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Code:     http.StatusGatewayTimeout,
+		Reason:   metav1.StatusReasonTimeout,
+		Message:  fmt.Sprintf("the %s is still in progress after %s, see workflow %s", input.Request.Verb, timeout, id.InstanceID),
+		Details:  statusDetails(input),
 	}
-	if field == allowedTemplate {
-		return nil
+	body, err := json.Marshal(status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal timeout status: %w", err)
 	}
-	return fmt.Errorf("invalid use of '$' in %s field '%s': only '%s' is allowed", fieldName, field, allowedTemplate)
+	return &distributedtx.KubeResp{
+		Body:        body,
+		ContentType: "application/json",
+		StatusCode:  http.StatusGatewayTimeout,
+	}, nil
 }
 
-func filterFromRel(rel *rules.ResolvedRel) (*v1.RelationshipFilter, error) {
-	if err := validateFieldForDollarUsage(rel.ResourceType, "resourceType", "$resourceType"); err != nil {
-		return nil, err
-	}
-	if err := validateFieldForDollarUsage(rel.ResourceID, "resourceID", "$resourceID"); err != nil {
-		return nil, err
-	}
-	if err := validateFieldForDollarUsage(rel.ResourceRelation, "resourceRelation", "$resourceRelation"); err != nil {
-		return nil, err
+// statusDetails returns the details of a Status about the object of the
+// input.
+func statusDetails(input *rules.ResolveInput) *metav1.StatusDetails {
+	name := input.Request.Name
+	if input.Object != nil && input.Object.Name != "" {
+		name = input.Object.Name
 	}
-	if err := validateFieldForDollarUsage(rel.SubjectType, "subjectType", "$subjectType"); err != nil {
-		return nil, err
+	return &metav1.StatusDetails{
+		Name:  name,
+		Group: input.Request.APIGroup,
+		Kind:  input.Request.Resource,
 	}
-	if err := validateFieldForDollarUsage(rel.SubjectID, "subjectID", "$subjectID"); err != nil {
-		return nil, err
-	}
-	if err := validateFieldForDollarUsage(rel.SubjectRelation, "subjectRelation", "$subjectRelation"); err != nil {
-		return nil, err
-	}
-
-	f := &v1.RelationshipFilter{}
+}
 
-	if rel.ResourceType != "$resourceType" {
-		f.ResourceType = rel.ResourceType
-	}
-	if rel.ResourceID != "$resourceID" {
-		f.OptionalResourceId = rel.ResourceID
+// acceptedStatus returns a 202 response with a Status that carries the
+// reason and message.
+func acceptedStatus(input *rules.ResolveInput, reason metav1.StatusReason, message string) (*distributedtx.KubeResp, error) {
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusSuccess,
+		Code:     http.StatusAccepted,
+		Reason:   reason,
+		Message:  message,
+		Details:  statusDetails(input),
 	}
-	if rel.ResourceRelation != "$resourceRelation" {
-		f.OptionalRelation = rel.ResourceRelation
+	body, err := json.Marshal(status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal accepted status: %w", err)
 	}
-	var needsSubjectFilter bool
+	return &distributedtx.KubeResp{
+		Body:        body,
+		ContentType: "application/json",
+		StatusCode:  http.StatusAccepted,
+	}, nil
+}
 
-	if rel.SubjectType != "$subjectType" && rel.SubjectType != "" {
-		needsSubjectFilter = true
-	}
-	if rel.SubjectID != "$subjectID" && rel.SubjectID != "" {
-		needsSubjectFilter = true
-	}
-	if rel.SubjectRelation != "$subjectRelation" && rel.SubjectRelation != "" {
-		needsSubjectFilter = true
+// requestApproval starts the workflow that holds a write until it is
+// approved, and returns a 202 response without waiting for it. The Status
+// names the workflow, which approvers approve or reject with the workflow
+// admin API.
+func requestApproval(ctx context.Context, workflowClient *client.Client, input *rules.ResolveInput, writeInput *distributedtx.WriteObjInput, wf string, approval *rules.Approval) (*distributedtx.KubeResp, error) {
+	id, err := workflowClient.CreateWorkflowInstance(ctx, client.WorkflowInstanceOptions{
+		InstanceID: uuid.NewString(),
+	}, distributedtx.CurrentWorkflow("ApproveWrite"), &distributedtx.ApprovalInput{
+		Write:    writeInput,
+		Workflow: wf,
+		Approval: approval.Templates,
+		Timeout:  approval.Timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create new workflow instance for approval: %w", err)
 	}
+	klog.V(2).InfoS("write is pending approval", "workflow", id.InstanceID, "user", input.User.GetName(), "verb", input.Request.Verb, "resource", input.Request.Resource)
+	return acceptedStatus(input, StatusReasonPendingApproval, fmt.Sprintf("the %s is pending approval until %s, see workflow %s", input.Request.Verb, time.Now().Add(approval.Timeout).UTC().Format(time.RFC3339), id.InstanceID))
+}
+
+// resolveFromResponse returns whether the relationships of the update are
+// resolved against the object returned by kube instead of the request.
+func resolveFromResponse(update *rules.UpdateSet, input *rules.ResolveInput) bool {
+	return update.Templates.ResolveFrom == proxyrule.ResolveFromResponse || hasGeneratedName(input)
+}
 
-	if needsSubjectFilter {
-		f.OptionalSubjectFilter = &v1.SubjectFilter{}
+// hasGeneratedName returns whether the request creates an object whose name
+// is generated by kube.
+func hasGeneratedName(input *rules.ResolveInput) bool {
+	return input.Request.Verb == "create" &&
+		input.Object != nil &&
+		input.Object.Name == "" &&
+		input.Object.GenerateName != ""
+}
 
-		if rel.SubjectType != "$subjectType" && rel.SubjectType != "" {
-			f.OptionalSubjectFilter.SubjectType = rel.SubjectType
-		}
-		if rel.SubjectID != "$subjectID" && rel.SubjectID != "" {
-			f.OptionalSubjectFilter.OptionalSubjectId = rel.SubjectID
-		}
-		if rel.SubjectRelation != "$subjectRelation" && rel.SubjectRelation != "" {
-			f.OptionalSubjectFilter.OptionalRelation = &v1.SubjectFilter_RelationFilter{
-				Relation: rel.SubjectRelation,
-			}
-		}
+// waitForRemoval returns how the workflow waits for a deleted object to be
+// removed before writing relationships, or nil if it doesn't. The uid of the
+// object is recorded, so that a new object with the same name isn't taken
+// for the deleted one.
+func waitForRemoval(update *rules.UpdateSet, input *rules.ResolveInput) (*distributedtx.WaitForRemoval, error) {
+	if input.Request.Verb != "delete" || update.Templates.WaitForRemoval == nil {
+		return nil, nil
 	}
-
-	if err := f.Validate(); err != nil {
-		return nil, fmt.Errorf("invalid relationship filter: %w", err)
+	if err := input.LoadCurrentObject(); err != nil {
+		return nil, err
 	}
 
-	return f, nil
+	removal := &distributedtx.WaitForRemoval{Timeout: update.Templates.WaitForRemoval.Timeout.Duration}
+	if input.OldObject != nil {
+		removal.UID = string(input.OldObject.UID)
+	}
+	return removal, nil
 }
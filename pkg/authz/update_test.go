@@ -1,379 +1,246 @@
 package authz
 
 import (
+	"encoding/json"
+	"net/http"
 	"testing"
+	"time"
 
+	"github.com/cschleiden/go-workflows/workflow"
 	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/endpoints/request"
 
-	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
-
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
 	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
 )
 
-func TestFilterFromRel(t *testing.T) {
+func TestResolveFromResponse(t *testing.T) {
+	generated := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{GenerateName: "web-"}}
+	named := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "web"}}
+
 	tests := []struct {
 		name        string
-		rel         *rules.ResolvedRel
-		expected    *v1.RelationshipFilter
-		expectError bool
+		resolveFrom proxyrule.ResolveMode
+		verb        string
+		object      *metav1.PartialObjectMetadata
+		want        bool
+	}{
+		{name: "default", verb: "create", object: named, want: false},
+		{name: "request", resolveFrom: proxyrule.ResolveFromRequest, verb: "create", object: named, want: false},
+		{name: "response", resolveFrom: proxyrule.ResolveFromResponse, verb: "create", object: named, want: true},
+		{name: "response for delete", resolveFrom: proxyrule.ResolveFromResponse, verb: "delete", want: true},
+		{name: "generated name", resolveFrom: proxyrule.ResolveFromRequest, verb: "create", object: generated, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := &rules.UpdateSet{Templates: proxyrule.Update{ResolveFrom: tt.resolveFrom}}
+			input := &rules.ResolveInput{
+				Request: &request.RequestInfo{Verb: tt.verb},
+				Object:  tt.object,
+			}
+			require.Equal(t, tt.want, resolveFromResponse(update, input))
+		})
+	}
+}
+
+func TestHasGeneratedName(t *testing.T) {
+	tests := []struct {
+		name   string
+		verb   string
+		object *metav1.PartialObjectMetadata
+		want   bool
 	}{
 		{
-			name: "all concrete values",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "namespace",
-				ResourceID:       "default",
-				ResourceRelation: "viewer",
-				SubjectType:      "user",
-				SubjectID:        "alice",
-				SubjectRelation:  "",
-			},
-			expected: &v1.RelationshipFilter{
-				ResourceType:       "namespace",
-				OptionalResourceId: "default",
-				OptionalRelation:   "viewer",
-				OptionalSubjectFilter: &v1.SubjectFilter{
-					SubjectType:       "user",
-					OptionalSubjectId: "alice",
-					OptionalRelation:  nil,
-				},
-			},
-			expectError: false,
-		},
-		{
-			name: "all template variables",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "$resourceType",
-				ResourceID:       "$resourceID",
-				ResourceRelation: "$resourceRelation",
-				SubjectType:      "$subjectType",
-				SubjectID:        "$subjectID",
-				SubjectRelation:  "$subjectRelation",
-			},
-			expected: &v1.RelationshipFilter{
-				ResourceType:          "",
-				OptionalResourceId:    "",
-				OptionalRelation:      "",
-				OptionalSubjectFilter: nil,
-			},
-			expectError: false,
-		},
-		{
-			name: "mixed concrete and template values; subject type is required so error is raised",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "namespace",
-				ResourceID:       "$resourceID",
-				ResourceRelation: "viewer",
-				SubjectType:      "$subjectType",
-				SubjectID:        "alice",
-				SubjectRelation:  "",
-			},
-			expectError: true,
-		},
-		{
-			name: "subject relation with concrete value",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "namespace",
-				ResourceID:       "default",
-				ResourceRelation: "viewer",
-				SubjectType:      "group",
-				SubjectID:        "admins",
-				SubjectRelation:  "member",
-			},
-			expected: &v1.RelationshipFilter{
-				ResourceType:       "namespace",
-				OptionalResourceId: "default",
-				OptionalRelation:   "viewer",
-				OptionalSubjectFilter: &v1.SubjectFilter{
-					SubjectType:       "group",
-					OptionalSubjectId: "admins",
-					OptionalRelation: &v1.SubjectFilter_RelationFilter{
-						Relation: "member",
-					},
-				},
-			},
-			expectError: false,
-		},
-		{
-			name: "subject relation with template variable",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "namespace",
-				ResourceID:       "default",
-				ResourceRelation: "viewer",
-				SubjectType:      "group",
-				SubjectID:        "admins",
-				SubjectRelation:  "$subjectRelation",
-			},
-			expected: &v1.RelationshipFilter{
-				ResourceType:       "namespace",
-				OptionalResourceId: "default",
-				OptionalRelation:   "viewer",
-				OptionalSubjectFilter: &v1.SubjectFilter{
-					SubjectType:       "group",
-					OptionalSubjectId: "admins",
-					OptionalRelation:  nil,
-				},
-			},
-			expectError: false,
-		},
-		{
-			name: "empty subject relation",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "namespace",
-				ResourceID:       "default",
-				ResourceRelation: "viewer",
-				SubjectType:      "user",
-				SubjectID:        "alice",
-				SubjectRelation:  "",
-			},
-			expected: &v1.RelationshipFilter{
-				ResourceType:       "namespace",
-				OptionalResourceId: "default",
-				OptionalRelation:   "viewer",
-				OptionalSubjectFilter: &v1.SubjectFilter{
-					SubjectType:       "user",
-					OptionalSubjectId: "alice",
-					OptionalRelation:  nil,
-				},
-			},
-			expectError: false,
-		},
-		{
-			name: "invalid dollar in resourceType",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "namespace$invalid",
-				ResourceID:       "default",
-				ResourceRelation: "viewer",
-				SubjectType:      "user",
-				SubjectID:        "alice",
-				SubjectRelation:  "",
-			},
-			expected:    nil,
-			expectError: true,
-		},
-		{
-			name: "invalid dollar in resourceID",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "namespace",
-				ResourceID:       "default$invalid",
-				ResourceRelation: "viewer",
-				SubjectType:      "user",
-				SubjectID:        "alice",
-				SubjectRelation:  "",
-			},
-			expected:    nil,
-			expectError: true,
+			name:   "create with generateName",
+			verb:   "create",
+			object: &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{GenerateName: "web-"}},
+			want:   true,
 		},
 		{
-			name: "invalid dollar in resourceRelation",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "namespace",
-				ResourceID:       "default",
-				ResourceRelation: "viewer$invalid",
-				SubjectType:      "user",
-				SubjectID:        "alice",
-				SubjectRelation:  "",
-			},
-			expected:    nil,
-			expectError: true,
+			name:   "create with name and generateName",
+			verb:   "create",
+			object: &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "web", GenerateName: "web-"}},
+			want:   false,
 		},
 		{
-			name: "invalid dollar in subjectType",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "namespace",
-				ResourceID:       "default",
-				ResourceRelation: "viewer",
-				SubjectType:      "user$invalid",
-				SubjectID:        "alice",
-				SubjectRelation:  "",
-			},
-			expected:    nil,
-			expectError: true,
+			name:   "create with name",
+			verb:   "create",
+			object: &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "web"}},
+			want:   false,
 		},
 		{
-			name: "invalid dollar in subjectID",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "namespace",
-				ResourceID:       "default",
-				ResourceRelation: "viewer",
-				SubjectType:      "user",
-				SubjectID:        "alice$invalid",
-				SubjectRelation:  "",
-			},
-			expected:    nil,
-			expectError: true,
+			name:   "update with generateName",
+			verb:   "update",
+			object: &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "web-x7k2p", GenerateName: "web-"}},
+			want:   false,
 		},
 		{
-			name: "invalid dollar in subjectRelation",
-			rel: &rules.ResolvedRel{
-				ResourceType:     "namespace",
-				ResourceID:       "default",
-				ResourceRelation: "viewer",
-				SubjectType:      "user",
-				SubjectID:        "alice",
-				SubjectRelation:  "member$invalid",
-			},
-			expected:    nil,
-			expectError: true,
+			name: "delete",
+			verb: "delete",
+			want: false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result, err := filterFromRel(tt.rel)
-			if tt.expectError {
-				require.Error(t, err)
-				require.Nil(t, result)
-			} else {
-				require.NoError(t, err)
-				require.Equal(t, tt.expected, result)
+			input := &rules.ResolveInput{
+				Request: &request.RequestInfo{Verb: tt.verb},
+				Object:  tt.object,
 			}
+			require.Equal(t, tt.want, hasGeneratedName(input))
 		})
 	}
 }
 
-func TestFilterFromRel_SubjectFilterCreation(t *testing.T) {
+func TestWaitForRemoval(t *testing.T) {
 	tests := []struct {
-		name                string
-		subjectType         string
-		subjectID           string
-		subjectRelation     string
-		expectSubjectFilter bool
+		name           string
+		verb           string
+		waitForRemoval *proxyrule.WaitForRemoval
+		oldObject      *metav1.PartialObjectMetadata
+		want           *distributedtx.WaitForRemoval
 	}{
+		{name: "not configured", verb: "delete"},
 		{
-			name:                "all subject fields are template variables",
-			subjectType:         "$subjectType",
-			subjectID:           "$subjectID",
-			subjectRelation:     "",
-			expectSubjectFilter: false,
-		},
-		{
-			name:                "subject type is concrete",
-			subjectType:         "user",
-			subjectID:           "$subjectID",
-			subjectRelation:     "",
-			expectSubjectFilter: true,
-		},
-		{
-			name:                "subject ID is concrete",
-			subjectType:         "something",
-			subjectID:           "alice",
-			subjectRelation:     "",
-			expectSubjectFilter: true,
-		},
-		{
-			name:                "subject relation is concrete",
-			subjectType:         "something",
-			subjectID:           "$subjectID",
-			subjectRelation:     "member",
-			expectSubjectFilter: true,
+			name:           "delete",
+			verb:           "delete",
+			waitForRemoval: &proxyrule.WaitForRemoval{Timeout: metav1.Duration{Duration: time.Hour}},
+			want:           &distributedtx.WaitForRemoval{Timeout: time.Hour},
 		},
 		{
-			name:                "subject relation is template variable",
-			subjectType:         "something",
-			subjectID:           "$subjectID",
-			subjectRelation:     "$subjectRelation",
-			expectSubjectFilter: true,
+			name:           "delete with default timeout",
+			verb:           "delete",
+			waitForRemoval: &proxyrule.WaitForRemoval{},
+			want:           &distributedtx.WaitForRemoval{},
 		},
 		{
-			name:                "empty subject type should not create filter by itself",
-			subjectType:         "",
-			subjectID:           "$subjectID",
-			subjectRelation:     "",
-			expectSubjectFilter: false,
+			name:           "delete records the uid of the object",
+			verb:           "delete",
+			waitForRemoval: &proxyrule.WaitForRemoval{},
+			oldObject:      &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "web", UID: "c0ffee"}},
+			want:           &distributedtx.WaitForRemoval{UID: "c0ffee"},
 		},
 		{
-			name:                "empty subject ID should not create filter by itself",
-			subjectType:         "$subjectType",
-			subjectID:           "",
-			subjectRelation:     "",
-			expectSubjectFilter: false,
+			name:           "create",
+			verb:           "create",
+			waitForRemoval: &proxyrule.WaitForRemoval{Timeout: metav1.Duration{Duration: time.Hour}},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			rel := &rules.ResolvedRel{
-				ResourceType:     "namespace",
-				ResourceID:       "default",
-				ResourceRelation: "viewer",
-				SubjectType:      tt.subjectType,
-				SubjectID:        tt.subjectID,
-				SubjectRelation:  tt.subjectRelation,
-			}
-
-			result, err := filterFromRel(rel)
+			update := &rules.UpdateSet{Templates: proxyrule.Update{WaitForRemoval: tt.waitForRemoval}}
+			input := &rules.ResolveInput{Request: &request.RequestInfo{Verb: tt.verb}, OldObject: tt.oldObject}
+			removal, err := waitForRemoval(update, input)
 			require.NoError(t, err)
-
-			if tt.expectSubjectFilter {
-				require.NotNil(t, result.OptionalSubjectFilter, "expected subject filter to be created")
-			} else {
-				require.Nil(t, result.OptionalSubjectFilter, "expected subject filter to be nil")
-			}
+			require.Equal(t, tt.want, removal)
 		})
 	}
 }
 
-func TestValidateFieldForDollarUsage(t *testing.T) {
+func TestWriteOptionsForRule(t *testing.T) {
+	defaults := WriteOptions{
+		Timeout: time.Minute,
+		Retry: distributedtx.RetryPolicy{
+			MaxKubeAttempts:     5,
+			KubeBackoff:         100 * time.Millisecond,
+			MaxActivityAttempts: 3,
+		},
+	}
+
 	tests := []struct {
-		name            string
-		field           string
-		fieldName       string
-		allowedTemplate string
-		expectError     bool
+		name     string
+		defaults WriteOptions
+		rule     *rules.RunnableRule
+		want     WriteOptions
 	}{
 		{
-			name:            "no dollar sign",
-			field:           "namespace",
-			fieldName:       "resourceType",
-			allowedTemplate: "$resourceType",
-			expectError:     false,
+			name:     "defaults",
+			defaults: defaults,
+			rule:     &rules.RunnableRule{},
+			want:     defaults,
 		},
 		{
-			name:            "valid template variable",
-			field:           "$resourceType",
-			fieldName:       "resourceType",
-			allowedTemplate: "$resourceType",
-			expectError:     false,
+			name: "no defaults",
+			rule: &rules.RunnableRule{},
+			want: WriteOptions{Timeout: distributedtx.DefaultWorkflowTimeout},
 		},
 		{
-			name:            "invalid dollar usage",
-			field:           "namespace$invalid",
-			fieldName:       "resourceType",
-			allowedTemplate: "$resourceType",
-			expectError:     true,
+			name:     "timeout",
+			defaults: defaults,
+			rule:     &rules.RunnableRule{Timeout: 5 * time.Minute},
+			want: WriteOptions{
+				Timeout: 5 * time.Minute,
+				Retry:   defaults.Retry,
+			},
 		},
 		{
-			name:            "dollar at beginning but not valid template",
-			field:           "$invalid",
-			fieldName:       "resourceType",
-			allowedTemplate: "$resourceType",
-			expectError:     true,
+			name:     "partial retry policy",
+			defaults: defaults,
+			rule: &rules.RunnableRule{Retry: &proxyrule.RetryPolicy{
+				MaxAttempts: 10,
+			}},
+			want: WriteOptions{
+				Timeout: time.Minute,
+				Retry: distributedtx.RetryPolicy{
+					MaxKubeAttempts:     10,
+					KubeBackoff:         100 * time.Millisecond,
+					MaxActivityAttempts: 3,
+				},
+			},
 		},
 		{
-			name:            "multiple dollars",
-			field:           "$resource$Type",
-			fieldName:       "resourceType",
-			allowedTemplate: "$resourceType",
-			expectError:     true,
+			name:     "full retry policy",
+			defaults: defaults,
+			rule: &rules.RunnableRule{Retry: &proxyrule.RetryPolicy{
+				MaxAttempts:         1,
+				Backoff:             metav1.Duration{Duration: time.Second},
+				MaxActivityAttempts: 1,
+			}},
+			want: WriteOptions{
+				Timeout: time.Minute,
+				Retry: distributedtx.RetryPolicy{
+					MaxKubeAttempts:     1,
+					KubeBackoff:         time.Second,
+					MaxActivityAttempts: 1,
+				},
+			},
 		},
 		{
-			name:            "empty field",
-			field:           "",
-			fieldName:       "resourceType",
-			allowedTemplate: "$resourceType",
-			expectError:     false,
+			name:     "lock granularity",
+			defaults: WriteOptions{Timeout: time.Minute, LockGranularity: distributedtx.LockGranularityObjectVerb},
+			rule:     &rules.RunnableRule{LockGranularity: proxyrule.NamespaceLockGranularity},
+			want:     WriteOptions{Timeout: time.Minute, LockGranularity: distributedtx.LockGranularityNamespace},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := validateFieldForDollarUsage(tt.field, tt.fieldName, tt.allowedTemplate)
-			if tt.expectError {
-				require.Error(t, err)
-				require.Contains(t, err.Error(), "invalid use of '$'")
-			} else {
-				require.NoError(t, err)
-			}
+			require.Equal(t, tt.want, tt.defaults.forRule(tt.rule))
 		})
 	}
 }
+
+func TestWriteInProgress(t *testing.T) {
+	input := &rules.ResolveInput{
+		Request: &request.RequestInfo{Verb: "create", APIGroup: "example.com", Resource: "bigresources"},
+		Object:  &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "big"}},
+	}
+
+	resp, err := writeInProgress(input, &workflow.Instance{InstanceID: "1234"}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	require.Equal(t, "application/json", resp.ContentType)
+
+	var status metav1.Status
+	require.NoError(t, json.Unmarshal(resp.Body, &status))
+	require.Equal(t, "Status", status.Kind)
+	require.Equal(t, metav1.StatusFailure, status.Status)
+	require.Equal(t, metav1.StatusReasonTimeout, status.Reason)
+	require.Equal(t, int32(http.StatusGatewayTimeout), status.Code)
+	require.Equal(t, "the create is still in progress after 1m0s, see workflow 1234", status.Message)
+	require.Equal(t, &metav1.StatusDetails{Name: "big", Group: "example.com", Kind: "bigresources"}, status.Details)
+}
@@ -0,0 +1,147 @@
+package authz
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/handlers/negotiation"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+// MaxSubjectAccessReviewBytes is the largest SubjectAccessReview that the
+// webhook reads. Reviews only hold the attributes of a request, never its
+// body, so larger ones are refused.
+const MaxSubjectAccessReviewBytes = 1 << 20
+
+// WithAuthorizationWebhook returns a handler that answers the
+// SubjectAccessReviews that kube sends to an authorization webhook with the
+// rules. Requests that aren't SubjectAccessReviews are passed to handler.
+//
+// Kube forwards the request after the webhook allows it, so nothing that
+// needs the response of kube or a write to SpiceDB can be enforced:
+// requests that the proxy would filter or post-check get no opinion rather
+// than being allowed unfiltered, and writes are checked but their
+// relationships aren't written. WebhookWarnings lists the rules this
+// affects.
+func WithAuthorizationWebhook(handler http.Handler, restMapper meta.RESTMapper, permissionsClient v1.PermissionsServiceClient, matcher *rules.Matcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, MaxSubjectAccessReviewBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("SubjectAccessReview is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			responsewriters.InternalError(w, req, fmt.Errorf("unable to read request body: %w", err))
+			return
+		}
+		obj, _, err := codecs.UniversalDeserializer().Decode(body, nil, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to decode SubjectAccessReview: %s", err), http.StatusBadRequest)
+			return
+		}
+		review, ok := obj.(*authorizationv1.SubjectAccessReview)
+		if !ok {
+			http.Error(w, fmt.Sprintf("expected an authorization.k8s.io/v1 SubjectAccessReview, got %T", obj), http.StatusBadRequest)
+			return
+		}
+
+		review.Status = reviewSubjectAccess(req, restMapper, permissionsClient, *matcher, &review.Spec)
+		klog.FromContext(req.Context()).V(3).Info("answered subject access review",
+			"user", review.Spec.User,
+			"allowed", review.Status.Allowed,
+			"denied", review.Status.Denied,
+			"reason", review.Status.Reason)
+
+		responsewriters.WriteObjectNegotiated(codecs, negotiation.DefaultEndpointRestrictions, authorizationv1.SchemeGroupVersion, w, req, http.StatusOK, review, false)
+	})
+}
+
+func reviewSubjectAccess(req *http.Request, restMapper meta.RESTMapper, permissionsClient v1.PermissionsServiceClient, matcher rules.Matcher, spec *authorizationv1.SubjectAccessReviewSpec) authorizationv1.SubjectAccessReviewStatus {
+	userInfo := &user.DefaultInfo{
+		Name:   spec.User,
+		UID:    spec.UID,
+		Groups: spec.Groups,
+	}
+	if len(spec.Extra) > 0 {
+		userInfo.Extra = make(map[string][]string, len(spec.Extra))
+		for k, v := range spec.Extra {
+			userInfo.Extra[k] = v
+		}
+	}
+
+	switch {
+	case spec.ResourceAttributes != nil:
+		info := ResourceAttributesRequestInfo(restMapper, spec.ResourceAttributes)
+		review := ReviewAccess(req.Context(), matcher, permissionsClient, reviewInput(info, userInfo))
+		if review.Decision == DecisionAllow && (review.PreFiltered || review.PostFiltered || review.PostChecked) {
+			return authorizationv1.SubjectAccessReviewStatus{
+				Reason: fmt.Sprintf("rules %v filter or post-check the %s, which an authorization webhook can't enforce", review.Rules, info.Verb),
+			}
+		}
+		return accessReviewStatus(review)
+	case spec.NonResourceAttributes != nil:
+		info := NonResourceAttributesRequestInfo(spec.NonResourceAttributes)
+		return accessReviewStatus(ReviewAccess(req.Context(), matcher, permissionsClient, reviewInput(info, userInfo)))
+	default:
+		return authorizationv1.SubjectAccessReviewStatus{EvaluationError: "the review has neither resource nor non-resource attributes"}
+	}
+}
+
+// WebhookWarnings returns a warning for each part of the rules that an
+// authorization webhook can't enforce.
+func WebhookWarnings(configs []proxyrule.Config) []string {
+	var warnings []string
+	for _, config := range configs {
+		var verbs []string
+		for _, m := range config.Matches {
+			verbs = append(verbs, m.Verbs...)
+		}
+		hasVerb := func(candidates ...string) bool {
+			return slices.ContainsFunc(verbs, func(v string) bool { return slices.Contains(candidates, v) })
+		}
+
+		if len(config.PreFilters) > 0 || len(config.PostFilters) > 0 {
+			warnings = append(warnings, fmt.Sprintf("rule %q filters lists and watches, which get no opinion from the webhook", config.Name))
+		}
+		if len(config.PostChecks) > 0 {
+			warnings = append(warnings, fmt.Sprintf("rule %q has post-checks, so the gets it matches get no opinion from the webhook", config.Name))
+		}
+		if hasVerb(updateVerbs...) && hasUpdate(config.Update) {
+			warnings = append(warnings, fmt.Sprintf("rule %q writes relationships, which the webhook doesn't do; the writes it matches are only checked", config.Name))
+		}
+		if config.Approval != nil {
+			warnings = append(warnings, fmt.Sprintf("rule %q requires approvals, which the webhook can't wait for; the writes it matches are only checked", config.Name))
+		}
+	}
+	return warnings
+}
+
+// hasUpdate returns whether the update writes relationships, or checks
+// preconditions that the webhook can't evaluate.
+func hasUpdate(update proxyrule.Update) bool {
+	return len(update.PreconditionExists) > 0 ||
+		len(update.PreconditionDoesNotExist) > 0 ||
+		len(update.CreateRelationships) > 0 ||
+		len(update.TouchRelationships) > 0 ||
+		len(update.DeleteRelationships) > 0 ||
+		len(update.DeleteByFilter) > 0 ||
+		len(update.KubeWrites) > 0
+}
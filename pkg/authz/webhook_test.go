@@ -0,0 +1,144 @@
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/spicedb/pkg/tuple"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+func TestWithAuthorizationWebhook(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: []*v1.RelationshipUpdate{{
+		Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
+		Relationship: tuple.MustParseV1Rel("namespace:visible#viewer@user:janedoe"),
+	}}})
+	require.NoError(t, err)
+
+	configs := []proxyrule.Config{
+		{Spec: proxyrule.Spec{
+			Matches: []proxyrule.Match{{GroupVersion: "v1", Resource: "namespaces", Verbs: []string{"get", "delete"}}},
+			Checks:  []proxyrule.StringOrTemplate{{Template: "namespace:{{name}}#view@user:{{user.name}}"}},
+		}},
+		{Spec: proxyrule.Spec{
+			Matches: []proxyrule.Match{{GroupVersion: "v1", Resource: "namespaces", Verbs: []string{"update"}}},
+			Checks:  []proxyrule.StringOrTemplate{{Template: "namespace:{{name}}#undefined@user:{{user.name}}"}},
+		}},
+		{Spec: proxyrule.Spec{
+			Matches: []proxyrule.Match{{GroupVersion: "v1", Resource: "namespaces", Verbs: []string{"list"}}},
+			PreFilters: []proxyrule.PreFilter{{
+				FromObjectIDNameExpr:    "{{resourceId}}",
+				LookupMatchingResources: &proxyrule.StringOrTemplate{Template: "namespace:$#view@user:{{user.name}}"},
+			}},
+		}},
+	}
+	var matcher rules.Matcher
+	matcher, err = rules.NewMapMatcher(configs)
+	require.NoError(t, err)
+
+	handler := WithAuthorizationWebhook(http.NotFoundHandler(), nil, psc, &matcher)
+	review := func(attrs *authorizationv1.ResourceAttributes) authorizationv1.SubjectAccessReviewStatus {
+		t.Helper()
+		body, err := json.Marshal(&authorizationv1.SubjectAccessReview{
+			TypeMeta: metav1.TypeMeta{Kind: "SubjectAccessReview", APIVersion: "authorization.k8s.io/v1"},
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				ResourceAttributes: attrs,
+				User:               "janedoe",
+				Groups:             []string{"system:authenticated"},
+			},
+		})
+		require.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		var out authorizationv1.SubjectAccessReview
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &out))
+		return out.Status
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		status := review(&authorizationv1.ResourceAttributes{Verb: "get", Version: "v1", Resource: "namespaces", Name: "visible"})
+		require.True(t, status.Allowed)
+	})
+	t.Run("denied", func(t *testing.T) {
+		status := review(&authorizationv1.ResourceAttributes{Verb: "delete", Version: "v1", Resource: "namespaces", Name: "hidden"})
+		require.False(t, status.Allowed)
+		require.True(t, status.Denied)
+	})
+	t.Run("no opinion without a matching rule", func(t *testing.T) {
+		status := review(&authorizationv1.ResourceAttributes{Verb: "get", Version: "v1", Resource: "pods", Namespace: "default", Name: "web"})
+		require.False(t, status.Allowed)
+		require.False(t, status.Denied)
+		require.Equal(t, "no rule matches the request", status.Reason)
+	})
+	t.Run("no opinion if a check fails to run", func(t *testing.T) {
+		status := review(&authorizationv1.ResourceAttributes{Verb: "update", Version: "v1", Resource: "namespaces", Name: "visible"})
+		require.False(t, status.Allowed)
+		require.False(t, status.Denied)
+		require.Contains(t, status.EvaluationError, "bulk check error for namespace:visible#undefined@user:janedoe")
+	})
+	t.Run("no opinion for filtered lists", func(t *testing.T) {
+		status := review(&authorizationv1.ResourceAttributes{Verb: "list", Version: "v1", Resource: "namespaces"})
+		require.False(t, status.Allowed)
+		require.False(t, status.Denied)
+		require.Contains(t, status.Reason, "can't enforce")
+	})
+
+	t.Run("not a review", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{"kind":"Namespace","apiVersion":"v1"}`))))
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+	t.Run("too large", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(make([]byte, MaxSubjectAccessReviewBytes+1))))
+		require.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	})
+}
+
+func TestWebhookWarnings(t *testing.T) {
+	configs := []proxyrule.Config{
+		{Spec: proxyrule.Spec{
+			Matches: []proxyrule.Match{{GroupVersion: "v1", Resource: "namespaces", Verbs: []string{"get"}}},
+			Checks:  []proxyrule.StringOrTemplate{{Template: "namespace:{{name}}#view@user:{{user.name}}"}},
+		}},
+		{Spec: proxyrule.Spec{
+			Matches: []proxyrule.Match{{GroupVersion: "v1", Resource: "namespaces", Verbs: []string{"list"}}},
+			PreFilters: []proxyrule.PreFilter{{
+				FromObjectIDNameExpr:    "{{resourceId}}",
+				LookupMatchingResources: &proxyrule.StringOrTemplate{Template: "namespace:$#view@user:{{user.name}}"},
+			}},
+		}},
+		{Spec: proxyrule.Spec{
+			Matches: []proxyrule.Match{{GroupVersion: "v1", Resource: "namespaces", Verbs: []string{"create"}}},
+			Update: proxyrule.Update{
+				CreateRelationships: []proxyrule.StringOrTemplate{{Template: "namespace:{{name}}#creator@user:{{user.name}}"}},
+			},
+		}},
+	}
+	configs[1].Name = "list-namespaces"
+	configs[2].Name = "create-namespaces"
+
+	require.Equal(t, []string{
+		`rule "list-namespaces" filters lists and watches, which get no opinion from the webhook`,
+		`rule "create-namespaces" writes relationships, which the webhook doesn't do; the writes it matches are only checked`,
+	}, WebhookWarnings(configs))
+}
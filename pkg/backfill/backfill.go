@@ -0,0 +1,325 @@
+// Package backfill seeds SpiceDB with the relationships of objects that
+// already exist in a cluster before the proxy is put in front of it.
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/pager"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/spicedb/pkg/tuple"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+// DefaultBatchSize is the number of relationships sent per message of the
+// bulk import, or touched per write if they already exist.
+const DefaultBatchSize = 1000
+
+// Options configure how a Backfiller determines the owner of an object.
+type Options struct {
+	// OwnerAnnotation is the annotation whose value is the user that owns an
+	// object.
+	OwnerAnnotation string
+
+	// OwnerField is the dot-separated path of a string field whose value is
+	// the user that owns an object, e.g. "spec.owner". It is used for
+	// objects without the owner annotation.
+	OwnerField string
+
+	// DefaultSubject is the user that owns objects without the owner
+	// annotation or field. Objects without an owner are skipped if it is
+	// empty.
+	DefaultSubject string
+
+	// BatchSize is the number of relationships sent per message of the bulk
+	// import, or touched per write if they already exist.
+	BatchSize int
+}
+
+// Backfiller lists the objects of every resource that has create rules, and
+// resolves the creates and touches of those rules against each object as
+// if its owner had created it through the proxy.
+type Backfiller struct {
+	opts              Options
+	kubeClient        dynamic.Interface
+	permissionsClient v1.PermissionsServiceClient
+
+	rules map[schema.GroupVersionResource][]*rules.RunnableRule
+}
+
+// NewBackfiller creates a Backfiller for the resources of the rule configs.
+func NewBackfiller(configs []proxyrule.Config, kubeClient dynamic.Interface, permissionsClient v1.PermissionsServiceClient, opts Options) (*Backfiller, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+
+	createRules := make(map[schema.GroupVersionResource][]*rules.RunnableRule)
+	for _, config := range configs {
+		rule, err := rules.Compile(config)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't compile rule %s: %w", config.Name, err)
+		}
+		if rule.Update == nil || (len(rule.Update.Creates) == 0 && len(rule.Update.Touches) == 0) {
+			continue
+		}
+		for _, m := range config.Matches {
+			if !slices.Contains(m.Verbs, "create") {
+				continue
+			}
+			gv, err := schema.ParseGroupVersion(m.GroupVersion)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse gv %q: %w", m.GroupVersion, err)
+			}
+			gvr := gv.WithResource(m.Resource)
+			if !slices.Contains(createRules[gvr], rule) {
+				createRules[gvr] = append(createRules[gvr], rule)
+			}
+		}
+	}
+
+	return &Backfiller{
+		opts:              opts,
+		kubeClient:        kubeClient,
+		permissionsClient: permissionsClient,
+		rules:             createRules,
+	}, nil
+}
+
+// Resources returns the resources that are backfilled.
+func (b *Backfiller) Resources() []schema.GroupVersionResource {
+	resources := make([]schema.GroupVersionResource, 0, len(b.rules))
+	for gvr := range b.rules {
+		resources = append(resources, gvr)
+	}
+	slices.SortFunc(resources, func(a, b schema.GroupVersionResource) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return resources
+}
+
+// Plan lists the objects of every backfilled resource, and returns the
+// relationships that their create rules resolve to. Each relationship is
+// returned once, even if several objects or rules resolve to it.
+func (b *Backfiller) Plan(ctx context.Context) ([]*v1.Relationship, error) {
+	var planned []*v1.Relationship
+	seen := make(map[string]struct{})
+	err := b.EachObject(ctx, func(gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+		owner, err := b.OwnerOf(obj)
+		if err != nil {
+			return err
+		}
+		if owner == "" {
+			klog.V(3).InfoS("skipping object without owner", "resource", gvr, "namespace", obj.GetNamespace(), "name", obj.GetName())
+			return nil
+		}
+
+		rels, err := b.Resolve(gvr, obj, owner)
+		if err != nil {
+			return err
+		}
+		for _, rel := range rels {
+			key := tuple.MustV1StringRelationship(rel)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			planned = append(planned, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return planned, nil
+}
+
+// EachObject lists the objects of every backfilled resource, and calls fn
+// for each of them.
+func (b *Backfiller) EachObject(ctx context.Context, fn func(gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error) error {
+	for _, gvr := range b.Resources() {
+		listed := 0
+		p := pager.New(func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+			return b.kubeClient.Resource(gvr).List(ctx, opts)
+		})
+		err := p.EachListItem(ctx, metav1.ListOptions{}, func(obj runtime.Object) error {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return fmt.Errorf("unexpected object of type %T", obj)
+			}
+			listed++
+			return fn(gvr, u)
+		})
+		if err != nil {
+			return fmt.Errorf("unable to list %s: %w", gvr, err)
+		}
+		klog.FromContext(ctx).V(2).Info("listed objects of resource", "resource", gvr, "objects", listed)
+	}
+	return nil
+}
+
+// Resolve returns the relationships that the create rules of the resource
+// resolve to for the object, as if owner had created it.
+func (b *Backfiller) Resolve(gvr schema.GroupVersionResource, obj *unstructured.Unstructured, owner string) ([]*v1.Relationship, error) {
+	input := rules.NewResolveInputFromObject(rules.NewRequestInfo("create", gvr, obj.GetNamespace(), obj.GetName()), &user.DefaultInfo{Name: owner}, obj.Object)
+	matching, err := rules.FilterRulesWithCELConditions(b.rules[gvr], input)
+	if err != nil {
+		return nil, fmt.Errorf("unable to evaluate rule conditions for %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	var rels []*v1.Relationship
+	for _, rule := range matching {
+		resolved, err := rule.Update.ResolveWrites(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve relationships of rule %s for %s/%s: %w", rule.Name, obj.GetNamespace(), obj.GetName(), err)
+		}
+		rels = append(rels, resolved.CreateRelationships...)
+		rels = append(rels, resolved.TouchRelationships...)
+	}
+	return rels, nil
+}
+
+// OwnerOf returns the user that owns the object, from the owner annotation,
+// the owner field or the default subject, in that order. It returns an
+// empty string if the object has no owner.
+func (b *Backfiller) OwnerOf(obj *unstructured.Unstructured) (string, error) {
+	if b.opts.OwnerAnnotation != "" {
+		if owner := obj.GetAnnotations()[b.opts.OwnerAnnotation]; owner != "" {
+			return owner, nil
+		}
+	}
+	if b.opts.OwnerField != "" {
+		owner, found, err := unstructured.NestedString(obj.Object, strings.Split(b.opts.OwnerField, ".")...)
+		if err != nil {
+			return "", fmt.Errorf("unable to read owner field %s of %s/%s: %w", b.opts.OwnerField, obj.GetNamespace(), obj.GetName(), err)
+		}
+		if found && owner != "" {
+			return owner, nil
+		}
+	}
+	return b.opts.DefaultSubject, nil
+}
+
+// ResourceTypes returns the object types of the resources that the create
+// templates write, for the templates whose resource type isn't templated.
+func (b *Backfiller) ResourceTypes() []string {
+	var types []string
+	for _, matching := range b.rules {
+		for _, rule := range matching {
+			templates := slices.Concat(rule.Update.Templates.CreateRelationships, rule.Update.Templates.TouchRelationships)
+			for _, tpl := range templates {
+				var resourceType string
+				switch {
+				case tpl.RelationshipTemplate != nil:
+					resourceType = tpl.RelationshipTemplate.Resource.Type
+				case tpl.Template != "":
+					resourceType, _, _ = strings.Cut(tpl.Template, ":")
+				}
+				if resourceType == "" || strings.Contains(resourceType, "{{") || slices.Contains(types, resourceType) {
+					continue
+				}
+				types = append(types, resourceType)
+			}
+		}
+	}
+	slices.Sort(types)
+	return types
+}
+
+// Import writes the relationships to SpiceDB, and returns the number of
+// relationships that were written. They are imported with
+// ImportBulkRelationships, which fails without writing anything if any of
+// them already exists, i.e. on a re-run or for objects whose relationships
+// the proxy already wrote. The relationships are then touched in batches
+// with WriteRelationships instead.
+func (b *Backfiller) Import(ctx context.Context, rels []*v1.Relationship) (uint64, error) {
+	if len(rels) == 0 {
+		return 0, nil
+	}
+
+	loaded, err := b.importBulk(ctx, rels)
+	if status.Code(err) != codes.AlreadyExists {
+		if err != nil {
+			return 0, fmt.Errorf("unable to import relationships: %w", err)
+		}
+		return loaded, nil
+	}
+
+	klog.FromContext(ctx).V(2).Info("relationships already exist, touching them instead of importing them", "relationships", len(rels))
+	for batch := range slices.Chunk(rels, b.opts.BatchSize) {
+		updates := make([]*v1.RelationshipUpdate, 0, len(batch))
+		for _, rel := range batch {
+			updates = append(updates, &v1.RelationshipUpdate{
+				Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
+				Relationship: rel,
+			})
+		}
+		if _, err := b.permissionsClient.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: updates}); err != nil {
+			return 0, fmt.Errorf("unable to touch relationships: %w", err)
+		}
+	}
+	return uint64(len(rels)), nil
+}
+
+// importBulk imports the relationships with ImportBulkRelationships, and
+// returns the error of SpiceDB unwrapped, so that its code can be checked.
+func (b *Backfiller) importBulk(ctx context.Context, rels []*v1.Relationship) (uint64, error) {
+	stream, err := b.permissionsClient.ImportBulkRelationships(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for batch := range slices.Chunk(rels, b.opts.BatchSize) {
+		if err := stream.Send(&v1.ImportBulkRelationshipsRequest{Relationships: batch}); err != nil {
+			if _, recvErr := stream.CloseAndRecv(); recvErr != nil {
+				err = recvErr
+			}
+			return 0, err
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return 0, err
+	}
+	return resp.NumLoaded, nil
+}
+
+// Run plans the backfill and imports the planned relationships. With
+// dryRun, the planned relationships are printed to out instead.
+func (b *Backfiller) Run(ctx context.Context, dryRun bool, out io.Writer) error {
+	planned, err := b.Plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		for _, rel := range planned {
+			if _, err := fmt.Fprintln(out, tuple.MustV1StringRelationship(rel)); err != nil {
+				return err
+			}
+		}
+		klog.FromContext(ctx).Info("planned backfill", "relationships", len(planned), "resources", b.Resources())
+		return nil
+	}
+
+	loaded, err := b.Import(ctx, planned)
+	if err != nil {
+		return err
+	}
+	klog.FromContext(ctx).Info("backfilled relationships", "relationships", loaded, "resources", b.Resources())
+	return nil
+}
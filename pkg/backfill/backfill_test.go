@@ -0,0 +1,260 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/spicedb/pkg/tuple"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+var (
+	namespacesGVR = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	podsGVR       = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+)
+
+const testRules = `
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: create-namespaces
+match:
+- apiVersion: v1
+  resource: namespaces
+  verbs: ["create"]
+update:
+  creates:
+  - tpl: "namespace:{{name}}#creator@user:{{user.name}}"
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: create-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["create"]
+update:
+  touches:
+  - tpl: "pod:{{namespacedName}}#creator@user:{{user.name}}"
+  - tpl: "pod:{{namespacedName}}#namespace@namespace:{{namespace}}"
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: delete-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["delete"]
+update:
+  deleteByFilter:
+  - tpl: "pod:{{namespacedName}}#$resourceRelation@$subjectType:$subjectID"
+`
+
+func parseRules(t *testing.T, config string) []proxyrule.Config {
+	t.Helper()
+	configs, err := proxyrule.Parse(strings.NewReader(config))
+	require.NoError(t, err)
+	return configs
+}
+
+func newKubeClient(objects ...runtime.Object) *fake.FakeDynamicClient {
+	return fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		namespacesGVR: "NamespaceList",
+		podsGVR:       "PodList",
+	}, objects...)
+}
+
+func newObject(kind, namespace, name string, annotations map[string]any, spec map[string]any) *unstructured.Unstructured {
+	metadata := map[string]any{"name": name}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+	if annotations != nil {
+		metadata["annotations"] = annotations
+	}
+	obj := map[string]any{"apiVersion": "v1", "kind": kind, "metadata": metadata}
+	if spec != nil {
+		obj["spec"] = spec
+	}
+	return &unstructured.Unstructured{Object: obj}
+}
+
+func relStrings(rels []*v1.Relationship) []string {
+	strs := make([]string, 0, len(rels))
+	for _, rel := range rels {
+		strs = append(strs, tuple.MustV1StringRelationship(rel))
+	}
+	return strs
+}
+
+func TestNewBackfiller(t *testing.T) {
+	b, err := NewBackfiller(parseRules(t, testRules), nil, nil, Options{})
+	require.NoError(t, err)
+
+	// rules without creates or touches are not backfilled
+	require.Equal(t, []schema.GroupVersionResource{namespacesGVR, podsGVR}, b.Resources())
+	require.Equal(t, DefaultBatchSize, b.opts.BatchSize)
+}
+
+func TestPlan(t *testing.T) {
+	objects := []runtime.Object{
+		newObject("Namespace", "", "annotated", map[string]any{"authzed.com/owner": "alice"}, nil),
+		newObject("Namespace", "", "unowned", nil, nil),
+		newObject("Pod", "annotated", "field", nil, map[string]any{"owner": "bob"}),
+		newObject("Pod", "annotated", "both", map[string]any{"authzed.com/owner": "alice"}, map[string]any{"owner": "bob"}),
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{
+			name: "owner annotation",
+			opts: Options{OwnerAnnotation: "authzed.com/owner"},
+			want: []string{
+				"namespace:annotated#creator@user:alice",
+				"pod:annotated/both#creator@user:alice",
+				"pod:annotated/both#namespace@namespace:annotated",
+			},
+		},
+		{
+			name: "owner annotation and field",
+			opts: Options{OwnerAnnotation: "authzed.com/owner", OwnerField: "spec.owner"},
+			want: []string{
+				"namespace:annotated#creator@user:alice",
+				"pod:annotated/both#creator@user:alice",
+				"pod:annotated/both#namespace@namespace:annotated",
+				"pod:annotated/field#creator@user:bob",
+				"pod:annotated/field#namespace@namespace:annotated",
+			},
+		},
+		{
+			name: "default subject",
+			opts: Options{OwnerField: "spec.owner", DefaultSubject: "admin"},
+			want: []string{
+				"namespace:annotated#creator@user:admin",
+				"namespace:unowned#creator@user:admin",
+				"pod:annotated/both#creator@user:bob",
+				"pod:annotated/both#namespace@namespace:annotated",
+				"pod:annotated/field#creator@user:bob",
+				"pod:annotated/field#namespace@namespace:annotated",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewBackfiller(parseRules(t, testRules), newKubeClient(objects...), nil, tt.opts)
+			require.NoError(t, err)
+
+			planned, err := b.Plan(t.Context())
+			require.NoError(t, err)
+			require.ElementsMatch(t, tt.want, relStrings(planned))
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	kubeClient := newKubeClient(
+		newObject("Namespace", "", "default", nil, nil),
+		newObject("Pod", "default", "web", nil, nil),
+		newObject("Pod", "default", "db", nil, nil),
+	)
+	b, err := NewBackfiller(parseRules(t, testRules), kubeClient, psc, Options{DefaultSubject: "admin", BatchSize: 2})
+	require.NoError(t, err)
+
+	want := []string{
+		"namespace:default#creator@user:admin",
+		"pod:default/db#creator@user:admin",
+		"pod:default/db#namespace@namespace:default",
+		"pod:default/web#creator@user:admin",
+		"pod:default/web#namespace@namespace:default",
+	}
+
+	// a dry run prints the planned relationships without writing them
+	var out bytes.Buffer
+	require.NoError(t, b.Run(ctx, true, &out))
+	require.ElementsMatch(t, want, strings.Split(strings.TrimSpace(out.String()), "\n"))
+	existing := readRelationships(ctx, t, psc)
+	for _, rel := range want {
+		require.NotContains(t, existing, rel)
+	}
+
+	require.NoError(t, b.Run(ctx, false, &out))
+	require.Subset(t, readRelationships(ctx, t, psc), want)
+
+	// relationships that already exist, e.g. on a re-run, are touched
+	require.NoError(t, b.Run(ctx, false, &out))
+	require.Subset(t, readRelationships(ctx, t, psc), want)
+}
+
+func TestRunWithExistingRelationships(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	// the proxy already wrote the relationships of the namespace
+	_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: []*v1.RelationshipUpdate{{
+		Operation:    v1.RelationshipUpdate_OPERATION_CREATE,
+		Relationship: tuple.MustParseV1Rel("namespace:default#creator@user:alice"),
+	}}})
+	require.NoError(t, err)
+
+	kubeClient := newKubeClient(
+		newObject("Namespace", "", "default", map[string]any{"authzed.com/owner": "alice"}, nil),
+		newObject("Pod", "default", "web", nil, nil),
+	)
+	b, err := NewBackfiller(parseRules(t, testRules), kubeClient, psc, Options{OwnerAnnotation: "authzed.com/owner", DefaultSubject: "admin"})
+	require.NoError(t, err)
+
+	planned, err := b.Plan(ctx)
+	require.NoError(t, err)
+	loaded, err := b.Import(ctx, planned)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), loaded)
+	require.Subset(t, readRelationships(ctx, t, psc), []string{
+		"namespace:default#creator@user:alice",
+		"pod:default/web#creator@user:admin",
+		"pod:default/web#namespace@namespace:default",
+	})
+}
+
+func readRelationships(ctx context.Context, t *testing.T, psc v1.PermissionsServiceClient) []string {
+	t.Helper()
+	var rels []string
+	for _, resourceType := range []string{"namespace", "pod"} {
+		stream, err := psc.ReadRelationships(ctx, &v1.ReadRelationshipsRequest{
+			Consistency:        &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+			RelationshipFilter: &v1.RelationshipFilter{ResourceType: resourceType},
+		})
+		require.NoError(t, err)
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				break
+			}
+			rels = append(rels, tuple.MustV1StringRelationship(resp.Relationship))
+		}
+	}
+	return rels
+}
@@ -0,0 +1,144 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/proxy"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/reconciler"
+)
+
+// ClusterOptions are the options of commands that compare the objects of a
+// cluster with the relationships in SpiceDB.
+type ClusterOptions struct {
+	Options
+
+	SpiceDBOptions proxy.SpiceDBOptions
+	KubeconfigPath string
+	RuleConfigFile string
+}
+
+// NewClusterOptions returns the default cluster options.
+func NewClusterOptions() ClusterOptions {
+	return ClusterOptions{
+		Options: Options{
+			OwnerAnnotation: reconciler.DefaultOwnerAnnotation,
+			BatchSize:       DefaultBatchSize,
+		},
+		SpiceDBOptions: proxy.NewSpiceDBOptions(),
+	}
+}
+
+func (o *ClusterOptions) AddFlags(fs *pflag.FlagSet) {
+	o.SpiceDBOptions.AddFlags(fs)
+
+	fs.StringVar(&o.KubeconfigPath, "kubeconfig", "", "The path to the kubeconfig of the cluster. If empty, the in-cluster config is used.")
+	fs.StringVar(&o.RuleConfigFile, "rule-config", "", "The path to a file containing proxy rule configuration")
+	fs.StringVar(&o.OwnerAnnotation, "owner-annotation", o.OwnerAnnotation, "The annotation whose value is the user that owns an object.")
+	fs.StringVar(&o.OwnerField, "owner-field", "", "The dot-separated path of a string field whose value is the user that owns an object, e.g. spec.owner. Used for objects without the owner annotation.")
+	fs.StringVar(&o.DefaultSubject, "default-subject", "", "The user that owns objects without the owner annotation or field. If empty, such objects are skipped.")
+}
+
+func (o *ClusterOptions) Validate() []error {
+	var errs []error
+
+	if len(o.RuleConfigFile) == 0 {
+		errs = append(errs, fmt.Errorf("--rule-config is required"))
+	}
+	if o.SpiceDBOptions.SpiceDBEndpoint == proxy.EmbeddedSpiceDBEndpoint {
+		errs = append(errs, fmt.Errorf("--spicedb-endpoint must be a remote SpiceDB"))
+	}
+	return errs
+}
+
+// RuleConfigs parses the rule config file.
+func (o *ClusterOptions) RuleConfigs() ([]proxyrule.Config, error) {
+	ruleFile, err := os.Open(o.RuleConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open rule config file: %w", err)
+	}
+	defer ruleFile.Close()
+	ruleConfigs, err := proxyrule.Parse(ruleFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse rule config file: %w", err)
+	}
+	return ruleConfigs, nil
+}
+
+// KubeClient creates a client for the cluster.
+func (o *ClusterOptions) KubeClient() (dynamic.Interface, error) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", o.KubeconfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load kube REST config: %w", err)
+	}
+	kubeClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create kube client: %w", err)
+	}
+	return kubeClient, nil
+}
+
+// CommandOptions are the options of the backfill command.
+type CommandOptions struct {
+	ClusterOptions
+
+	DryRun bool
+}
+
+// NewCommandOptions returns the default options of the backfill command.
+func NewCommandOptions() *CommandOptions {
+	return &CommandOptions{ClusterOptions: NewClusterOptions()}
+}
+
+func (o *CommandOptions) AddFlags(fs *pflag.FlagSet) {
+	o.ClusterOptions.AddFlags(fs)
+
+	fs.IntVar(&o.BatchSize, "batch-size", o.BatchSize, "The number of relationships sent per message of the bulk import, or touched per write if they already exist.")
+	fs.BoolVar(&o.DryRun, "dry-run", false, "if true, prints the relationships that would be written instead of writing them.")
+}
+
+func (o *CommandOptions) Validate() []error {
+	errs := o.ClusterOptions.Validate()
+	if o.OwnerAnnotation == "" && o.OwnerField == "" && o.DefaultSubject == "" {
+		errs = append(errs, fmt.Errorf("one of --owner-annotation, --owner-field or --default-subject is required"))
+	}
+	return errs
+}
+
+// Run backfills the relationships of the objects in the cluster, or prints
+// them to out with --dry-run.
+func (o *CommandOptions) Run(ctx context.Context, out io.Writer) error {
+	ruleConfigs, err := o.RuleConfigs()
+	if err != nil {
+		return err
+	}
+	kubeClient, err := o.KubeClient()
+	if err != nil {
+		return err
+	}
+
+	var permissionsClient v1.PermissionsServiceClient
+	if !o.DryRun {
+		conn, err := o.SpiceDBOptions.NewRemoteConn()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		permissionsClient = v1.NewPermissionsServiceClient(conn)
+	}
+
+	b, err := NewBackfiller(ruleConfigs, kubeClient, permissionsClient, o.Options)
+	if err != nil {
+		return err
+	}
+	return b.Run(ctx, o.DryRun, out)
+}
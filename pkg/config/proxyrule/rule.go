@@ -36,6 +36,22 @@ type LockMode string
 const (
 	PessimisticLockMode LockMode = "Pessimistic"
 	OptimisticLockMode  LockMode = "Optimistic"
+	EventualLockMode    LockMode = "Eventual"
+)
+
+type LockGranularity string
+
+const (
+	ObjectVerbLockGranularity LockGranularity = "ObjectVerb"
+	ObjectLockGranularity     LockGranularity = "Object"
+	NamespaceLockGranularity  LockGranularity = "Namespace"
+)
+
+type ResolveMode string
+
+const (
+	ResolveFromRequest  ResolveMode = "Request"
+	ResolveFromResponse ResolveMode = "Response"
 )
 
 // Spec defines a single rule for the proxy that matches incoming
@@ -50,7 +66,47 @@ type Spec struct {
 	//
 	// If set to "Pessimistic", the proxy will use pessimistic locking by
 	// acquiring a lock on the object before performing the update.
-	Locking LockMode `json:"lock,omitempty" validate:"omitempty,oneof=Optimistic Pessimistic"`
+	//
+	// If set to "Eventual", the proxy will write to kube first and respond
+	// right away, the relationships are written to SpiceDB in the background.
+	Locking LockMode `json:"lock,omitempty" validate:"omitempty,oneof=Optimistic Pessimistic Eventual"`
+
+	// LockGranularity is what the "Pessimistic" lock mode locks. The default
+	// is specified on the command line as a flag.
+	//
+	// If set to "ObjectVerb", writes of an object with the same verb exclude
+	// each other. If set to "Object", writes of an object with any verb do.
+	// If set to "Namespace", writes of any object in the same namespace do;
+	// cluster-scoped objects are locked per object.
+	LockGranularity LockGranularity `json:"lockGranularity,omitempty" validate:"omitempty,oneof=ObjectVerb Object Namespace"`
+
+	// Retry configures how often the dual write of this rule retries its
+	// writes. Fields that aren't set use the defaults specified on the
+	// command line.
+	Retry *RetryPolicy `json:"retry,omitempty" validate:"omitempty"`
+
+	// Timeout is how long the proxy waits for the dual write of this rule
+	// before it responds, i.e. "2m". The default is specified on the command
+	// line.
+	//
+	// If the write is still in progress after the timeout, the proxy responds
+	// with `504 Timeout` and a Status that names the workflow, which keeps
+	// running in the background.
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// Preflight, if true, sends the request to kube with `dryRun=All` before
+	// the relationships are written. If kube rejects the request, i.e.
+	// because of validation, a quota or an admission webhook, the error is
+	// returned without writing to SpiceDB. It costs an extra request to kube
+	// for every write, and only applies to the "Optimistic" lock mode.
+	Preflight bool `json:"preflight,omitempty"`
+
+	// Approval, if set, holds the writes of this rule until another user
+	// approves them. The proxy responds to a held write with `202 Accepted`
+	// and a Status that names the workflow, and the write is only applied
+	// once a user who passes the approval checks approves it. It only
+	// applies to rules that match write verbs.
+	Approval *Approval `json:"approval,omitempty" validate:"omitempty"`
 
 	// Matches defines the requests that this rule applies to. Cannot be empty.
 	Matches []Match `json:"match" validate:"required,min=1,dive"`
@@ -61,7 +117,10 @@ type Spec struct {
 	// Available variables in CEL expressions:
 	// - request: request information (verb, resource, apiGroup, apiVersion, name, namespace)
 	// - user: user information (name, uid, groups, extra)
-	// - object: the Kubernetes object being operated on (for create/update/patch operations)
+	// - object: the full Kubernetes object being operated on, including its
+	//   spec (for create/update/patch operations). For patch operations this is
+	//   the current object with the patch applied.
+	// - oldObject: the existing Kubernetes object (for update/patch/delete operations)
 	// - name: the name of the resource
 	// - resourceNamespace: the namespace of the resource
 	// - namespacedName: the namespaced name of the resource
@@ -84,6 +143,8 @@ type Spec struct {
 	// completes successfully, but before returning the response. These only apply
 	// to read-only operations (non-write and non-list operations).
 	// If any PostCheck returns NO_PERMISSION, the operation will fail.
+	// PostChecks are resolved against the object returned by kube, so they
+	// can refer to fields set by kube, like `object.metadata.uid`.
 	PostChecks []StringOrTemplate `json:"postcheck,omitempty" validate:"omitempty,dive"`
 
 	// PreFilters are LookupResources requests to filter the results before any
@@ -92,17 +153,57 @@ type Spec struct {
 
 	// PostFilters are authorization checks to filter the results after the
 	// Kubernetes API call completes but before returning the response.
-	// Used for List requests. If a PostFilter is set and a PreFilter
+	// Used for List and Watch requests. If a PostFilter is set and a PreFilter
 	// is missing, the LookupResources call is skipped.
 	PostFilters []PostFilter `json:"postfilter,omitempty" validate:"omitempty,dive"`
 
+	// OnGarbageCollected defines the relationships to write when kube removes
+	// an object that the rule matches without a request to the proxy, because
+	// its namespace or its owner (per `metadata.ownerReferences`) was deleted.
+	// The templates are resolved against the metadata of the removed object.
+	//
+	// If no rule for a resource defines OnGarbageCollected, the updates of the
+	// rules that match `delete` for the resource are used instead.
+	// Garbage collection only runs if it's enabled on the command line.
+	OnGarbageCollected *Update `json:"onGarbageCollected,omitempty" validate:"omitempty"`
+
 	// Update contains the updates to perform if the request matches, the checks succeed,
 	// and this is a write operation of some kind (Create, Update, or Delete).
 	Update Update `json:"update,omitempty" validate:"omitempty"`
 }
 
 // Update is an update to perform against the SpiceDB relationships.
+//
+// When an object is created with `metadata.generateName` and no name, its
+// name is only known once kube has created it, and the update behaves as if
+// ResolveFrom is "Response".
+//
+// Relationships that are resolved against the response are written before
+// the response is returned to the client. If they can't be written, a
+// created object is deleted again. Preconditions are always resolved against
+// the request, and checked before the write to kube.
 type Update struct {
+	// ResolveFrom determines which object the creates, touches, deletes and
+	// deleteByFilter templates are resolved against. The default is
+	// "Request".
+	//
+	// If set to "Request", the templates are resolved against the object in
+	// the request, and written to SpiceDB as specified by the lock mode.
+	//
+	// If set to "Response", the templates are resolved against the object
+	// returned by kube, and written after the kube write succeeds. This makes
+	// fields that are set by kube, like `object.metadata.uid`, available to
+	// the templates. For deletes that don't return the deleted object, the
+	// templates are resolved against the object as it was before the delete.
+	ResolveFrom ResolveMode `json:"resolveFrom,omitempty" validate:"omitempty,oneof=Request Response"`
+
+	// WaitForRemoval, if set, delays the relationship writes of a delete
+	// until kube has actually removed the object. Objects with finalizers and
+	// namespaces that are terminating still exist after kube accepts the
+	// delete, and their owners keep access to them until they are gone.
+	// It only applies to rules that match the `delete` verb.
+	WaitForRemoval *WaitForRemoval `json:"waitForRemoval,omitempty" validate:"omitempty"`
+
 	// PreconditionExists defines the relationships that must exist for the update
 	// operation to be succeed. Equivalent of Preconditions in SpiceDB.
 	// To specify dynamic portions of the relationship, use the following dollar
@@ -149,6 +250,78 @@ type Update struct {
 	// - `$subjectID` for the subject ID
 	// - `$subjectRelation` for the subject relation
 	DeleteByFilter []StringOrTemplate `json:"deleteByFilter,omitempty" validate:"omitempty,dive,required_without=creates touches deletes"`
+
+	// KubeWrites are objects that are created in kube after the object of
+	// a create, update or patch request has been written, i.e. a
+	// RoleBinding or a default NetworkPolicy in a namespace that was
+	// created. They are created by the same workflow as the relationships,
+	// and deleted again if the workflow rolls back.
+	KubeWrites []KubeWrite `json:"kubeWrites,omitempty" validate:"omitempty,dive"`
+}
+
+// KubeWrite is an object that is created in kube as a side effect of a
+// write.
+//
+// Objects that already exist are left as they are, and aren't deleted if
+// the workflow rolls back.
+type KubeWrite struct {
+	// Resource is the resource of the object, i.e. "rolebindings". The group
+	// and version are those of the `apiVersion` of the manifest.
+	Resource string `json:"resource" validate:"required"`
+
+	// Template is a Bloblang expression that returns the manifest of the
+	// object. It is evaluated against the same fields as relationship
+	// templates, and `response` holds the object returned by kube, i.e.
+	// `response.metadata.uid`. Namespaced objects must set
+	// `metadata.namespace`.
+	Template string `json:"template" validate:"required"`
+}
+
+// WaitForRemoval configures how long a delete waits for kube to remove the
+// object before its relationships are written.
+//
+// The delete is returned to the client as soon as kube accepts it, and the
+// proxy waits for the object to be removed in the background. The wait is
+// persisted in the workflow database, so it resumes if the proxy restarts.
+// If the object still exists after the timeout, the relationships are kept.
+type WaitForRemoval struct {
+	// Timeout is how long to wait for the object to be removed, i.e. "30m".
+	// The default is 10 minutes.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+}
+
+// Approval configures who can approve the writes of a rule, and how long a
+// write waits for an approval.
+//
+// Nothing is written to SpiceDB or kube before a write is approved. A write
+// that is rejected, or not approved before the timeout, is dropped.
+type Approval struct {
+	// Checks are the checks that a user must pass to approve or reject a
+	// write. They are resolved against the request, with `user` being the
+	// user who approves it, i.e.
+	// "namespace:{{name}}#approve@user:{{user.name}}". Their subject must
+	// be the approving user or one of their groups. The user who made the
+	// request can't approve it.
+	Checks []StringOrTemplate `json:"checks" validate:"required,min=1,dive"`
+
+	// Timeout is how long a write waits for an approval, i.e. "1h". The
+	// default is 1 hour.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+}
+
+// RetryPolicy configures how often a dual write retries its writes before
+// it rolls back.
+type RetryPolicy struct {
+	// MaxAttempts is how often the write to kube is attempted.
+	MaxAttempts int `json:"maxAttempts,omitempty" validate:"omitempty,min=1"`
+
+	// Backoff is the delay before the first retry of the write to kube,
+	// i.e. "500ms". It doubles with every further retry.
+	Backoff metav1.Duration `json:"backoff,omitempty"`
+
+	// MaxActivityAttempts is how often each step of the dual write, i.e. a
+	// single write to SpiceDB, is attempted before it fails.
+	MaxActivityAttempts int `json:"maxActivityAttempts,omitempty" validate:"omitempty,min=1"`
 }
 
 // Match determines which requests the rule applies to
@@ -193,7 +366,9 @@ type PreFilter struct {
 type PostFilter struct {
 	// CheckPermissionTemplate is a template defining a CheckPermission request to filter on.
 	// This template will be applied to each object in the response to determine if it should be included.
-	// Use object fields like {{metadata.name}} and {{metadata.namespace}} in the template.
+	// Use object fields like {{metadata.name}} and {{metadata.namespace}} in the template,
+	// or any field of the full object, i.e. {{object.spec.nodeName}}.
+	// PostFilters also apply to the objects of watch events.
 	CheckPermissionTemplate *StringOrTemplate `json:"checkPermissionTemplate" validate:"required"`
 }
 
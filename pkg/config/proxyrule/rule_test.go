@@ -3,6 +3,7 @@ package proxyrule
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/stretchr/testify/require"
@@ -346,6 +347,111 @@ update:
 				},
 			}},
 		},
+		{
+			name: "rule that waits for removal",
+			config: `
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+match:
+- apiVersion: v1
+  resource: namespaces
+  verbs: ["delete"]
+update:
+  waitForRemoval:
+    timeout: 30m
+  deletes:
+  - tpl: "namespace:{{name}}#creator@user:{{user.name}}"
+`,
+			expectRules: []Config{{
+				TypeMeta: v1alpha1ProxyRule,
+				Spec: Spec{
+					Matches: []Match{{
+						GroupVersion: "v1",
+						Resource:     "namespaces",
+						Verbs:        []string{"delete"},
+					}},
+					Update: Update{
+						WaitForRemoval: &WaitForRemoval{Timeout: v1.Duration{Duration: 30 * time.Minute}},
+						DeleteRelationships: []StringOrTemplate{{
+							Template: "namespace:{{name}}#creator@user:{{user.name}}",
+						}},
+					},
+				},
+			}},
+		},
+		{
+			name: "rule with retry policy and timeout",
+			config: `
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+match:
+- apiVersion: example.com/v1
+  resource: bigresources
+  verbs: ["create"]
+retry:
+  maxAttempts: 10
+  backoff: 500ms
+  maxActivityAttempts: 5
+timeout: 2m
+update:
+  creates:
+  - tpl: "bigresource:{{name}}#creator@user:{{user.name}}"
+`,
+			expectRules: []Config{{
+				TypeMeta: v1alpha1ProxyRule,
+				Spec: Spec{
+					Retry: &RetryPolicy{
+						MaxAttempts:         10,
+						Backoff:             v1.Duration{Duration: 500 * time.Millisecond},
+						MaxActivityAttempts: 5,
+					},
+					Timeout: &v1.Duration{Duration: 2 * time.Minute},
+					Matches: []Match{{
+						GroupVersion: "example.com/v1",
+						Resource:     "bigresources",
+						Verbs:        []string{"create"},
+					}},
+					Update: Update{
+						CreateRelationships: []StringOrTemplate{{
+							Template: "bigresource:{{name}}#creator@user:{{user.name}}",
+						}},
+					},
+				},
+			}},
+		},
+		{
+			name: "rule with preflight",
+			config: `
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+lock: Optimistic
+preflight: true
+match:
+- apiVersion: v1
+  resource: namespaces
+  verbs: ["create"]
+update:
+  creates:
+  - tpl: "namespace:{{name}}#creator@user:{{user.name}}"
+`,
+			expectRules: []Config{{
+				TypeMeta: v1alpha1ProxyRule,
+				Spec: Spec{
+					Locking:   OptimisticLockMode,
+					Preflight: true,
+					Matches: []Match{{
+						GroupVersion: "v1",
+						Resource:     "namespaces",
+						Verbs:        []string{"create"},
+					}},
+					Update: Update{
+						CreateRelationships: []StringOrTemplate{{
+							Template: "namespace:{{name}}#creator@user:{{user.name}}",
+						}},
+					},
+				},
+			}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -429,6 +535,126 @@ func TestValidation(t *testing.T) {
 				},
 				expectErr: false,
 			},
+			{
+				name: "valid lock mode - Eventual",
+				spec: Spec{
+					Locking: EventualLockMode,
+					Matches: []Match{{
+						GroupVersion: "v1",
+						Resource:     "pods",
+						Verbs:        []string{"get"},
+					}},
+				},
+				expectErr: false,
+			},
+			{
+				name: "valid lock granularity",
+				spec: Spec{
+					LockGranularity: NamespaceLockGranularity,
+					Matches: []Match{{
+						GroupVersion: "v1",
+						Resource:     "pods",
+						Verbs:        []string{"get"},
+					}},
+				},
+				expectErr: false,
+			},
+			{
+				name: "invalid lock granularity",
+				spec: Spec{
+					LockGranularity: "Cluster",
+					Matches: []Match{{
+						GroupVersion: "v1",
+						Resource:     "pods",
+						Verbs:        []string{"get"},
+					}},
+				},
+				expectErr: true,
+			},
+			{
+				name: "valid kube writes",
+				spec: Spec{
+					Matches: []Match{{
+						GroupVersion: "v1",
+						Resource:     "namespaces",
+						Verbs:        []string{"create"},
+					}},
+					Update: Update{
+						CreateRelationships: []StringOrTemplate{{Template: "namespace:{{name}}#creator@user:{{user.name}}"}},
+						KubeWrites: []KubeWrite{{
+							Resource: "rolebindings",
+							Template: `{"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "RoleBinding", "metadata": {"name": "admin", "namespace": this.name}}`,
+						}},
+					},
+				},
+				expectErr: false,
+			},
+			{
+				name: "kube write without resource",
+				spec: Spec{
+					Matches: []Match{{
+						GroupVersion: "v1",
+						Resource:     "namespaces",
+						Verbs:        []string{"create"},
+					}},
+					Update: Update{
+						CreateRelationships: []StringOrTemplate{{Template: "namespace:{{name}}#creator@user:{{user.name}}"}},
+						KubeWrites:          []KubeWrite{{Template: `{}`}},
+					},
+				},
+				expectErr: true,
+			},
+			{
+				name: "valid retry policy",
+				spec: Spec{
+					Retry: &RetryPolicy{MaxAttempts: 1, MaxActivityAttempts: 1},
+					Matches: []Match{{
+						GroupVersion: "v1",
+						Resource:     "pods",
+						Verbs:        []string{"create"},
+					}},
+				},
+				expectErr: false,
+			},
+			{
+				name: "invalid retry policy",
+				spec: Spec{
+					Retry: &RetryPolicy{MaxAttempts: -1},
+					Matches: []Match{{
+						GroupVersion: "v1",
+						Resource:     "pods",
+						Verbs:        []string{"create"},
+					}},
+				},
+				expectErr: true,
+			},
+			{
+				name: "valid approval",
+				spec: Spec{
+					Approval: &Approval{
+						Checks:  []StringOrTemplate{{Template: "namespace:{{name}}#approve@user:{{user.name}}"}},
+						Timeout: v1.Duration{Duration: time.Hour},
+					},
+					Matches: []Match{{
+						GroupVersion: "v1",
+						Resource:     "namespaces",
+						Verbs:        []string{"delete"},
+					}},
+				},
+				expectErr: false,
+			},
+			{
+				name: "approval without checks",
+				spec: Spec{
+					Approval: &Approval{},
+					Matches: []Match{{
+						GroupVersion: "v1",
+						Resource:     "namespaces",
+						Verbs:        []string{"delete"},
+					}},
+				},
+				expectErr: true,
+			},
 			{
 				name: "missing matches",
 				spec: Spec{
@@ -603,6 +829,26 @@ func TestValidation(t *testing.T) {
 				},
 				expectErr: false,
 			},
+			{
+				name: "valid update resolved from response",
+				update: Update{
+					ResolveFrom: ResolveFromResponse,
+					CreateRelationships: []StringOrTemplate{{
+						Template: "pod:{{object.metadata.uid}}#view@user:admin",
+					}},
+				},
+				expectErr: false,
+			},
+			{
+				name: "invalid resolveFrom",
+				update: Update{
+					ResolveFrom: "Object",
+					CreateRelationships: []StringOrTemplate{{
+						Template: "pod:test#view@user:admin",
+					}},
+				},
+				expectErr: true,
+			},
 			{
 				name: "valid update with preconditions",
 				update: Update{
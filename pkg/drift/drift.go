@@ -0,0 +1,282 @@
+// Package drift reports the differences between the objects in kube and the
+// relationships in SpiceDB.
+package drift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/spicedb/pkg/tuple"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/backfill"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+)
+
+const (
+	// readPageSize is the number of relationships read per request.
+	readPageSize = 1000
+
+	// writeBatchSize is the number of relationship updates written per
+	// request, which is the default limit of SpiceDB.
+	writeBatchSize = 1000
+
+	// identityUser is the user that templates are resolved as to determine
+	// which SpiceDB objects belong to a kube object without an owner. The
+	// resolved relationships are not written.
+	identityUser = "drift"
+)
+
+// Options configure a Detector.
+type Options struct {
+	backfill.Options
+
+	// ActiveWorkflows is the set of IDs of workflow instances that haven't
+	// finished. Locks held by any other workflow are reported as leftover.
+	// If nil, every lock is reported.
+	ActiveWorkflows map[string]struct{}
+}
+
+// Detector compares the objects of every resource that has create rules with
+// the relationships of the SpiceDB objects that those rules write.
+type Detector struct {
+	opts              Options
+	backfiller        *backfill.Backfiller
+	permissionsClient v1.PermissionsServiceClient
+}
+
+// Report lists the differences between kube and SpiceDB.
+type Report struct {
+	// Orphans are relationships of SpiceDB objects that no kube object
+	// resolves to.
+	Orphans []*v1.Relationship
+
+	// Missing are kube objects whose SpiceDB objects have no relationships.
+	Missing []MissingObject
+
+	// Locks are lock relationships of workflows that aren't running.
+	Locks []*v1.Relationship
+}
+
+// MissingObject is a kube object whose SpiceDB objects have no
+// relationships.
+type MissingObject struct {
+	Resource  schema.GroupVersionResource
+	Namespace string
+	Name      string
+
+	// Relationships are the relationships that the create rules resolve to
+	// for the owner of the object. It is empty if the object has no owner.
+	Relationships []*v1.Relationship
+}
+
+// NewDetector creates a Detector for the resources of the rule configs.
+func NewDetector(configs []proxyrule.Config, kubeClient dynamic.Interface, permissionsClient v1.PermissionsServiceClient, opts Options) (*Detector, error) {
+	backfiller, err := backfill.NewBackfiller(configs, kubeClient, permissionsClient, opts.Options)
+	if err != nil {
+		return nil, err
+	}
+	return &Detector{
+		opts:              opts,
+		backfiller:        backfiller,
+		permissionsClient: permissionsClient,
+	}, nil
+}
+
+// Detect lists the objects in kube and the relationships in SpiceDB, and
+// reports the differences.
+func (d *Detector) Detect(ctx context.Context) (*Report, error) {
+	type object struct {
+		gvr       schema.GroupVersionResource
+		namespace string
+		name      string
+		resources []string
+		rels      []*v1.Relationship
+	}
+
+	var objects []object
+	expected := make(map[string]struct{})
+	resourceTypes := d.backfiller.ResourceTypes()
+	err := d.backfiller.EachObject(ctx, func(gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+		owner, err := d.backfiller.OwnerOf(obj)
+		if err != nil {
+			return err
+		}
+		resolveAs := owner
+		if resolveAs == "" {
+			resolveAs = identityUser
+		}
+		rels, err := d.backfiller.Resolve(gvr, obj, resolveAs)
+		if err != nil {
+			return err
+		}
+
+		o := object{gvr: gvr, namespace: obj.GetNamespace(), name: obj.GetName()}
+		if owner != "" {
+			o.rels = rels
+		}
+		for _, rel := range rels {
+			key := objectKey(rel.Resource)
+			expected[key] = struct{}{}
+			if !slices.Contains(o.resources, key) {
+				o.resources = append(o.resources, key)
+			}
+			if !slices.Contains(resourceTypes, rel.Resource.ObjectType) {
+				resourceTypes = append(resourceTypes, rel.Resource.ObjectType)
+			}
+		}
+		objects = append(objects, o)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	existing := make(map[string]struct{})
+	for _, resourceType := range resourceTypes {
+		err := d.readRelationships(ctx, &v1.RelationshipFilter{ResourceType: resourceType}, func(rel *v1.Relationship) {
+			key := objectKey(rel.Resource)
+			existing[key] = struct{}{}
+			if _, ok := expected[key]; !ok {
+				report.Orphans = append(report.Orphans, rel)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, o := range objects {
+		if len(o.resources) == 0 {
+			continue
+		}
+		found := slices.ContainsFunc(o.resources, func(key string) bool {
+			_, ok := existing[key]
+			return ok
+		})
+		if !found {
+			report.Missing = append(report.Missing, MissingObject{Resource: o.gvr, Namespace: o.namespace, Name: o.name, Relationships: o.rels})
+		}
+	}
+
+	err = d.readRelationships(ctx, distributedtx.LockFilter(), func(rel *v1.Relationship) {
+		if d.opts.ActiveWorkflows != nil {
+			if _, ok := d.opts.ActiveWorkflows[rel.Subject.Object.ObjectId]; ok {
+				return
+			}
+		}
+		report.Locks = append(report.Locks, rel)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	klog.FromContext(ctx).V(2).Info("detected drift", "resourceTypes", resourceTypes, "objects", len(objects), "orphans", len(report.Orphans), "missing", len(report.Missing), "locks", len(report.Locks))
+	return report, nil
+}
+
+// readRelationships reads every relationship that matches the filter, one
+// page at a time.
+func (d *Detector) readRelationships(ctx context.Context, filter *v1.RelationshipFilter, fn func(*v1.Relationship)) error {
+	var cursor *v1.Cursor
+	for {
+		stream, err := d.permissionsClient.ReadRelationships(ctx, &v1.ReadRelationshipsRequest{
+			Consistency: &v1.Consistency{
+				Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true},
+			},
+			RelationshipFilter: filter,
+			OptionalLimit:      readPageSize,
+			OptionalCursor:     cursor,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to read relationships of %s: %w", filter.ResourceType, err)
+		}
+
+		read := 0
+		for {
+			resp, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("unable to read relationships of %s: %w", filter.ResourceType, err)
+			}
+			read++
+			cursor = resp.AfterResultCursor
+			fn(resp.Relationship)
+		}
+		if read < readPageSize {
+			return nil
+		}
+	}
+}
+
+// Fix deletes the orphaned relationships and leftover locks of the report,
+// and writes the relationships of missing objects that have an owner.
+func (d *Detector) Fix(ctx context.Context, report *Report) error {
+	var updates []*v1.RelationshipUpdate
+	for _, rel := range slices.Concat(report.Orphans, report.Locks) {
+		updates = append(updates, &v1.RelationshipUpdate{Operation: v1.RelationshipUpdate_OPERATION_DELETE, Relationship: rel})
+	}
+	for _, missing := range report.Missing {
+		if len(missing.Relationships) == 0 {
+			klog.FromContext(ctx).Info("not fixing object without owner", "resource", missing.Resource, "namespace", missing.Namespace, "name", missing.Name)
+			continue
+		}
+		for _, rel := range missing.Relationships {
+			updates = append(updates, &v1.RelationshipUpdate{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: rel})
+		}
+	}
+
+	for batch := range slices.Chunk(updates, writeBatchSize) {
+		if _, err := d.permissionsClient.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: batch}); err != nil {
+			return fmt.Errorf("unable to write relationships: %w", err)
+		}
+	}
+	klog.FromContext(ctx).Info("fixed drift", "updates", len(updates))
+	return nil
+}
+
+// Empty returns whether the report found no differences.
+func (r *Report) Empty() bool {
+	return len(r.Orphans) == 0 && len(r.Missing) == 0 && len(r.Locks) == 0
+}
+
+// Write prints the differences of the report to w, one per line.
+func (r *Report) Write(w io.Writer) error {
+	for _, rel := range r.Orphans {
+		if _, err := fmt.Fprintf(w, "orphaned relationship: %s\n", tuple.MustV1StringRelationship(rel)); err != nil {
+			return err
+		}
+	}
+	for _, missing := range r.Missing {
+		name := missing.Name
+		if missing.Namespace != "" {
+			name = missing.Namespace + "/" + name
+		}
+		if _, err := fmt.Fprintf(w, "missing relationships: %s %s\n", missing.Resource.GroupResource(), name); err != nil {
+			return err
+		}
+	}
+	for _, rel := range r.Locks {
+		if _, err := fmt.Fprintf(w, "leftover lock: %s\n", tuple.MustV1StringRelationship(rel)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d orphaned relationships, %d objects with missing relationships, %d leftover locks\n", len(r.Orphans), len(r.Missing), len(r.Locks))
+	return err
+}
+
+func objectKey(obj *v1.ObjectReference) string {
+	return obj.ObjectType + ":" + obj.ObjectId
+}
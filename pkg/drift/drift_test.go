@@ -0,0 +1,123 @@
+package drift
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/spicedb/pkg/tuple"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/backfill"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+var podsGVR = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+const testRules = `
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: create-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["create"]
+update:
+  creates:
+  - tpl: "pod:{{namespacedName}}#creator@user:{{user.name}}"
+`
+
+func TestDetect(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	var updates []*v1.RelationshipUpdate
+	for _, rel := range []string{
+		"pod:default/web#creator@user:alice",
+		"pod:default/web#viewer@user:bob",
+		"pod:default/db#creator@user:carol",
+		"pod:default/gone#creator@user:alice",
+		"pod:default/gone#viewer@user:bob",
+		"lock:crashed#workflow@workflow:crashed",
+		"lock:running#workflow@workflow:running",
+	} {
+		updates = append(updates, &v1.RelationshipUpdate{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: tuple.MustParseV1Rel(rel)})
+	}
+	_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: updates})
+	require.NoError(t, err)
+
+	kubeClient := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{podsGVR: "PodList"},
+		newPod("web", "alice"),
+		newPod("db", ""),
+		newPod("new", "bob"),
+		newPod("unowned", ""),
+	)
+	configs, err := proxyrule.Parse(strings.NewReader(testRules))
+	require.NoError(t, err)
+	d, err := NewDetector(configs, kubeClient, psc, Options{
+		Options:         backfill.Options{OwnerAnnotation: "authzed.com/owner"},
+		ActiveWorkflows: map[string]struct{}{"running": {}},
+	})
+	require.NoError(t, err)
+
+	report, err := d.Detect(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"pod:default/gone#creator@user:alice", "pod:default/gone#viewer@user:bob"}, relStrings(report.Orphans))
+	require.ElementsMatch(t, []string{"lock:crashed#workflow@workflow:crashed"}, relStrings(report.Locks))
+	require.Len(t, report.Missing, 2)
+	missing := map[string][]string{}
+	for _, m := range report.Missing {
+		require.Equal(t, podsGVR, m.Resource)
+		missing[m.Namespace+"/"+m.Name] = relStrings(m.Relationships)
+	}
+	require.Equal(t, map[string][]string{
+		"default/new":     {"pod:default/new#creator@user:bob"},
+		"default/unowned": {},
+	}, missing)
+
+	var out bytes.Buffer
+	require.NoError(t, report.Write(&out))
+	require.Contains(t, out.String(), "orphaned relationship: pod:default/gone#creator@user:alice\n")
+	require.Contains(t, out.String(), "missing relationships: pods default/new\n")
+	require.Contains(t, out.String(), "leftover lock: lock:crashed#workflow@workflow:crashed\n")
+	require.Contains(t, out.String(), "2 orphaned relationships, 2 objects with missing relationships, 1 leftover locks\n")
+
+	require.NoError(t, d.Fix(ctx, report))
+
+	// only the object without an owner is left
+	report, err = d.Detect(ctx)
+	require.NoError(t, err)
+	require.Empty(t, report.Orphans)
+	require.Empty(t, report.Locks)
+	require.Len(t, report.Missing, 1)
+	require.Equal(t, "unowned", report.Missing[0].Name)
+}
+
+func newPod(name, owner string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]any{"apiVersion": "v1", "kind": "Pod"}}
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	if owner != "" {
+		obj.SetAnnotations(map[string]string{"authzed.com/owner": owner})
+	}
+	return obj
+}
+
+func relStrings(rels []*v1.Relationship) []string {
+	strs := make([]string, 0, len(rels))
+	for _, rel := range rels {
+		strs = append(strs, tuple.MustV1StringRelationship(rel))
+	}
+	return strs
+}
@@ -0,0 +1,117 @@
+package drift
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cschleiden/go-workflows/backend/redis"
+	"github.com/cschleiden/go-workflows/backend/sqlite"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/backfill"
+)
+
+// CommandOptions are the options of the drift command.
+type CommandOptions struct {
+	backfill.ClusterOptions
+
+	WorkflowDatabasePath   string
+	WorkflowRedisURL       string
+	WorkflowRedisKeyPrefix string
+	Fix                    bool
+}
+
+// NewCommandOptions returns the default options of the drift command.
+func NewCommandOptions() *CommandOptions {
+	return &CommandOptions{ClusterOptions: backfill.NewClusterOptions()}
+}
+
+func (o *CommandOptions) AddFlags(fs *pflag.FlagSet) {
+	o.ClusterOptions.AddFlags(fs)
+
+	fs.StringVar(&o.WorkflowDatabasePath, "workflow-database-path", "", "Path for the file representing the SQLite database of the proxy's workflow engine. Locks of workflows that are still running in it are not reported. If empty, every lock is reported.")
+	fs.StringVar(&o.WorkflowRedisURL, "workflow-redis-url", "", "The URL of the Redis of the proxy's workflow engine, for proxies that run with --workflow-backend=redis. Locks of workflows that are still running in it are not reported.")
+	fs.StringVar(&o.WorkflowRedisKeyPrefix, "workflow-redis-key-prefix", "spicedb-kubeapi-proxy:", "The prefix of the keys of the proxy's workflow engine in Redis.")
+	fs.BoolVar(&o.Fix, "fix", false, "if true, deletes orphaned relationships and leftover locks, and writes the relationships of objects that have none.")
+}
+
+func (o *CommandOptions) Validate() []error {
+	errs := o.ClusterOptions.Validate()
+	if o.WorkflowDatabasePath != "" && o.WorkflowRedisURL != "" {
+		errs = append(errs, fmt.Errorf("only one of --workflow-database-path or --workflow-redis-url can be set"))
+	}
+	return errs
+}
+
+// Run reports the drift between the cluster and SpiceDB to out, and fixes it
+// with --fix.
+func (o *CommandOptions) Run(ctx context.Context, out io.Writer) error {
+	ruleConfigs, err := o.RuleConfigs()
+	if err != nil {
+		return err
+	}
+	kubeClient, err := o.KubeClient()
+	if err != nil {
+		return err
+	}
+	conn, err := o.SpiceDBOptions.NewRemoteConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	opts := Options{Options: o.Options}
+	switch {
+	case o.WorkflowDatabasePath != "":
+		if _, err := os.Stat(o.WorkflowDatabasePath); err != nil {
+			return fmt.Errorf("unable to open workflow database: %w", err)
+		}
+		b := sqlite.NewSqliteBackend(o.WorkflowDatabasePath)
+		defer b.Close()
+		opts.ActiveWorkflows, err = distributedtx.ActiveInstanceIDs(ctx, b)
+		if err != nil {
+			return err
+		}
+	case o.WorkflowRedisURL != "":
+		redisOpts, err := goredis.ParseURL(o.WorkflowRedisURL)
+		if err != nil {
+			return fmt.Errorf("unable to parse workflow Redis URL: %w", err)
+		}
+		rdb := goredis.NewClient(redisOpts)
+		defer rdb.Close()
+		b, err := redis.NewRedisBackend(rdb, redis.WithKeyPrefix(o.WorkflowRedisKeyPrefix))
+		if err != nil {
+			return fmt.Errorf("unable to open workflow Redis: %w", err)
+		}
+		opts.ActiveWorkflows, err = distributedtx.ActiveInstanceIDs(ctx, b)
+		if err != nil {
+			return err
+		}
+	case o.Fix:
+		klog.FromContext(ctx).Info("no workflow database, every lock will be deleted; the proxy must not be running")
+	}
+
+	d, err := NewDetector(ruleConfigs, kubeClient, v1.NewPermissionsServiceClient(conn), opts)
+	if err != nil {
+		return err
+	}
+	report, err := d.Detect(ctx)
+	if err != nil {
+		return err
+	}
+	if err := report.Write(out); err != nil {
+		return err
+	}
+
+	if !o.Fix || report.Empty() {
+		return nil
+	}
+	return d.Fix(ctx, report)
+}
@@ -0,0 +1,267 @@
+// Package gc cleans up the relationships of objects that kube removes
+// without a request to the proxy, because their namespace or their owner was
+// deleted.
+package gc
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+// User is the user that the templates are resolved as for garbage collected
+// objects, since they are not removed by a request of a specific user.
+var User = &user.DefaultInfo{Name: "system:spicedb-kubeapi-proxy:garbage-collector"}
+
+// Cause describes why kube removed an object.
+type Cause string
+
+const (
+	// CauseOwner means that the object had ownerReferences, and was removed
+	// by kube's garbage collector.
+	CauseOwner Cause = "ownerReference"
+
+	// CauseNamespace means that the object was removed because its
+	// namespace was deleted.
+	CauseNamespace Cause = "namespace"
+)
+
+var namespacesGVR = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+
+// Collector watches the resources that have rules for deletes or garbage
+// collection, and writes the relationship updates of those rules when kube
+// removes an object because its namespace or owner was deleted.
+//
+// The resources are watched with their whole objects, not only their
+// metadata, so that templates and conditions that read the spec or other
+// fields of the body resolve like they do for requests.
+type Collector struct {
+	kubeClient        dynamic.Interface
+	permissionsClient v1.PermissionsServiceClient
+
+	// rules holds the rules for each watched resource.
+	rules map[schema.GroupVersionResource][]*rules.RunnableRule
+}
+
+// NewCollector creates a Collector for the resources of the rule configs.
+//
+// Rules that define onGarbageCollected are used for the resources that they
+// match. For resources without such rules, the rules that match the delete
+// verb and define an update are used instead. Of rules that also match
+// other verbs, only the deletes and deleteByFilter of the update are used,
+// since its creates and touches are meant for the other verbs.
+func NewCollector(configs []proxyrule.Config, kubeClient dynamic.Interface, permissionsClient v1.PermissionsServiceClient) (*Collector, error) {
+	gcRules := make(map[schema.GroupVersionResource][]*rules.RunnableRule)
+	deleteRules := make(map[schema.GroupVersionResource][]*rules.RunnableRule)
+	for _, config := range configs {
+		rule, err := rules.Compile(config)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't compile rule %s: %w", config.Name, err)
+		}
+		var deletes *rules.RunnableRule
+		for _, m := range config.Matches {
+			gv, err := schema.ParseGroupVersion(m.GroupVersion)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse gv %q: %w", m.GroupVersion, err)
+			}
+			gvr := gv.WithResource(m.Resource)
+
+			switch {
+			case rule.OnGarbageCollected != nil:
+				gcRules[gvr] = appendOnce(gcRules[gvr], rule)
+			case rule.Update != nil && slices.Contains(m.Verbs, "delete"):
+				collected := rule
+				if slices.ContainsFunc(m.Verbs, func(verb string) bool { return verb != "delete" }) {
+					if deletes == nil {
+						deletes = withDeletesOnly(rule)
+					}
+					collected = deletes
+				}
+				deleteRules[gvr] = appendOnce(deleteRules[gvr], collected)
+			}
+		}
+	}
+
+	for gvr, matching := range deleteRules {
+		if _, ok := gcRules[gvr]; !ok {
+			gcRules[gvr] = matching
+		}
+	}
+
+	return &Collector{
+		kubeClient:        kubeClient,
+		permissionsClient: permissionsClient,
+		rules:             gcRules,
+	}, nil
+}
+
+// withDeletesOnly returns a copy of the rule whose update only has the
+// deletes and deleteByFilter of the update of the rule.
+func withDeletesOnly(rule *rules.RunnableRule) *rules.RunnableRule {
+	deletes := *rule
+	deletes.Update = &rules.UpdateSet{
+		Deletes:         rule.Update.Deletes,
+		DeletesByFilter: rule.Update.DeletesByFilter,
+	}
+	return &deletes
+}
+
+func appendOnce(matching []*rules.RunnableRule, rule *rules.RunnableRule) []*rules.RunnableRule {
+	if slices.Contains(matching, rule) {
+		return matching
+	}
+	return append(matching, rule)
+}
+
+// Resources returns the resources that the collector watches.
+func (c *Collector) Resources() []schema.GroupVersionResource {
+	resources := make([]schema.GroupVersionResource, 0, len(c.rules))
+	for gvr := range c.rules {
+		resources = append(resources, gvr)
+	}
+	slices.SortFunc(resources, func(a, b schema.GroupVersionResource) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return resources
+}
+
+// Run watches the resources until the context is cancelled.
+func (c *Collector) Run(ctx context.Context) error {
+	if len(c.rules) == 0 {
+		klog.FromContext(ctx).Info("no rules for garbage collection, not watching any resources")
+		<-ctx.Done()
+		return nil
+	}
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(c.kubeClient, 0)
+	for _, gvr := range c.Resources() {
+		_, err := factory.ForResource(gvr).Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			DeleteFunc: func(obj any) {
+				c.onDelete(ctx, gvr, obj)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to watch %s: %w", gvr, err)
+		}
+	}
+
+	klog.FromContext(ctx).Info("starting garbage collection", "resources", c.Resources())
+	factory.Start(ctx.Done())
+	for gvr, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			klog.FromContext(ctx).Info("unable to sync resource for garbage collection", "resource", gvr)
+		}
+	}
+
+	<-ctx.Done()
+	factory.Shutdown()
+	return nil
+}
+
+func (c *Collector) onDelete(ctx context.Context, gvr schema.GroupVersionResource, obj any) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	removed, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		klog.FromContext(ctx).Info("unexpected object in delete event", "resource", gvr, "type", fmt.Sprintf("%T", obj))
+		return
+	}
+
+	err := retry.OnError(retry.DefaultBackoff, func(error) bool { return ctx.Err() == nil }, func() error {
+		cause, err := c.cause(ctx, removed)
+		if err != nil || cause == "" {
+			return err
+		}
+		klog.V(3).InfoS("collecting relationships of removed object", "resource", gvr, "namespace", removed.GetNamespace(), "name", removed.GetName(), "cause", cause)
+		return c.Collect(ctx, gvr, removed)
+	})
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "unable to collect relationships of removed object", "resource", gvr, "namespace", removed.GetNamespace(), "name", removed.GetName())
+	}
+}
+
+// cause returns why kube removed the object, or an empty cause if it was
+// not garbage collected.
+func (c *Collector) cause(ctx context.Context, removed *unstructured.Unstructured) (Cause, error) {
+	if len(removed.GetOwnerReferences()) > 0 {
+		return CauseOwner, nil
+	}
+	if removed.GetNamespace() == "" {
+		return "", nil
+	}
+
+	namespace, err := c.kubeClient.Resource(namespacesGVR).Get(ctx, removed.GetNamespace(), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return CauseNamespace, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to get namespace %s: %w", removed.GetNamespace(), err)
+	}
+	if namespace.GetDeletionTimestamp() != nil {
+		return CauseNamespace, nil
+	}
+	return "", nil
+}
+
+// Collect resolves the rules of the resource against the removed object and
+// writes their relationship updates. Creates are written as touches, and
+// deletes of relationships that don't exist succeed, so collecting an
+// object more than once has no further effect.
+func (c *Collector) Collect(ctx context.Context, gvr schema.GroupVersionResource, removed *unstructured.Unstructured) error {
+	input := rules.NewResolveInputFromObject(rules.NewRequestInfo("delete", gvr, removed.GetNamespace(), removed.GetName()), User, removed.Object)
+
+	matching, err := rules.FilterRulesWithCELConditions(c.rules[gvr], input)
+	if err != nil {
+		return fmt.Errorf("unable to evaluate rule conditions: %w", err)
+	}
+
+	var (
+		updates []*v1.RelationshipUpdate
+		filters []*v1.RelationshipFilter
+	)
+	for _, rule := range matching {
+		update := rule.OnGarbageCollected
+		if update == nil {
+			update = rule.Update
+		}
+
+		resolved, err := update.ResolveWrites(input)
+		if err != nil {
+			return fmt.Errorf("unable to resolve relationships of rule %s: %w", rule.Name, err)
+		}
+		updates = append(updates, resolved.IdempotentUpdates()...)
+		filters = append(filters, resolved.DeleteByFilter...)
+	}
+
+	if len(updates) > 0 {
+		if _, err := c.permissionsClient.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: updates}); err != nil {
+			return fmt.Errorf("unable to write relationships: %w", err)
+		}
+	}
+	for _, filter := range filters {
+		if _, err := c.permissionsClient.DeleteRelationships(ctx, &v1.DeleteRelationshipsRequest{RelationshipFilter: filter}); err != nil {
+			return fmt.Errorf("unable to delete relationships (%v): %w", filter, err)
+		}
+	}
+
+	klog.V(4).InfoS("collected relationships of removed object", "resource", gvr, "namespace", removed.GetNamespace(), "name", removed.GetName(), "updates", len(updates), "filters", len(filters))
+	return nil
+}
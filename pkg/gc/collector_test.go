@@ -0,0 +1,283 @@
+package gc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/spicedb/pkg/tuple"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+var (
+	podsGVR       = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	configMapsGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+)
+
+const testRules = `
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: delete-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["delete"]
+update:
+  deleteByFilter:
+  - tpl: "pod:{{namespacedName}}#$resourceRelation@$subjectType:$subjectID"
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: get-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["get"]
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: delete-testresources
+match:
+- apiVersion: example.com/v1
+  resource: testresources
+  verbs: ["delete"]
+update:
+  deletes:
+  - tpl: "testresource:{{namespacedName}}#creator@user:{{user.name}}"
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: collect-testresources
+match:
+- apiVersion: example.com/v1
+  resource: testresources
+  verbs: ["create"]
+onGarbageCollected:
+  deleteByFilter:
+  - tpl: "testresource:{{namespacedName}}#$resourceRelation@$subjectType:$subjectID"
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: configmaps
+match:
+- apiVersion: v1
+  resource: configmaps
+  verbs: ["create", "delete"]
+update:
+  creates:
+  - tpl: "testresource:{{namespacedName}}#creator@user:{{user.name}}"
+  deletes:
+  - tpl: "testresource:{{namespacedName}}#viewer@user:{{object.data.viewer}}"
+`
+
+func parseRules(t *testing.T, config string) []proxyrule.Config {
+	t.Helper()
+	configs, err := proxyrule.Parse(strings.NewReader(config))
+	require.NoError(t, err)
+	return configs
+}
+
+func TestNewCollector(t *testing.T) {
+	c, err := NewCollector(parseRules(t, testRules), nil, nil)
+	require.NoError(t, err)
+
+	testresources := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "testresources"}
+	require.Equal(t, []schema.GroupVersionResource{configMapsGVR, podsGVR, testresources}, c.Resources())
+
+	require.Len(t, c.rules[podsGVR], 1)
+	require.Equal(t, "delete-pods", c.rules[podsGVR][0].Name)
+
+	// rules that define onGarbageCollected take precedence over delete rules
+	require.Len(t, c.rules[testresources], 1)
+	require.Equal(t, "collect-testresources", c.rules[testresources][0].Name)
+
+	// only the deletes of rules that also match other verbs are used
+	require.Len(t, c.rules[configMapsGVR], 1)
+	require.Empty(t, c.rules[configMapsGVR][0].Update.Creates)
+	require.Len(t, c.rules[configMapsGVR][0].Update.Deletes, 1)
+}
+
+func TestCause(t *testing.T) {
+	namespace := func(name string, terminating bool) *unstructured.Unstructured {
+		ns := newObject("v1", "Namespace", "", name)
+		if terminating {
+			ns.SetDeletionTimestamp(&metav1.Time{Time: time.Now()})
+		}
+		return ns
+	}
+	owned := newObject("v1", "Pod", "default", "web-x7k2p")
+	owned.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web", UID: "c0ffee"}})
+
+	tests := []struct {
+		name    string
+		removed *unstructured.Unstructured
+		want    Cause
+	}{
+		{name: "owned object", removed: owned, want: CauseOwner},
+		{name: "object in terminating namespace", removed: newObject("v1", "Pod", "terminating", "web"), want: CauseNamespace},
+		{name: "object in removed namespace", removed: newObject("v1", "Pod", "removed", "web"), want: CauseNamespace},
+		{name: "object in active namespace", removed: newObject("v1", "Pod", "default", "web")},
+		{name: "cluster scoped object", removed: newObject("v1", "Namespace", "", "default")},
+	}
+
+	c := &Collector{kubeClient: newKubeClient(namespace("default", false), namespace("terminating", true))}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cause, err := c.cause(t.Context(), tt.removed)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, cause)
+		})
+	}
+}
+
+func TestCollect(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	creator := &v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: "testresource", ObjectId: "default/settings"},
+		Relation: "creator",
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "alice"}},
+	}
+	viewer := &v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: "testresource", ObjectId: "default/settings"},
+		Relation: "viewer",
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "bob"}},
+	}
+	_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: []*v1.RelationshipUpdate{
+		{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: creator},
+		{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: viewer},
+	}})
+	require.NoError(t, err)
+
+	c, err := NewCollector(parseRules(t, testRules), nil, psc)
+	require.NoError(t, err)
+
+	// the deletes resolve against the body of the removed object, and the
+	// creates of the rule are not written
+	removed := newObject("v1", "ConfigMap", "default", "settings")
+	removed.Object["data"] = map[string]any{"viewer": "bob"}
+	require.NoError(t, c.Collect(ctx, configMapsGVR, removed))
+
+	rels := readRelationships(ctx, t, psc, "testresource")
+	require.Equal(t, []string{"testresource:default/settings#creator@user:alice"}, rels)
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	rel := func(id, relation string) *v1.Relationship {
+		return &v1.Relationship{
+			Resource: &v1.ObjectReference{ObjectType: "pod", ObjectId: id},
+			Relation: relation,
+			Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "alice"}},
+		}
+	}
+	exists := func(r *v1.Relationship) bool {
+		resp, err := psc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+			Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+			Resource:    r.Resource,
+			Permission:  r.Relation,
+			Subject:     r.Subject,
+		})
+		require.NoError(t, err)
+		return resp.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+	}
+
+	owned := newObject("v1", "Pod", "default", "web-x7k2p")
+	owned.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web", UID: "c0ffee"}})
+	unowned := newObject("v1", "Pod", "default", "db")
+
+	var updates []*v1.RelationshipUpdate
+	for _, r := range []*v1.Relationship{rel("default/web-x7k2p", "creator"), rel("default/web-x7k2p", "viewer"), rel("default/db", "creator")} {
+		updates = append(updates, &v1.RelationshipUpdate{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: r})
+	}
+	_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: updates})
+	require.NoError(t, err)
+
+	kubeClient := newKubeClient(newObject("v1", "Namespace", "", "default"), owned, unowned)
+	c, err := NewCollector(parseRules(t, testRules), kubeClient, psc)
+	require.NoError(t, err)
+	go func() {
+		require.NoError(t, c.Run(ctx)) // nolint:testifylint
+	}()
+
+	// wait for the informers to watch before removing objects
+	require.Eventually(t, func() bool {
+		for _, action := range kubeClient.Actions() {
+			if action.GetVerb() == "watch" && action.GetResource() == podsGVR {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	pods := kubeClient.Resource(podsGVR).Namespace("default")
+	require.NoError(t, pods.Delete(ctx, unowned.GetName(), metav1.DeleteOptions{}))
+	require.NoError(t, pods.Delete(ctx, owned.GetName(), metav1.DeleteOptions{}))
+
+	require.Eventually(t, func() bool {
+		return !exists(rel("default/web-x7k2p", "creator")) && !exists(rel("default/web-x7k2p", "viewer"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the unowned pod in an active namespace was not garbage collected, so
+	// its relationships are left to the rule for deletes
+	require.True(t, exists(rel("default/db", "creator")))
+}
+
+func newKubeClient(objects ...runtime.Object) *fake.FakeDynamicClient {
+	return fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		namespacesGVR: "NamespaceList",
+		podsGVR:       "PodList",
+		configMapsGVR: "ConfigMapList",
+		{Group: "example.com", Version: "v1", Resource: "testresources"}: "TestResourceList",
+	}, objects...)
+}
+
+func newObject(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func readRelationships(ctx context.Context, t *testing.T, psc v1.PermissionsServiceClient, resourceType string) []string {
+	t.Helper()
+	stream, err := psc.ReadRelationships(ctx, &v1.ReadRelationshipsRequest{
+		Consistency:        &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+		RelationshipFilter: &v1.RelationshipFilter{ResourceType: resourceType},
+	})
+	require.NoError(t, err)
+	var rels []string
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			break
+		}
+		rels = append(rels, tuple.MustV1StringRelationship(resp.Relationship))
+	}
+	return rels
+}
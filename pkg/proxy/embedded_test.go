@@ -1,13 +1,17 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apiserver/pkg/endpoints/request"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
@@ -66,6 +70,22 @@ func TestEmbeddedMode(t *testing.T) {
 		// The error should not be a connection refused error
 		require.NotContains(t, err.Error(), "connection refused")
 	})
+
+	t.Run("metrics need authentication", func(t *testing.T) {
+		get := func(client *http.Client) int {
+			req, err := http.NewRequestWithContext(ctx, "GET", EmbeddedProxyHost+"/metrics", nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+			_, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp.StatusCode
+		}
+
+		require.Equal(t, http.StatusUnauthorized, get(proxySrv.GetEmbeddedClient()))
+		require.Equal(t, http.StatusOK, get(proxySrv.GetEmbeddedClient(WithUser("admin-user"))))
+	})
 }
 
 func TestEmbeddedModeCustomHeaders(t *testing.T) {
@@ -397,6 +417,108 @@ func (t *testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 // createEmbeddedTestOptions creates minimal options for embedded testing
+func TestEmbeddedAuthzWebhookMode(t *testing.T) {
+	defer require.NoError(t, logsv1.ResetForTest(utilfeature.DefaultFeatureGate))
+	ctx := t.Context()
+
+	opts := createEmbeddedTestOptions(t)
+	opts.Mode = ModeAuthzWebhook
+	opts.WebhookUsers = []string{"kube-apiserver"}
+	completedConfig, err := opts.Complete(ctx)
+	require.NoError(t, err)
+
+	proxySrv, err := NewServer(ctx, completedConfig)
+	require.NoError(t, err)
+	require.Nil(t, proxySrv.WorkflowWorker)
+
+	review := func(client *http.Client) *http.Response {
+		body, err := json.Marshal(&authorizationv1.SubjectAccessReview{
+			TypeMeta: metav1.TypeMeta{Kind: "SubjectAccessReview", APIVersion: "authorization.k8s.io/v1"},
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: "get", Version: "v1", Resource: "namespaces", Name: "default"},
+				User:               "janedoe",
+			},
+		})
+		require.NoError(t, err)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, EmbeddedProxyHost+"/", bytes.NewReader(body))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// the webhook only answers authenticated callers, i.e. kube
+	resp := review(proxySrv.GetEmbeddedClient())
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// and only the configured ones
+	resp = review(proxySrv.GetEmbeddedClient(WithUser("janedoe")))
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = review(proxySrv.GetEmbeddedClient(WithUser("kube-apiserver")))
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var out authorizationv1.SubjectAccessReview
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	require.True(t, out.Status.Allowed)
+}
+
+func TestEmbeddedAdmissionWebhookMode(t *testing.T) {
+	defer require.NoError(t, logsv1.ResetForTest(utilfeature.DefaultFeatureGate))
+	ctx := t.Context()
+
+	opts := createEmbeddedTestOptions(t)
+	opts.Mode = ModeAdmissionWebhook
+	opts.WebhookUsers = []string{"kube-apiserver"}
+	completedConfig, err := opts.Complete(ctx)
+	require.NoError(t, err)
+
+	proxySrv, err := NewServer(ctx, completedConfig)
+	require.NoError(t, err)
+	require.NotNil(t, proxySrv.WorkflowWorker)
+	require.NotNil(t, proxySrv.AdmissionWebhook)
+
+	review := func(client *http.Client) *http.Response {
+		body, err := json.Marshal(&admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "review",
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+				Namespace: "default",
+				Name:      "settings",
+				Operation: admissionv1.Create,
+			},
+		})
+		require.NoError(t, err)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, EmbeddedProxyHost+"/", bytes.NewReader(body))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// the webhook only answers authenticated callers, i.e. kube
+	resp := review(proxySrv.GetEmbeddedClient())
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// and only the configured ones
+	resp = review(proxySrv.GetEmbeddedClient(WithUser("janedoe")))
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = review(proxySrv.GetEmbeddedClient(WithUser("kube-apiserver")))
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var out admissionv1.AdmissionReview
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	require.NotNil(t, out.Response)
+	require.Equal(t, "review", string(out.Response.UID))
+	require.True(t, out.Response.Allowed)
+}
+
 func createEmbeddedTestOptions(t *testing.T) *Options {
 	t.Helper()
 
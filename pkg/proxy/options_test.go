@@ -2,13 +2,17 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/google/uuid"
+	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/codes"
 	"k8s.io/apiserver/pkg/endpoints/request"
@@ -156,6 +160,237 @@ prefilter:
 	require.ErrorContains(t, err, "expected")
 }
 
+func TestWorkflowBackend(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	tests := []struct {
+		name       string
+		backend    string
+		redisURL   string
+		wantErr    string
+		wantClient bool
+	}{
+		{name: "default"},
+		{name: "sqlite", backend: WorkflowBackendSQLite},
+		{name: "redis", backend: WorkflowBackendRedis, redisURL: "redis://" + mr.Addr(), wantClient: true},
+		{name: "redis without url", backend: WorkflowBackendRedis, wantErr: "--workflow-redis-url is required"},
+		{name: "redis with invalid url", backend: WorkflowBackendRedis, redisURL: "http://" + mr.Addr(), wantErr: "unable to parse workflow Redis URL"},
+		{name: "unknown", backend: "mysql", wantErr: `unknown --workflow-backend "mysql"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := optionsForTesting(t, WithEmbeddedSpiceDBEndpoint)
+			opts.WorkflowBackend = tt.backend
+			opts.WorkflowRedisURL = tt.redisURL
+
+			var err error
+			if errs := opts.Validate(); len(errs) > 0 {
+				err = errors.Join(errs...)
+			} else {
+				_, err = opts.Complete(t.Context())
+			}
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			if !tt.wantClient {
+				require.Nil(t, opts.WorkflowRedisClient)
+				return
+			}
+			require.NotNil(t, opts.WorkflowRedisClient)
+			require.NoError(t, opts.WorkflowRedisClient.Ping(t.Context()).Err())
+		})
+	}
+}
+
+func TestWorkflowRetryFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    *Options
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			want: &Options{
+				WorkflowTimeout:             30 * time.Second,
+				WorkflowMaxKubeAttempts:     5,
+				WorkflowKubeBackoff:         100 * time.Millisecond,
+				WorkflowMaxActivityAttempts: 3,
+				SpiceDBOptions:              SpiceDBOptions{MaxUpdatesPerWrite: 1000},
+			},
+		},
+		{
+			name: "overridden",
+			args: []string{
+				"--workflow-timeout=2m",
+				"--workflow-max-kube-attempts=10",
+				"--workflow-kube-backoff=1s",
+				"--workflow-max-activity-attempts=1",
+				"--spicedb-max-updates-per-write=100",
+			},
+			want: &Options{
+				WorkflowTimeout:             2 * time.Minute,
+				WorkflowMaxKubeAttempts:     10,
+				WorkflowKubeBackoff:         time.Second,
+				WorkflowMaxActivityAttempts: 1,
+				SpiceDBOptions:              SpiceDBOptions{MaxUpdatesPerWrite: 100},
+			},
+		},
+		{
+			name:    "negative timeout",
+			args:    []string{"--workflow-timeout=-1s"},
+			wantErr: "--workflow-timeout must not be negative",
+		},
+		{
+			name:    "negative attempts",
+			args:    []string{"--workflow-max-kube-attempts=-1"},
+			wantErr: "--workflow-max-kube-attempts must not be negative",
+		},
+		{
+			name:    "negative max updates per write",
+			args:    []string{"--spicedb-max-updates-per-write=-1"},
+			wantErr: "--spicedb-max-updates-per-write must not be negative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := NewOptions(WithEmbeddedSpiceDBEndpoint)
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			opts.AddFlags(fs)
+			require.NoError(t, fs.Parse(append([]string{
+				"--backend-kubeconfig=" + kubeConfigForTest(t),
+				"--rule-config=" + ruleConfigForTest(t),
+			}, tt.args...)))
+
+			err := errors.Join(opts.Validate()...)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want.WorkflowTimeout, opts.WorkflowTimeout)
+			require.Equal(t, tt.want.WorkflowMaxKubeAttempts, opts.WorkflowMaxKubeAttempts)
+			require.Equal(t, tt.want.WorkflowKubeBackoff, opts.WorkflowKubeBackoff)
+			require.Equal(t, tt.want.WorkflowMaxActivityAttempts, opts.WorkflowMaxActivityAttempts)
+			require.Equal(t, tt.want.SpiceDBOptions.MaxUpdatesPerWrite, opts.SpiceDBOptions.MaxUpdatesPerWrite)
+		})
+	}
+}
+
+func TestLockFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    *Options
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			want: &Options{
+				LockBackend:        "SpiceDB",
+				LockLeaseNamespace: "kube-system",
+				LockGranularity:    "ObjectVerb",
+				LockSweepInterval:  time.Minute,
+			},
+		},
+		{
+			name: "lease",
+			args: []string{
+				"--lock-backend=Lease",
+				"--lock-lease-namespace=proxy",
+				"--lock-ttl=1m",
+				"--lock-granularity=Namespace",
+				"--lock-sweep-interval=0",
+			},
+			want: &Options{
+				LockBackend:        "Lease",
+				LockLeaseNamespace: "proxy",
+				LockTTL:            time.Minute,
+				LockGranularity:    "Namespace",
+			},
+		},
+		{
+			name:    "unknown backend",
+			args:    []string{"--lock-backend=etcd"},
+			wantErr: `unknown --lock-backend "etcd"`,
+		},
+		{
+			name:    "negative ttl",
+			args:    []string{"--lock-ttl=-1s"},
+			wantErr: "--lock-ttl must not be negative",
+		},
+		{
+			name:    "unknown granularity",
+			args:    []string{"--lock-granularity=Cluster"},
+			wantErr: `unknown --lock-granularity "Cluster"`,
+		},
+		{
+			name:    "negative sweep interval",
+			args:    []string{"--lock-sweep-interval=-1s"},
+			wantErr: "--lock-sweep-interval must not be negative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := NewOptions(WithEmbeddedSpiceDBEndpoint)
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			opts.AddFlags(fs)
+			require.NoError(t, fs.Parse(append([]string{
+				"--backend-kubeconfig=" + kubeConfigForTest(t),
+				"--rule-config=" + ruleConfigForTest(t),
+			}, tt.args...)))
+
+			err := errors.Join(opts.Validate()...)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want.LockBackend, opts.LockBackend)
+			require.Equal(t, tt.want.LockLeaseNamespace, opts.LockLeaseNamespace)
+			require.Equal(t, tt.want.LockTTL, opts.LockTTL)
+			require.Equal(t, tt.want.LockGranularity, opts.LockGranularity)
+			require.Equal(t, tt.want.LockSweepInterval, opts.LockSweepInterval)
+		})
+	}
+}
+
+func TestModeFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{name: "default", want: ModeProxy},
+		{name: "authz webhook", args: []string{"--mode=authz-webhook", "--webhook-users=kube-apiserver"}, want: ModeAuthzWebhook},
+		{name: "admission webhook", args: []string{"--mode=admission-webhook", "--webhook-groups=system:masters"}, want: ModeAdmissionWebhook},
+		{name: "webhook without callers", args: []string{"--mode=authz-webhook"}, wantErr: "--webhook-users or --webhook-groups is required with --mode=authz-webhook"},
+		{name: "unknown", args: []string{"--mode=admission"}, wantErr: `unknown --mode "admission"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := NewOptions(WithEmbeddedSpiceDBEndpoint)
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			opts.AddFlags(fs)
+			require.NoError(t, fs.Parse(append([]string{
+				"--backend-kubeconfig=" + kubeConfigForTest(t),
+				"--rule-config=" + ruleConfigForTest(t),
+			}, tt.args...)))
+
+			err := errors.Join(opts.Validate()...)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, opts.Mode)
+		})
+	}
+}
+
 func optionsForTesting(t *testing.T, opts ...setOpt) *Options {
 	t.Helper()
 
@@ -8,10 +8,16 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/cschleiden/go-workflows/diag"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -24,18 +30,25 @@ import (
 	"k8s.io/apiserver/pkg/server"
 	genericfilters "k8s.io/apiserver/pkg/server/filters"
 	diskcached "k8s.io/client-go/discovery/cached/disk"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/homedir"
 	"k8s.io/klog/v2"
 
 	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
 
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/admission"
 	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz"
 	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/gc"
 	"github.com/authzed/spicedb-kubeapi-proxy/pkg/inmemory"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/reconciler"
 	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/workflowadmin"
 )
 
 type Server struct {
@@ -44,6 +57,24 @@ type Server struct {
 	WorkflowWorker *distributedtx.Worker
 	KubeClient     *kubernetes.Clientset
 	Matcher        *rules.Matcher
+
+	// Collector cleans up relationships of garbage collected objects. It is
+	// nil unless garbage collection is enabled.
+	Collector *gc.Collector
+
+	// Reconciler writes relationships of objects that are created or
+	// deleted without a request to the proxy. It is nil unless the
+	// reconciler is enabled.
+	Reconciler *reconciler.Reconciler
+
+	// AdmissionWebhook starts the workflows that write the relationships of
+	// the writes it admitted once they are persisted in kube. It is nil
+	// unless the server runs in admission-webhook mode.
+	AdmissionWebhook *admission.Webhook
+
+	// LockSweeper removes the locks that crashed writes left behind. It is
+	// nil if the sweeper is disabled.
+	LockSweeper *distributedtx.LockSweeper
 }
 
 func NewServer(ctx context.Context, c *CompletedConfig) (*Server, error) {
@@ -127,14 +158,35 @@ func NewServer(ctx context.Context, c *CompletedConfig) (*Server, error) {
 		),
 	}
 
-	workflowClient, worker, err := distributedtx.SetupWithSQLiteBackend(ctx,
-		s.opts.PermissionsClient,
-		s.KubeClient.RESTClient(),
-		c.config.WorkflowDatabasePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize distributed transaction handling: %w", err)
+	if s.opts.GarbageCollection {
+		dynamicClient, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create dynamic client for garbage collection: %w", err)
+		}
+		s.Collector, err = gc.NewCollector(s.opts.RuleConfigs, dynamicClient, s.opts.PermissionsClient)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize garbage collection: %w", err)
+		}
+	}
+
+	if s.opts.Reconciler {
+		dynamicClient, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create dynamic client for the reconciler: %w", err)
+		}
+		broadcaster := record.NewBroadcaster(record.WithContext(ctx))
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: s.KubeClient.CoreV1().Events("")})
+		s.Reconciler, err = reconciler.NewReconciler(s.opts.RuleConfigs, dynamicClient, s.opts.PermissionsClient, reconciler.Options{
+			User:            s.opts.ReconcilerUser,
+			OwnerAnnotation: s.opts.ReconcilerOwnerAnnotation,
+			GracePeriod:     s.opts.ReconcilerGracePeriod,
+			Recorder:        broadcaster.NewRecorder(runtime.NewScheme(), corev1.EventSource{Component: "spicedb-kubeapi-proxy-reconciler"}),
+			RESTMapper:      restMapper,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize the reconciler: %w", err)
+		}
 	}
-	s.WorkflowWorker = worker
 
 	// Matcher is a pointer to an interface to make it easy to swap at runtime in tests
 	s.Matcher = &s.opts.Matcher
@@ -144,7 +196,109 @@ func NewServer(ctx context.Context, c *CompletedConfig) (*Server, error) {
 	codecs := serializer.NewCodecFactory(scheme)
 	failHandler := genericapifilters.Unauthorized(codecs)
 
-	handler := authz.WithAuthorization(clusterProxy, failHandler, restMapper, c.config.PermissionsClient, c.config.WatchClient, workflowClient, s.Matcher, s.opts.InputExtractor)
+	// An authorization webhook answers kube instead of proxying requests,
+	// so it has no workflows.
+	if s.opts.Mode == ModeAuthzWebhook {
+		for _, warning := range authz.WebhookWarnings(s.opts.RuleConfigs) {
+			klog.FromContext(ctx).Info("rule can't be fully enforced by the authorization webhook", "warning", warning)
+		}
+
+		handler := authz.WithAuthorizationWebhook(http.NotFoundHandler(), restMapper, s.opts.PermissionsClient, s.Matcher)
+		handler = withWebhookCallers(handler, s.opts.WebhookUsers, s.opts.WebhookGroups)
+		handler = withAuthentication(handler, failHandler, s.opts.AuthenticationInfo.Authenticator)
+		handler = genericapifilters.WithRequestInfo(handler, requestInfoResolver)
+		handler = genericfilters.WithHTTPLogging(handler)
+		handler = genericfilters.WithPanicRecovery(handler, requestInfoResolver)
+
+		mux.Handle("/", handler)
+		s.Handler = mux
+		return s, nil
+	}
+
+	// An admission webhook answers kube instead of proxying requests, and
+	// writes relationships with workflows after kube persists the objects.
+	if s.opts.Mode == ModeAdmissionWebhook {
+		workflowClient, err := s.setupWorkflows(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		s.AdmissionWebhook, err = admission.NewWebhook(s.opts.RuleConfigs, workflowClient, s.opts.PermissionsClient, admission.Options{
+			ConfirmTimeout:     s.opts.AdmissionConfirmTimeout,
+			RemovalTimeout:     s.opts.AdmissionRemovalTimeout,
+			MaxUpdatesPerWrite: s.opts.SpiceDBOptions.MaxUpdatesPerWrite,
+			LockGranularity:    s.opts.LockGranularity,
+			Locks:              s.lockBackend(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize the admission webhook: %w", err)
+		}
+
+		var handler http.Handler = s.AdmissionWebhook
+		handler = withWebhookCallers(handler, s.opts.WebhookUsers, s.opts.WebhookGroups)
+		handler = withAuthentication(handler, failHandler, s.opts.AuthenticationInfo.Authenticator)
+		handler = genericapifilters.WithRequestInfo(handler, requestInfoResolver)
+		handler = genericfilters.WithHTTPLogging(handler)
+		handler = genericfilters.WithPanicRecovery(handler, requestInfoResolver)
+
+		mux.Handle("/", handler)
+		s.Handler = mux
+		return s, nil
+	}
+
+	workflowClient, err := s.setupWorkflows(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	worker := s.WorkflowWorker
+	locks := s.lockBackend()
+	worker.SetLockBackend(locks)
+	if s.opts.LockSweepInterval > 0 {
+		diagBackend, ok := worker.Backend().(diag.Backend)
+		if !ok {
+			return nil, fmt.Errorf("workflow backend %T doesn't support listing workflows", worker.Backend())
+		}
+		s.LockSweeper = distributedtx.NewLockSweeper(locks, diagBackend, s.opts.LockSweepInterval)
+	}
+
+	outboxCollector, err := distributedtx.NewOutboxCollector(worker.Backend())
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize outbox metrics: %w", err)
+	}
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(outboxCollector); err != nil {
+		return nil, fmt.Errorf("failed to register outbox metrics: %w", err)
+	}
+	// the metrics are served on the same port as the proxy, so they need the
+	// same authentication
+	metricsHandler := withAuthentication(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), failHandler, s.opts.AuthenticationInfo.Authenticator)
+	metricsHandler = genericapifilters.WithRequestInfo(metricsHandler, requestInfoResolver)
+	mux.Handle("/metrics", metricsHandler)
+
+	// The default input extractor reads objects from kube to resolve patches
+	if s.opts.InputExtractor == nil {
+		s.opts.InputExtractor = rules.NewKubeResolveInputExtractor(s.KubeClient.RESTClient())
+	}
+
+	handler := authz.WithAuthorization(clusterProxy, failHandler, restMapper, c.config.PermissionsClient, c.config.WatchClient, workflowClient, s.Matcher, s.opts.InputExtractor, authz.WriteOptions{
+		Timeout: s.opts.WorkflowTimeout,
+		Retry: distributedtx.RetryPolicy{
+			MaxKubeAttempts:     s.opts.WorkflowMaxKubeAttempts,
+			KubeBackoff:         s.opts.WorkflowKubeBackoff,
+			MaxActivityAttempts: s.opts.WorkflowMaxActivityAttempts,
+		},
+		LockGranularity:    s.opts.LockGranularity,
+		MaxUpdatesPerWrite: s.opts.SpiceDBOptions.MaxUpdatesPerWrite,
+		Locks:              locks,
+	})
+	// the workflow admin API also serves approvals, so it's installed even
+	// if there are no admin groups
+	admin, err := distributedtx.NewAdmin(worker.Backend(), workflowClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize the workflow admin API: %w", err)
+	}
+	admin.MaxUpdatesPerWrite = s.opts.SpiceDBOptions.MaxUpdatesPerWrite
+	admin.PermissionsClient = s.opts.PermissionsClient
+	handler = workflowadmin.WithWorkflowAdmin(handler, failHandler, admin, s.opts.WorkflowAdminGroups)
 	handler = withAuthentication(handler, failHandler, s.opts.AuthenticationInfo.Authenticator)
 	handler = genericapifilters.WithRequestInfo(handler, requestInfoResolver)
 	handler = genericfilters.WithHTTPLogging(handler)
@@ -157,6 +311,48 @@ func NewServer(ctx context.Context, c *CompletedConfig) (*Server, error) {
 	return s, nil
 }
 
+// setupWorkflows creates the workflow engine with the configured backend.
+// Its worker is started by Run.
+func (s *Server) setupWorkflows(ctx context.Context, c *CompletedConfig) (*client.Client, error) {
+	var workflowClient *client.Client
+	var worker *distributedtx.Worker
+	var err error
+	switch c.config.WorkflowBackend {
+	case WorkflowBackendRedis:
+		workflowClient, worker, err = distributedtx.SetupWithRedisBackend(ctx,
+			s.opts.PermissionsClient,
+			s.KubeClient.RESTClient(),
+			c.config.WorkflowRedisClient,
+			c.config.WorkflowRedisKeyPrefix)
+	default:
+		workflowClient, worker, err = distributedtx.SetupWithSQLiteBackend(ctx,
+			s.opts.PermissionsClient,
+			s.KubeClient.RESTClient(),
+			c.config.WorkflowDatabasePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize distributed transaction handling: %w", err)
+	}
+	s.WorkflowWorker = worker
+	return workflowClient, nil
+}
+
+// lockBackend returns the backend that pessimistic writes store their locks
+// in, according to --lock-backend.
+func (s *Server) lockBackend() distributedtx.LockBackend {
+	if s.opts.LockBackend == distributedtx.LockBackendLease {
+		return &distributedtx.LeaseLockBackend{
+			KubeClient: s.KubeClient.RESTClient(),
+			Namespace:  s.opts.LockLeaseNamespace,
+			TTL:        s.opts.LockTTL,
+		}
+	}
+	return &distributedtx.SpiceDBLockBackend{
+		PermissionClient: s.opts.PermissionsClient,
+		TTL:              s.opts.LockTTL,
+	}
+}
+
 func (s *Server) PermissionClient() v1.PermissionsServiceClient {
 	return s.opts.PermissionsClient
 }
@@ -172,9 +368,26 @@ func (s *Server) Run(ctx context.Context) error {
 			return s.opts.SpiceDBOptions.EmbeddedSpiceDB.Run(ctx)
 		})
 	}
-	g.Go(func() error {
-		return s.WorkflowWorker.Start(ctx)
-	})
+	if s.WorkflowWorker != nil {
+		g.Go(func() error {
+			return s.WorkflowWorker.Start(ctx)
+		})
+	}
+	if s.Collector != nil {
+		g.Go(func() error {
+			return s.Collector.Run(ctx)
+		})
+	}
+	if s.Reconciler != nil {
+		g.Go(func() error {
+			return s.Reconciler.Run(ctx)
+		})
+	}
+	if s.LockSweeper != nil {
+		g.Go(func() error {
+			return s.LockSweeper.Run(ctx)
+		})
+	}
 
 	if !s.opts.EmbeddedMode {
 		// For regular mode, use TLS serving
@@ -192,8 +405,10 @@ func (s *Server) Run(ctx context.Context) error {
 	if err := g.Wait(); err != nil {
 		ctx, cancel = context.WithTimeout(context.Background(), 1*time.Minute)
 		defer cancel()
-		if err := s.WorkflowWorker.Shutdown(ctx); err != nil {
-			return err
+		if s.WorkflowWorker != nil {
+			if err := s.WorkflowWorker.Shutdown(ctx); err != nil {
+				return err
+			}
 		}
 		return err
 	}
@@ -221,6 +436,24 @@ func withAuthentication(handler, failed http.Handler, auth authenticator.Request
 	})
 }
 
+// withWebhookCallers only passes requests of the users, or users in the
+// groups, that are allowed to call the webhook, i.e. the kube apiserver.
+// Other authenticated users could otherwise probe the rules for any user, or
+// have the admission webhook write relationships.
+func withWebhookCallers(handler http.Handler, users, groups []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		caller, ok := request.UserFrom(req.Context())
+		if !ok || !slices.Contains(users, caller.GetName()) && !slices.ContainsFunc(caller.GetGroups(), func(group string) bool {
+			return slices.Contains(groups, group)
+		}) {
+			klog.V(3).InfoS("caller is not allowed to call the webhook", "method", req.Method, "url", req.URL)
+			http.Error(w, "the webhook only answers the kube apiserver", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
 // Note: these helpers are copied from cli-runtime/pkg/genericclioptions/config.go
 // and can be removed if we move to config.ConfigFlags
 
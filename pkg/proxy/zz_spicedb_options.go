@@ -37,6 +37,7 @@ func (s *SpiceDBOptions) ToOption() SpiceDBOptionsOption {
 		to.SkipVerifyCA = s.SkipVerifyCA
 		to.SecureSpiceDBTokensBySpace = s.SecureSpiceDBTokensBySpace
 		to.SpicedbCAPath = s.SpicedbCAPath
+		to.MaxUpdatesPerWrite = s.MaxUpdatesPerWrite
 	}
 }
 
@@ -48,6 +49,7 @@ func (s SpiceDBOptions) DebugMap() map[string]any {
 	debugMap["SkipVerifyCA"] = helpers.DebugValue(s.SkipVerifyCA, false)
 	debugMap["SecureSpiceDBTokensBySpace"] = helpers.SensitiveDebugValue(s.SecureSpiceDBTokensBySpace)
 	debugMap["SpicedbCAPath"] = helpers.DebugValue(s.SpicedbCAPath, false)
+	debugMap["MaxUpdatesPerWrite"] = helpers.DebugValue(s.MaxUpdatesPerWrite, false)
 	return debugMap
 }
 
@@ -108,3 +110,10 @@ func WithSpicedbCAPath(spicedbCAPath string) SpiceDBOptionsOption {
 		s.SpicedbCAPath = spicedbCAPath
 	}
 }
+
+// WithMaxUpdatesPerWrite returns an option that can set MaxUpdatesPerWrite on a SpiceDBOptions
+func WithMaxUpdatesPerWrite(maxUpdatesPerWrite int) SpiceDBOptionsOption {
+	return func(s *SpiceDBOptions) {
+		s.MaxUpdatesPerWrite = maxUpdatesPerWrite
+	}
+}
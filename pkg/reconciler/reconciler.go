@@ -0,0 +1,437 @@
+// Package reconciler writes the relationships of objects that are created or
+// deleted in kube without a request to the proxy, i.e. by controllers or by
+// clients that talk to kube directly.
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/rules"
+)
+
+const (
+	// DefaultUser is the user that templates are resolved as for objects
+	// that don't have an owner annotation.
+	DefaultUser = "system:spicedb-kubeapi-proxy:reconciler"
+
+	// DefaultOwnerAnnotation is the conventional annotation that names the
+	// user that owns an object created outside the proxy. The reconciler
+	// only reads it if it is configured as Options.OwnerAnnotation.
+	DefaultOwnerAnnotation = "authzed.com/owner"
+
+	// DefaultGracePeriod is how long the reconciler waits after an object is
+	// created before it writes its relationships, so that writes through the
+	// proxy that complete after the kube write aren't mistaken for objects
+	// created outside the proxy.
+	DefaultGracePeriod = 30 * time.Second
+)
+
+// Reasons of the events that record reconcile actions.
+const (
+	ReasonCreated       = "RelationshipsCreated"
+	ReasonDeleted       = "RelationshipsDeleted"
+	ReasonFailed        = "RelationshipsFailed"
+	reasonAlreadyExists = "RelationshipsExist"
+)
+
+// Options configure a Reconciler.
+type Options struct {
+	// User is the user that templates are resolved as, unless the object has
+	// the owner annotation.
+	User string
+
+	// OwnerAnnotation, if set, is the annotation whose value is used as the
+	// user that templates are resolved as. Anyone who can edit an object
+	// can set its annotations, so the annotation must only be configured if
+	// every such user may act as any user that they name in it.
+	OwnerAnnotation string
+
+	// GracePeriod is how long to wait after an object is created before its
+	// relationships are written.
+	GracePeriod time.Duration
+
+	// Recorder, if set, records every reconcile action as an event on the
+	// reconciled object.
+	Recorder record.EventRecorder
+
+	// RESTMapper is used to determine the kind of reconciled objects for
+	// events.
+	RESTMapper meta.RESTMapper
+}
+
+// Reconciler watches the resources that have rules for creates or deletes,
+// and writes the relationships of those rules for objects that are created
+// or deleted without a request to the proxy.
+//
+// Objects that already have relationships in SpiceDB when they are observed
+// are left alone, since they were created through the proxy. Relationship
+// creates are written as touches, so reconciling an object more than once
+// has no further effect.
+//
+// The resources are watched with their whole objects, not only their
+// metadata, so that templates and conditions that read the spec or other
+// fields of the body resolve like they do for requests.
+type Reconciler struct {
+	opts              Options
+	kubeClient        dynamic.Interface
+	permissionsClient v1.PermissionsServiceClient
+
+	createRules map[schema.GroupVersionResource][]*rules.RunnableRule
+	deleteRules map[schema.GroupVersionResource][]*rules.RunnableRule
+
+	queue   workqueue.TypedRateLimitingInterface[item]
+	stores  map[schema.GroupVersionResource]cache.Store
+	started bool
+}
+
+// item is a reconcile action that is queued for an observed object.
+type item struct {
+	verb string
+	gvr  schema.GroupVersionResource
+	obj  *unstructured.Unstructured
+}
+
+// NewReconciler creates a Reconciler for the resources of the rule configs.
+func NewReconciler(configs []proxyrule.Config, kubeClient dynamic.Interface, permissionsClient v1.PermissionsServiceClient, opts Options) (*Reconciler, error) {
+	if opts.User == "" {
+		opts.User = DefaultUser
+	}
+
+	r := &Reconciler{
+		opts:              opts,
+		kubeClient:        kubeClient,
+		permissionsClient: permissionsClient,
+		createRules:       make(map[schema.GroupVersionResource][]*rules.RunnableRule),
+		deleteRules:       make(map[schema.GroupVersionResource][]*rules.RunnableRule),
+		stores:            make(map[schema.GroupVersionResource]cache.Store),
+	}
+	for _, config := range configs {
+		rule, err := rules.Compile(config)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't compile rule %s: %w", config.Name, err)
+		}
+		if rule.Update == nil {
+			continue
+		}
+		for _, m := range config.Matches {
+			gv, err := schema.ParseGroupVersion(m.GroupVersion)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse gv %q: %w", m.GroupVersion, err)
+			}
+			gvr := gv.WithResource(m.Resource)
+
+			if slices.Contains(m.Verbs, "create") && !slices.Contains(r.createRules[gvr], rule) {
+				r.createRules[gvr] = append(r.createRules[gvr], rule)
+			}
+			if slices.Contains(m.Verbs, "delete") && !slices.Contains(r.deleteRules[gvr], rule) {
+				r.deleteRules[gvr] = append(r.deleteRules[gvr], rule)
+			}
+		}
+	}
+	return r, nil
+}
+
+// Resources returns the resources that the reconciler watches.
+func (r *Reconciler) Resources() []schema.GroupVersionResource {
+	var resources []schema.GroupVersionResource
+	for gvr := range r.createRules {
+		resources = append(resources, gvr)
+	}
+	for gvr := range r.deleteRules {
+		if _, ok := r.createRules[gvr]; !ok {
+			resources = append(resources, gvr)
+		}
+	}
+	slices.SortFunc(resources, func(a, b schema.GroupVersionResource) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return resources
+}
+
+// Run watches the resources and reconciles observed objects until the
+// context is cancelled. Objects that exist when the reconciler starts are
+// reconciled as if they had just been created.
+func (r *Reconciler) Run(ctx context.Context) error {
+	resources := r.Resources()
+	if len(resources) == 0 {
+		klog.FromContext(ctx).Info("no rules to reconcile, not watching any resources")
+		<-ctx.Done()
+		return nil
+	}
+
+	r.queue = workqueue.NewTypedRateLimitingQueueWithConfig(
+		workqueue.DefaultTypedControllerRateLimiter[item](),
+		workqueue.TypedRateLimitingQueueConfig[item]{Name: "reconciler"},
+	)
+	defer r.queue.ShutDown()
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(r.kubeClient, 0)
+	for _, gvr := range resources {
+		informer := factory.ForResource(gvr).Informer()
+		r.stores[gvr] = informer.GetStore()
+		_, err := informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(obj any, isInInitialList bool) {
+				r.onAdd(gvr, obj, isInInitialList)
+			},
+			DeleteFunc: func(obj any) {
+				r.onDelete(gvr, obj)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to watch %s: %w", gvr, err)
+		}
+	}
+
+	klog.FromContext(ctx).Info("starting reconciler", "resources", resources)
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	for gvr, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			klog.FromContext(ctx).Info("unable to sync resource for reconciliation", "resource", gvr)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		r.queue.ShutDown()
+	}()
+	for r.processNextItem(ctx) {
+	}
+	return nil
+}
+
+func (r *Reconciler) onAdd(gvr schema.GroupVersionResource, obj any, isInInitialList bool) {
+	if _, ok := r.createRules[gvr]; !ok {
+		return
+	}
+	added, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	if isInInitialList {
+		r.queue.Add(item{verb: "create", gvr: gvr, obj: added})
+		return
+	}
+	r.queue.AddAfter(item{verb: "create", gvr: gvr, obj: added}, r.opts.GracePeriod)
+}
+
+func (r *Reconciler) onDelete(gvr schema.GroupVersionResource, obj any) {
+	if _, ok := r.deleteRules[gvr]; !ok {
+		return
+	}
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	removed, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	r.queue.Add(item{verb: "delete", gvr: gvr, obj: removed})
+}
+
+func (r *Reconciler) processNextItem(ctx context.Context) bool {
+	next, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(next)
+
+	if err := r.reconcile(ctx, next); err != nil {
+		klog.FromContext(ctx).Error(err, "unable to reconcile object, retrying", "resource", next.gvr, "namespace", next.obj.GetNamespace(), "name", next.obj.GetName(), "verb", next.verb)
+		r.queue.AddRateLimited(next)
+		return true
+	}
+	r.queue.Forget(next)
+	return true
+}
+
+func (r *Reconciler) reconcile(ctx context.Context, next item) error {
+	if next.verb == "create" && !r.exists(next.gvr, next.obj) {
+		// the object was deleted again during the grace period
+		return nil
+	}
+
+	_, err := r.Reconcile(ctx, next.verb, next.gvr, next.obj)
+	return err
+}
+
+// exists returns whether the observed object still exists in kube.
+func (r *Reconciler) exists(gvr schema.GroupVersionResource, obj *unstructured.Unstructured) bool {
+	store, ok := r.stores[gvr]
+	if !ok {
+		return true
+	}
+	current, exists, err := store.Get(obj)
+	if err != nil || !exists {
+		return false
+	}
+	currentObj, ok := current.(*unstructured.Unstructured)
+	return ok && currentObj.GetUID() == obj.GetUID()
+}
+
+// Reconcile writes the relationships of the rules for the verb ("create" or
+// "delete") of the resource, resolved against the observed object. It
+// returns the number of written relationship updates and filters.
+func (r *Reconciler) Reconcile(ctx context.Context, verb string, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) (int, error) {
+	candidates := r.createRules[gvr]
+	if verb == "delete" {
+		candidates = r.deleteRules[gvr]
+	}
+
+	owner := r.userFor(obj)
+	input := rules.NewResolveInputFromObject(rules.NewRequestInfo(verb, gvr, obj.GetNamespace(), obj.GetName()), owner, obj.Object)
+
+	matching, err := rules.FilterRulesWithCELConditions(candidates, input)
+	if err != nil {
+		return 0, r.recordFailure(ctx, verb, gvr, obj, fmt.Errorf("unable to evaluate rule conditions: %w", err))
+	}
+
+	var (
+		updates []*v1.RelationshipUpdate
+		filters []*v1.RelationshipFilter
+	)
+	for _, rule := range matching {
+		resolved, err := rule.Update.ResolveWrites(input)
+		if err != nil {
+			return 0, r.recordFailure(ctx, verb, gvr, obj, fmt.Errorf("unable to resolve relationships of rule %s: %w", rule.Name, err))
+		}
+		updates = append(updates, resolved.IdempotentUpdates()...)
+		filters = append(filters, resolved.DeleteByFilter...)
+	}
+	if len(updates) == 0 && len(filters) == 0 {
+		return 0, nil
+	}
+
+	if verb == "create" {
+		managed, err := r.hasRelationships(ctx, updates)
+		if err != nil {
+			return 0, err
+		}
+		if managed {
+			r.record(ctx, gvr, obj, corev1.EventTypeNormal, reasonAlreadyExists, "relationships already exist, not reconciling", "user", owner.Name)
+			return 0, nil
+		}
+	}
+
+	if len(updates) > 0 {
+		if _, err := r.permissionsClient.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: updates}); err != nil {
+			return 0, r.recordFailure(ctx, verb, gvr, obj, fmt.Errorf("unable to write relationships: %w", err))
+		}
+	}
+	for _, filter := range filters {
+		if _, err := r.permissionsClient.DeleteRelationships(ctx, &v1.DeleteRelationshipsRequest{RelationshipFilter: filter}); err != nil {
+			return 0, r.recordFailure(ctx, verb, gvr, obj, fmt.Errorf("unable to delete relationships (%v): %w", filter, err))
+		}
+	}
+
+	reason := ReasonCreated
+	if verb == "delete" {
+		reason = ReasonDeleted
+	}
+	r.record(ctx, gvr, obj, corev1.EventTypeNormal, reason,
+		fmt.Sprintf("reconciled %d relationship updates and %d delete filters as %s", len(updates), len(filters), owner.Name),
+		"user", owner.Name, "updates", len(updates), "filters", len(filters))
+	return len(updates) + len(filters), nil
+}
+
+// userFor returns the user that owns the object, from the owner annotation
+// if one is configured.
+func (r *Reconciler) userFor(obj *unstructured.Unstructured) *user.DefaultInfo {
+	if r.opts.OwnerAnnotation == "" {
+		return &user.DefaultInfo{Name: r.opts.User}
+	}
+	if owner := obj.GetAnnotations()[r.opts.OwnerAnnotation]; owner != "" {
+		return &user.DefaultInfo{Name: owner}
+	}
+	return &user.DefaultInfo{Name: r.opts.User}
+}
+
+// hasRelationships returns whether any resource of the updates already has
+// relationships in SpiceDB.
+func (r *Reconciler) hasRelationships(ctx context.Context, updates []*v1.RelationshipUpdate) (bool, error) {
+	seen := make(map[string]struct{})
+	for _, update := range updates {
+		if update.Operation == v1.RelationshipUpdate_OPERATION_DELETE {
+			continue
+		}
+		resource := update.Relationship.Resource
+		key := resource.ObjectType + ":" + resource.ObjectId
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		stream, err := r.permissionsClient.ReadRelationships(ctx, &v1.ReadRelationshipsRequest{
+			Consistency: &v1.Consistency{
+				Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true},
+			},
+			RelationshipFilter: &v1.RelationshipFilter{
+				ResourceType:       resource.ObjectType,
+				OptionalResourceId: resource.ObjectId,
+			},
+			OptionalLimit: 1,
+		})
+		if err != nil {
+			return false, fmt.Errorf("unable to read relationships of %s: %w", key, err)
+		}
+		_, err = stream.Recv()
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, io.EOF) {
+			return false, fmt.Errorf("unable to read relationships of %s: %w", key, err)
+		}
+	}
+	return false, nil
+}
+
+func (r *Reconciler) recordFailure(ctx context.Context, verb string, gvr schema.GroupVersionResource, obj *unstructured.Unstructured, err error) error {
+	r.record(ctx, gvr, obj, corev1.EventTypeWarning, ReasonFailed, fmt.Sprintf("unable to reconcile %s: %v", verb, err))
+	return err
+}
+
+// record logs a reconcile action, and records it as an event on the object
+// if a recorder is configured.
+func (r *Reconciler) record(ctx context.Context, gvr schema.GroupVersionResource, obj *unstructured.Unstructured, eventType, reason, message string, keysAndValues ...any) {
+	klog.FromContext(ctx).V(2).Info(message, append([]any{"resource", gvr, "namespace", obj.GetNamespace(), "name", obj.GetName(), "reason", reason}, keysAndValues...)...)
+	if r.opts.Recorder == nil {
+		return
+	}
+
+	ref := &corev1.ObjectReference{
+		APIVersion: gvr.GroupVersion().String(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+		UID:        obj.GetUID(),
+	}
+	if r.opts.RESTMapper != nil {
+		gvk, err := r.opts.RESTMapper.KindFor(gvr)
+		if err != nil {
+			utilruntime.HandleErrorWithContext(ctx, err, "unable to determine kind of reconciled object", "resource", gvr)
+		}
+		ref.Kind = gvk.Kind
+	}
+	r.opts.Recorder.Event(ref, eventType, reason, message)
+}
@@ -0,0 +1,298 @@
+package reconciler
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb/spicedbtest"
+)
+
+var (
+	podsGVR       = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	namespacesGVR = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+)
+
+const testRules = `
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: create-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["create"]
+update:
+  creates:
+  - tpl: "pod:{{namespacedName}}#creator@user:{{user.name}}"
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: delete-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["delete"]
+update:
+  deleteByFilter:
+  - tpl: "pod:{{namespacedName}}#$resourceRelation@$subjectType:$subjectID"
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: get-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["get"]
+---
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: namespaces
+match:
+- apiVersion: v1
+  resource: namespaces
+  verbs: ["create", "delete"]
+update:
+  creates:
+  - tpl: "namespace:{{name}}#creator@user:{{user.name}}"
+`
+
+func parseRules(t *testing.T, config string) []proxyrule.Config {
+	t.Helper()
+	configs, err := proxyrule.Parse(strings.NewReader(config))
+	require.NoError(t, err)
+	return configs
+}
+
+func TestNewReconciler(t *testing.T) {
+	r, err := NewReconciler(parseRules(t, testRules), nil, nil, Options{})
+	require.NoError(t, err)
+
+	require.Equal(t, []schema.GroupVersionResource{namespacesGVR, podsGVR}, r.Resources())
+	require.Equal(t, DefaultUser, r.opts.User)
+	require.Empty(t, r.opts.OwnerAnnotation)
+
+	require.Len(t, r.createRules[podsGVR], 1)
+	require.Equal(t, "create-pods", r.createRules[podsGVR][0].Name)
+	require.Len(t, r.deleteRules[podsGVR], 1)
+	require.Equal(t, "delete-pods", r.deleteRules[podsGVR][0].Name)
+
+	// a rule that matches both verbs is used for both
+	require.Len(t, r.createRules[namespacesGVR], 1)
+	require.Len(t, r.deleteRules[namespacesGVR], 1)
+}
+
+func TestReconcile(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+	_, err := psc.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: []*v1.RelationshipUpdate{
+		{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: rel("pod", "default/proxied", "creator", "bob")},
+		{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: rel("pod", "default/removed", "creator", "bob")},
+		{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: rel("pod", "default/removed", "viewer", "alice")},
+	}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		verb            string
+		ownerAnnotation string
+		obj             *unstructured.Unstructured
+		wantWritten     int
+		wantErr         string
+		wantEvent       string
+		want            []*v1.Relationship
+		wantMissing     []*v1.Relationship
+	}{
+		{
+			name:            "created object with owner annotation",
+			verb:            "create",
+			ownerAnnotation: DefaultOwnerAnnotation,
+			obj:             newPod("default", "helm", map[string]string{DefaultOwnerAnnotation: "alice"}),
+			wantWritten:     1,
+			wantEvent:       "Normal RelationshipsCreated",
+			want:            []*v1.Relationship{rel("pod", "default/helm", "creator", "alice")},
+		},
+		{
+			name:      "owner annotation is ignored unless configured",
+			verb:      "create",
+			obj:       newPod("default", "unowned", map[string]string{DefaultOwnerAnnotation: "alice"}),
+			wantErr:   "unable to resolve relationships of rule create-pods",
+			wantEvent: "Warning RelationshipsFailed",
+			wantMissing: []*v1.Relationship{
+				rel("pod", "default/unowned", "creator", "alice"),
+			},
+		},
+		{
+			name:            "created object that already has relationships",
+			verb:            "create",
+			ownerAnnotation: DefaultOwnerAnnotation,
+			obj:             newPod("default", "proxied", map[string]string{DefaultOwnerAnnotation: "alice"}),
+			wantEvent:       "Normal RelationshipsExist",
+			want:            []*v1.Relationship{rel("pod", "default/proxied", "creator", "bob")},
+			wantMissing: []*v1.Relationship{
+				rel("pod", "default/proxied", "creator", "alice"),
+			},
+		},
+		{
+			name:            "created object without owner annotation",
+			verb:            "create",
+			ownerAnnotation: DefaultOwnerAnnotation,
+			obj:             newPod("default", "controller", nil),
+			wantErr:         "unable to resolve relationships of rule create-pods",
+			wantEvent:       "Warning RelationshipsFailed",
+		},
+		{
+			name:        "deleted object",
+			verb:        "delete",
+			obj:         newPod("default", "removed", nil),
+			wantWritten: 1,
+			wantEvent:   "Normal RelationshipsDeleted",
+			wantMissing: []*v1.Relationship{
+				rel("pod", "default/removed", "creator", "bob"),
+				rel("pod", "default/removed", "viewer", "alice"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			r, err := NewReconciler(parseRules(t, testRules), nil, psc, Options{Recorder: recorder, OwnerAnnotation: tt.ownerAnnotation})
+			require.NoError(t, err)
+
+			written, err := r.Reconcile(ctx, tt.verb, podsGVR, tt.obj)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.wantWritten, written)
+
+			require.Len(t, recorder.Events, 1)
+			require.True(t, strings.HasPrefix(<-recorder.Events, tt.wantEvent))
+
+			for _, r := range tt.want {
+				require.True(t, hasRelationship(ctx, t, psc, r), "missing relationship %v", r)
+			}
+			for _, r := range tt.wantMissing {
+				require.False(t, hasRelationship(ctx, t, psc, r), "unexpected relationship %v", r)
+			}
+		})
+	}
+}
+
+func TestReconcileObjectBody(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+	r, err := NewReconciler(parseRules(t, `
+apiVersion: authzed.com/v1alpha1
+kind: ProxyRule
+metadata:
+  name: create-pods
+match:
+- apiVersion: v1
+  resource: pods
+  verbs: ["create"]
+update:
+  creates:
+  - tpl: "pod:{{namespacedName}}#viewer@user:{{object.spec.serviceAccountName}}"
+`), nil, psc, Options{})
+	require.NoError(t, err)
+
+	pod := newPod("default", "app", nil)
+	require.NoError(t, unstructured.SetNestedField(pod.Object, "deployer", "spec", "serviceAccountName"))
+
+	written, err := r.Reconcile(ctx, "create", podsGVR, pod)
+	require.NoError(t, err)
+	require.Equal(t, 1, written)
+	require.True(t, hasRelationship(ctx, t, psc, rel("pod", "default/app", "viewer", "deployer")))
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	psc := spicedbtest.NewPermissionsClient(ctx, t)
+
+	existing := newPod("default", "existing", map[string]string{DefaultOwnerAnnotation: "alice"})
+	kubeClient := newKubeClient(existing)
+	r, err := NewReconciler(parseRules(t, testRules), kubeClient, psc, Options{GracePeriod: 10 * time.Millisecond, OwnerAnnotation: DefaultOwnerAnnotation})
+	require.NoError(t, err)
+	go func() {
+		require.NoError(t, r.Run(ctx)) // nolint:testifylint
+	}()
+
+	// objects that exist when the reconciler starts are reconciled
+	require.Eventually(t, func() bool {
+		return hasRelationship(ctx, t, psc, rel("pod", "default/existing", "creator", "alice"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	pods := kubeClient.Resource(podsGVR).Namespace("default")
+	_, err = pods.Create(ctx, newPod("default", "created", map[string]string{DefaultOwnerAnnotation: "bob"}), metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return hasRelationship(ctx, t, psc, rel("pod", "default/created", "creator", "bob"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, pods.Delete(ctx, existing.GetName(), metav1.DeleteOptions{}))
+	require.Eventually(t, func() bool {
+		return !hasRelationship(ctx, t, psc, rel("pod", "default/existing", "creator", "alice"))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func rel(resourceType, id, relation, subject string) *v1.Relationship {
+	return &v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: resourceType, ObjectId: id},
+		Relation: relation,
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: subject}},
+	}
+}
+
+func hasRelationship(ctx context.Context, t *testing.T, psc v1.PermissionsServiceClient, r *v1.Relationship) bool {
+	resp, err := psc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+		Consistency: &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}},
+		Resource:    r.Resource,
+		Permission:  r.Relation,
+		Subject:     r.Subject,
+	})
+	require.NoError(t, err)
+	return resp.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+}
+
+func newKubeClient(objects ...runtime.Object) *fake.FakeDynamicClient {
+	return fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		namespacesGVR: "NamespaceList",
+		podsGVR:       "PodList",
+	}, objects...)
+}
+
+func newPod(namespace, name string, annotations map[string]string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Pod")
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetUID(types.UID("uid-" + name))
+	obj.SetAnnotations(annotations)
+	return obj
+}
@@ -0,0 +1,70 @@
+package rules
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+)
+
+// DefaultApprovalTimeout is how long a write waits for an approval if the
+// rule doesn't specify a timeout.
+const DefaultApprovalTimeout = time.Hour
+
+// approvalVerbs are the verbs whose requests can be held for an approval.
+var approvalVerbs = []string{"create", "update", "patch", "delete"}
+
+// Approval is a compiled proxyrule.Approval.
+type Approval struct {
+	Checks  []RelationshipExpr
+	Timeout time.Duration
+
+	// Templates is the uncompiled approval, which is passed to the approval
+	// workflow so that the checks can be resolved for the approver.
+	Templates proxyrule.Approval
+}
+
+// CompileApproval compiles the checks of an approval.
+func CompileApproval(approval proxyrule.Approval) (*Approval, error) {
+	if len(approval.Checks) == 0 {
+		return nil, fmt.Errorf("approval must specify at least one check")
+	}
+	checks, err := compileStringOrObjTemplates(approval.Checks)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling approval checks: %w", err)
+	}
+
+	timeout := approval.Timeout.Duration
+	if timeout <= 0 {
+		timeout = DefaultApprovalTimeout
+	}
+	return &Approval{Checks: checks, Timeout: timeout, Templates: approval}, nil
+}
+
+// ResolveChecks resolves the checks of the approval. The user of the input
+// is the user who approves the write.
+func (a *Approval) ResolveChecks(input *ResolveInput) ([]*ResolvedRel, error) {
+	var resolved []*ResolvedRel
+	for _, check := range a.Checks {
+		rels, err := check.GenerateRelationships(input)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving approval check: %w", err)
+		}
+		resolved = append(resolved, rels...)
+	}
+	return resolved, nil
+}
+
+// validateApprovalVerbs ensures approvals are only used with write verbs,
+// since only writes are held until they are approved.
+func validateApprovalVerbs(matches []proxyrule.Match) error {
+	for _, match := range matches {
+		for _, verb := range match.Verbs {
+			if !slices.Contains(approvalVerbs, verb) {
+				return fmt.Errorf("approval cannot be used with verb %q, only writes can be approved", verb)
+			}
+		}
+	}
+	return nil
+}
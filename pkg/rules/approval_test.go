@@ -0,0 +1,69 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+)
+
+func TestCompileApproval(t *testing.T) {
+	approval, err := CompileApproval(proxyrule.Approval{
+		Checks: []proxyrule.StringOrTemplate{{Template: "namespace:{{name}}#approve@user:{{user.name}}"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, DefaultApprovalTimeout, approval.Timeout)
+
+	// the checks are resolved for the user who approves the write
+	input := NewResolveInput(
+		&request.RequestInfo{Verb: "delete", Resource: "namespaces", Name: "prod"},
+		&user.DefaultInfo{Name: "bob"},
+		&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "prod"}},
+		nil,
+		nil,
+	)
+	resolved, err := approval.ResolveChecks(input)
+	require.NoError(t, err)
+	require.Equal(t, []*ResolvedRel{{
+		ResourceType:     "namespace",
+		ResourceID:       "prod",
+		ResourceRelation: "approve",
+		SubjectType:      "user",
+		SubjectID:        "bob",
+	}}, resolved)
+
+	approval, err = CompileApproval(proxyrule.Approval{
+		Checks:  []proxyrule.StringOrTemplate{{Template: "namespace:{{name}}#approve@user:{{user.name}}"}},
+		Timeout: metav1.Duration{Duration: time.Minute},
+	})
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, approval.Timeout)
+
+	_, err = CompileApproval(proxyrule.Approval{})
+	require.ErrorContains(t, err, "at least one check")
+}
+
+func TestCompileRuleWithApproval(t *testing.T) {
+	config := proxyrule.Config{Spec: proxyrule.Spec{
+		Matches: []proxyrule.Match{{GroupVersion: "v1", Resource: "namespaces", Verbs: []string{"delete"}}},
+		Approval: &proxyrule.Approval{
+			Checks: []proxyrule.StringOrTemplate{{Template: "namespace:{{name}}#approve@user:{{user.name}}"}},
+		},
+	}}
+
+	// writes that need an approval go through the dual write, even without
+	// relationships
+	rule, err := Compile(config)
+	require.NoError(t, err)
+	require.NotNil(t, rule.Approval)
+	require.NotNil(t, rule.Update)
+
+	config.Matches[0].Verbs = []string{"get", "delete"}
+	_, err = Compile(config)
+	require.ErrorContains(t, err, `approval cannot be used with verb "get"`)
+}
@@ -2,6 +2,8 @@ package rules
 
 import (
 	"fmt"
+	"reflect"
+	"slices"
 	"strings"
 
 	"github.com/warpstreamlabs/bento/public/bloblang"
@@ -55,4 +57,65 @@ func init() {
 	if err != nil {
 		panic(fmt.Sprintf("failed to register split_namespace function: %v", err))
 	}
+
+	// Register values_added and values_removed functions, which compute the
+	// relationships to create and delete when a field of an object changes
+	err = customBloblangEnv.RegisterFunction("values_added", func(args ...any) (bloblang.Function, error) {
+		return func() (any, error) {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("values_added function expects exactly 2 arguments")
+			}
+			return valuesNotIn(args[1], args[0])
+		}, nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("failed to register values_added function: %v", err))
+	}
+
+	err = customBloblangEnv.RegisterFunction("values_removed", func(args ...any) (bloblang.Function, error) {
+		return func() (any, error) {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("values_removed function expects exactly 2 arguments")
+			}
+			return valuesNotIn(args[0], args[1])
+		}, nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("failed to register values_removed function: %v", err))
+	}
+}
+
+// valuesNotIn returns the values of `from` that are not values of `other`.
+// Each argument may be null, a single value, or an array of values, so that
+// the same helper works for labels and for list fields.
+func valuesNotIn(from, other any) ([]any, error) {
+	fromValues, err := valueSet(from)
+	if err != nil {
+		return nil, err
+	}
+	otherValues, err := valueSet(other)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]any, 0, len(fromValues))
+	for _, v := range fromValues {
+		if !slices.ContainsFunc(otherValues, func(o any) bool { return reflect.DeepEqual(o, v) }) {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+func valueSet(v any) ([]any, error) {
+	switch val := v.(type) {
+	case nil:
+		return nil, nil
+	case []any:
+		return val, nil
+	case map[string]any:
+		return nil, fmt.Errorf("expected a value or an array of values, got an object")
+	default:
+		return []any{val}, nil
+	}
 }
@@ -191,3 +191,82 @@ func TestSplitNamespaceFunctionErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestValuesAddedAndRemovedFunctions(t *testing.T) {
+	tests := []struct {
+		name        string
+		old         any
+		new         any
+		wantAdded   any
+		wantRemoved any
+		wantErr     bool
+	}{
+		{
+			name:        "changed label",
+			old:         "a",
+			new:         "b",
+			wantAdded:   []any{"b"},
+			wantRemoved: []any{"a"},
+		},
+		{
+			name:        "unchanged label",
+			old:         "a",
+			new:         "a",
+			wantAdded:   []any{},
+			wantRemoved: []any{},
+		},
+		{
+			name:        "label added",
+			old:         nil,
+			new:         "a",
+			wantAdded:   []any{"a"},
+			wantRemoved: []any{},
+		},
+		{
+			name:        "label removed",
+			old:         "a",
+			new:         nil,
+			wantAdded:   []any{},
+			wantRemoved: []any{"a"},
+		},
+		{
+			name:        "list field",
+			old:         []any{"a", "b"},
+			new:         []any{"b", "c"},
+			wantAdded:   []any{"c"},
+			wantRemoved: []any{"a"},
+		},
+		{
+			name:    "object field",
+			old:     map[string]any{"a": "b"},
+			new:     "a",
+			wantErr: true,
+		},
+	}
+
+	added, err := CompileBloblangExpression(`{{ values_added(old, new) }}`)
+	require.NoError(t, err)
+	removed, err := CompileBloblangExpression(`{{ values_removed(old, new) }}`)
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]any{
+				"old": tt.old,
+				"new": tt.new,
+			}
+
+			gotAdded, err := added.Query(data)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantAdded, gotAdded)
+
+			gotRemoved, err := removed.Query(data)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantRemoved, gotRemoved)
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package rules
+
+import (
+	"fmt"
+
+	"github.com/warpstreamlabs/bento/public/bloblang"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+)
+
+// KubeWriteExpr is a compiled proxyrule.KubeWrite.
+type KubeWriteExpr struct {
+	Resource string
+	Template *bloblang.Executor
+
+	// usesCurrentObject is set if the template refers to the current state
+	// of the object, see ResolveInput.LoadCurrentObject.
+	usesCurrentObject bool
+}
+
+// CompileKubeWrite compiles the manifest template of a kube write. Like
+// tupleSet expressions, the template is always a Bloblang expression.
+func CompileKubeWrite(write proxyrule.KubeWrite) (*KubeWriteExpr, error) {
+	if write.Resource == "" {
+		return nil, fmt.Errorf("kube write must specify a resource")
+	}
+	template, err := CompileTupleSetExpression(write.Template)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling kube write template for %s: %w", write.Resource, err)
+	}
+	return &KubeWriteExpr{
+		Resource:          write.Resource,
+		Template:          template,
+		usesCurrentObject: usesCurrentObject(write.Template),
+	}, nil
+}
+
+// Resolve returns the manifest of the object to write. The response is the
+// object that kube returned for the request, which the template can refer
+// to as `response`.
+func (k *KubeWriteExpr) Resolve(input *ResolveInput, response map[string]any) (*unstructured.Unstructured, error) {
+	data, err := bloblangInput(input, k.usesCurrentObject)
+	if err != nil {
+		return nil, fmt.Errorf("error converting input to bloblang input: %w", err)
+	}
+	if response != nil {
+		data["response"] = normalizeToBloblangTypes(response)
+	}
+
+	result, err := k.Template.Query(data)
+	if err != nil {
+		return nil, fmt.Errorf("error executing kube write template for %s: %w", k.Resource, err)
+	}
+	manifest, ok := result.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("kube write template for %s must return an object, got %T", k.Resource, result)
+	}
+
+	object := &unstructured.Unstructured{Object: manifest}
+	if object.GetAPIVersion() == "" || object.GetKind() == "" {
+		return nil, fmt.Errorf("kube write template for %s must set apiVersion and kind", k.Resource)
+	}
+	if _, err := schema.ParseGroupVersion(object.GetAPIVersion()); err != nil {
+		return nil, fmt.Errorf("kube write template for %s has an invalid apiVersion: %w", k.Resource, err)
+	}
+	if object.GetName() == "" && object.GetGenerateName() == "" {
+		return nil, fmt.Errorf("kube write template for %s must set metadata.name or metadata.generateName", k.Resource)
+	}
+	return object, nil
+}
+
+// GroupVersionResource returns the resource of the object that the manifest
+// describes.
+func (k *KubeWriteExpr) GroupVersionResource(object *unstructured.Unstructured) schema.GroupVersionResource {
+	return object.GroupVersionKind().GroupVersion().WithResource(k.Resource)
+}
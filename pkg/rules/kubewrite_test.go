@@ -0,0 +1,122 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
+)
+
+func TestKubeWrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		write     proxyrule.KubeWrite
+		response  map[string]any
+		want      map[string]any
+		wantGVR   schema.GroupVersionResource
+		expectErr string
+	}{
+		{
+			name: "role binding in created namespace",
+			write: proxyrule.KubeWrite{
+				Resource: "rolebindings",
+				Template: `{
+					"apiVersion": "rbac.authorization.k8s.io/v1",
+					"kind": "RoleBinding",
+					"metadata": {"name": "admin", "namespace": this.name},
+					"roleRef": {"apiGroup": "rbac.authorization.k8s.io", "kind": "ClusterRole", "name": "admin"},
+					"subjects": [{"apiGroup": "rbac.authorization.k8s.io", "kind": "User", "name": this.user.name}]
+				}`,
+			},
+			want: map[string]any{
+				"apiVersion": "rbac.authorization.k8s.io/v1",
+				"kind":       "RoleBinding",
+				"metadata":   map[string]any{"name": "admin", "namespace": "team"},
+				"roleRef":    map[string]any{"apiGroup": "rbac.authorization.k8s.io", "kind": "ClusterRole", "name": "admin"},
+				"subjects":   []any{map[string]any{"apiGroup": "rbac.authorization.k8s.io", "kind": "User", "name": "alice"}},
+			},
+			wantGVR: schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "rolebindings"},
+		},
+		{
+			name: "refers to the response",
+			write: proxyrule.KubeWrite{
+				Resource: "configmaps",
+				Template: `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "owner", "namespace": this.name}, "data": {"uid": this.response.metadata.uid}}`,
+			},
+			response: map[string]any{"metadata": map[string]any{"name": "team", "uid": "1234"}},
+			want: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]any{"name": "owner", "namespace": "team"},
+				"data":       map[string]any{"uid": "1234"},
+			},
+			wantGVR: schema.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+		},
+		{
+			name: "not an object",
+			write: proxyrule.KubeWrite{
+				Resource: "configmaps",
+				Template: `"configmap"`,
+			},
+			expectErr: "must return an object",
+		},
+		{
+			name: "missing kind",
+			write: proxyrule.KubeWrite{
+				Resource: "configmaps",
+				Template: `{"apiVersion": "v1", "metadata": {"name": "owner"}}`,
+			},
+			expectErr: "must set apiVersion and kind",
+		},
+		{
+			name: "missing name",
+			write: proxyrule.KubeWrite{
+				Resource: "configmaps",
+				Template: `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"namespace": this.name}}`,
+			},
+			expectErr: "must set metadata.name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write, err := CompileKubeWrite(tt.write)
+			require.NoError(t, err)
+
+			input := NewResolveInput(
+				&request.RequestInfo{Verb: "create", Resource: "namespaces"},
+				&user.DefaultInfo{Name: "alice"},
+				&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "team"}},
+				[]byte(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"team"}}`),
+				nil,
+			)
+			object, err := write.Resolve(input, tt.response)
+			if tt.expectErr != "" {
+				require.ErrorContains(t, err, tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, object.Object)
+			require.Equal(t, tt.wantGVR, write.GroupVersionResource(object))
+		})
+	}
+}
+
+func TestCompileKubeWrite(t *testing.T) {
+	_, err := CompileKubeWrite(proxyrule.KubeWrite{Template: `{}`})
+	require.ErrorContains(t, err, "must specify a resource")
+
+	_, err = CompileKubeWrite(proxyrule.KubeWrite{Resource: "configmaps", Template: `{"apiVersion": `})
+	require.Error(t, err)
+
+	update, err := CompileUpdate(proxyrule.Update{
+		KubeWrites: []proxyrule.KubeWrite{{Resource: "configmaps", Template: `{}`}},
+	})
+	require.NoError(t, err)
+	require.Len(t, update.KubeWrites, 1)
+}
@@ -0,0 +1,145 @@
+package rules
+
+import (
+	"fmt"
+	"path"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"sigs.k8s.io/yaml"
+)
+
+// lazyObject holds an unstructured object that is decoded on first use, so
+// that requests whose rules never look at the object don't pay for decoding
+// it. The object is decoded once, so the fields of the input that it is
+// decoded from must not change after it is first used.
+type lazyObject struct {
+	once   sync.Once
+	object map[string]any
+	err    error
+}
+
+// decodedObject returns a lazyObject holding an already decoded object.
+func decodedObject(object map[string]any) *lazyObject {
+	l := &lazyObject{object: normalizeToBloblangTypes(object).(map[string]any)}
+	l.once.Do(func() {})
+	return l
+}
+
+// get returns the object decoded from raw and meta by the first call. A nil
+// lazyObject decodes on every call.
+func (l *lazyObject) get(raw []byte, meta *metav1.PartialObjectMetadata) (map[string]any, error) {
+	if l == nil {
+		return unstructuredFrom(raw, meta)
+	}
+	l.once.Do(func() {
+		l.object, l.err = unstructuredFrom(raw, meta)
+	})
+	return l.object, l.err
+}
+
+// NewResolveInputFromObject creates a ResolveInput for an object that has
+// already been decoded, such as an item of a list or watch response.
+func NewResolveInputFromObject(req *request.RequestInfo, user *user.DefaultInfo, object map[string]any) *ResolveInput {
+	var pom metav1.PartialObjectMetadata
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object, &pom); err != nil {
+		// fall back to just the identifying fields of the object
+		metadata, _ := object["metadata"].(map[string]any)
+		pom.Name, _ = metadata["name"].(string)
+		pom.Namespace, _ = metadata["namespace"].(string)
+	}
+
+	input := NewResolveInput(req, user, &pom, nil, nil)
+	input.object = decodedObject(object)
+	return input
+}
+
+// NewRequestInfo returns the info of a request for an object of the given
+// resource. It is used to resolve templates against objects that are not
+// part of a request to the proxy, such as objects observed by watching kube.
+func NewRequestInfo(verb string, gvr schema.GroupVersionResource, namespace, name string) *request.RequestInfo {
+	apiPrefix := "apis"
+	p := path.Join("/", apiPrefix, gvr.Group, gvr.Version)
+	if gvr.Group == "" {
+		apiPrefix = "api"
+		p = path.Join("/", apiPrefix, gvr.Version)
+	}
+	if namespace != "" {
+		p = path.Join(p, "namespaces", namespace)
+	}
+	p = path.Join(p, gvr.Resource, name)
+
+	return &request.RequestInfo{
+		IsResourceRequest: true,
+		Path:              p,
+		Verb:              verb,
+		APIPrefix:         apiPrefix,
+		APIGroup:          gvr.Group,
+		APIVersion:        gvr.Version,
+		Namespace:         namespace,
+		Resource:          gvr.Resource,
+		Name:              name,
+		Parts:             []string{gvr.Resource, name},
+	}
+}
+
+// UnstructuredObject returns the full object that results from the request,
+// including its spec. It is decoded from the request body the first time it
+// is requested, and falls back to the object metadata when the body isn't
+// available or can't be decoded. It returns nil if there is no object.
+// The result of a patch request is loaded first, see LoadCurrentObject.
+//
+// The returned map is shared and must not be modified.
+func (r *ResolveInput) UnstructuredObject() (map[string]any, error) {
+	if r.Request != nil && r.Request.Verb == "patch" {
+		if err := r.LoadCurrentObject(); err != nil {
+			return nil, err
+		}
+	}
+	return r.object.get(r.objectBytes(), r.Object)
+}
+
+// UnstructuredOldObject returns the full object as it was before an update,
+// patch or delete request, loaded and decoded on first use. It returns nil
+// if there is no existing object.
+//
+// The returned map is shared and must not be modified.
+func (r *ResolveInput) UnstructuredOldObject() (map[string]any, error) {
+	if err := r.LoadCurrentObject(); err != nil {
+		return nil, err
+	}
+	return r.oldObject.get(r.OldObjectBody, r.OldObject)
+}
+
+// unstructuredFrom decodes a serialized (JSON or YAML) object, and overlays
+// the already decoded metadata of the object onto it.
+func unstructuredFrom(raw []byte, objectMeta *metav1.PartialObjectMetadata) (map[string]any, error) {
+	var object map[string]any
+	if len(raw) > 0 {
+		if err := yaml.Unmarshal(raw, &object); err != nil {
+			// the body may be in a format that only the kube decoder
+			// understands (i.e. protobuf), use the metadata instead
+			object = nil
+		}
+	}
+
+	if objectMeta != nil {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(objectMeta)
+		if err != nil {
+			return nil, fmt.Errorf("error converting object metadata to unstructured: %w", err)
+		}
+		if object == nil {
+			object = map[string]any{}
+		}
+		object["metadata"] = obj["metadata"]
+	}
+
+	if object == nil {
+		return nil, nil
+	}
+	return normalizeToBloblangTypes(object).(map[string]any), nil
+}
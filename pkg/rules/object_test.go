@@ -0,0 +1,181 @@
+package rules
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestUnstructuredObject(t *testing.T) {
+	tests := []struct {
+		name   string
+		object *metav1.PartialObjectMetadata
+		body   string
+		want   map[string]any
+	}{
+		{
+			name:   "json body",
+			object: &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+			body:   `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"foo"},"data":{"key":"value"}}`,
+			want: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]any{"name": "foo", "creationTimestamp": nil},
+				"data":       map[string]any{"key": "value"},
+			},
+		},
+		{
+			name:   "yaml body",
+			object: &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+			body:   "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\ndata:\n  key: value\n",
+			want: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]any{"name": "foo", "creationTimestamp": nil},
+				"data":       map[string]any{"key": "value"},
+			},
+		},
+		{
+			name:   "undecodable body falls back to metadata",
+			object: &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+			body:   "\x00\x01k8s",
+			want: map[string]any{
+				"metadata": map[string]any{"name": "foo", "creationTimestamp": nil},
+			},
+		},
+		{
+			name: "no object",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			if tt.body != "" {
+				body = []byte(tt.body)
+			}
+			input := NewResolveInput(&request.RequestInfo{Verb: "create"}, &user.DefaultInfo{Name: "alice"}, tt.object, body, nil)
+
+			got, err := input.UnstructuredObject()
+			require.NoError(t, err)
+			if tt.want == nil {
+				require.Nil(t, got)
+				return
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestUnstructuredObjectCache(t *testing.T) {
+	input := NewResolveInput(&request.RequestInfo{Verb: "update"}, &user.DefaultInfo{Name: "alice"}, nil, []byte(`{"spec":{"size":1}}`), nil)
+
+	first, err := input.UnstructuredObject()
+	require.NoError(t, err)
+	second, err := input.UnstructuredObject()
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"spec": map[string]any{"size": float64(1)}}, first)
+
+	// the decoded object is reused
+	first["cached"] = true
+	require.Equal(t, true, second["cached"])
+
+	// the object is only decoded once, even by concurrent callers
+	objects := make([]map[string]any, 4)
+	errs := make([]error, len(objects))
+	var wg sync.WaitGroup
+	for i := range objects {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			objects[i], errs[i] = input.UnstructuredObject()
+		}()
+	}
+	wg.Wait()
+	for i, object := range objects {
+		require.NoError(t, errs[i])
+		require.Equal(t, true, object["cached"])
+	}
+}
+
+func TestNewResolveInputFromObject(t *testing.T) {
+	input := NewResolveInputFromObject(
+		&request.RequestInfo{Verb: "list", Resource: "pods"},
+		&user.DefaultInfo{Name: "alice"},
+		map[string]any{
+			"metadata": map[string]any{
+				"name":        "foo",
+				"namespace":   "default",
+				"annotations": map[string]any{"example.com/owner": "bob"},
+				"ownerReferences": []any{
+					map[string]any{"apiVersion": "apps/v1", "kind": "ReplicaSet", "name": "foo-abc", "uid": "1234"},
+				},
+			},
+			"spec": map[string]any{"nodeName": "node-1"},
+		},
+	)
+	require.Equal(t, "foo", input.Name)
+	require.Equal(t, "default", input.Namespace)
+	require.Equal(t, "default/foo", input.NamespacedName)
+	require.Equal(t, "bob", input.Object.Annotations["example.com/owner"])
+
+	expr, err := CompileBloblangExpression(`{{ this.object.spec.nodeName + "/" + this.metadata.annotations."example.com/owner" + "/" + this.object.metadata.ownerReferences.index(0).name }}`)
+	require.NoError(t, err)
+	data, err := convertToBloblangInput(input)
+	require.NoError(t, err)
+	got, err := expr.Query(data)
+	require.NoError(t, err)
+	require.Equal(t, "node-1/bob/foo-abc", got)
+}
+
+func TestNewRequestInfo(t *testing.T) {
+	tests := []struct {
+		name      string
+		gvr       schema.GroupVersionResource
+		namespace string
+		want      *request.RequestInfo
+	}{
+		{
+			name:      "core resource",
+			gvr:       schema.GroupVersionResource{Version: "v1", Resource: "pods"},
+			namespace: "default",
+			want: &request.RequestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/namespaces/default/pods/foo",
+				Verb:              "delete",
+				APIPrefix:         "api",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "pods",
+				Name:              "foo",
+				Parts:             []string{"pods", "foo"},
+			},
+		},
+		{
+			name: "cluster scoped group resource",
+			gvr:  schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"},
+			want: &request.RequestInfo{
+				IsResourceRequest: true,
+				Path:              "/apis/rbac.authorization.k8s.io/v1/clusterroles/foo",
+				Verb:              "delete",
+				APIPrefix:         "apis",
+				APIGroup:          "rbac.authorization.k8s.io",
+				APIVersion:        "v1",
+				Resource:          "clusterroles",
+				Name:              "foo",
+				Parts:             []string{"clusterroles", "foo"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, NewRequestInfo("delete", tt.gvr, tt.namespace, "foo"))
+		})
+	}
+}
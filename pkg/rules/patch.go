@@ -0,0 +1,93 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// patchTypeFromContentType returns the PatchType for the Content-Type header
+// of a patch request. Parameters of the media type, such as the charset,
+// are ignored.
+func patchTypeFromContentType(contentType string) (k8stypes.PatchType, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("invalid patch content type %q: %w", contentType, err)
+	}
+	switch pt := k8stypes.PatchType(mediaType); pt {
+	case k8stypes.JSONPatchType, k8stypes.MergePatchType, k8stypes.StrategicMergePatchType, k8stypes.ApplyYAMLPatchType:
+		return pt, nil
+	default:
+		return "", fmt.Errorf("unsupported patch content type %q", contentType)
+	}
+}
+
+// applyPatch computes the object that results from applying a patch to the
+// current serialized (JSON) state of an object. `current` may be nil for
+// server-side apply requests that create the object.
+//
+// Server-side apply is approximated by merging the applied configuration into
+// the current object (as a strategic merge for built-in types, and as a JSON
+// merge patch for everything else). Fields that kube would remove because
+// they were dropped from a previous apply configuration of the same field
+// manager are not removed.
+func applyPatch(patchType k8stypes.PatchType, current, patch []byte) ([]byte, error) {
+	switch patchType {
+	case k8stypes.JSONPatchType:
+		p, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode json patch: %w", err)
+		}
+		return p.Apply(current)
+
+	case k8stypes.MergePatchType:
+		return jsonpatch.MergePatch(current, patch)
+
+	case k8stypes.StrategicMergePatchType:
+		dataStruct, err := patchDataStruct(current)
+		if err != nil {
+			return nil, err
+		}
+		return strategicpatch.StrategicMergePatch(current, patch, dataStruct)
+
+	case k8stypes.ApplyYAMLPatchType:
+		applied, err := yaml.YAMLToJSON(patch)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert apply configuration to json: %w", err)
+		}
+		if current == nil {
+			return applied, nil
+		}
+		if dataStruct, err := patchDataStruct(current); err == nil {
+			return strategicpatch.StrategicMergePatch(current, applied, dataStruct)
+		}
+		return jsonpatch.MergePatch(current, applied)
+
+	default:
+		return nil, fmt.Errorf("unsupported patch type %q", patchType)
+	}
+}
+
+// patchDataStruct returns an empty typed object for the kind of the
+// serialized object, which is required to look up strategic merge keys.
+// Only types registered in the client-go scheme are supported; kube rejects
+// strategic merge patches for custom resources as well.
+func patchDataStruct(current []byte) (any, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(current, &typeMeta); err != nil {
+		return nil, fmt.Errorf("unable to decode type of patched object: %w", err)
+	}
+	gvk := typeMeta.GroupVersionKind()
+	obj, err := scheme.Scheme.New(gvk)
+	if err != nil {
+		return nil, fmt.Errorf("strategic merge patch is not supported for %s: %w", gvk, err)
+	}
+	return obj, nil
+}
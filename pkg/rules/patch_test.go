@@ -0,0 +1,392 @@
+package rules
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/cel-go/cel"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest/fake"
+)
+
+const currentPod = `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"foo","namespace":"default","labels":{"team":"a"}},"spec":{"containers":[{"name":"app","image":"nginx"}]}}`
+
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		patchType k8stypes.PatchType
+		current   string
+		patch     string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "json patch",
+			patchType: k8stypes.JSONPatchType,
+			current:   currentPod,
+			patch:     `[{"op":"replace","path":"/metadata/labels/team","value":"b"}]`,
+			want:      `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"foo","namespace":"default","labels":{"team":"b"}},"spec":{"containers":[{"name":"app","image":"nginx"}]}}`,
+		},
+		{
+			name:      "merge patch",
+			patchType: k8stypes.MergePatchType,
+			current:   currentPod,
+			patch:     `{"metadata":{"labels":{"team":null,"env":"prod"}}}`,
+			want:      `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"foo","namespace":"default","labels":{"env":"prod"}},"spec":{"containers":[{"name":"app","image":"nginx"}]}}`,
+		},
+		{
+			name:      "strategic merge patch merges lists by key",
+			patchType: k8stypes.StrategicMergePatchType,
+			current:   currentPod,
+			patch:     `{"spec":{"containers":[{"name":"sidecar","image":"envoy"}]}}`,
+			want:      `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"foo","namespace":"default","labels":{"team":"a"}},"spec":{"containers":[{"name":"sidecar","image":"envoy"},{"name":"app","image":"nginx"}]}}`,
+		},
+		{
+			name:      "strategic merge patch on unknown type",
+			patchType: k8stypes.StrategicMergePatchType,
+			current:   `{"apiVersion":"example.com/v1","kind":"Widget","metadata":{"name":"foo"}}`,
+			patch:     `{"metadata":{"labels":{"team":"b"}}}`,
+			wantErr:   true,
+		},
+		{
+			name:      "apply to existing object",
+			patchType: k8stypes.ApplyYAMLPatchType,
+			current:   currentPod,
+			patch: `apiVersion: v1
+kind: Pod
+metadata:
+  name: foo
+  labels:
+    team: b
+`,
+			want: `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"foo","namespace":"default","labels":{"team":"b"}},"spec":{"containers":[{"name":"app","image":"nginx"}]}}`,
+		},
+		{
+			name:      "apply to existing custom resource",
+			patchType: k8stypes.ApplyYAMLPatchType,
+			current:   `{"apiVersion":"example.com/v1","kind":"Widget","metadata":{"name":"foo"},"spec":{"size":1}}`,
+			patch: `apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: foo
+spec:
+  color: red
+`,
+			want: `{"apiVersion":"example.com/v1","kind":"Widget","metadata":{"name":"foo"},"spec":{"color":"red","size":1}}`,
+		},
+		{
+			name:      "apply creates object",
+			patchType: k8stypes.ApplyYAMLPatchType,
+			patch: `apiVersion: v1
+kind: Namespace
+metadata:
+  name: foo
+`,
+			want: `{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"foo"}}`,
+		},
+		{
+			name:      "invalid json patch",
+			patchType: k8stypes.JSONPatchType,
+			current:   currentPod,
+			patch:     `{"op":"replace"}`,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var current []byte
+			if tt.current != "" {
+				current = []byte(tt.current)
+			}
+			got, err := applyPatch(tt.patchType, current, []byte(tt.patch))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.JSONEq(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestPatchTypeFromContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        k8stypes.PatchType
+		wantErr     bool
+	}{
+		{contentType: "application/json-patch+json", want: k8stypes.JSONPatchType},
+		{contentType: "application/merge-patch+json; charset=utf-8", want: k8stypes.MergePatchType},
+		{contentType: "application/strategic-merge-patch+json", want: k8stypes.StrategicMergePatchType},
+		{contentType: "application/apply-patch+yaml; charset=UTF-8", want: k8stypes.ApplyYAMLPatchType},
+		{contentType: "application/json", wantErr: true},
+		{contentType: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			got, err := patchTypeFromContentType(tt.contentType)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestKubeResolveInputExtractorPatch(t *testing.T) {
+	extractor := NewKubeResolveInputExtractor(fakePodClient(t, nil))
+
+	newRequest := func(path, name, contentType, body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPatch, path, io.NopCloser(bytes.NewBufferString(body)))
+		req.Header.Set("Content-Type", contentType)
+		ctx := request.WithRequestInfo(req.Context(), &request.RequestInfo{
+			IsResourceRequest: true,
+			Path:              path,
+			Verb:              "patch",
+			APIVersion:        "v1",
+			Namespace:         "default",
+			Resource:          "pods",
+			Name:              name,
+		})
+		ctx = request.WithUser(ctx, &user.DefaultInfo{Name: "alice"})
+		return req.WithContext(ctx)
+	}
+
+	t.Run("merge patch without metadata", func(t *testing.T) {
+		patch := `{"metadata":{"labels":{"team":"b"}}}`
+		req := newRequest("/api/v1/namespaces/default/pods/foo", "foo", string(k8stypes.MergePatchType), patch)
+
+		input, err := extractor.ExtractFromHttp(req)
+		require.NoError(t, err)
+		require.Equal(t, "foo", input.Name)
+		require.Equal(t, "default", input.Namespace)
+		require.NoError(t, input.LoadCurrentObject())
+		require.Equal(t, "b", input.Object.Labels["team"])
+		require.Equal(t, "a", input.OldObject.Labels["team"])
+		require.Equal(t, patch, string(input.Body))
+
+		// the original patch is still sent upstream
+		forwarded, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		require.Equal(t, patch, string(forwarded))
+
+		// templates see the patched object
+		data, err := convertToBloblangInput(input)
+		require.NoError(t, err)
+		object := data["object"].(map[string]any)
+		require.Equal(t, "Pod", object["kind"])
+	})
+
+	t.Run("apply creates missing object", func(t *testing.T) {
+		req := newRequest("/api/v1/namespaces/default/pods/bar", "bar", string(k8stypes.ApplyYAMLPatchType), "apiVersion: v1\nkind: Pod\nmetadata:\n  name: bar\n")
+
+		input, err := extractor.ExtractFromHttp(req)
+		require.NoError(t, err)
+		require.NoError(t, input.LoadCurrentObject())
+		require.Equal(t, "bar", input.Name)
+		require.Equal(t, "default", input.Namespace)
+		require.Equal(t, "bar", input.Object.Name)
+	})
+
+	t.Run("json patch on missing object", func(t *testing.T) {
+		req := newRequest("/api/v1/namespaces/default/pods/bar", "bar", string(k8stypes.JSONPatchType), `[]`)
+
+		input, err := extractor.ExtractFromHttp(req)
+		require.NoError(t, err)
+		require.Error(t, input.LoadCurrentObject())
+	})
+
+	t.Run("unsupported patch type", func(t *testing.T) {
+		req := newRequest("/api/v1/namespaces/default/pods/foo", "foo", "application/json", `{}`)
+
+		input, err := extractor.ExtractFromHttp(req)
+		require.NoError(t, err)
+		require.Error(t, input.LoadCurrentObject())
+	})
+}
+
+func TestKubeResolveInputExtractorOldObject(t *testing.T) {
+	extractor := NewKubeResolveInputExtractor(fakePodClient(t, nil))
+
+	newRequest := func(method, verb, name, body string) *http.Request {
+		path := "/api/v1/namespaces/default/pods/" + name
+		req := httptest.NewRequest(method, path, io.NopCloser(bytes.NewBufferString(body)))
+		ctx := request.WithRequestInfo(req.Context(), &request.RequestInfo{
+			IsResourceRequest: true,
+			Path:              path,
+			Verb:              verb,
+			APIVersion:        "v1",
+			Namespace:         "default",
+			Resource:          "pods",
+			Name:              name,
+		})
+		ctx = request.WithUser(ctx, &user.DefaultInfo{Name: "alice"})
+		return req.WithContext(ctx)
+	}
+
+	t.Run("update", func(t *testing.T) {
+		req := newRequest(http.MethodPut, "update", "foo", `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"foo","namespace":"default","labels":{"team":"b"}}}`)
+
+		input, err := extractor.ExtractFromHttp(req)
+		require.NoError(t, err)
+		require.Equal(t, "b", input.Object.Labels["team"])
+		require.NoError(t, input.LoadCurrentObject())
+		require.Equal(t, "a", input.OldObject.Labels["team"])
+
+		data, err := convertToBloblangInput(input)
+		require.NoError(t, err)
+		oldObject := data["oldObject"].(map[string]any)
+		require.Equal(t, "nginx", oldObject["spec"].(map[string]any)["containers"].([]any)[0].(map[string]any)["image"])
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		input, err := extractor.ExtractFromHttp(newRequest(http.MethodDelete, "delete", "foo", ""))
+		require.NoError(t, err)
+		require.Nil(t, input.Object)
+		require.NoError(t, input.LoadCurrentObject())
+		require.Equal(t, "a", input.OldObject.Labels["team"])
+
+		celInput, err := convertToCELInput(input)
+		require.NoError(t, err)
+		require.Contains(t, celInput, "oldObject")
+	})
+
+	t.Run("delete missing object", func(t *testing.T) {
+		input, err := extractor.ExtractFromHttp(newRequest(http.MethodDelete, "delete", "bar", ""))
+		require.NoError(t, err)
+		require.NoError(t, input.LoadCurrentObject())
+		require.Nil(t, input.OldObject)
+	})
+
+	t.Run("create doesn't fetch", func(t *testing.T) {
+		input, err := extractor.ExtractFromHttp(newRequest(http.MethodPost, "create", "foo", `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"foo"}}`))
+		require.NoError(t, err)
+		require.NoError(t, input.LoadCurrentObject())
+		require.Nil(t, input.OldObject)
+	})
+}
+
+func TestKubeResolveInputExtractorLoadsOnDemand(t *testing.T) {
+	var gets atomic.Int32
+	extractor := NewKubeResolveInputExtractor(fakePodClient(t, &gets))
+
+	newInput := func(t *testing.T) *ResolveInput {
+		path := "/api/v1/namespaces/default/pods/foo"
+		req := httptest.NewRequest(http.MethodPatch, path, io.NopCloser(bytes.NewBufferString(`{"metadata":{"labels":{"team":"b"}}}`)))
+		req.Header.Set("Content-Type", string(k8stypes.MergePatchType))
+		ctx := request.WithRequestInfo(req.Context(), &request.RequestInfo{
+			IsResourceRequest: true,
+			Path:              path,
+			Verb:              "patch",
+			APIVersion:        "v1",
+			Namespace:         "default",
+			Resource:          "pods",
+			Name:              "foo",
+		})
+		ctx = request.WithUser(ctx, &user.DefaultInfo{Name: "alice"})
+
+		gets.Store(0)
+		input, err := extractor.ExtractFromHttp(req.WithContext(ctx))
+		require.NoError(t, err)
+		require.Zero(t, gets.Load(), "extracting the input must not fetch the object")
+		return input
+	}
+
+	t.Run("templates that don't use the object", func(t *testing.T) {
+		input := newInput(t)
+		expr, err := compileUnparsedRelExpr(&UncompiledRelExpr{
+			ResourceType:     "pod",
+			ResourceID:       "{{namespacedName}}",
+			ResourceRelation: "editor",
+			SubjectType:      "user",
+			SubjectID:        "{{user.name}}",
+		})
+		require.NoError(t, err)
+
+		rels, err := expr.GenerateRelationships(input)
+		require.NoError(t, err)
+		require.Equal(t, "default/foo", rels[0].ResourceID)
+		require.Zero(t, gets.Load())
+
+		matches, err := EvaluateCELConditions(compileCEL(t, `name == "foo"`), input)
+		require.NoError(t, err)
+		require.True(t, matches)
+		require.Zero(t, gets.Load())
+	})
+
+	t.Run("templates that use the object", func(t *testing.T) {
+		input := newInput(t)
+		expr, err := compileUnparsedRelExpr(&UncompiledRelExpr{
+			ResourceType:     "team",
+			ResourceID:       "{{object.metadata.labels.team}}",
+			ResourceRelation: "member",
+			SubjectType:      "team",
+			SubjectID:        "{{oldObject.metadata.labels.team}}",
+		})
+		require.NoError(t, err)
+
+		rels, err := expr.GenerateRelationships(input)
+		require.NoError(t, err)
+		require.Equal(t, "b", rels[0].ResourceID)
+		require.Equal(t, "a", rels[0].SubjectID)
+		require.EqualValues(t, 1, gets.Load())
+	})
+
+	t.Run("conditions that use the object", func(t *testing.T) {
+		input := newInput(t)
+		matches, err := EvaluateCELConditions(compileCEL(t, `oldObject.metadata.labels.team == "a"`), input)
+		require.NoError(t, err)
+		require.True(t, matches)
+		require.EqualValues(t, 1, gets.Load())
+	})
+}
+
+// compileCEL compiles a CEL condition in the environment of rules.
+func compileCEL(t *testing.T, expr string) []cel.Program {
+	env, err := createCELEnvironment()
+	require.NoError(t, err)
+	ast, issues := env.Compile(expr)
+	require.NoError(t, issues.Err())
+	program, err := env.Program(ast)
+	require.NoError(t, err)
+	return []cel.Program{program}
+}
+
+// fakePodClient returns a kube client that serves a single pod, default/foo.
+// It counts the requests it serves in gets, if set.
+func fakePodClient(t *testing.T, gets *atomic.Int32) *fake.RESTClient {
+	return &fake.RESTClient{
+		NegotiatedSerializer: codecs,
+		Client: fake.CreateHTTPClient(func(r *http.Request) (*http.Response, error) {
+			require.Equal(t, http.MethodGet, r.Method)
+			if gets != nil {
+				gets.Add(1)
+			}
+			header := http.Header{}
+			header.Set("Content-Type", runtime.ContentTypeJSON)
+			if r.URL.Path == "/api/v1/namespaces/default/pods/foo" {
+				return &http.Response{
+					Header:     header,
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewBufferString(currentPod)),
+				}, nil
+			}
+			return &http.Response{
+				Header:     header,
+				StatusCode: http.StatusNotFound,
+				Body:       io.NopCloser(bytes.NewBufferString(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`)),
+			}, nil
+		}),
+	}
+}
@@ -2,25 +2,31 @@ package rules
 
 import (
 	"bytes"
-	"encoding/json"
+	"cmp"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"regexp"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
 	"github.com/warpstreamlabs/bento/public/bloblang"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	k8stypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 
 	"github.com/authzed/spicedb-kubeapi-proxy/pkg/config/proxyrule"
 )
@@ -33,6 +39,7 @@ var (
 		"request":           types.NewMapType(types.StringType, types.DynType),
 		"user":              types.NewMapType(types.StringType, types.DynType),
 		"object":            types.NewMapType(types.StringType, types.DynType),
+		"oldObject":         types.NewMapType(types.StringType, types.DynType),
 		"name":              types.StringType,
 		"resourceNamespace": types.StringType, // namespace is reserved in CEL
 		"namespacedName":    types.StringType,
@@ -116,6 +123,31 @@ func (m MapMatcher) Match(match *request.RequestInfo) []*RunnableRule {
 	}]
 }
 
+// A RequestLister lists the requests that a Matcher has rules for.
+type RequestLister interface {
+	Requests() []RequestMeta
+}
+
+var _ RequestLister = MapMatcher{}
+
+// Requests returns the requests that the MapMatcher has rules for, sorted by
+// group, version, resource and verb.
+func (m MapMatcher) Requests() []RequestMeta {
+	requests := make([]RequestMeta, 0, len(m))
+	for meta := range m {
+		requests = append(requests, meta)
+	}
+	slices.SortFunc(requests, func(a, b RequestMeta) int {
+		return cmp.Or(
+			cmp.Compare(a.APIGroup, b.APIGroup),
+			cmp.Compare(a.APIVersion, b.APIVersion),
+			cmp.Compare(a.Resource, b.Resource),
+			cmp.Compare(a.Verb, b.Verb),
+		)
+	})
+	return requests
+}
+
 // UncompiledRelExpr represents a relationship template expression that hasn't
 // been converted to RelExpr yet.
 type UncompiledRelExpr struct {
@@ -141,19 +173,27 @@ type RelExpr struct {
 	SubjectType      *bloblang.Executor
 	SubjectID        *bloblang.Executor
 	SubjectRelation  *bloblang.Executor
+
+	// usesCurrentObject is set if the expressions refer to the current
+	// state of the object, see ResolveInput.LoadCurrentObject.
+	usesCurrentObject bool
 }
 
 // TupleSetExpr represents a Bloblang expression that returns an array
 // of relationship strings to be parsed individually.
 type TupleSetExpr struct {
 	Expression *bloblang.Executor
+
+	// usesCurrentObject is set if the expression refers to the current
+	// state of the object, see ResolveInput.LoadCurrentObject.
+	usesCurrentObject bool
 }
 
 // GenerateRelationships executes the tuple set expression and parses each
 // returned string as a relationship.
 func (t *TupleSetExpr) GenerateRelationships(input *ResolveInput) ([]*ResolvedRel, error) {
 	// Convert input to interface{} for Bloblang
-	data, err := convertToBloblangInput(input)
+	data, err := bloblangInput(input, t.usesCurrentObject)
 	if err != nil {
 		return nil, fmt.Errorf("error converting input to bloblang input: %w", err)
 	}
@@ -237,6 +277,35 @@ type ResolveInput struct {
 	Object         *metav1.PartialObjectMetadata `json:"object"`
 	Body           []byte                        `json:"body"`
 	Headers        http.Header                   `json:"headers"`
+
+	// ObjectBody is the serialized object that results from the request, if
+	// it differs from Body. For patch requests, Body holds the patch and
+	// ObjectBody holds the current object with the patch applied.
+	ObjectBody []byte `json:"-"`
+
+	// OldObject and OldObjectBody hold the state of the object before an
+	// update, patch or delete request. They are nil for other requests and
+	// when the object doesn't exist.
+	OldObject     *metav1.PartialObjectMetadata `json:"oldObject"`
+	OldObjectBody []byte                        `json:"-"`
+
+	// object and oldObject cache the decoded full objects, see
+	// UnstructuredObject and UnstructuredOldObject. They are decoded once,
+	// so the fields above must not change after the objects are first used.
+	object    *lazyObject
+	oldObject *lazyObject
+
+	// current fetches the fields that depend on the current state of the
+	// object, see LoadCurrentObject.
+	current *currentObjectLoader
+}
+
+// objectBytes returns the serialized object that the request produces.
+func (r ResolveInput) objectBytes() []byte {
+	if r.ObjectBody != nil {
+		return r.ObjectBody
+	}
+	return r.Body
 }
 
 func (r ResolveInput) ToKeyValues() []any {
@@ -246,6 +315,7 @@ func (r ResolveInput) ToKeyValues() []any {
 		"namespace", r.Namespace,
 		"namespacedName", r.NamespacedName,
 		"object", r.Object,
+		"oldObject", r.OldObject,
 		"body", r.Body,
 	)
 
@@ -275,7 +345,36 @@ func (r ResolveInput) ToKeyValues() []any {
 	return expanded
 }
 
+// NewResolveInputFromHttp extracts a ResolveInput from a request without
+// consulting kube. Patch bodies are decoded as if they were full objects, so
+// only merge patches that include the object's type and metadata can be
+// resolved; use KubeResolveInputExtractor to support all patch types.
 func NewResolveInputFromHttp(req *http.Request) (*ResolveInput, error) {
+	return resolveInputFromHttp(req, nil)
+}
+
+// KubeResolveInputExtractor extracts ResolveInput from requests, and uses
+// a kube client to fetch the current state of objects that are being
+// updated, patched or deleted. The current state is exposed as OldObject, and
+// is used to compute the result of patches. It is only fetched when a rule
+// uses it, see ResolveInput.LoadCurrentObject.
+type KubeResolveInputExtractor struct {
+	KubeClient rest.Interface
+}
+
+var _ ResolveInputExtractor = &KubeResolveInputExtractor{}
+
+// NewKubeResolveInputExtractor creates a KubeResolveInputExtractor that reads
+// objects with the provided client.
+func NewKubeResolveInputExtractor(kubeClient rest.Interface) *KubeResolveInputExtractor {
+	return &KubeResolveInputExtractor{KubeClient: kubeClient}
+}
+
+func (e *KubeResolveInputExtractor) ExtractFromHttp(req *http.Request) (*ResolveInput, error) {
+	return resolveInputFromHttp(req, e.KubeClient)
+}
+
+func resolveInputFromHttp(req *http.Request, kubeClient rest.Interface) (*ResolveInput, error) {
 	requestInfo, ok := request.RequestInfoFrom(req.Context())
 	if !ok {
 		return nil, fmt.Errorf("unable to get request info from request")
@@ -285,6 +384,10 @@ func NewResolveInputFromHttp(req *http.Request) (*ResolveInput, error) {
 		return nil, fmt.Errorf("unable to get user info from request")
 	}
 
+	// update/patch/delete requests operate on an existing object, which is
+	// only fetched once a rule needs it, see LoadCurrentObject
+	fetchCurrent := kubeClient != nil && slices.Contains([]string{"update", "patch", "delete"}, requestInfo.Verb)
+
 	// create/update requests should contain an object body, parse it and
 	// include in the input
 	var body []byte
@@ -295,17 +398,128 @@ func NewResolveInputFromHttp(req *http.Request) (*ResolveInput, error) {
 		if err != nil {
 			return nil, fmt.Errorf("unable to read request body: %w", err)
 		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		// the object that results from a patch is only known once the
+		// patch is applied to the current object
+		if requestInfo.Verb != "patch" || !fetchCurrent {
+			var pom metav1.PartialObjectMetadata
+			_, _, err = codecs.UniversalDeserializer().Decode(body, nil, &pom)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode request body as kube object: %w", err)
+			}
+			object = &pom
+		}
+	}
+	input := NewResolveInput(requestInfo, userInfo.(*user.DefaultInfo), object, body, req.Header.Clone())
+	if fetchCurrent {
+		ctx, contentType := req.Context(), req.Header.Get("Content-Type")
+		input.current = &currentObjectLoader{load: func() error {
+			return input.loadCurrentObject(ctx, kubeClient, contentType)
+		}}
+	}
+	return input, nil
+}
+
+// currentObjectLoader fetches the current state of the object targeted by a
+// request the first time that it is needed.
+type currentObjectLoader struct {
+	once   sync.Once
+	loaded atomic.Bool
+	err    error
+	load   func() error
+}
+
+// pending reports whether the current object still has to be fetched.
+func (l *currentObjectLoader) pending() bool {
+	return l != nil && !l.loaded.Load()
+}
+
+// LoadCurrentObject fetches the current state of the object targeted by an
+// update, patch or delete request into OldObject and OldObjectBody, and for
+// patch requests applies the patch to it to set Object and ObjectBody. It
+// only fetches once, and does nothing for inputs that weren't extracted by a
+// KubeResolveInputExtractor.
+//
+// The object is fetched with the client of the extractor, so it must only be
+// loaded for rules that use it. UnstructuredObject, UnstructuredOldObject and
+// the templates and conditions that refer to the object load it on demand.
+func (r *ResolveInput) LoadCurrentObject() error {
+	if r.current == nil {
+		return nil
+	}
+	r.current.once.Do(func() {
+		r.current.err = r.current.load()
+		r.current.loaded.Store(true)
+	})
+	return r.current.err
+}
+
+// loadCurrentObject fetches the object targeted by the request and sets the
+// fields of the input that are derived from it.
+func (r *ResolveInput) loadCurrentObject(ctx context.Context, kubeClient rest.Interface, contentType string) error {
+	oldObjectBody, err := currentObject(ctx, kubeClient, r.Request)
+	if err != nil {
+		return err
+	}
+	if oldObjectBody != nil {
 		var pom metav1.PartialObjectMetadata
-		_, _, err = codecs.UniversalDeserializer().Decode(body, nil, &pom)
+		_, _, err = codecs.UniversalDeserializer().Decode(oldObjectBody, nil, &pom)
 		if err != nil {
-			return nil, fmt.Errorf("unable to decode request body as kube object: %w", err)
+			return fmt.Errorf("unable to decode existing object: %w", err)
 		}
+		r.OldObject = &pom
+	}
+	r.OldObjectBody = oldObjectBody
+
+	if r.Request.Verb != "patch" {
+		return nil
+	}
+	objectBody, err := patchedObject(oldObjectBody, contentType, r.Body)
+	if err != nil {
+		return err
+	}
+	var pom metav1.PartialObjectMetadata
+	_, _, err = codecs.UniversalDeserializer().Decode(objectBody, nil, &pom)
+	if err != nil {
+		return fmt.Errorf("unable to decode patched object: %w", err)
+	}
+	r.Object = &pom
+	r.ObjectBody = objectBody
+	return nil
+}
 
-		object = &pom
+// currentObject fetches the current state of the object targeted by a
+// request. It returns nil if the object doesn't exist.
+func currentObject(ctx context.Context, kubeClient rest.Interface, requestInfo *request.RequestInfo) ([]byte, error) {
+	current, err := kubeClient.Get().AbsPath(requestInfo.Path).SetHeader("Accept", "application/json").Do(ctx).Raw()
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch existing object: %w", err)
+	}
+	return current, nil
+}
 
-		req.Body = io.NopCloser(bytes.NewReader(body))
+// patchedObject applies a patch to the current state of the object targeted
+// by a patch request.
+func patchedObject(current []byte, contentType string, patch []byte) ([]byte, error) {
+	patchType, err := patchTypeFromContentType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	// server-side apply creates objects that don't exist
+	if current == nil && patchType != k8stypes.ApplyYAMLPatchType {
+		return nil, fmt.Errorf("unable to apply %s patch: object not found", patchType)
 	}
-	return NewResolveInput(requestInfo, userInfo.(*user.DefaultInfo), object, body, req.Header.Clone()), nil
+
+	patched, err := applyPatch(patchType, current, patch)
+	if err != nil {
+		return nil, fmt.Errorf("unable to apply %s patch: %w", patchType, err)
+	}
+	return patched, nil
 }
 
 // NewResolveInput creates a ResolveInput with normalized fields.
@@ -346,12 +560,14 @@ func NewResolveInput(req *request.RequestInfo, user *user.DefaultInfo, object *m
 		Object:         object,
 		Body:           body,
 		Headers:        headers,
+		object:         &lazyObject{},
+		oldObject:      &lazyObject{},
 	}
 }
 
 func ResolveRel(expr *RelExpr, input *ResolveInput) (*ResolvedRel, error) {
 	// Convert input to interface{} for Bloblang
-	data, err := convertToBloblangInput(input)
+	data, err := bloblangInput(input, expr.usesCurrentObject)
 	if err != nil {
 		return nil, fmt.Errorf("error converting input to bloblang input: %w", err)
 	}
@@ -498,13 +714,15 @@ func convertToCELInput(input *ResolveInput) (map[string]any, error) {
 		}
 	}
 
-	// Convert object info to map
-	if input.Object != nil {
-		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(input.Object)
-		if err != nil {
-			return nil, fmt.Errorf("error converting object metadata to unstructured: %w", err)
-		}
-		data["object"] = obj
+	// Convert the full object and the existing object to maps. Objects that
+	// still have to be fetched are only fetched if a condition uses them.
+	pending := input.current.pending()
+	patch := input.Request != nil && input.Request.Verb == "patch"
+	if err := addCELObject(data, "object", pending && patch, input.UnstructuredObject); err != nil {
+		return nil, err
+	}
+	if err := addCELObject(data, "oldObject", pending, input.UnstructuredOldObject); err != nil {
+		return nil, err
 	}
 
 	// Validate that all keys in data exist in the CEL environment field map
@@ -517,8 +735,43 @@ func convertToCELInput(input *ResolveInput) (map[string]any, error) {
 	return normalizeToBloblangTypes(data).(map[string]any), nil
 }
 
-// convertToBloblangInput converts ResolveInput to a format suitable for Bloblang
+// addCELObject adds an object to a CEL input. A lazy object is added as a
+// function that CEL only calls if the object is referenced.
+func addCELObject(data map[string]any, key string, lazy bool, get func() (map[string]any, error)) error {
+	if lazy {
+		data[key] = func() ref.Val {
+			object, err := get()
+			if err != nil {
+				return types.WrapErr(err)
+			}
+			if object == nil {
+				return types.NewErr("no such attribute: %s", key)
+			}
+			return types.DefaultTypeAdapter.NativeToValue(object)
+		}
+		return nil
+	}
+
+	object, err := get()
+	if err != nil {
+		return err
+	}
+	if object != nil {
+		data[key] = object
+	}
+	return nil
+}
+
+// convertToBloblangInput converts ResolveInput to a format suitable for
+// Bloblang, including the objects that have to be fetched first.
 func convertToBloblangInput(input *ResolveInput) (map[string]any, error) {
+	return bloblangInput(input, true)
+}
+
+// bloblangInput converts ResolveInput to a format suitable for Bloblang. The
+// objects that have to be fetched first are left out unless current is set,
+// see LoadCurrentObject.
+func bloblangInput(input *ResolveInput, current bool) (map[string]any, error) {
 	// Convert to a map structure that Bloblang can navigate
 	data := map[string]any{
 		"name":           input.Name,
@@ -550,64 +803,36 @@ func convertToBloblangInput(input *ResolveInput) (map[string]any, error) {
 		}
 	}
 
-	// Parse JSON body and merge with object metadata
-	if len(input.Body) > 0 {
-		var bodyData map[string]any
-		if err := json.Unmarshal(input.Body, &bodyData); err == nil {
-			// Successfully parsed JSON body
-			if input.Object != nil {
-				// Merge object metadata with body data
-				obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(input.Object)
-				if err != nil {
-					return nil, fmt.Errorf("error converting object metadata to unstructured: %w", err)
-				}
-
-				// Start with body data (contains full object spec)
-				objectData := normalizeToBloblangTypes(bodyData).(map[string]any)
+	skipCurrent := !current && input.current.pending()
+	patch := input.Request != nil && input.Request.Verb == "patch"
 
-				// Merge in object metadata if it exists and is more complete
-				if metadata, ok := obj["metadata"]; ok {
-					objectData["metadata"] = normalizeToBloblangTypes(metadata)
-				}
-
-				data["object"] = objectData
-				data["metadata"] = objectData["metadata"]
-			} else {
-				// Only body data available
-				objectData := normalizeToBloblangTypes(bodyData).(map[string]any)
-				data["object"] = objectData
-			}
-		} else {
-			// Failed to parse JSON, fall back to object metadata only
+	// Include the full object, with its metadata as decoded by kube. The
+	// object that results from a patch is only known once it is loaded.
+	if !skipCurrent || !patch {
+		object, err := input.UnstructuredObject()
+		if err != nil {
+			return nil, err
+		}
+		if object != nil {
+			data["object"] = object
 			if input.Object != nil {
-				obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(input.Object)
-				if err != nil {
-					return nil, fmt.Errorf("error converting object metadata to unstructured: %w", err)
-				}
-
-				objectData := map[string]any{
-					"metadata": normalizeToBloblangTypes(obj["metadata"]),
-				}
-
-				data["object"] = objectData
-				data["metadata"] = objectData["metadata"]
+				data["metadata"] = object["metadata"]
 			}
 		}
-
+	}
+	if len(input.objectBytes()) > 0 {
 		data["body"] = input.Body
-	} else if input.Object != nil {
-		// No body, but we have object metadata
-		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(input.Object)
+	}
+
+	// Include the existing object for update, patch and delete requests
+	if !skipCurrent {
+		oldObject, err := input.UnstructuredOldObject()
 		if err != nil {
-			return nil, fmt.Errorf("error converting object metadata to unstructured: %w", err)
+			return nil, err
 		}
-
-		objectData := map[string]any{
-			"metadata": normalizeToBloblangTypes(obj["metadata"]),
+		if oldObject != nil {
+			data["oldObject"] = oldObject
 		}
-
-		data["object"] = objectData
-		data["metadata"] = objectData["metadata"]
 	}
 
 	return normalizeToBloblangTypes(data).(map[string]any), nil
@@ -663,6 +888,26 @@ type RunnableRule struct {
 	Update       *UpdateSet
 	PreFilter    []*PreFilter
 	PostFilter   []*PostFilter
+
+	// OnGarbageCollected is the update for objects that kube removes
+	// because their namespace or owner was deleted.
+	OnGarbageCollected *UpdateSet
+
+	// Retry and Timeout override the defaults for the dual write of the
+	// rule, if set.
+	Retry   *proxyrule.RetryPolicy
+	Timeout time.Duration
+
+	// Preflight sends writes to kube as a dry run before writing to SpiceDB.
+	Preflight bool
+
+	// LockGranularity overrides the default of what pessimistic writes of
+	// the rule lock, if set.
+	LockGranularity proxyrule.LockGranularity
+
+	// Approval, if set, holds the writes of the rule until they are
+	// approved.
+	Approval *Approval
 }
 
 type UpdateSet struct {
@@ -672,6 +917,14 @@ type UpdateSet struct {
 	Touches         []RelationshipExpr
 	Deletes         []RelationshipExpr
 	DeletesByFilter []RelationshipExpr
+
+	// KubeWrites are the objects that are created in kube after the write.
+	KubeWrites []*KubeWriteExpr
+
+	// Templates is the uncompiled update, which is passed to the dual-write
+	// workflow when the relationships can only be resolved after the write
+	// to kube.
+	Templates proxyrule.Update
 }
 
 // LookupType defines whether an LR or LS request is made for a filter
@@ -715,8 +968,14 @@ type ResolvedPostFilter struct {
 // Bloblang expressions are pre-compiled and stored.
 func Compile(config proxyrule.Config) (*RunnableRule, error) {
 	runnable := &RunnableRule{
-		Name:     config.Name,
-		LockMode: config.Locking,
+		Name:            config.Name,
+		LockMode:        config.Locking,
+		Retry:           config.Retry,
+		Preflight:       config.Preflight,
+		LockGranularity: config.LockGranularity,
+	}
+	if config.Timeout != nil {
+		runnable.Timeout = config.Timeout.Duration
 	}
 	var err error
 
@@ -764,81 +1023,34 @@ func Compile(config proxyrule.Config) (*RunnableRule, error) {
 		}
 	}
 
-	var updateSet *UpdateSet
-
-	if config.Update.PreconditionExists != nil {
-		updateSet = &UpdateSet{}
-		must, err := compileStringOrObjTemplates(config.Update.PreconditionExists)
-		if err != nil {
-			return nil, fmt.Errorf("error compiling preconditionExists: %w", err)
-		}
-		updateSet.MustExist = must
-	}
-
-	if config.Update.PreconditionDoesNotExist != nil {
-		if updateSet == nil {
-			updateSet = &UpdateSet{}
-		}
-
-		mustNot, err := compileStringOrObjTemplates(config.Update.PreconditionDoesNotExist)
-		if err != nil {
-			return nil, fmt.Errorf("error compiling preconditionDoesNotExist: %w", err)
-		}
-		updateSet.MustNotExist = mustNot
-	}
-
-	if config.Update.CreateRelationships != nil {
-		if updateSet == nil {
-			updateSet = &UpdateSet{}
-		}
-
-		creates, err := compileStringOrObjTemplates(config.Update.CreateRelationships)
-		if err != nil {
-			return nil, fmt.Errorf("error compiling createRelationships: %w", err)
-		}
-		updateSet.Creates = creates
+	runnable.Update, err = CompileUpdate(config.Update)
+	if err != nil {
+		return nil, err
 	}
 
-	if config.Update.TouchRelationships != nil {
-		if updateSet == nil {
-			updateSet = &UpdateSet{}
+	if config.Approval != nil {
+		if err := validateApprovalVerbs(config.Matches); err != nil {
+			return nil, err
 		}
-
-		touches, err := compileStringOrObjTemplates(config.Update.TouchRelationships)
+		runnable.Approval, err = CompileApproval(*config.Approval)
 		if err != nil {
 			return nil, err
 		}
-		updateSet.Touches = touches
-	}
-
-	if config.Update.DeleteRelationships != nil {
-		if updateSet == nil {
-			updateSet = &UpdateSet{}
-		}
 
-		deletes, err := compileStringOrObjTemplates(config.Update.DeleteRelationships)
-		if err != nil {
-			return nil, fmt.Errorf("error compiling deleteRelationships: %w", err)
+		// writes that are approved go through the dual write workflow, even
+		// if they don't update any relationships
+		if runnable.Update == nil {
+			runnable.Update = &UpdateSet{Templates: config.Update}
 		}
-
-		updateSet.Deletes = deletes
 	}
 
-	if config.Update.DeleteByFilter != nil {
-		if updateSet == nil {
-			updateSet = &UpdateSet{}
-		}
-
-		deletesByFilter, err := compileStringOrObjTemplates(config.Update.DeleteByFilter)
+	if config.OnGarbageCollected != nil {
+		runnable.OnGarbageCollected, err = CompileUpdate(*config.OnGarbageCollected)
 		if err != nil {
-			return nil, fmt.Errorf("error compiling deleteByFilter: %w", err)
+			return nil, fmt.Errorf("error compiling onGarbageCollected: %w", err)
 		}
-
-		updateSet.DeletesByFilter = deletesByFilter
 	}
 
-	runnable.Update = updateSet
-
 	for _, f := range config.PreFilters {
 		name, err := CompileBloblangExpression(f.FromObjectIDNameExpr)
 		if err != nil {
@@ -896,6 +1108,102 @@ func Compile(config proxyrule.Config) (*RunnableRule, error) {
 	return runnable, nil
 }
 
+// CompileUpdate compiles the relationship templates and kube writes of an
+// update. It returns nil if the update doesn't define any of them.
+func CompileUpdate(update proxyrule.Update) (*UpdateSet, error) {
+	var updateSet *UpdateSet
+
+	if update.PreconditionExists != nil {
+		updateSet = &UpdateSet{}
+		must, err := compileStringOrObjTemplates(update.PreconditionExists)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling preconditionExists: %w", err)
+		}
+		updateSet.MustExist = must
+	}
+
+	if update.PreconditionDoesNotExist != nil {
+		if updateSet == nil {
+			updateSet = &UpdateSet{}
+		}
+
+		mustNot, err := compileStringOrObjTemplates(update.PreconditionDoesNotExist)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling preconditionDoesNotExist: %w", err)
+		}
+		updateSet.MustNotExist = mustNot
+	}
+
+	if update.CreateRelationships != nil {
+		if updateSet == nil {
+			updateSet = &UpdateSet{}
+		}
+
+		creates, err := compileStringOrObjTemplates(update.CreateRelationships)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling createRelationships: %w", err)
+		}
+		updateSet.Creates = creates
+	}
+
+	if update.TouchRelationships != nil {
+		if updateSet == nil {
+			updateSet = &UpdateSet{}
+		}
+
+		touches, err := compileStringOrObjTemplates(update.TouchRelationships)
+		if err != nil {
+			return nil, err
+		}
+		updateSet.Touches = touches
+	}
+
+	if update.DeleteRelationships != nil {
+		if updateSet == nil {
+			updateSet = &UpdateSet{}
+		}
+
+		deletes, err := compileStringOrObjTemplates(update.DeleteRelationships)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling deleteRelationships: %w", err)
+		}
+
+		updateSet.Deletes = deletes
+	}
+
+	if update.DeleteByFilter != nil {
+		if updateSet == nil {
+			updateSet = &UpdateSet{}
+		}
+
+		deletesByFilter, err := compileStringOrObjTemplates(update.DeleteByFilter)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling deleteByFilter: %w", err)
+		}
+
+		updateSet.DeletesByFilter = deletesByFilter
+	}
+
+	if update.KubeWrites != nil {
+		if updateSet == nil {
+			updateSet = &UpdateSet{}
+		}
+
+		for _, write := range update.KubeWrites {
+			kubeWrite, err := CompileKubeWrite(write)
+			if err != nil {
+				return nil, fmt.Errorf("error compiling kubeWrites: %w", err)
+			}
+			updateSet.KubeWrites = append(updateSet.KubeWrites, kubeWrite)
+		}
+	}
+
+	if updateSet != nil {
+		updateSet.Templates = update
+	}
+	return updateSet, nil
+}
+
 // compileStringOrObjTemplates converts a list of StringOrTemplate into a
 // list of compiled RelationshipExpr.
 func compileStringOrObjTemplates(tmpls []proxyrule.StringOrTemplate) ([]RelationshipExpr, error) {
@@ -908,7 +1216,8 @@ func compileStringOrObjTemplates(tmpls []proxyrule.StringOrTemplate) ([]Relation
 				return nil, fmt.Errorf("error compiling tuple set expression: %w", err)
 			}
 			tupleSetExpr := &TupleSetExpr{
-				Expression: executor,
+				Expression:        executor,
+				usesCurrentObject: usesCurrentObject(c.TupleSet),
 			}
 			exprs = append(exprs, tupleSetExpr)
 		} else {
@@ -996,9 +1305,22 @@ func compileUnparsedRelExpr(u *UncompiledRelExpr) (*RelExpr, error) {
 			return nil, fmt.Errorf("error compiling subject relation %q: %w", u.SubjectRelation, err)
 		}
 	}
+	expr.usesCurrentObject = usesCurrentObject(u.ResourceType, u.ResourceID, u.ResourceRelation, u.SubjectType, u.SubjectID, u.SubjectRelation)
 	return &expr, nil
 }
 
+// currentObjectFields matches the fields of the template input that hold
+// the current state of the object, or all of the input.
+var currentObjectFields = regexp.MustCompile(`\b(?:object|oldObject|metadata|this)\b`)
+
+// usesCurrentObject reports whether any of the templates may refer to the
+// current state of the object, which is only fetched for the templates
+// that need it. Literal text that happens to match is harmless, it only
+// fetches the object needlessly.
+func usesCurrentObject(templates ...string) bool {
+	return slices.ContainsFunc(templates, currentObjectFields.MatchString)
+}
+
 // CompileBloblangExpression checks to see if its argument is an expression of
 // the form `{{ ... }}` where ... is a Bloblang expression. If the argument
 // doesn't appear to be an expression, it is returned as a literal expression.
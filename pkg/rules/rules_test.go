@@ -968,6 +968,46 @@ func TestCELConditions(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			name: "CEL condition on object spec - should pass",
+			config: proxyrule.Config{Spec: proxyrule.Spec{
+				Matches: []proxyrule.Match{{
+					GroupVersion: "v1",
+					Resource:     "pods",
+					Verbs:        []string{"create"},
+				}},
+				If: []string{"object.spec.serviceAccountName == 'builder' && object.spec.containers.exists(c, c.image.startsWith('registry.example.com/'))"},
+			}},
+			input: &ResolveInput{
+				Request: &request.RequestInfo{Verb: "create", Resource: "pods"},
+				Object: &metav1.PartialObjectMetadata{
+					ObjectMeta: metav1.ObjectMeta{Name: "x"},
+				},
+				Body: []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"x"},"spec":{"serviceAccountName":"builder","containers":[{"name":"app","image":"registry.example.com/app"}]}}`),
+			},
+			want: true,
+		},
+		{
+			name: "CEL condition comparing object with oldObject - should pass",
+			config: proxyrule.Config{Spec: proxyrule.Spec{
+				Matches: []proxyrule.Match{{
+					GroupVersion: "v1",
+					Resource:     "namespaces",
+					Verbs:        []string{"update"},
+				}},
+				If: []string{"object.metadata.labels['team'] != oldObject.metadata.labels['team']"},
+			}},
+			input: &ResolveInput{
+				Request: &request.RequestInfo{Verb: "update", Resource: "namespaces"},
+				Object: &metav1.PartialObjectMetadata{
+					ObjectMeta: metav1.ObjectMeta{Name: "x", Labels: map[string]string{"team": "b"}},
+				},
+				OldObject: &metav1.PartialObjectMetadata{
+					ObjectMeta: metav1.ObjectMeta{Name: "x", Labels: map[string]string{"team": "a"}},
+				},
+			},
+			want: true,
+		},
 		{
 			name: "CEL condition on user name - should pass",
 			config: proxyrule.Config{Spec: proxyrule.Spec{
@@ -1315,6 +1355,23 @@ func TestMapMatcherMatch(t *testing.T) {
 	}
 }
 
+func TestMapMatcherRequests(t *testing.T) {
+	m, err := NewMapMatcher([]proxyrule.Config{
+		{Spec: proxyrule.Spec{
+			Matches: []proxyrule.Match{{GroupVersion: "example.com/v1alpha1", Resource: "wardles", Verbs: []string{"list", "get"}}},
+		}},
+		{Spec: proxyrule.Spec{
+			Matches: []proxyrule.Match{{GroupVersion: "v1", Resource: "pods", Verbs: []string{"get"}}},
+		}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []RequestMeta{
+		{Verb: "get", APIVersion: "v1", Resource: "pods"},
+		{Verb: "get", APIGroup: "example.com", APIVersion: "v1alpha1", Resource: "wardles"},
+		{Verb: "list", APIGroup: "example.com", APIVersion: "v1alpha1", Resource: "wardles"},
+	}, m.Requests())
+}
+
 func TestNormalizeToBloblangTypes(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -437,3 +437,48 @@ func TestTupleSetInChecksAndPreconditions(t *testing.T) {
 		})
 	}
 }
+
+func TestTupleSetWithOldObjectDiff(t *testing.T) {
+	newInput := func() *ResolveInput {
+		return NewResolveInput(
+			&request.RequestInfo{Verb: "update", Resource: "namespaces", Name: "x"},
+			&user.DefaultInfo{Name: "alice"},
+			&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "x", Labels: map[string]string{"team": "b"}}},
+			[]byte(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"x","labels":{"team":"b"}}}`),
+			nil,
+		)
+	}
+	input := newInput()
+	input.OldObject = &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "x", Labels: map[string]string{"team": "a"}}}
+	input.OldObjectBody = []byte(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"x","labels":{"team":"a"}}}`)
+
+	touches, err := CompileTupleSetExpression(`values_added(this.oldObject.metadata.labels.team, this.object.metadata.labels.team).map_each(t -> "namespace:" + this.name + "#team@team:" + t)`)
+	require.NoError(t, err)
+	deletes, err := CompileTupleSetExpression(`values_removed(this.oldObject.metadata.labels.team, this.object.metadata.labels.team).map_each(t -> "namespace:" + this.name + "#team@team:" + t)`)
+	require.NoError(t, err)
+
+	created, err := (&TupleSetExpr{Expression: touches}).GenerateRelationships(input)
+	require.NoError(t, err)
+	require.Equal(t, []*ResolvedRel{{
+		ResourceType:     "namespace",
+		ResourceID:       "x",
+		ResourceRelation: "team",
+		SubjectType:      "team",
+		SubjectID:        "b",
+	}}, created)
+
+	deleted, err := (&TupleSetExpr{Expression: deletes}).GenerateRelationships(input)
+	require.NoError(t, err)
+	require.Equal(t, []*ResolvedRel{{
+		ResourceType:     "namespace",
+		ResourceID:       "x",
+		ResourceRelation: "team",
+		SubjectType:      "team",
+		SubjectID:        "a",
+	}}, deleted)
+
+	// without an existing object, everything is added and nothing is removed
+	deleted, err = (&TupleSetExpr{Expression: deletes}).GenerateRelationships(newInput())
+	require.NoError(t, err)
+	require.Empty(t, deleted)
+}
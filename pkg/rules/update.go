@@ -0,0 +1,243 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+)
+
+// ResolvedUpdate holds the relationship writes of an UpdateSet, resolved
+// against a specific request.
+type ResolvedUpdate struct {
+	Preconditions       []*v1.Precondition
+	CreateRelationships []*v1.Relationship
+	TouchRelationships  []*v1.Relationship
+	DeleteRelationships []*v1.Relationship
+	DeleteByFilter      []*v1.RelationshipFilter
+}
+
+// Resolve resolves all relationship templates of the update against the
+// input.
+func (u *UpdateSet) Resolve(input *ResolveInput) (*ResolvedUpdate, error) {
+	preconditions, err := u.ResolvePreconditions(input)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := u.ResolveWrites(input)
+	if err != nil {
+		return nil, err
+	}
+	resolved.Preconditions = preconditions
+	return resolved, nil
+}
+
+// ResolvePreconditions resolves the preconditionExists and
+// preconditionDoesNotExist templates of the update against the input.
+func (u *UpdateSet) ResolvePreconditions(input *ResolveInput) ([]*v1.Precondition, error) {
+	preconditions := make([]*v1.Precondition, 0, len(u.MustExist)+len(u.MustNotExist))
+
+	for _, precondition := range u.MustExist {
+		resolvedRels, err := precondition.GenerateRelationships(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve must rule: %w", err)
+		}
+		// Create a precondition for each resolved relationship
+		for _, rel := range resolvedRels {
+			filterFromRel, err := filterFromRel(rel)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create filter from relationship (%v): %w", rel, err)
+			}
+			p := &v1.Precondition{
+				Filter: filterFromRel,
+			}
+			p.Operation = v1.Precondition_OPERATION_MUST_MATCH
+			preconditions = append(preconditions, p)
+		}
+	}
+	for _, precondition := range u.MustNotExist {
+		resolvedRels, err := precondition.GenerateRelationships(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve must not rule: %w", err)
+		}
+		// Create a precondition for each resolved relationship
+		for _, rel := range resolvedRels {
+			filterFromRel, err := filterFromRel(rel)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create filter from relationship (%v): %w", rel, err)
+			}
+			p := &v1.Precondition{
+				Filter: filterFromRel,
+			}
+			p.Operation = v1.Precondition_OPERATION_MUST_NOT_MATCH
+			preconditions = append(preconditions, p)
+		}
+	}
+	return preconditions, nil
+}
+
+// ResolveWrites resolves the creates, touches, deletes and deleteByFilter
+// templates of the update against the input.
+func (u *UpdateSet) ResolveWrites(input *ResolveInput) (*ResolvedUpdate, error) {
+	createRels, err := relsFromExprs(u.Creates, input)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve create relationships: %w", err)
+	}
+
+	touchRels, err := relsFromExprs(u.Touches, input)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve touch relationships: %w", err)
+	}
+
+	deleteRels, err := relsFromExprs(u.Deletes, input)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve delete relationships: %w", err)
+	}
+
+	deleteByFilter := make([]*v1.RelationshipFilter, 0, len(u.DeletesByFilter))
+	for _, deleteByFilterExpr := range u.DeletesByFilter {
+		resolvedRels, err := deleteByFilterExpr.GenerateRelationships(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve delete by filter: %w", err)
+		}
+		// Create a filter for each resolved relationship
+		for _, rel := range resolvedRels {
+			filter, err := filterFromRel(rel)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create filter from relationship (%v): %w", rel, err)
+			}
+			deleteByFilter = append(deleteByFilter, filter)
+		}
+	}
+
+	return &ResolvedUpdate{
+		CreateRelationships: createRels,
+		TouchRelationships:  touchRels,
+		DeleteRelationships: deleteRels,
+		DeleteByFilter:      deleteByFilter,
+	}, nil
+}
+
+// IdempotentUpdates returns the relationship updates of the resolved
+// update, with creates written as touches, so that writing them more than
+// once has no further effect. DeleteByFilter is not included.
+func (u *ResolvedUpdate) IdempotentUpdates() []*v1.RelationshipUpdate {
+	updates := make([]*v1.RelationshipUpdate, 0, len(u.CreateRelationships)+len(u.TouchRelationships)+len(u.DeleteRelationships))
+	for _, rel := range u.CreateRelationships {
+		updates = append(updates, &v1.RelationshipUpdate{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: rel})
+	}
+	for _, rel := range u.TouchRelationships {
+		updates = append(updates, &v1.RelationshipUpdate{Operation: v1.RelationshipUpdate_OPERATION_TOUCH, Relationship: rel})
+	}
+	for _, rel := range u.DeleteRelationships {
+		updates = append(updates, &v1.RelationshipUpdate{Operation: v1.RelationshipUpdate_OPERATION_DELETE, Relationship: rel})
+	}
+	return updates
+}
+
+func relsFromExprs(exprs []RelationshipExpr, input *ResolveInput) ([]*v1.Relationship, error) {
+	var rels []*v1.Relationship
+	for _, expr := range exprs {
+		resolvedRels, err := expr.GenerateRelationships(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve write rule: %w", err)
+		}
+		for _, rel := range resolvedRels {
+			relationship := &v1.Relationship{
+				Resource: &v1.ObjectReference{
+					ObjectType: rel.ResourceType,
+					ObjectId:   rel.ResourceID,
+				},
+				Relation: rel.ResourceRelation,
+				Subject: &v1.SubjectReference{
+					Object: &v1.ObjectReference{
+						ObjectType: rel.SubjectType,
+						ObjectId:   rel.SubjectID,
+					},
+					OptionalRelation: rel.SubjectRelation,
+				},
+			}
+			if err := relationship.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid relationship `%s`: %w", relationship, err)
+			}
+			rels = append(rels, relationship)
+		}
+	}
+	return rels, nil
+}
+
+func validateFieldForDollarUsage(field, fieldName string, allowedTemplate string) error {
+	if !strings.Contains(field, "$") {
+		return nil
+	}
+	if field == allowedTemplate {
+		return nil
+	}
+	return fmt.Errorf("invalid use of '$' in %s field '%s': only '%s' is allowed", fieldName, field, allowedTemplate)
+}
+
+func filterFromRel(rel *ResolvedRel) (*v1.RelationshipFilter, error) {
+	if err := validateFieldForDollarUsage(rel.ResourceType, "resourceType", "$resourceType"); err != nil {
+		return nil, err
+	}
+	if err := validateFieldForDollarUsage(rel.ResourceID, "resourceID", "$resourceID"); err != nil {
+		return nil, err
+	}
+	if err := validateFieldForDollarUsage(rel.ResourceRelation, "resourceRelation", "$resourceRelation"); err != nil {
+		return nil, err
+	}
+	if err := validateFieldForDollarUsage(rel.SubjectType, "subjectType", "$subjectType"); err != nil {
+		return nil, err
+	}
+	if err := validateFieldForDollarUsage(rel.SubjectID, "subjectID", "$subjectID"); err != nil {
+		return nil, err
+	}
+	if err := validateFieldForDollarUsage(rel.SubjectRelation, "subjectRelation", "$subjectRelation"); err != nil {
+		return nil, err
+	}
+
+	f := &v1.RelationshipFilter{}
+
+	if rel.ResourceType != "$resourceType" {
+		f.ResourceType = rel.ResourceType
+	}
+	if rel.ResourceID != "$resourceID" {
+		f.OptionalResourceId = rel.ResourceID
+	}
+	if rel.ResourceRelation != "$resourceRelation" {
+		f.OptionalRelation = rel.ResourceRelation
+	}
+	var needsSubjectFilter bool
+
+	if rel.SubjectType != "$subjectType" && rel.SubjectType != "" {
+		needsSubjectFilter = true
+	}
+	if rel.SubjectID != "$subjectID" && rel.SubjectID != "" {
+		needsSubjectFilter = true
+	}
+	if rel.SubjectRelation != "$subjectRelation" && rel.SubjectRelation != "" {
+		needsSubjectFilter = true
+	}
+
+	if needsSubjectFilter {
+		f.OptionalSubjectFilter = &v1.SubjectFilter{}
+
+		if rel.SubjectType != "$subjectType" && rel.SubjectType != "" {
+			f.OptionalSubjectFilter.SubjectType = rel.SubjectType
+		}
+		if rel.SubjectID != "$subjectID" && rel.SubjectID != "" {
+			f.OptionalSubjectFilter.OptionalSubjectId = rel.SubjectID
+		}
+		if rel.SubjectRelation != "$subjectRelation" && rel.SubjectRelation != "" {
+			f.OptionalSubjectFilter.OptionalRelation = &v1.SubjectFilter_RelationFilter{
+				Relation: rel.SubjectRelation,
+			}
+		}
+	}
+
+	if err := f.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid relationship filter: %w", err)
+	}
+
+	return f, nil
+}
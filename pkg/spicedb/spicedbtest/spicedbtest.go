@@ -0,0 +1,36 @@
+// Package spicedbtest runs in-process SpiceDB servers for tests.
+package spicedbtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/spicedb"
+)
+
+// NewPermissionsClient starts an in-process SpiceDB server with the
+// bootstrap schema, which runs until ctx is done, and returns a client for
+// it. The error that the server stopped with is checked when the test
+// cleans up, so ctx must be done by then.
+func NewPermissionsClient(ctx context.Context, t testing.TB) v1.PermissionsServiceClient {
+	t.Helper()
+	srv, err := spicedb.NewServer(ctx, "", nil)
+	require.NoError(t, err)
+
+	// the server runs on its own goroutine, which must not fail the test
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		require.NoError(t, <-errCh)
+	})
+
+	dialCtx, err := srv.GRPCDialContext(ctx)
+	require.NoError(t, err)
+	return v1.NewPermissionsServiceClient(dialCtx)
+}
@@ -0,0 +1,160 @@
+package workflowadmin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/cschleiden/go-workflows/workflow"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog/v2"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
+)
+
+// PathPrefix is the path that the workflow admin API is served under.
+const PathPrefix = "/spicedb-kubeapi-proxy/workflows"
+
+// StartedWorkflow is the response of the retry and rollback endpoints.
+type StartedWorkflow struct {
+	InstanceID string `json:"instanceID"`
+}
+
+// ApprovalDecision is the response of the approve and reject endpoints.
+type ApprovalDecision struct {
+	InstanceID string `json:"instanceID"`
+	Approved   bool   `json:"approved"`
+}
+
+// WithWorkflowAdmin serves the workflow admin API to authenticated users in
+// one of the admin groups, and passes every other request to handler.
+//
+//	GET  /spicedb-kubeapi-proxy/workflows?state=Running&state=Failed
+//	GET  /spicedb-kubeapi-proxy/workflows/{id}
+//	POST /spicedb-kubeapi-proxy/workflows/{id}/retry
+//	POST /spicedb-kubeapi-proxy/workflows/{id}/rollback
+//
+// Writes that wait for an approval are approved or rejected by any
+// authenticated user other than the requester who passes the approval
+// checks of the write, whether or not they are in an admin group. The
+// approver's uid and groups are passed on to the checks.
+//
+//	POST /spicedb-kubeapi-proxy/workflows/{id}/approve
+//	POST /spicedb-kubeapi-proxy/workflows/{id}/reject
+func WithWorkflowAdmin(handler, failed http.Handler, admin *distributedtx.Admin, groups []string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+PathPrefix, func(w http.ResponseWriter, req *http.Request) {
+		summaries, err := admin.List(req.Context(), req.URL.Query()["state"]...)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		if summaries == nil {
+			summaries = []*distributedtx.WorkflowSummary{}
+		}
+		writeJSON(w, http.StatusOK, summaries)
+	})
+	mux.HandleFunc("GET "+PathPrefix+"/{id}", func(w http.ResponseWriter, req *http.Request) {
+		details, err := admin.Get(req.Context(), req.PathValue("id"))
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, details)
+	})
+	mux.HandleFunc("POST "+PathPrefix+"/{id}/retry", startHandler(admin.Retry))
+	mux.HandleFunc("POST "+PathPrefix+"/{id}/rollback", startHandler(admin.Rollback))
+
+	approvals := http.NewServeMux()
+	approvals.HandleFunc("POST "+PathPrefix+"/{id}/approve", decideHandler(admin.Approve, true))
+	approvals.HandleFunc("POST "+PathPrefix+"/{id}/reject", decideHandler(admin.Reject, false))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != PathPrefix && !strings.HasPrefix(req.URL.Path, PathPrefix+"/") {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		user, ok := request.UserFrom(req.Context())
+		if !ok {
+			failed.ServeHTTP(w, req)
+			return
+		}
+
+		if _, pattern := approvals.Handler(req); pattern != "" {
+			klog.FromContext(req.Context()).Info("workflow approval request", "user", user.GetName(), "method", req.Method, "url", req.URL)
+			approvals.ServeHTTP(w, req)
+			return
+		}
+
+		if !slices.ContainsFunc(user.GetGroups(), func(group string) bool {
+			return slices.Contains(groups, group)
+		}) {
+			klog.V(3).InfoS("user is not a workflow admin", "method", req.Method, "url", req.URL)
+			failed.ServeHTTP(w, req)
+			return
+		}
+
+		klog.FromContext(req.Context()).Info("workflow admin request", "user", user.GetName(), "method", req.Method, "url", req.URL)
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// startHandler serves an endpoint that starts a workflow for the instance
+// in the path.
+func startHandler(start func(ctx context.Context, instanceID string) (*workflow.Instance, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		instance, err := start(req.Context(), req.PathValue("id"))
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, StartedWorkflow{InstanceID: instance.InstanceID})
+	}
+}
+
+// decideHandler serves an endpoint that approves or rejects the instance in
+// the path as the user of the request.
+func decideHandler(decide func(ctx context.Context, instanceID string, approver *user.DefaultInfo) error, approved bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		u, _ := request.UserFrom(req.Context())
+		approver := &user.DefaultInfo{
+			Name:   u.GetName(),
+			UID:    u.GetUID(),
+			Groups: u.GetGroups(),
+			Extra:  u.GetExtra(),
+		}
+		if err := decide(req.Context(), req.PathValue("id"), approver); err != nil {
+			writeError(w, req, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ApprovalDecision{InstanceID: req.PathValue("id"), Approved: approved})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.ErrorS(err, "unable to write workflow admin response")
+	}
+}
+
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	statusCode := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, distributedtx.ErrWorkflowNotFound):
+		statusCode = http.StatusNotFound
+	case errors.Is(err, distributedtx.ErrWorkflowRunning), errors.Is(err, distributedtx.ErrWorkflowNotRetryable), errors.Is(err, distributedtx.ErrNotPendingApproval):
+		statusCode = http.StatusConflict
+	case errors.Is(err, distributedtx.ErrSelfApproval), errors.Is(err, distributedtx.ErrApprovalDenied):
+		statusCode = http.StatusForbidden
+	default:
+		klog.FromContext(req.Context()).Error(err, "workflow admin request failed", "method", req.Method, "url", req.URL)
+	}
+	http.Error(w, err.Error(), statusCode)
+}
@@ -0,0 +1,132 @@
+package workflowadmin
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cschleiden/go-workflows/backend/sqlite"
+	"github.com/cschleiden/go-workflows/client"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
+)
+
+func TestWithWorkflowAdmin(t *testing.T) {
+	b := sqlite.NewInMemoryBackend()
+	c := client.New(b)
+	_, err := c.CreateWorkflowInstance(t.Context(), client.WorkflowInstanceOptions{InstanceID: "running"}, "PessimisticWriteToSpiceDBAndKube", &distributedtx.WriteObjInput{
+		RequestInfo: &request.RequestInfo{Verb: "create", Resource: "pods", Namespace: "default"},
+		UserInfo:    &user.DefaultInfo{Name: "janedoe"},
+		ObjectMeta:  &metav1.ObjectMeta{Name: "web"},
+	})
+	require.NoError(t, err)
+	admin, err := distributedtx.NewAdmin(b, c)
+	require.NoError(t, err)
+
+	proxied := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	failed := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	handler := WithWorkflowAdmin(proxied, failed, admin, []string{"admins"})
+
+	// the user is authenticated by the client certificate of the proxy;
+	// here it is taken from a header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u := &user.DefaultInfo{Name: "someone"}
+		if group := req.Header.Get("Group"); group != "" {
+			u.Groups = []string{group}
+		}
+		handler.ServeHTTP(w, req.WithContext(request.WithUser(req.Context(), u)))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		group  string
+		want   int
+	}{
+		{name: "other paths are proxied", method: http.MethodGet, path: "/api/v1/pods", want: http.StatusTeapot},
+		{name: "non-admins are rejected", method: http.MethodGet, path: PathPrefix, group: "developers", want: http.StatusUnauthorized},
+		{name: "list", method: http.MethodGet, path: PathPrefix, group: "admins", want: http.StatusOK},
+		{name: "get", method: http.MethodGet, path: PathPrefix + "/running", group: "admins", want: http.StatusOK},
+		{name: "unknown workflow", method: http.MethodGet, path: PathPrefix + "/unknown", group: "admins", want: http.StatusNotFound},
+		{name: "retry running workflow", method: http.MethodPost, path: PathPrefix + "/running/retry", group: "admins", want: http.StatusConflict},
+		{name: "wrong method", method: http.MethodGet, path: PathPrefix + "/running/retry", group: "admins", want: http.StatusMethodNotAllowed},
+		{name: "approvals are served to non-admins", method: http.MethodPost, path: PathPrefix + "/running/approve", group: "developers", want: http.StatusConflict},
+		{name: "reject workflow that isn't pending approval", method: http.MethodPost, path: PathPrefix + "/running/reject", want: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(t.Context(), tt.method, srv.URL+tt.path, nil)
+			require.NoError(t, err)
+			req.Header.Set("Group", tt.group)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.want, resp.StatusCode)
+		})
+	}
+
+	// the CLI talks to the API with a kubeconfig
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: proxy
+  cluster:
+    server: `+srv.URL+`
+users:
+- name: admin
+  user: {}
+contexts:
+- name: proxy
+  context:
+    cluster: proxy
+    user: admin
+current-context: proxy
+`), 0o600))
+	opts := NewCommandOptions()
+	opts.KubeconfigPath = kubeconfig
+	opts.States = []string{distributedtx.WorkflowStateRunning}
+
+	var out bytes.Buffer
+	require.ErrorContains(t, opts.List(t.Context(), &out), "401 Unauthorized")
+
+	// a round tripper that adds the admin group stands in for the
+	// client certificate
+	opts.wrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.Header.Set("Group", "admins")
+			return rt.RoundTrip(req)
+		})
+	}
+	require.NoError(t, opts.List(t.Context(), &out))
+	require.Contains(t, out.String(), "INSTANCE")
+	// without a worker, the workflow hasn't started yet and its input
+	// isn't in its history
+	require.Regexp(t, `running\s+Running`, out.String())
+
+	out.Reset()
+	require.NoError(t, opts.Get(t.Context(), "running", &out))
+	require.Contains(t, out.String(), `"instanceID": "running"`)
+
+	require.ErrorContains(t, opts.Retry(t.Context(), "running", &out), "409 Conflict")
+	require.ErrorContains(t, opts.Approve(t.Context(), "running", &out), "not pending approval")
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,162 @@
+package workflowadmin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/authzed/spicedb-kubeapi-proxy/pkg/authz/distributedtx"
+)
+
+// CommandOptions are the options of the workflows commands.
+type CommandOptions struct {
+	KubeconfigPath string
+	States         []string
+
+	// wrapTransport wraps the transport of the client in tests.
+	wrapTransport func(http.RoundTripper) http.RoundTripper
+}
+
+// NewCommandOptions returns the default options of the workflows commands.
+func NewCommandOptions() *CommandOptions {
+	return &CommandOptions{}
+}
+
+func (o *CommandOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.KubeconfigPath, "kubeconfig", "", "The path to a kubeconfig that connects to the proxy as a user in one of its --workflow-admin-groups.")
+}
+
+// AddListFlags adds the flags of the list command.
+func (o *CommandOptions) AddListFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&o.States, "state", []string{distributedtx.WorkflowStateRunning, distributedtx.WorkflowStatePendingApproval, distributedtx.WorkflowStateFailed}, "The states of the listed workflows, any of Running, PendingApproval, Failed or Completed. If empty, every workflow is listed.")
+}
+
+func (o *CommandOptions) Validate() []error {
+	var errs []error
+	if len(o.KubeconfigPath) == 0 {
+		errs = append(errs, fmt.Errorf("--kubeconfig is required"))
+	}
+	return errs
+}
+
+// List prints the workflows in the requested states as a table.
+func (o *CommandOptions) List(ctx context.Context, out io.Writer) error {
+	query := url.Values{"state": o.States}
+	var summaries []*distributedtx.WorkflowSummary
+	if err := o.do(ctx, http.MethodGet, PathPrefix+"?"+query.Encode(), &summaries); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tSTATE\tWORKFLOW\tUSER\tVERB\tRESOURCE\tNAMESPACE\tNAME\tCREATED\tERROR")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.InstanceID, s.State, s.Workflow, s.User, s.Verb, s.Resource, s.Namespace, s.Name, s.CreatedAt.Format(time.RFC3339), s.Error)
+	}
+	return w.Flush()
+}
+
+// Get prints a workflow with its input and history as JSON.
+func (o *CommandOptions) Get(ctx context.Context, instanceID string, out io.Writer) error {
+	var details json.RawMessage
+	if err := o.do(ctx, http.MethodGet, PathPrefix+"/"+url.PathEscape(instanceID), &details); err != nil {
+		return err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, details, "", "  "); err != nil {
+		return fmt.Errorf("unable to format workflow: %w", err)
+	}
+	_, err := fmt.Fprintln(out, indented.String())
+	return err
+}
+
+// Retry starts a new instance of a finished workflow with the same input.
+func (o *CommandOptions) Retry(ctx context.Context, instanceID string, out io.Writer) error {
+	return o.start(ctx, instanceID, "retry", out)
+}
+
+// Rollback reverts the relationships that a workflow wrote.
+func (o *CommandOptions) Rollback(ctx context.Context, instanceID string, out io.Writer) error {
+	return o.start(ctx, instanceID, "rollback", out)
+}
+
+// Approve approves a write that is pending approval.
+func (o *CommandOptions) Approve(ctx context.Context, instanceID string, out io.Writer) error {
+	return o.decide(ctx, instanceID, "approve", out)
+}
+
+// Reject rejects a write that is pending approval.
+func (o *CommandOptions) Reject(ctx context.Context, instanceID string, out io.Writer) error {
+	return o.decide(ctx, instanceID, "reject", out)
+}
+
+func (o *CommandOptions) decide(ctx context.Context, instanceID, action string, out io.Writer) error {
+	var decision ApprovalDecision
+	if err := o.do(ctx, http.MethodPost, PathPrefix+"/"+url.PathEscape(instanceID)+"/"+action, &decision); err != nil {
+		return err
+	}
+	verdict := "rejected"
+	if decision.Approved {
+		verdict = "approved"
+	}
+	_, err := fmt.Fprintf(out, "%s workflow %s\n", verdict, decision.InstanceID)
+	return err
+}
+
+func (o *CommandOptions) start(ctx context.Context, instanceID, action string, out io.Writer) error {
+	var started StartedWorkflow
+	if err := o.do(ctx, http.MethodPost, PathPrefix+"/"+url.PathEscape(instanceID)+"/"+action, &started); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "started %s of workflow %s: %s\n", action, instanceID, started.InstanceID)
+	return err
+}
+
+// do sends a request to the admin API of the proxy and decodes the response
+// into v.
+func (o *CommandOptions) do(ctx context.Context, method, path string, v any) error {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", o.KubeconfigPath)
+	if err != nil {
+		return fmt.Errorf("unable to load kube REST config: %w", err)
+	}
+	if o.wrapTransport != nil {
+		restConfig.Wrap(o.wrapTransport)
+	}
+	httpClient, err := rest.HTTPClientFor(restConfig)
+	if err != nil {
+		return fmt.Errorf("unable to create client for the proxy: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(restConfig.Host, "/")+path, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach the proxy: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response: %w", err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s %s failed with %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unable to decode response: %w", err)
+	}
+	return nil
+}